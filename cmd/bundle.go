@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	fp "path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	df "github.com/slyphon/dfi/internal/dotfile"
+)
+
+func newBundleCommand() *cobra.Command {
+	var (
+		outPath string
+		groups  []string
+	)
+
+	bundleCmd := &cobra.Command{
+		Use:   "bundle [flags] [manifest]",
+		Short: "Packs the sources in a manifest into a tar archive",
+		Long: `Usage: dfi bundle [flags] [manifest]
+
+Writes a tar archive of the manifest (by default ./` + df.ManifestFileName + `) and all of
+the sources of its groups, which must be inside of the directory the manifest
+is in. The same sources always make the same archive. Install it on another
+machine with 'dfi install-bundle'. With --group, only the named groups are
+packed, and the manifest in the archive lists only them.
+`,
+		Example: `  dfi bundle --out dotfiles.tar ~/.settings/dfi.toml
+
+  # only the dotfiles and bin groups
+  dfi bundle -g dotfiles -g bin --out dotfiles.tar ~/.settings/dfi.toml`,
+		Args: usageArgs(cobra.MaximumNArgs(1)),
+
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			manifestPath := df.ManifestFileName
+			if len(args) > 0 {
+				manifestPath = args[0]
+			}
+
+			if outPath == "-" {
+				return df.WriteBundle(manifestPath, groups, cmd.OutOrStdout())
+			}
+
+			// written next to where it's going, so a failure doesn't
+			// leave half a bundle behind
+			tmp := fmt.Sprintf("%s.tmp_%d", outPath, os.Getpid())
+			f, err := os.Create(tmp)
+			if err != nil {
+				return errors.Wrapf(err, "failed to create %#v", tmp)
+			}
+			defer os.Remove(tmp)
+
+			if err = df.WriteBundle(manifestPath, groups, f); err != nil {
+				f.Close()
+				return err
+			}
+			if err = f.Close(); err != nil {
+				return err
+			}
+			return errors.Wrapf(os.Rename(tmp, outPath), "failed to write %#v", outPath)
+		},
+	}
+
+	bundleCmd.Flags().StringVarP(&outPath, "out", "o", "dfi-bundle.tar", "Where to write the bundle, '-' for stdout")
+	setComplete(bundleCmd.Flags(), "out", "files")
+
+	bundleCmd.Flags().StringArrayVarP(
+		&groups,
+		"group", "g", nil,
+		"Only pack the group with this name from the manifest (may be repeated)",
+	)
+	setComplete(bundleCmd.Flags(), "group", "manifest-groups")
+
+	return bundleCmd
+}
+
+func newInstallBundleCommand(installFn df.InstallBundleFn, opts *rootOpts) *cobra.Command {
+	bs := &df.BundleSettings{}
+
+	if installFn == nil {
+		installFn = df.InstallBundle
+	}
+
+	installCmd := &cobra.Command{
+		Use:   "install-bundle [flags] bundle.tar|hash",
+		Short: "Unpacks a bundle from 'dfi bundle' and links its sources",
+		Long: `Usage: dfi install-bundle [flags] bundle.tar|hash
+
+Unpacks a bundle made by 'dfi bundle' into its own directory, named by the
+bundle's hash, under $XDG_DATA_HOME/dfi/bundles (by default
+~/.local/share/dfi/bundles), and links each group in its manifest from there.
+Links into a bundle that was installed before are switched over to the new
+one, as part of the same run as the rest, so a failure leaves them as they
+were. Older bundles are kept, so installing one again, by its file or by its
+hash, rolls back to it. With --group, only the named groups are linked.
+`,
+		Example: `  dfi install-bundle dotfiles.tar
+
+  # roll back to a bundle that was installed before
+  ls ~/.local/share/dfi/bundles
+  dfi install-bundle 3f2a9c01
+
+  # only link the dotfiles group
+  dfi install-bundle -g dotfiles dotfiles.tar`,
+		Args: usageArgs(cobra.ExactArgs(1)),
+
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			if err = opts.resolve(); err != nil {
+				return err
+			}
+
+			bs.Settings = *opts.settings
+			bs.Bundle = args[0]
+
+			dir, err := installFn(bs)
+			if dir != "" {
+				fmt.Fprintf(cmd.OutOrStdout(), "%s\t%s\n", fp.Base(dir), dir)
+			}
+			printFailures(cmd.ErrOrStderr(), err)
+			return err
+		},
+	}
+
+	installCmd.Flags().BoolVarP(
+		&opts.settings.KeepGoing,
+		"keep-going", "k", false,
+		"Carry on after a link fails, and report all of the failures at the end",
+	)
+	installCmd.Flags().BoolVar(
+		&opts.settings.Atomic,
+		"atomic", false,
+		"Rename new links over files and symlinks in the way, so the link path never goes missing",
+	)
+	installCmd.Flags().StringArrayVarP(
+		&bs.Groups,
+		"group", "g", nil,
+		"Only link the group with this name from the bundle's manifest (may be repeated)",
+	)
+	setComplete(installCmd.Flags(), "group", "bundle-groups")
+
+	return installCmd
+}
@@ -0,0 +1,366 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	str "strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	df "github.com/slyphon/dfi/internal/dotfile"
+)
+
+// the completion scripts call 'dfi __complete words...' with the words of
+// the command line up to and including the one being completed. It prints
+// a candidate per line, as "value\tdescription", and then a directive
+// telling the script whether to complete file names as well.
+const (
+	completeCmdName = "__complete"
+
+	directiveFiles = ":files"
+	directiveDirs  = ":dirs"
+	directiveNone  = ":none"
+
+	// completeAnnotation on a flag says how to complete its value: "files",
+	// "dirs", or the name of one of the valueCompleters
+	completeAnnotation = "dfi_complete"
+)
+
+// valueCompleters return the values a flag can take, given the arguments
+// on the command line so far
+var valueCompleters = map[string]func(args []string) []string{
+	"on-conflict":     func([]string) []string { return df.OnConflictNames() },
+	"git-check":       func([]string) []string { return df.GitCheckNames() },
+	"manifest-groups": manifestGroups,
+	"bundle-groups":   bundleGroups,
+}
+
+// manifestGroups returns the group names in the manifest given as the
+// first argument, or ./dfi.toml
+func manifestGroups(args []string) []string {
+	path := df.ManifestFileName
+	if len(args) > 0 {
+		path = args[0]
+	}
+	m, err := df.ReadManifest(path)
+	if err != nil {
+		return nil
+	}
+	return m.GroupNames()
+}
+
+// bundleGroups returns the group names in the bundle given as the first
+// argument, falling back to the ones in ./dfi.toml
+func bundleGroups(args []string) []string {
+	if len(args) == 0 {
+		return manifestGroups(nil)
+	}
+	m, err := df.ReadBundleManifest(args[0])
+	if err != nil {
+		return manifestGroups(nil)
+	}
+	return m.GroupNames()
+}
+
+// setComplete sets how the named flag in flags is completed
+func setComplete(flags *pflag.FlagSet, name, how string) {
+	if err := flags.SetAnnotation(name, completeAnnotation, []string{how}); err != nil {
+		panic(err)
+	}
+}
+
+type candidate struct {
+	value, desc string
+}
+
+// completer works out the candidates for the last of words
+type completer struct {
+	root  *cobra.Command
+	words []string
+
+	// args are the arguments to the command before the one being completed
+	args []string
+}
+
+// allFlags returns cmd's own flags and the ones it inherits
+func allFlags(cmd *cobra.Command) *pflag.FlagSet {
+	flags := pflag.NewFlagSet(cmd.Name(), pflag.ContinueOnError)
+	flags.AddFlagSet(cmd.LocalFlags())
+	flags.AddFlagSet(cmd.InheritedFlags())
+	return flags
+}
+
+// lookupFlag finds the flag for word (eg. '--prefix' or '-p') that cmd accepts
+func lookupFlag(cmd *cobra.Command, word string) *pflag.Flag {
+	var f *pflag.Flag
+	switch {
+	case str.HasPrefix(word, "--"):
+		f = allFlags(cmd).Lookup(word[2:])
+	case str.HasPrefix(word, "-") && len(word) == 2:
+		f = allFlags(cmd).ShorthandLookup(word[1:])
+	}
+	return f
+}
+
+// takesValue returns true if f needs a value, ie. it isn't a bool
+func takesValue(f *pflag.Flag) bool {
+	return f != nil && f.NoOptDefVal == ""
+}
+
+// positionalArgs returns the words that aren't flags or their values
+func positionalArgs(cmd *cobra.Command, words []string) (args []string) {
+	for i := 0; i < len(words); i++ {
+		switch w := words[i]; {
+		case w == "=":
+			continue
+		case str.HasPrefix(w, "-") && len(w) > 1:
+			if !str.Contains(w, "=") && takesValue(lookupFlag(cmd, w)) {
+				// bash splits '--flag=value' into '--flag', '=', 'value'
+				if i++; i < len(words) && words[i] == "=" {
+					i++
+				}
+			}
+		default:
+			args = append(args, w)
+		}
+	}
+	return args
+}
+
+func (c *completer) complete() (cands []candidate, directive string) {
+	if len(c.words) == 0 {
+		c.words = []string{""}
+	}
+	cur := c.words[len(c.words)-1]
+	before := c.words[:len(c.words)-1]
+
+	cmd, rest, err := c.root.Find(before)
+	if err != nil {
+		cmd, rest = c.root, before
+	}
+	c.args = positionalArgs(cmd, rest)
+
+	// bash splits '--flag=value' into '--flag', '=', 'value'
+	prev := ""
+	if n := len(before); n > 0 {
+		prev = before[n-1]
+		if prev == "=" && n > 1 {
+			prev = before[n-2]
+		}
+	}
+
+	switch {
+	case takesValue(lookupFlag(cmd, prev)):
+		return c.flagValues(lookupFlag(cmd, prev), "", cur)
+	case str.HasPrefix(cur, "--") && str.Contains(cur, "="):
+		i := str.Index(cur, "=")
+		return c.flagValues(lookupFlag(cmd, cur[:i]), cur[:i+1], cur[i+1:])
+	case str.HasPrefix(cur, "-"):
+		return c.flagNames(cmd, cur), directiveNone
+	}
+
+	for _, sub := range cmd.Commands() {
+		if sub.IsAvailableCommand() && str.HasPrefix(sub.Name(), cur) {
+			cands = append(cands, candidate{sub.Name(), sub.Short})
+		}
+	}
+	for _, arg := range cmd.ValidArgs {
+		if str.HasPrefix(arg, cur) {
+			cands = append(cands, candidate{arg, ""})
+		}
+	}
+	if len(cmd.ValidArgs) > 0 {
+		return cands, directiveNone
+	}
+	// everything else dfi takes is a path
+	return cands, directiveFiles
+}
+
+// flagValues returns the values for f that start with cur, each with
+// prefix in front of it
+func (c *completer) flagValues(f *pflag.Flag, prefix, cur string) ([]candidate, string) {
+	if f == nil {
+		return nil, directiveFiles
+	}
+
+	how := ""
+	if a := f.Annotations[completeAnnotation]; len(a) > 0 {
+		how = a[0]
+	}
+
+	switch how {
+	case "files":
+		return nil, directiveFiles
+	case "dirs":
+		return nil, directiveDirs
+	}
+
+	var cands []candidate
+	if values, ok := valueCompleters[how]; ok {
+		for _, v := range values(c.args) {
+			if str.HasPrefix(v, cur) {
+				cands = append(cands, candidate{prefix + v, ""})
+			}
+		}
+	}
+	return cands, directiveNone
+}
+
+// flagNames returns the flags of cmd that start with cur
+func (c *completer) flagNames(cmd *cobra.Command, cur string) (cands []candidate) {
+	allFlags(cmd).VisitAll(func(f *pflag.Flag) {
+		if f.Hidden {
+			return
+		}
+		if name := "--" + f.Name; str.HasPrefix(name, cur) {
+			cands = append(cands, candidate{name, f.Usage})
+		}
+		if name := "-" + f.Shorthand; f.Shorthand != "" && cur == name {
+			cands = append(cands, candidate{name, f.Usage})
+		}
+	})
+	return cands
+}
+
+func newCompleteCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:                completeCmdName + " words...",
+		Short:              "Prints the completions for a command line, for the completion scripts",
+		Hidden:             true,
+		DisableFlagParsing: true,
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c := &completer{root: cmd.Root(), words: args}
+			cands, directive := c.complete()
+
+			out := cmd.OutOrStdout()
+			for _, cand := range cands {
+				if cand.desc == "" {
+					fmt.Fprintln(out, cand.value)
+				} else {
+					fmt.Fprintf(out, "%s\t%s\n", cand.value, cand.desc)
+				}
+			}
+			fmt.Fprintln(out, directive)
+			return nil
+		},
+	}
+}
+
+var completionScripts = map[string]string{
+	"bash": `# bash completion for dfi
+__dfi_complete() {
+    local cur="${COMP_WORDS[COMP_CWORD]}" line
+    local out
+    out=$("${COMP_WORDS[0]}" ` + completeCmdName + ` "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null) || return
+
+    COMPREPLY=()
+    while IFS= read -r line; do
+        case "$line" in
+            :files) compopt -o filenames 2>/dev/null
+                    COMPREPLY+=($(compgen -f -- "$cur")) ;;
+            :dirs)  compopt -o filenames 2>/dev/null
+                    COMPREPLY+=($(compgen -d -- "$cur")) ;;
+            :*)     ;;
+            *)      COMPREPLY+=("${line%%$'\t'*}") ;;
+        esac
+    done <<< "$out"
+}
+
+complete -F __dfi_complete dfi
+`,
+
+	"zsh": `#compdef dfi
+# zsh completion for dfi
+_dfi() {
+    local -a candidates
+    local line value desc directive out
+    out=$(${words[1]} ` + completeCmdName + ` "${(@)words[2,CURRENT]}" 2>/dev/null) || return 1
+
+    for line in "${(@f)out}"; do
+        case $line in
+            :files|:dirs|:none) directive=$line ;;
+            *)
+                value=${line%%$'\t'*}
+                desc=""
+                [[ $line == *$'\t'* ]] && desc=${line#*$'\t'}
+                candidates+=("${value//:/\\:}${desc:+:$desc}")
+                ;;
+        esac
+    done
+
+    (( ${#candidates} )) && _describe 'dfi' candidates
+    case $directive in
+        :files) _files ;;
+        :dirs)  _files -/ ;;
+    esac
+}
+
+if [ "$funcstack[1]" = "_dfi" ]; then
+    _dfi "$@"
+else
+    compdef _dfi dfi
+fi
+`,
+
+	"fish": `# fish completion for dfi
+function __dfi_complete
+    set -l args (commandline -opc)
+    set -e args[1]
+    set -l cur (commandline -ct)
+
+    for line in (command dfi ` + completeCmdName + ` $args "$cur" 2>/dev/null)
+        switch $line
+            case :files
+                __fish_complete_path "$cur"
+            case :dirs
+                __fish_complete_directories "$cur"
+            case ':*'
+            case '*'
+                echo $line
+        end
+    end
+end
+
+complete -c dfi -f -a '(__dfi_complete)'
+`,
+}
+
+// writeCompletion writes the completion script for shell to w
+func writeCompletion(w io.Writer, shell string) error {
+	script, ok := completionScripts[shell]
+	if !ok {
+		return usageError{fmt.Errorf("no completion for shell %#v, use bash, zsh or fish", shell)}
+	}
+	_, err := io.WriteString(w, script)
+	return err
+}
+
+func newCompletionCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "completion bash|zsh|fish",
+		Short: "Prints a shell completion script",
+		Long: `Usage: dfi completion bash|zsh|fish
+
+Prints a script that completes dfi's subcommands, flags and their values,
+including the --on-conflct and --git-check choices and the names of the
+groups in a manifest or bundle, for the given shell. Paths are completed as
+usual.
+`,
+		Example: `  # bash, for the current shell, or add it to ~/.bashrc
+  source <(dfi completion bash)
+
+  # zsh, anywhere in $fpath
+  dfi completion zsh > ~/.zfunc/_dfi
+
+  # fish
+  dfi completion fish > ~/.config/fish/completions/dfi.fish`,
+		Args:      usageArgs(cobra.ExactValidArgs(1)),
+		ValidArgs: []string{"bash", "zsh", "fish"},
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return writeCompletion(cmd.OutOrStdout(), args[0])
+		},
+	}
+}
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"os"
+	fp "path/filepath"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+
+	df "github.com/slyphon/dfi/internal/dotfile"
+)
+
+const configName = "config"
+
+// Config is the contents of the optional dfi config file
+type Config struct {
+	Hooks    df.Hooks          `mapstructure:"hooks"`
+	Secrets  []df.SecretPolicy `mapstructure:"secrets"`
+	Identity string            `mapstructure:"identity"`
+
+	// Recipients and RecipientsFiles are who sources are encrypted to, as
+	// well as the identity, see df.Keys
+	Recipients      []string `mapstructure:"recipients"`
+	RecipientsFiles []string `mapstructure:"recipients_files"`
+}
+
+// configDir returns $XDG_CONFIG_HOME/dfi, falling back to ~/.config/dfi
+func configDir() (string, error) {
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		return fp.Join(xdg, "dfi"), nil
+	}
+
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to find home directory")
+	}
+
+	return fp.Join(home, ".config", "dfi"), nil
+}
+
+// loadConfig reads the config file at path, or if path is empty, looks for
+// a file named 'config' with any extension viper supports in the configDir.
+// It's not an error for the default config file to be missing.
+func loadConfig(path string) (*Config, error) {
+	v := viper.New()
+
+	if path != "" {
+		v.SetConfigFile(path)
+	} else {
+		dir, err := configDir()
+		if err != nil {
+			return nil, err
+		}
+		v.SetConfigName(configName)
+		v.AddConfigPath(dir)
+	}
+
+	if err := v.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok || path != "" {
+			return nil, errors.Wrap(err, "failed to read config")
+		}
+	}
+
+	cfg := &Config{}
+	if err := v.Unmarshal(cfg); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse config %#v", v.ConfigFileUsed())
+	}
+
+	return cfg, nil
+}
+
+// expandHome expands a leading '~' in path to the user's home directory
+func expandHome(path string) (string, error) {
+	p, err := homedir.Expand(path)
+	return p, errors.Wrapf(err, "failed to expand %#v", path)
+}
+
+// expandHomes is expandHome for each of paths
+func expandHomes(paths []string) ([]string, error) {
+	out := make([]string, len(paths))
+	for i, p := range paths {
+		var err error
+		if out[i], err = expandHome(p); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,208 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	df "github.com/slyphon/dfi/internal/dotfile"
+	ppath "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+// recipientOpts are the recipients given on the command line, on top of
+// the ones in the config file
+type recipientOpts struct {
+	recipients      []string
+	recipientsFiles []string
+}
+
+func (r *recipientOpts) addFlags(flags *pflag.FlagSet) {
+	flags.StringArrayVarP(
+		&r.recipients,
+		"recipient", "r", nil,
+		"Also encrypt to this age public key (may be repeated)",
+	)
+	flags.StringArrayVarP(
+		&r.recipientsFiles,
+		"recipients-file", "R", nil,
+		"Also encrypt to the age public keys in this file, one per line (may be repeated)",
+	)
+	setComplete(flags, "recipients-file", "files")
+}
+
+// identityPath returns the identity from the flags or config, or the
+// default one
+func (o *rootOpts) identityPath() (string, error) {
+	if err := o.resolve(); err != nil {
+		return "", err
+	}
+	if o.settings.Identity != "" {
+		return o.settings.Identity, nil
+	}
+	return df.IdentityPath()
+}
+
+// keys returns the identity, and the recipients from the config and r
+func (o *rootOpts) keys(r *recipientOpts) (df.Keys, error) {
+	path, err := o.identityPath()
+	if err != nil {
+		return df.Keys{}, err
+	}
+	files, err := expandHomes(r.recipientsFiles)
+	if err != nil {
+		return df.Keys{}, err
+	}
+	return df.Keys{
+		Identity:        path,
+		Recipients:      append(append([]string{}, o.recipients...), r.recipients...),
+		RecipientsFiles: append(append([]string{}, o.recipientsFiles...), files...),
+	}, nil
+}
+
+func newKeygenCommand(opts *rootOpts) *cobra.Command {
+	return &cobra.Command{
+		Use:   "keygen [flags]",
+		Short: "Creates a new age identity to encrypt sources with",
+		Long: `Usage: dfi keygen [flags]
+
+Writes a new age X25519 identity to the identity file (by default
+$XDG_DATA_HOME/dfi/identity, see --identity), readable only by you, and
+prints its path and public key. It won't overwrite one that's already there.
+The file is the same as age-keygen writes, and one made by age-keygen works
+as well. Copy it to each machine that installs the encrypted sources, but
+never commit it.
+`,
+		Example: `  dfi keygen
+  dfi --identity ~/.ssh/dfi-identity keygen`,
+		Args: usageArgs(cobra.NoArgs),
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path, err := opts.identityPath()
+			if err != nil {
+				return err
+			}
+			if err = df.GenerateIdentity(path); err != nil {
+				return err
+			}
+			id, err := df.ReadIdentity(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%s\t%s\n", path, id.PublicKey())
+			return nil
+		},
+	}
+}
+
+func newEncryptCommand(opts *rootOpts) *cobra.Command {
+	r := &recipientOpts{}
+
+	encryptCmd := &cobra.Command{
+		Use:   "encrypt [flags] files...",
+		Short: "Encrypts files with age, so they can be committed as sources",
+		Long: `Usage: dfi encrypt [flags] files...
+
+Encrypts each file with age, to the identity and any other recipients (see
+--recipient, and 'recipients' and 'recipients_files' in the config file),
+and writes it next to the file with ` + df.EncryptedSuffix + ` added to its name. Commit the
+encrypted file instead of the original. When it's installed, it's decrypted
+into a private directory and linked from there, eg. dotfiles/netrc` + df.EncryptedSuffix + `
+becomes ~/.netrc with prefix '.'. Files encrypted with the age tool work too.
+`,
+		Example: `  dfi encrypt ~/.settings/dotfiles/netrc && rm ~/.settings/dotfiles/netrc
+
+  # so a teammate can decrypt it with their own identity
+  dfi encrypt -r age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p ~/.settings/dotfiles/netrc`,
+		Args: usageArgs(cobra.MinimumNArgs(1)),
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			keys, err := opts.keys(r)
+			if err != nil {
+				return err
+			}
+			id, err := keys.Load()
+			if err != nil {
+				return err
+			}
+
+			for _, arg := range args {
+				out, err := df.EncryptFile(id, arg)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(cmd.OutOrStdout(), out)
+			}
+			return nil
+		},
+	}
+
+	r.addFlags(encryptCmd.Flags())
+
+	return encryptCmd
+}
+
+func newReencryptCommand(opts *rootOpts) *cobra.Command {
+	var dryRun, asJSON bool
+	r := &recipientOpts{}
+
+	reencryptCmd := &cobra.Command{
+		Use:   "reencrypt [flags]",
+		Short: "Encrypts edits to decrypted copies back into their sources",
+		Long: `Usage: dfi reencrypt [flags]
+
+Finds the decrypted copies of encrypted sources that have been edited
+through their links, and encrypts each back into its source, to the
+identity and any other recipients as for 'dfi encrypt', so the change can
+be committed. A copy whose source has changed as well is listed as diverged
+and left alone, and dfi exits non-zero.
+
+age files don't say who they were encrypted to, so the other recipients of
+a source aren't kept on their own: give them again with -r or -R, or in the
+config file. A source that was encrypted to more recipients than that,
+besides the identity, isn't reencrypted, and dfi exits non-zero.
+`,
+		Example: `  # list the edited copies
+  dfi reencrypt -n
+
+  dfi reencrypt -R ~/.settings/recipients.txt && git -C ~/.settings commit -a -m 'update secrets'`,
+		Args: usageArgs(cobra.NoArgs),
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			keys, err := opts.keys(r)
+			if err != nil {
+				return err
+			}
+			stateDir, err := df.StateDir()
+			if err != nil {
+				return err
+			}
+
+			found, rerr := df.Reencrypt(ppath.NewOsFs(), stateDir, keys, dryRun)
+
+			if asJSON {
+				if found == nil {
+					found = []df.Reencrypted{}
+				}
+				enc := json.NewEncoder(cmd.OutOrStdout())
+				enc.SetIndent("", "  ")
+				if err = enc.Encode(found); err != nil {
+					return err
+				}
+				return rerr
+			}
+
+			for _, re := range found {
+				fmt.Fprintf(cmd.OutOrStdout(), "%s\t%s <- %s\n", re.State, re.Source, re.Copy)
+			}
+			return rerr
+		},
+	}
+
+	reencryptCmd.Flags().BoolVarP(&dryRun, "dry-run", "n", false, "Only list the edited copies")
+	reencryptCmd.Flags().BoolVar(&asJSON, "json", false, "Print the result as JSON")
+	r.addFlags(reencryptCmd.Flags())
+
+	return reencryptCmd
+}
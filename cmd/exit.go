@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	df "github.com/slyphon/dfi/internal/dotfile"
+)
+
+// The exit codes dfi uses, so scripts can tell what went wrong
+const (
+	ExitOK = 0
+	// ExitFailure is for any error that doesn't have its own code
+	ExitFailure = 1
+	// ExitUsage means the flags were invalid
+	ExitUsage = 2
+	// ExitConflict means a link path existed and --on-conflict was 'fail'
+	ExitConflict = 3
+	// ExitDuplicateName means two sources had the same name
+	ExitDuplicateName = 4
+	// ExitDestNotDir means the destination didn't exist or wasn't a directory
+	ExitDestNotDir = 5
+	// ExitUnsupportedFileType means a path was a fifo, socket, device, etc.
+	ExitUnsupportedFileType = 6
+	// ExitLocked means another run held the lock on the destination
+	ExitLocked = 7
+	// ExitModified means verify found sources that changed since they were installed
+	ExitModified = 8
+	// ExitPlanMismatch means a link path changed since the plan being applied was made
+	ExitPlanMismatch = 9
+	// ExitInsecureDir means a secret would have been linked into a directory others can write to
+	ExitInsecureDir = 10
+)
+
+// usageError marks errors in the command line, as opposed to
+// errors that happened while running
+type usageError struct {
+	error
+}
+
+func (e usageError) Unwrap() error { return e.error }
+
+// usageArgs wraps a cobra.PositionalArgs so the errors it returns are
+// usageErrors, eg. usageArgs(cobra.MinimumNArgs(2))
+func usageArgs(check cobra.PositionalArgs) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, args []string) error {
+		if err := check(cmd, args); err != nil {
+			return usageError{err}
+		}
+		return nil
+	}
+}
+
+// ExitCode returns the exit code for the error returned by a command
+func ExitCode(err error) int {
+	var (
+		usage       usageError
+		conflict    *df.ConflictError
+		duplicate   *df.DuplicateNameError
+		destNotDir  *df.DestNotDirError
+		unsupported *df.UnsupportedFileTypeError
+		locked      *df.LockedError
+		modified    *df.ModifiedSourcesError
+		mismatch    *df.PlanMismatchError
+		insecure    *df.InsecureDirError
+	)
+
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.As(err, &usage):
+		return ExitUsage
+	case errors.As(err, &conflict):
+		return ExitConflict
+	case errors.As(err, &duplicate):
+		return ExitDuplicateName
+	case errors.As(err, &destNotDir):
+		return ExitDestNotDir
+	case errors.As(err, &unsupported):
+		return ExitUnsupportedFileType
+	case errors.As(err, &locked):
+		return ExitLocked
+	case errors.As(err, &modified):
+		return ExitModified
+	case errors.As(err, &mismatch):
+		return ExitPlanMismatch
+	case errors.As(err, &insecure):
+		return ExitInsecureDir
+	default:
+		return ExitFailure
+	}
+}
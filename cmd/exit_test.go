@@ -0,0 +1,16 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsageArgs(t *testing.T) {
+	r := require.New(t)
+	check := usageArgs(cobra.MinimumNArgs(2))
+
+	r.NoError(check(&cobra.Command{}, []string{"a", "b"}))
+	r.Equal(ExitUsage, ExitCode(check(&cobra.Command{}, []string{"a"})))
+}
@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+
+	df "github.com/slyphon/dfi/internal/dotfile"
+)
+
+const (
+	defaultSettingsDir = ".settings/dotfiles"
+	defaultInitPrefix  = "."
+)
+
+// newInitCommand creates the 'init' subcommand. The prefix and on-conflict
+// strategy come from the root command's persistent flags.
+func newInitCommand(initFn df.InitFn, opts *rootOpts) *cobra.Command {
+	initSettings := &df.InitSettings{}
+
+	if initFn == nil {
+		initFn = df.Init
+	}
+
+	initCmd := &cobra.Command{
+		Use:   "init [flags] paths...",
+		Short: "Moves existing dotfiles into a settings directory and links them back",
+		Long: `Usage: dfi init [flags] paths...
+
+Bootstraps a settings directory from existing dotfiles. Each path is moved
+into the settings directory with the prefix stripped from its name (the
+reverse of --prefix, which defaults to '.' here), then a symlink is created
+where it used to be. Finally a starter manifest listing what was moved is
+written, by default next to the settings directory.
+`,
+		Example: `  # creates ~/.settings/dotfiles/{bashrc,vimrc} and ~/.settings/dfi.toml
+  dfi init ~/.bashrc ~/.vimrc
+
+  dfi init --settings-dir ~/src/dotfiles/bin --prefix '' ~/bin/*`,
+		Args: usageArgs(cobra.MinimumNArgs(1)),
+
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			if initSettings.OnConflict, err = df.OnConflictForString(opts.conflictOpt); err != nil {
+				return err
+			}
+
+			initSettings.Prefix = opts.settings.Prefix
+			if !cmd.Flags().Changed("prefix") {
+				initSettings.Prefix = defaultInitPrefix
+			}
+
+			if initSettings.SettingsDir == "" {
+				if initSettings.SettingsDir, err = expandHome("~/" + defaultSettingsDir); err != nil {
+					return err
+				}
+			}
+
+			initSettings.Paths = args
+
+			return initFn(initSettings)
+		},
+	}
+
+	initCmd.Flags().StringVarP(
+		&initSettings.SettingsDir,
+		"settings-dir", "d", "",
+		"The directory to move the files into (default ~/"+defaultSettingsDir+")",
+	)
+
+	initCmd.Flags().StringVarP(
+		&initSettings.ManifestPath,
+		"manifest", "m", "",
+		"Where to write the manifest (default "+df.ManifestFileName+" next to the settings dir)",
+	)
+
+	setComplete(initCmd.Flags(), "settings-dir", "dirs")
+	setComplete(initCmd.Flags(), "manifest", "files")
+
+	return initCmd
+}
@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	df "github.com/slyphon/dfi/internal/dotfile"
+)
+
+// printPlan writes a table of the links in p and what will be done about them
+func printPlan(out io.Writer, p *df.Plan) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ACTION\tLINK PATH\tLINK DATA\tEXISTING")
+	for _, pl := range p.Links {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", pl.Action, pl.LinkPath, pl.LinkData, pl.Existing.Type)
+	}
+	_ = w.Flush()
+}
+
+// printMismatches writes a table of the link paths that changed since the
+// plan was made, if err is from applying one
+func printMismatches(out io.Writer, err error) {
+	var mismatch *df.PlanMismatchError
+	if !errors.As(err, &mismatch) {
+		return
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "LINK PATH\tPLANNED\tFOUND")
+	for _, m := range mismatch.Mismatches {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", m.LinkPath, m.Planned.Type, m.Found.Type)
+	}
+	_ = w.Flush()
+}
+
+func newPlanCommand(opts *rootOpts) *cobra.Command {
+	var outPath string
+
+	planCmd := &cobra.Command{
+		Use:   "plan [flags] sources... dest",
+		Short: "Writes the links a run would make, for 'dfi apply'",
+		Long: `Usage: dfi plan [flags] sources... dest
+
+Works out the links 'dfi sources... dest' would make, and what it would do
+about anything in the way, without changing anything. The plan is written
+as JSON to --out, and a summary to stderr. It records what was at each link
+path, so 'dfi apply --plan' can make exactly those links later, and refuse
+if anything changed in the meantime.
+`,
+		Example: `  # review what would be done, then do it
+  dfi plan -p . --out plan.json ~/.settings/dotfiles/* ~
+  dfi apply --plan plan.json`,
+		Args: usageArgs(cobra.MinimumNArgs(2)),
+
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			if err = opts.resolve(); err != nil {
+				return err
+			}
+			if err = opts.parseArgs(args); err != nil {
+				return err
+			}
+
+			p, err := df.MakePlan(opts.settings)
+			if err != nil {
+				return err
+			}
+			printPlan(cmd.ErrOrStderr(), p)
+
+			if outPath == "-" {
+				return p.Write(cmd.OutOrStdout())
+			}
+			f, err := os.Create(outPath)
+			if err != nil {
+				return errors.Wrapf(err, "failed to create plan %#v", outPath)
+			}
+			if err = p.Write(f); err != nil {
+				f.Close()
+				return err
+			}
+			return f.Close()
+		},
+	}
+
+	planCmd.Flags().StringVarP(&outPath, "out", "o", "-", "Where to write the plan, '-' for stdout")
+	planCmd.Flags().BoolVar(
+		&opts.settings.Atomic,
+		"atomic", false,
+		"Rename new links over files and symlinks in the way, so the link path never goes missing",
+	)
+	setComplete(planCmd.Flags(), "out", "files")
+
+	return planCmd
+}
+
+func newApplyCommand(opts *rootOpts) *cobra.Command {
+	var planPath string
+
+	applyCmd := &cobra.Command{
+		Use:   "apply --plan plan.json [flags]",
+		Short: "Makes the links in a plan from 'dfi plan'",
+		Long: `Usage: dfi apply --plan plan.json [flags]
+
+Makes exactly the links in a plan written by 'dfi plan', with its prefix,
+dest, and conflict strategy. If anything at one of the link paths is
+different from when the plan was made, nothing is done, the differences are
+listed, and dfi exits with code 9. Hooks are run as for a normal run.
+`,
+		Example: `  dfi apply --plan plan.json
+
+  # from stdin
+  ssh build-host dfi plan -p . ~/.settings/dotfiles/* ~ | dfi apply --plan -`,
+		Args: usageArgs(cobra.NoArgs),
+
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			if planPath == "" {
+				return usageError{fmt.Errorf("--plan is required")}
+			}
+			if err = opts.resolve(); err != nil {
+				return err
+			}
+
+			var in io.Reader = cmd.InOrStdin()
+			if planPath != "-" {
+				f, err := os.Open(planPath)
+				if err != nil {
+					return errors.Wrapf(err, "failed to open plan %#v", planPath)
+				}
+				defer f.Close()
+				in = f
+			}
+
+			p, err := df.ReadPlan(in)
+			if err != nil {
+				return err
+			}
+
+			err = df.ApplyPlan(opts.settings, p)
+			printMismatches(cmd.ErrOrStderr(), err)
+			printFailures(cmd.ErrOrStderr(), err)
+			return err
+		},
+	}
+
+	applyCmd.Flags().StringVar(&planPath, "plan", "", "The plan to apply, '-' for stdin")
+	applyCmd.Flags().BoolVarP(
+		&opts.settings.KeepGoing,
+		"keep-going", "k", false,
+		"Carry on after a link fails, and report all of the failures at the end",
+	)
+	applyCmd.Flags().IntVarP(
+		&opts.settings.Workers,
+		"jobs", "j", 1,
+		"How many links to create at once",
+	)
+	setComplete(applyCmd.Flags(), "plan", "files")
+
+	return applyCmd
+}
@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	str "strings"
+
+	"github.com/spf13/cobra"
+
+	df "github.com/slyphon/dfi/internal/dotfile"
+	ppath "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+type pruneOpts struct {
+	recursive bool
+	yes       bool
+	dryRun    bool
+	json      bool
+	foreign   bool
+}
+
+// confirm asks the question on out and returns true if the answer read
+// from in starts with 'y'
+func confirm(in io.Reader, out io.Writer, question string) (bool, error) {
+	fmt.Fprintf(out, "%s [y/N] ", question)
+
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+
+	return str.HasPrefix(str.ToLower(str.TrimSpace(answer)), "y"), nil
+}
+
+func printDangling(out io.Writer, links []df.DanglingLink, asJSON bool) error {
+	if asJSON {
+		if links == nil {
+			links = []df.DanglingLink{}
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(links)
+	}
+
+	for _, dl := range links {
+		state := "dangling"
+		switch {
+		case dl.Removed:
+			state = "removed"
+		case dl.Foreign:
+			state = "foreign"
+		}
+		fmt.Fprintf(out, "%s\t%s -> %s\n", state, dl.LinkPath, dl.LinkData)
+	}
+	return nil
+}
+
+func newPruneCommand() *cobra.Command {
+	opts := &pruneOpts{}
+
+	pruneCmd := &cobra.Command{
+		Use:   "prune [flags] source-root dest",
+		Short: "Removes dangling links in dest that point into source-root",
+		Long: `Usage: dfi prune [flags] source-root dest
+
+Looks in dest for symlinks that point inside of source-root, at files that
+no longer exist (eg. because they were deleted from the settings repository).
+They are listed, and after confirmation, removed. Relative links are resolved
+from the directory that contains them. source-root does not need to exist.
+
+Only links dfi made are removed. Links that point into source-root but
+were made some other way are listed as foreign, and left alone unless
+--include-foreign is given.
+`,
+		Example: `  # list and remove links like ~/.oldrc -> .settings/dotfiles/oldrc
+  dfi prune ~/.settings ~
+
+  # look through all of ~/.local, only list what would be removed, as JSON
+  dfi prune -r -n --json ~/.settings ~/.local`,
+		Args: usageArgs(cobra.ExactArgs(2)),
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			stateDir, err := df.StateDir()
+			if err != nil {
+				return err
+			}
+
+			links, err := df.FindDangling(ppath.NewOsFs(), args[0], args[1], opts.recursive)
+			if err != nil {
+				return err
+			}
+
+			st, err := df.ReadState(ppath.NewOsFs(), stateDir)
+			if err != nil {
+				return err
+			}
+			st.MarkForeign(links)
+
+			out := cmd.OutOrStdout()
+
+			n := 0
+			for _, dl := range links {
+				if opts.foreign || !dl.Foreign {
+					n++
+				}
+			}
+
+			if n > 0 && !opts.dryRun {
+				ok := opts.yes
+				if !ok {
+					if err = printDangling(cmd.ErrOrStderr(), links, false); err != nil {
+						return err
+					}
+					question := fmt.Sprintf("remove %d dangling links?", n)
+					if ok, err = confirm(cmd.InOrStdin(), cmd.ErrOrStderr(), question); err != nil {
+						return err
+					}
+				}
+
+				if ok {
+					if err = df.PruneDangling(ppath.NewOsFs(), stateDir, links, opts.foreign); err != nil {
+						return err
+					}
+				}
+			}
+
+			return printDangling(out, links, opts.json)
+		},
+	}
+
+	pruneCmd.Flags().BoolVarP(&opts.recursive, "recursive", "r", false, "Also look in directories below dest")
+	pruneCmd.Flags().BoolVarP(&opts.yes, "yes", "y", false, "Remove the links without asking")
+	pruneCmd.Flags().BoolVarP(&opts.dryRun, "dry-run", "n", false, "Only list the links, don't remove them")
+	pruneCmd.Flags().BoolVar(&opts.json, "json", false, "Print the result as JSON")
+	pruneCmd.Flags().BoolVar(&opts.foreign, "include-foreign", false, "Also remove links dfi didn't make")
+
+	return pruneCmd
+}
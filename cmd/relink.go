@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/spf13/cobra"
+
+	df "github.com/slyphon/dfi/internal/dotfile"
+)
+
+func printRelinked(out io.Writer, links []df.Relinked, dryRun, asJSON bool) error {
+	if asJSON {
+		if links == nil {
+			links = []df.Relinked{}
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(links)
+	}
+
+	state := "relinked"
+	if dryRun {
+		state = "relink"
+	}
+	for _, rl := range links {
+		note := ""
+		if rl.Dangling {
+			note = " (dangling)"
+		}
+		fmt.Fprintf(out, "%s\t%s -> %s, was %s%s\n", state, rl.LinkPath, rl.NewData, rl.OldData, note)
+	}
+	return nil
+}
+
+func newRelinkCommand(opts *rootOpts) *cobra.Command {
+	rs := &df.RelinkSettings{}
+	var asJSON bool
+
+	relinkCmd := &cobra.Command{
+		Use:   "relink --from OLD --to NEW [flags] [dest...]",
+		Short: "Points links at a settings directory that moved",
+		Long: `Usage: dfi relink --from OLD --to NEW [flags] [dest...]
+
+Finds the symlinks that point under OLD, in the directories dfi has made
+links in and in the given dests, and points each at the same place under
+NEW. Relative links are worked out again for the new location, absolute
+ones stay absolute. Each change is listed. OLD does not need to exist, so
+this works after the settings directory was moved.
+`,
+		Example: `  # after 'mv ~/.settings ~/src/dotfiles'
+  dfi relink --from ~/.settings --to ~/src/dotfiles
+
+  # also look through all of ~/.config, only list what would change
+  dfi relink -n -r --from ~/.settings --to ~/src/dotfiles ~/.config`,
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if rs.From == "" || rs.To == "" {
+				return usageError{fmt.Errorf("--from and --to are required")}
+			}
+			rs.Dests = args
+			rs.NoLock, rs.LockTimeout = opts.settings.NoLock, opts.settings.LockTimeout
+
+			relinked, err := df.Relink(rs)
+			if e := printRelinked(cmd.OutOrStdout(), relinked, rs.DryRun, asJSON); err == nil {
+				err = e
+			}
+			return err
+		},
+	}
+
+	relinkCmd.Flags().StringVar(&rs.From, "from", "", "Where the settings directory was")
+	relinkCmd.Flags().StringVar(&rs.To, "to", "", "Where the settings directory is now")
+	relinkCmd.Flags().BoolVarP(&rs.Recursive, "recursive", "r", false, "Also look in directories below the dests")
+	relinkCmd.Flags().BoolVarP(&rs.DryRun, "dry-run", "n", false, "Only list the links, don't change them")
+	relinkCmd.Flags().BoolVar(&asJSON, "json", false, "Print the result as JSON")
+
+	setComplete(relinkCmd.Flags(), "from", "dirs")
+	setComplete(relinkCmd.Flags(), "to", "dirs")
+
+	return relinkCmd
+}
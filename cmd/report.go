@@ -0,0 +1,27 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+
+	df "github.com/slyphon/dfi/internal/dotfile"
+)
+
+// printFailures writes a table of the links that failed, if err is
+// from a keep-going run. Other errors are left to the caller.
+func printFailures(out io.Writer, err error) {
+	var failed *df.FailedLinksError
+	if !errors.As(err, &failed) {
+		return
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "LINK PATH\tSOURCE\tERROR")
+	for _, f := range failed.Failures {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", f.LinkPath, f.Vpath, errors.Cause(f.Err))
+	}
+	_ = w.Flush()
+}
@@ -48,19 +48,136 @@ func hasStdinSource(sourceArgs []string) (b bool, err error) {
 }
 
 
+// commandFns are the implementations behind each command, so
+// they can be replaced with mocks for testing. nil means use the default.
+type commandFns struct {
+	run           df.RunFn
+	runAll        df.RunAllFn
+	init          df.InitFn
+	watch         df.WatchFn
+	installBundle df.InstallBundleFn
+}
+
+// rootOpts holds the values of the root command's persistent flags,
+// which are shared by the subcommands
+type rootOpts struct {
+	settings    *df.Settings
+	conflictOpt string
+	configPath  string
+	gitCheckOpt string
+	execAfter   []string
+	nullSep     bool
+	maps        []string
+
+	// from the config file, see Config
+	recipients      []string
+	recipientsFiles []string
+}
+
+// resolve parses the string options into settings, and loads the hooks,
+// secrets, identity and recipients from the config file
+func (o *rootOpts) resolve() (err error) {
+	if o.settings.OnConflict, err = df.OnConflictForString(o.conflictOpt); err != nil {
+		return err
+	}
+
+	if o.settings.GitCheck, err = df.GitCheckForString(o.gitCheckOpt); err != nil {
+		return err
+	}
+
+	var cfg *Config
+	if cfg, err = loadConfig(o.configPath); err != nil {
+		return err
+	}
+
+	o.settings.Hooks = cfg.Hooks
+	o.settings.Secrets = cfg.Secrets
+	if o.settings.Identity == "" {
+		o.settings.Identity = cfg.Identity
+	}
+	if o.settings.Identity != "" {
+		if o.settings.Identity, err = expandHome(o.settings.Identity); err != nil {
+			return err
+		}
+	}
+	o.recipients = cfg.Recipients
+	if o.recipientsFiles, err = expandHomes(cfg.RecipientsFiles); err != nil {
+		return err
+	}
+	if len(o.execAfter) > 0 {
+		o.settings.Hooks.Link = append(o.settings.Hooks.Link, df.LinkHook{Post: o.execAfter})
+	}
+
+	return nil
+}
+
+// parseArgs sets the sources and dest in settings from the arguments,
+// reading the sources from stdin if they're '-'
+func (o *rootOpts) parseArgs(args []string) (err error) {
+	settings := o.settings
+	settings.DestPath = args[len(args)-1]
+	sources := args[0 : len(args)-1]
+
+	var isStdin bool
+	if isStdin, err = hasStdinSource(sources); err != nil {
+		return err
+	}
+
+	if isStdin {
+		splitFunc := df.SplitOnNewlines
+		if o.nullSep {
+			splitFunc = df.SplitOnNullByte
+		}
+
+		if settings.SourcePaths, err = df.ReadSources(os.Stdin, splitFunc); err != nil {
+			return err
+		}
+	} else {
+		settings.SourcePaths = sources
+	}
+
+	log.Tracef("parsed settings: %+v", settings)
+	return nil
+}
+
+// mappedSettings returns settings for each of the --map flags
+func (o *rootOpts) mappedSettings() ([]*df.Settings, error) {
+	ss := make([]*df.Settings, 0, len(o.maps))
+	for _, spec := range o.maps {
+		m, err := df.ParseMapping(spec)
+		if err != nil {
+			return nil, usageError{err}
+		}
+		s, err := m.Settings(o.settings)
+		if err != nil {
+			return nil, err
+		}
+		ss = append(ss, s)
+	}
+	return ss, nil
+}
+
 // runFn here allows for injecting a different Run for testing.
 // if nil, then use the default one: dotfiles.Run
 func NewRootCommand(runFn df.RunFn) (rootCmd *cobra.Command) {
-	conflictOpt := ""
-	settings := &df.Settings{}
-	nullSep := false
+	return newRootCommand(commandFns{run: runFn})
+}
+
+func newRootCommand(fns commandFns) (rootCmd *cobra.Command) {
+	runFn := fns.run
+	opts := &rootOpts{settings: &df.Settings{}}
+	settings := opts.settings
 
 	if runFn == nil {
 		runFn = df.Run
 	}
+	runAllFn := fns.runAll
+	if runAllFn == nil {
+		runAllFn = df.RunAll
+	}
 
 	rootCmd = &cobra.Command{
-		Use:   "dfi sources... dest",
+		Use:   "dfi sources... dest | dfi --map SRC_GLOB:DEST[:PREFIX]...",
 		Short: "Manages dotfile symlinks to version-controlled files",
 		Long: `Usage: dfi [flags] sources... dest
 
@@ -70,6 +187,12 @@ two sources to the same symlink) is considered an error. Sources can
 also be '-' which means to read source paths from stdin, one per line,
 or if the -0 flag is given, separated by null bytes.
 
+Instead of sources and dest, --map links the sources matching SRC_GLOB into
+DEST, with PREFIX if it's given, otherwise --prefix. It can be repeated to
+link into several dests in one run, which is all or nothing like a run into
+one dest: link paths must be unique across all of them, each dest is locked,
+the failures are reported together, and the run hooks run once.
+
 In the case of conflicts (i.e. destination already exists) you can decide
 how files and symlinks will be handled.
 
@@ -83,39 +206,119 @@ If a link path already exists, the following strategies are available:
 
 * 'fail': stop processing and report an error.
 
+Hooks are shell commands that are run before and after the whole run, or
+around each link that was actually changed. They're configured in the
+config file (by default $XDG_CONFIG_HOME/dfi/config.{toml,yaml,json}):
+
+  [hooks]
+  pre_run = ["echo starting"]
+  post_run = ["echo done"]
+
+  [[hooks.link]]
+  match = "**/.tmux.conf"
+  post = ["tmux source-file ~/.tmux.conf"]
+
+Link hooks get the DFI_VPATH, DFI_LINK_PATH and DFI_LINK_DATA environment
+variables, run hooks get DFI_DEST_PATH and DFI_PREFIX. A failing hook is
+treated as an error.
+
+With --keep-going, a link that fails doesn't stop the run. The failed links
+are listed in a table at the end, and dfi exits non-zero.
+
+With --jobs, links are created by that many workers at once, which helps
+with large source sets. The output is in the same order either way, but
+link hooks may run concurrently.
+
+With --atomic, a file or symlink in the way is backed up (for 'rename') and
+the new link is created under a temporary name and renamed over it, so
+a shell sourcing the file never finds it missing.
+
+Runs on the same dest take turns: dest is locked with flock(2), using a file
+in $XDG_STATE_HOME/dfi/locks, for as long as a run takes. A run waits up to
+--lock-timeout for the lock, then fails naming the PID of the run that holds
+it. --no-lock skips locking.
+
+Secrets are sources whose links match a [[secrets]] policy in the config
+file, their mode may be no more permissive than 'mode' (default 0600), and
+the directory their link is in no more than 'dir_mode' (default 0700):
+
+  [[secrets]]
+  match = "**/{.netrc,.pgpass,.ssh/id_*}"
+  mode = "0600"
+
+Anything more permissive is logged, or for sources, fixed with --fix-perms.
+A secret is never linked into a directory that's group or world writable.
+
+Sources named *.age are encrypted with age, see 'dfi encrypt'. They're
+decrypted with the identity (by default $XDG_DATA_HOME/dfi/identity, or
+'identity' in the config file) into a private directory,
+$XDG_DATA_HOME/dfi/decrypted, and linked from there, without the suffix.
+
+With --git-check, each source must be a tracked file in a git repository
+with no uncommitted modifications. 'warn' logs any problems, 'fail' stops
+before anything is linked. The commit each repository is at is logged.
+
+Exit codes:
+
+  0  success
+  1  any error without its own code
+  2  invalid flags
+  3  a link path exists and --on-conflict is 'fail'
+  4  two sources have the same name
+  5  dest does not exist or is not a directory
+  6  a path is a fifo, socket or device, which can't be handled
+  7  another run holds the lock on dest
+  8  'dfi verify' found sources that changed since they were installed
+  9  a link path changed since the plan 'dfi apply' was given was made
+  10 a secret would be linked into a directory others can write to
+
 `,
-		Args: cobra.MinimumNArgs(2),
+		Example: `  # link ~/.settings/dotfiles/bashrc to ~/.bashrc, and so on
+  dfi -p . ~/.settings/dotfiles/* ~
 
-		RunE: func(cmd *cobra.Command, args []string) (err error) {
-			if settings.OnConflict, err = df.OnConflictForString(conflictOpt); err != nil {
-				return err
-			}
+  # link scripts into ~/.local/bin, replacing anything in the way
+  dfi -C replace ~/.settings/bin/* ~/.local/bin
 
-			settings.DestPath = args[len(args)-1]
+  # dotfiles into ~ and scripts into ~/.local/bin, in one run
+  dfi --map '~/.settings/dotfiles/*:~:.' --map '~/.settings/bin/*:~/.local/bin'
 
-			sources := args[0 : len(args)-1]
+  # link what's tracked in a repository, see which links fail
+  git -C ~/.settings/dotfiles ls-files -z | dfi -0 -k -p . - ~
 
-			var isStdin bool
-			if isStdin, err = hasStdinSource(sources); err != nil {
-				return err
+  # set up shell completion, see 'dfi completion --help'
+  source <(dfi completion bash)`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(opts.maps) > 0 {
+				if len(args) > 0 {
+					return usageError{fmt.Errorf("can't use sources and dest with --map")}
+				}
+				return nil
 			}
+			return usageArgs(cobra.MinimumNArgs(2))(cmd, args)
+		},
 
-			if isStdin {
-				splitFunc := df.SplitOnNewlines
-				if nullSep {
-					splitFunc = df.SplitOnNullByte
-				}
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			if err = opts.resolve(); err != nil {
+				return err
+			}
 
-				if settings.SourcePaths, err = df.ReadSources(os.Stdin, splitFunc); err != nil {
+			if len(opts.maps) > 0 {
+				var ss []*df.Settings
+				if ss, err = opts.mappedSettings(); err != nil {
 					return err
 				}
-			} else {
-				settings.SourcePaths = sources
+				err = runAllFn(ss)
+				printFailures(cmd.ErrOrStderr(), err)
+				return err
 			}
 
-			log.Tracef("parsed settings: %+v", settings)
+			if err = opts.parseArgs(args); err != nil {
+				return err
+			}
 
-			return runFn(settings)
+			err = runFn(settings)
+			printFailures(cmd.ErrOrStderr(), err)
+			return err
 		},
 	}
 
@@ -126,19 +329,111 @@ If a link path already exists, the following strategies are available:
 	)
 
 	rootCmd.PersistentFlags().StringVarP(
-		&conflictOpt,
+		&opts.conflictOpt,
 		"on-conflct", "C",
 		"rename",
 		"Action to take when the symlink location exists: rename, replace, warn, fail",
 	)
 
+	rootCmd.Flags().BoolVarP(
+		&settings.KeepGoing,
+		"keep-going", "k", false,
+		"Carry on after a link fails, and report all of the failures at the end",
+	)
+
+	rootCmd.Flags().BoolVar(
+		&settings.Atomic,
+		"atomic", false,
+		"Rename new links over files and symlinks in the way, so the link path never goes missing",
+	)
+
+	rootCmd.Flags().StringArrayVar(
+		&opts.maps,
+		"map", nil,
+		"Link the sources matching SRC_GLOB into DEST, as SRC_GLOB:DEST[:PREFIX] (may be repeated)",
+	)
+
+	rootCmd.Flags().IntVarP(
+		&settings.Workers,
+		"jobs", "j", 1,
+		"How many links to create at once",
+	)
+
 	rootCmd.PersistentFlags().BoolVarP(
-		&nullSep,
+		&opts.nullSep,
 		"null", "0",
 		false,
 		"Stdin input is separated by the null byte",
 	)
 
+	rootCmd.PersistentFlags().StringVar(
+		&opts.configPath,
+		"config", "",
+		"Path to the config file (default $XDG_CONFIG_HOME/dfi/config.*)",
+	)
+
+	rootCmd.PersistentFlags().StringVar(
+		&opts.gitCheckOpt,
+		"git-check", "off",
+		"Check sources are committed to git: off, warn, fail",
+	)
+
+	rootCmd.PersistentFlags().StringArrayVar(
+		&opts.execAfter,
+		"exec-after", nil,
+		"A shell command to run after each link that was changed (may be repeated)",
+	)
+
+	rootCmd.PersistentFlags().BoolVar(
+		&settings.FixPerms,
+		"fix-perms", false,
+		"Take away permissions secret sources have beyond their policy",
+	)
+
+	rootCmd.PersistentFlags().StringVar(
+		&settings.Identity,
+		"identity", "",
+		"The identity to decrypt and encrypt sources with (default $XDG_DATA_HOME/dfi/identity)",
+	)
+
+	rootCmd.PersistentFlags().BoolVar(
+		&settings.NoLock,
+		"no-lock", false,
+		"Don't lock dest, so other runs on it may overlap with this one",
+	)
+
+	rootCmd.PersistentFlags().DurationVar(
+		&settings.LockTimeout,
+		"lock-timeout", df.DefaultLockTimeout,
+		"How long to wait for another run on the same dest to finish",
+	)
+
+	setComplete(rootCmd.PersistentFlags(), "on-conflct", "on-conflict")
+	setComplete(rootCmd.PersistentFlags(), "git-check", "git-check")
+	setComplete(rootCmd.PersistentFlags(), "config", "files")
+	setComplete(rootCmd.PersistentFlags(), "identity", "files")
+
+	rootCmd.SetFlagErrorFunc(func(_ *cobra.Command, err error) error {
+		return usageError{err}
+	})
+
+	rootCmd.AddCommand(newInitCommand(fns.init, opts))
+	rootCmd.AddCommand(newPruneCommand())
+	rootCmd.AddCommand(newRelinkCommand(opts))
+	rootCmd.AddCommand(newStatusCommand())
+	rootCmd.AddCommand(newUninstallCommand())
+	rootCmd.AddCommand(newVerifyCommand())
+	rootCmd.AddCommand(newWatchCommand(fns.watch, opts))
+	rootCmd.AddCommand(newPlanCommand(opts))
+	rootCmd.AddCommand(newApplyCommand(opts))
+	rootCmd.AddCommand(newBundleCommand())
+	rootCmd.AddCommand(newInstallBundleCommand(fns.installBundle, opts))
+	rootCmd.AddCommand(newKeygenCommand(opts))
+	rootCmd.AddCommand(newEncryptCommand(opts))
+	rootCmd.AddCommand(newReencryptCommand(opts))
+	rootCmd.AddCommand(newCompletionCommand())
+	rootCmd.AddCommand(newCompleteCommand())
+
 	return rootCmd
 }
 
@@ -147,6 +442,6 @@ If a link path already exists, the following strategies are available:
 func Execute(rootCmd *cobra.Command) {
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
-		os.Exit(1)
+		os.Exit(ExitCode(err))
 	}
 }
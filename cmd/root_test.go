@@ -1,15 +1,24 @@
 package cmd
 
 import (
+	"bytes"
+	"fmt"
+	"encoding/json"
 	"io/ioutil"
 	"os"
+	fp "path/filepath"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/stretchr/testify/suite"
 
 	df "github.com/slyphon/dfi/internal/dotfile"
+	ppath "github.com/slyphon/dfi/pkg/pathlib"
 	testhelp "github.com/slyphon/dfi/pkg/testhelper"
 )
 
@@ -35,8 +44,11 @@ func TestRootCmdSuite(t *testing.T) {
 		var err error
 		s.tmpdir, err = ioutil.TempDir("", "rootcmdsuite")
 		s.NoError(err)
+		// keep the run locks out of the real state dir
+		s.NoError(os.Setenv("XDG_STATE_HOME", fp.Join(s.tmpdir, "state")))
 	})
 	s.AddAfterHook(func (a, b string){
+		os.Unsetenv("XDG_STATE_HOME")
 		if (s.tmpdir != "") {
 			err := os.RemoveAll(s.tmpdir)
 			log.Errorf("ignoring error tearing down tmpdir: %+v", err)
@@ -57,3 +69,477 @@ func (s *RootCmdSuite) TestCommandSanity() {
 	s.Equal([]string{"/a/b/c/settings"}, rm.settings.SourcePaths)
 	s.Equal("/a/b/c/home", rm.settings.DestPath)
 }
+
+func (s *RootCmdSuite) TestHooksFromConfigAndFlags() {
+	cfgPath := fp.Join(s.tmpdir, "config.toml")
+	cfg := `
+[hooks]
+pre_run = ["echo pre"]
+
+[[hooks.link]]
+match = "**/.tmux.conf"
+post = ["tmux source-file ~/.tmux.conf"]
+`
+	s.NoError(ioutil.WriteFile(cfgPath, []byte(cfg), 0o644))
+
+	rm := &RunMock{}
+	rootCmd := NewRootCommand(rm.Run)
+	rootCmd.SetArgs([]string{
+		"--config", cfgPath, "--exec-after", "fc-cache", "/a/b/c/settings", "/a/b/c/home",
+	})
+	s.NoError(rootCmd.Execute())
+
+	s.Equal([]string{"echo pre"}, rm.settings.Hooks.PreRun)
+	s.Equal(
+		[]df.LinkHook{
+			{Match: "**/.tmux.conf", Post: []string{"tmux source-file ~/.tmux.conf"}},
+			{Post: []string{"fc-cache"}},
+		},
+		rm.settings.Hooks.Link,
+	)
+}
+
+func (s *RootCmdSuite) TestSecretsFromConfig() {
+	cfgPath := fp.Join(s.tmpdir, "config.toml")
+	cfg := `
+[[secrets]]
+match = "**/.ssh/**"
+dir_mode = "0750"
+`
+	s.NoError(ioutil.WriteFile(cfgPath, []byte(cfg), 0o644))
+
+	rm := &RunMock{}
+	rootCmd := NewRootCommand(rm.Run)
+	rootCmd.SetArgs([]string{"--config", cfgPath, "--fix-perms", "/a/b/c/settings", "/a/b/c/home"})
+	s.NoError(rootCmd.Execute())
+
+	s.Equal([]df.SecretPolicy{{Match: "**/.ssh/**", DirMode: "0750"}}, rm.settings.Secrets)
+	s.True(rm.settings.FixPerms)
+}
+
+func (s *RootCmdSuite) TestInitCommand() {
+	var got *df.InitSettings
+	initFn := func(is *df.InitSettings) error {
+		got = is
+		return nil
+	}
+
+	rootCmd := newRootCommand(commandFns{init: initFn})
+	rootCmd.SetArgs([]string{"init", "-d", "/a/settings", "-C", "fail", "/a/.bashrc", "/a/.vimrc"})
+	s.NoError(rootCmd.Execute())
+	s.Equal(".", got.Prefix)
+	s.Equal("/a/settings", got.SettingsDir)
+	s.Equal(df.ConflictHandlers.Fail, got.OnConflict)
+	s.Equal([]string{"/a/.bashrc", "/a/.vimrc"}, got.Paths)
+
+	rootCmd = newRootCommand(commandFns{init: initFn})
+	rootCmd.SetArgs([]string{"init", "-p", "", "/a/bin/foo"})
+	s.NoError(rootCmd.Execute())
+	s.Equal("", got.Prefix)
+}
+
+func (s *RootCmdSuite) TestPruneCommand() {
+	link := fp.Join(s.tmpdir, ".oldrc")
+	s.NoError(os.Symlink("settings/oldrc", link))
+
+	run := func(input string, args ...string) string {
+		var out bytes.Buffer
+		rootCmd := NewRootCommand(nil)
+		rootCmd.SetArgs(append([]string{"prune"}, args...))
+		rootCmd.SetIn(strings.NewReader(input))
+		rootCmd.SetOut(&out)
+		rootCmd.SetErr(ioutil.Discard)
+		s.NoError(rootCmd.Execute())
+		return out.String()
+	}
+
+	settingsDir := fp.Join(s.tmpdir, "settings")
+
+	// dfi didn't make the link, so it's left alone
+	s.Contains(run("y\n", settingsDir, s.tmpdir), "foreign\t"+link)
+	_, err := os.Lstat(link)
+	s.NoError(err, "foreign link should not be removed")
+
+	stateDir, err := df.StateDir()
+	s.NoError(err)
+	s.NoError(df.UpdateState(ppath.NewOsFs(), stateDir, func(st *df.State) error {
+		st.Links[link] = df.LinkRecord{Vpath: fp.Join(settingsDir, "oldrc"), LinkData: "settings/oldrc"}
+		return nil
+	}))
+
+	s.Contains(run("n\n", settingsDir, s.tmpdir), "dangling\t"+link)
+	_, err = os.Lstat(link)
+	s.NoError(err, "link should not be removed without confirmation")
+
+	var result []df.DanglingLink
+	s.NoError(json.Unmarshal([]byte(run("y\n", "--json", settingsDir, s.tmpdir)), &result))
+	s.Equal([]df.DanglingLink{
+		{LinkPath: link, LinkData: "settings/oldrc", Target: fp.Join(settingsDir, "oldrc"), SourceRoot: settingsDir, Removed: true},
+	}, result)
+	_, err = os.Lstat(link)
+	s.True(os.IsNotExist(err))
+
+	st, err := df.ReadState(ppath.NewOsFs(), stateDir)
+	s.NoError(err)
+	s.Empty(st.Links, "removed links are forgotten")
+
+	other := fp.Join(s.tmpdir, ".otherrc")
+	s.NoError(os.Symlink("settings/otherrc", other))
+	s.Contains(run("", "-y", "--include-foreign", settingsDir, s.tmpdir), "removed\t"+other)
+}
+
+func (s *RootCmdSuite) TestStatusAndUninstall() {
+	settingsDir := fp.Join(s.tmpdir, "settings")
+	s.NoError(os.MkdirAll(settingsDir, 0o755))
+	for _, name := range []string{"bashrc", "vimrc", "zshrc"} {
+		s.NoError(ioutil.WriteFile(fp.Join(settingsDir, name), nil, 0o644))
+	}
+
+	home := fp.Join(s.tmpdir, "home")
+	s.NoError(os.Mkdir(home, 0o755))
+	s.NoError(df.Run(&df.Settings{
+		Prefix:      ".",
+		OnConflict:  df.ConflictHandlers.Fail,
+		SourcePaths: []string{fp.Join(settingsDir, "bashrc"), fp.Join(settingsDir, "vimrc")},
+		DestPath:    home,
+	}))
+	s.NoError(os.Remove(fp.Join(home, ".vimrc")))
+	s.NoError(os.Symlink(fp.Join(settingsDir, "zshrc"), fp.Join(home, ".zshrc")))
+
+	run := func(input string, args ...string) []string {
+		var out bytes.Buffer
+		rootCmd := NewRootCommand(nil)
+		rootCmd.SetArgs(args)
+		rootCmd.SetIn(strings.NewReader(input))
+		rootCmd.SetOut(&out)
+		rootCmd.SetErr(ioutil.Discard)
+		s.NoError(rootCmd.Execute())
+		return firstFields(strings.Split(strings.TrimSpace(out.String()), "\n"))
+	}
+
+	s.Equal([]string{"ok", "missing", "foreign"}, run("", "status", settingsDir, home))
+	s.Equal([]string{"ok", "missing", "foreign"}, run("n\n", "uninstall", settingsDir, home))
+	s.Equal([]string{"removed", "missing", "foreign"}, run("y\n", "uninstall", settingsDir, home))
+
+	_, err := os.Lstat(fp.Join(home, ".bashrc"))
+	s.True(os.IsNotExist(err))
+	_, err = os.Lstat(fp.Join(home, ".zshrc"))
+	s.NoError(err, "foreign links are left alone")
+	s.Equal([]string{"foreign"}, run("", "status", settingsDir, home))
+}
+
+func (s *RootCmdSuite) TestWatchCommand() {
+	var got *df.WatchSettings
+	watchFn := func(ws *df.WatchSettings, stop <-chan struct{}) error {
+		got = ws
+		return nil
+	}
+
+	rootCmd := newRootCommand(commandFns{watch: watchFn})
+	rootCmd.SetArgs([]string{"watch", "-p", ".", "--debounce", "2s", "/a/dotfiles", "/a/bin", "/home"})
+	s.NoError(rootCmd.Execute())
+	s.Equal(".", got.Prefix)
+	s.Equal("/home", got.DestPath)
+	s.Equal([]string{"/a/dotfiles", "/a/bin"}, got.SourceDirs)
+	s.Equal(2*time.Second, got.Debounce)
+}
+
+func (s *RootCmdSuite) TestExitCodes() {
+	home := fp.Join(s.tmpdir, "home")
+	settings := fp.Join(s.tmpdir, "settings")
+	s.NoError(os.MkdirAll(home, 0o755))
+	s.NoError(os.MkdirAll(fp.Join(settings, "a"), 0o755))
+	s.NoError(os.MkdirAll(fp.Join(settings, "b"), 0o755))
+	for _, name := range []string{"a/bashrc", "b/bashrc", "vimrc"} {
+		s.NoError(ioutil.WriteFile(fp.Join(settings, name), nil, 0o644))
+	}
+	s.NoError(ioutil.WriteFile(fp.Join(home, ".vimrc"), nil, 0o644))
+	cfgPath := fp.Join(s.tmpdir, "config.toml")
+	s.NoError(ioutil.WriteFile(cfgPath, nil, 0o644))
+
+	run := func(args ...string) int {
+		rootCmd := NewRootCommand(nil)
+		rootCmd.SetArgs(append([]string{"--config", cfgPath}, args...))
+		rootCmd.SetOutput(ioutil.Discard)
+		return ExitCode(rootCmd.Execute())
+	}
+
+	s.Equal(ExitUsage, run("--no-such-flag", "a", "b"))
+	s.Equal(ExitUsage, run(fp.Join(settings, "vimrc")), "no dest")
+	s.Equal(ExitUsage, run("status", home), "no source root")
+	s.Equal(ExitConflict, run("-p", ".", "-C", "fail", fp.Join(settings, "vimrc"), home))
+	s.Equal(ExitDuplicateName, run(fp.Join(settings, "a/bashrc"), fp.Join(settings, "b/bashrc"), home))
+	s.Equal(ExitDestNotDir, run(fp.Join(settings, "vimrc"), fp.Join(s.tmpdir, "nowhere")))
+	s.Equal(ExitFailure, run("-C", "sideways", fp.Join(settings, "vimrc"), home))
+	s.Equal(ExitOK, run("-p", ".", "-C", "replace", fp.Join(settings, "vimrc"), home))
+	s.Equal(ExitLocked, ExitCode(errors.WithStack(&df.LockedError{Dest: home, PID: 1})))
+	s.Equal(ExitModified, ExitCode(errors.WithStack(&df.ModifiedSourcesError{Changed: 1})))
+	s.Equal(ExitInsecureDir, ExitCode(errors.WithStack(&df.InsecureDirError{LinkPath: home, Dir: s.tmpdir})))
+}
+
+func (s *RootCmdSuite) TestPlanAndApply() {
+	settings := fp.Join(s.tmpdir, "settings")
+	home := fp.Join(s.tmpdir, "home")
+	s.NoError(os.MkdirAll(settings, 0o755))
+	s.NoError(os.MkdirAll(home, 0o755))
+	s.NoError(ioutil.WriteFile(fp.Join(settings, "bashrc"), nil, 0o644))
+	s.NoError(ioutil.WriteFile(fp.Join(home, ".bashrc"), []byte("old"), 0o644))
+	cfgPath := fp.Join(s.tmpdir, "config.toml")
+	s.NoError(ioutil.WriteFile(cfgPath, nil, 0o644))
+	planPath := fp.Join(s.tmpdir, "plan.json")
+
+	run := func(args ...string) int {
+		rootCmd := NewRootCommand(nil)
+		rootCmd.SetArgs(append([]string{"--config", cfgPath}, args...))
+		rootCmd.SetOutput(ioutil.Discard)
+		return ExitCode(rootCmd.Execute())
+	}
+
+	s.Equal(ExitOK, run("plan", "-p", ".", "-C", "replace", "--out", planPath, fp.Join(settings, "bashrc"), home))
+	_, err := os.Readlink(fp.Join(home, ".bashrc"))
+	s.Error(err, "plan changes nothing")
+
+	s.NoError(ioutil.WriteFile(fp.Join(home, ".bashrc"), []byte("edited"), 0o644))
+	s.Equal(ExitPlanMismatch, run("apply", "--plan", planPath))
+
+	s.Equal(ExitOK, run("plan", "-p", ".", "-C", "replace", "--out", planPath, fp.Join(settings, "bashrc"), home))
+	s.Equal(ExitOK, run("apply", "--plan", planPath))
+	target, err := os.Readlink(fp.Join(home, ".bashrc"))
+	s.NoError(err)
+	s.Equal("../settings/bashrc", target)
+
+	s.Equal(ExitUsage, run("apply"))
+}
+
+func (s *RootCmdSuite) TestEncryptedSources() {
+	settings := fp.Join(s.tmpdir, "settings")
+	home := fp.Join(s.tmpdir, "home")
+	s.NoError(os.MkdirAll(settings, 0o755))
+	s.NoError(os.MkdirAll(home, 0o755))
+	s.NoError(ioutil.WriteFile(fp.Join(settings, "netrc"), []byte("machine a"), 0o600))
+	s.NoError(os.Setenv("XDG_DATA_HOME", fp.Join(s.tmpdir, "data")))
+	defer os.Unsetenv("XDG_DATA_HOME")
+
+	cfgPath := fp.Join(s.tmpdir, "config.toml")
+	cfg := fmt.Sprintf("identity = %q\n", fp.Join(s.tmpdir, "identity"))
+	s.NoError(ioutil.WriteFile(cfgPath, []byte(cfg), 0o644))
+
+	run := func(args ...string) (string, int) {
+		var out bytes.Buffer
+		rootCmd := NewRootCommand(nil)
+		rootCmd.SetArgs(append([]string{"--config", cfgPath}, args...))
+		rootCmd.SetOut(&out)
+		rootCmd.SetErr(ioutil.Discard)
+		code := ExitCode(rootCmd.Execute())
+		return out.String(), code
+	}
+
+	out, code := run("keygen")
+	s.Equal(ExitOK, code)
+	s.Regexp("^"+fp.Join(s.tmpdir, "identity")+"\tage1[a-z0-9]+\n$", out)
+
+	source := fp.Join(settings, "netrc"+df.EncryptedSuffix)
+	out, code = run("encrypt", fp.Join(settings, "netrc"))
+	s.Equal(ExitOK, code)
+	s.Equal(source+"\n", out)
+	s.NoError(os.Remove(fp.Join(settings, "netrc")))
+
+	_, code = run("-p", ".", source, home)
+	s.Equal(ExitOK, code)
+	b, err := ioutil.ReadFile(fp.Join(home, ".netrc"))
+	s.NoError(err)
+	s.Equal("machine a", string(b))
+
+	s.NoError(ioutil.WriteFile(fp.Join(home, ".netrc"), []byte("machine b"), 0o600))
+	out, _ = run("status", settings, home)
+	s.True(strings.HasPrefix(out, "edited\t"+fp.Join(home, ".netrc")), out)
+
+	out, code = run("reencrypt")
+	s.Equal(ExitOK, code)
+	s.True(strings.HasPrefix(out, "edited\t"+source), out)
+	out, _ = run("status", settings, home)
+	s.True(strings.HasPrefix(out, "ok\t"), out)
+
+	// recipients from the config and the command line can decrypt too
+	other := func(name string) *df.Identity {
+		path := fp.Join(s.tmpdir, name)
+		s.NoError(df.GenerateIdentity(path))
+		id, err := df.ReadIdentity(path)
+		s.NoError(err)
+		return id
+	}
+	teammate, ci := other("teammate"), other("ci")
+	cfg += fmt.Sprintf("recipients = [%q]\n", teammate.PublicKey())
+	s.NoError(ioutil.WriteFile(cfgPath, []byte(cfg), 0o644))
+
+	s.NoError(ioutil.WriteFile(fp.Join(settings, "pgpass"), []byte("*:*:*:me:pw"), 0o600))
+	_, code = run("encrypt", "-r", ci.PublicKey(), fp.Join(settings, "pgpass"))
+	s.Equal(ExitOK, code)
+	data, err := ioutil.ReadFile(fp.Join(settings, "pgpass"+df.EncryptedSuffix))
+	s.NoError(err)
+	for _, id := range []*df.Identity{teammate, ci} {
+		b, err := id.Decrypt(data)
+		s.NoError(err)
+		s.Equal("*:*:*:me:pw", string(b))
+	}
+}
+
+func (s *RootCmdSuite) TestMapFlag() {
+	settings := fp.Join(s.tmpdir, "settings")
+	s.NoError(os.MkdirAll(fp.Join(settings, "bin"), 0o755))
+	for _, name := range []string{"bashrc", "vimrc", "bin/ls"} {
+		s.NoError(ioutil.WriteFile(fp.Join(settings, name), nil, 0o644))
+	}
+
+	var got []*df.Settings
+	run := func(args ...string) int {
+		got = nil
+		rootCmd := newRootCommand(commandFns{runAll: func(ss []*df.Settings) error {
+			got = ss
+			return nil
+		}})
+		rootCmd.SetArgs(args)
+		rootCmd.SetOutput(ioutil.Discard)
+		return ExitCode(rootCmd.Execute())
+	}
+
+	s.Equal(ExitOK, run(
+		"-p", "_", "-C", "replace",
+		"--map", fp.Join(settings, "*rc")+":/a/home:.",
+		"--map", fp.Join(settings, "bin/*")+":/a/bin",
+	))
+	s.Require().Len(got, 2)
+	s.Equal([]string{fp.Join(settings, "bashrc"), fp.Join(settings, "vimrc")}, got[0].SourcePaths)
+	s.Equal("/a/home", got[0].DestPath)
+	s.Equal(".", got[0].Prefix)
+	s.Equal([]string{fp.Join(settings, "bin/ls")}, got[1].SourcePaths)
+	s.Equal("/a/bin", got[1].DestPath)
+	s.Equal("_", got[1].Prefix)
+	s.Equal(df.ConflictHandlers.Replace, got[1].OnConflict)
+
+	s.Equal(ExitUsage, run("--map", fp.Join(settings, "*rc")+":/a/home", "a", "b"))
+	s.Equal(ExitUsage, run("--map", fp.Join(settings, "*rc")))
+	s.Equal(ExitFailure, run("--map", fp.Join(settings, "nothing*")+":/a/home"))
+}
+
+func (s *RootCmdSuite) TestLockFlags() {
+	rm := &RunMock{}
+	rootCmd := NewRootCommand(rm.Run)
+	rootCmd.SetArgs([]string{"/a/b/c/settings", "/a/b/c/home"})
+	s.NoError(rootCmd.Execute())
+	s.False(rm.settings.NoLock)
+	s.Equal(df.DefaultLockTimeout, rm.settings.LockTimeout)
+
+	rootCmd = NewRootCommand(rm.Run)
+	rootCmd.SetArgs([]string{"--no-lock", "--lock-timeout", "2m", "/a/b/c/settings", "/a/b/c/home"})
+	s.NoError(rootCmd.Execute())
+	s.True(rm.settings.NoLock)
+	s.Equal(2*time.Minute, rm.settings.LockTimeout)
+}
+
+func (s *RootCmdSuite) TestKeepGoing() {
+	home := fp.Join(s.tmpdir, "home")
+	settings := fp.Join(s.tmpdir, "settings")
+	s.NoError(os.MkdirAll(home, 0o755))
+	s.NoError(os.MkdirAll(settings, 0o755))
+	for _, name := range []string{"bashrc", "fifo", "vimrc"} {
+		s.NoError(ioutil.WriteFile(fp.Join(settings, name), nil, 0o644))
+	}
+	s.NoError(syscall.Mkfifo(fp.Join(home, ".fifo"), 0o644))
+	cfgPath := fp.Join(s.tmpdir, "config.toml")
+	s.NoError(ioutil.WriteFile(cfgPath, nil, 0o644))
+
+	stderr := &bytes.Buffer{}
+	rootCmd := NewRootCommand(nil)
+	rootCmd.SetArgs([]string{
+		"--config", cfgPath, "-p", ".", "--keep-going",
+		fp.Join(settings, "bashrc"), fp.Join(settings, "fifo"), fp.Join(settings, "vimrc"), home,
+	})
+	rootCmd.SetOutput(stderr)
+
+	err := rootCmd.Execute()
+	s.Error(err)
+	s.Equal(ExitFailure, ExitCode(err))
+	s.Equal("1 of 3 links failed", err.Error())
+
+	// cobra prints the error and usage after the table
+	lines := strings.Split(stderr.String(), "\n")
+	s.True(strings.HasPrefix(lines[2], "Error: 1 of 3 links failed"))
+	s.Regexp(`^LINK PATH\s+SOURCE\s+ERROR$`, lines[0])
+	s.Contains(lines[1], fp.Join(home, ".fifo"))
+	s.Contains(lines[1], "is a fifo, cannot back up")
+
+	s.FileExists(fp.Join(home, ".bashrc"))
+	s.FileExists(fp.Join(home, ".vimrc"))
+}
+
+func (s *RootCmdSuite) TestCompletion() {
+	complete := func(words ...string) []string {
+		out := &bytes.Buffer{}
+		rootCmd := NewRootCommand(nil)
+		rootCmd.SetArgs(append([]string{completeCmdName}, words...))
+		rootCmd.SetOutput(out)
+		s.NoError(rootCmd.Execute())
+		return strings.Split(strings.TrimSpace(out.String()), "\n")
+	}
+
+	s.Equal([]string{"watch\tKeeps the links in dest in sync with the contents of the source directories", ":files"},
+		complete("w"))
+	s.Equal([]string{"apply", "bundle", "completion", "encrypt", "init", "install-bundle", "keygen", "plan", "prune", "reencrypt", "relink", "status", "uninstall", "verify", "watch", ":files"}, firstFields(complete("")))
+	s.Equal([]string{"--keep-going", ":none"}, firstFields(complete("--keep")))
+	s.Equal([]string{"--debounce", ":none"}, firstFields(complete("watch", "--de")))
+
+	// the values of flags, however they're given
+	names := complete("-C", "")
+	s.Equal(append(df.OnConflictNames(), ":none"), names)
+	for _, name := range names[:len(names)-1] {
+		_, err := df.OnConflictForString(name)
+		s.NoError(err)
+	}
+	s.Equal([]string{"rename", "replace", ":none"}, complete("--on-conflct", "=", "re"))
+	s.Equal([]string{"--git-check=warn", ":none"}, complete("init", "--git-check=w"))
+	s.Equal([]string{":files"}, complete("--config", ""))
+	s.Equal([]string{":dirs"}, complete("init", "--settings-dir", "~/"))
+	s.Equal([]string{"zsh", ":none"}, complete("completion", "z"))
+
+	// group names come from the manifest, or the manifest in the bundle
+	settingsDir := fp.Join(s.tmpdir, "settings")
+	s.NoError(os.MkdirAll(fp.Join(settingsDir, "dotfiles"), 0o755))
+	s.NoError(ioutil.WriteFile(fp.Join(settingsDir, "dotfiles", "bashrc"), nil, 0o644))
+	manifest := fp.Join(settingsDir, df.ManifestFileName)
+	s.NoError((&df.Manifest{Groups: []df.ManifestGroup{
+		{Name: "dotfiles", Sources: []string{"dotfiles"}, Dest: "~"},
+		{Name: "bin", Sources: []string{"dotfiles/bashrc"}, Dest: "~/bin"},
+	}}).Write(manifest))
+	s.Equal([]string{"dotfiles", "bin", ":none"}, complete("bundle", manifest, "--group", ""))
+	s.Equal([]string{"bin", ":none"}, complete("bundle", "-o", "x.tar", manifest, "-g", "b"))
+
+	bundle := fp.Join(s.tmpdir, "bundle.tar")
+	f, err := os.Create(bundle)
+	s.NoError(err)
+	s.NoError(df.WriteBundle(manifest, []string{"bin"}, f))
+	s.NoError(f.Close())
+	s.Equal([]string{"--group=bin", ":none"}, complete("install-bundle", bundle, "--group="))
+
+	for _, shell := range []string{"bash", "zsh", "fish"} {
+		out := &bytes.Buffer{}
+		rootCmd := NewRootCommand(nil)
+		rootCmd.SetArgs([]string{"completion", shell})
+		rootCmd.SetOutput(out)
+		s.NoError(rootCmd.Execute())
+		s.Contains(out.String(), completeCmdName+" ", shell)
+	}
+
+	rootCmd := NewRootCommand(nil)
+	rootCmd.SetArgs([]string{"completion", "tcsh"})
+	rootCmd.SetOutput(ioutil.Discard)
+	s.Equal(ExitUsage, ExitCode(rootCmd.Execute()))
+}
+
+// firstFields returns the candidates without their descriptions
+func firstFields(lines []string) []string {
+	for i, l := range lines {
+		lines[i] = strings.SplitN(l, "\t", 2)[0]
+	}
+	return lines
+}
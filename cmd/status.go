@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/spf13/cobra"
+
+	df "github.com/slyphon/dfi/internal/dotfile"
+	ppath "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+type statusOpts struct {
+	recursive bool
+	yes       bool
+	dryRun    bool
+	json      bool
+}
+
+func printStatus(out io.Writer, links []df.LinkStatus, asJSON bool) error {
+	if asJSON {
+		if links == nil {
+			links = []df.LinkStatus{}
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(links)
+	}
+
+	for _, ls := range links {
+		state := string(ls.Status)
+		if ls.Secret != "" && ls.Secret != df.SecretCurrent {
+			state = string(ls.Secret)
+		}
+		if ls.Removed {
+			state = "removed"
+		}
+		fmt.Fprintf(out, "%s\t%s -> %s\n", state, ls.LinkPath, ls.LinkData)
+	}
+	return nil
+}
+
+// findStatus returns the status of the links in dest for source-root
+func findStatus(args []string, recursive bool) ([]df.LinkStatus, string, error) {
+	stateDir, err := df.StateDir()
+	if err != nil {
+		return nil, "", err
+	}
+	links, err := df.Status(ppath.NewOsFs(), stateDir, args[0], args[1], recursive)
+	return links, stateDir, err
+}
+
+func newStatusCommand() *cobra.Command {
+	opts := &statusOpts{}
+
+	statusCmd := &cobra.Command{
+		Use:   "status [flags] source-root dest",
+		Short: "Lists the links in dest that point into source-root",
+		Long: `Usage: dfi status [flags] source-root dest
+
+Lists the links dfi made in dest for sources in source-root, and whether
+each is still ok, missing, or has been changed to something else. Symlinks
+that point into source-root, but that dfi didn't make, are listed as
+foreign. A link to the decrypted copy of an encrypted source is listed as
+stale if the source has changed since it was decrypted, edited if the copy
+has, and diverged if both have.
+`,
+		Example: `  # list the links in ~ for ~/.settings
+  dfi status ~/.settings ~
+
+  # all of ~/.local, as JSON
+  dfi status -r --json ~/.settings ~/.local`,
+		Args: usageArgs(cobra.ExactArgs(2)),
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			links, _, err := findStatus(args, opts.recursive)
+			if err != nil {
+				return err
+			}
+			return printStatus(cmd.OutOrStdout(), links, opts.json)
+		},
+	}
+
+	statusCmd.Flags().BoolVarP(&opts.recursive, "recursive", "r", false, "Also look in directories below dest")
+	statusCmd.Flags().BoolVar(&opts.json, "json", false, "Print the result as JSON")
+
+	return statusCmd
+}
+
+func newUninstallCommand() *cobra.Command {
+	opts := &statusOpts{}
+
+	uninstallCmd := &cobra.Command{
+		Use:   "uninstall [flags] source-root dest",
+		Short: "Removes the links dfi made in dest for source-root",
+		Long: `Usage: dfi uninstall [flags] source-root dest
+
+Removes the links dfi made in dest for sources in source-root, after
+confirmation, and stops managing them. Links that are missing or have been
+changed to something else are forgotten but left as they are, and foreign
+links (ones dfi didn't make) are only listed.
+`,
+		Example: `  # remove the links in ~ for ~/.settings
+  dfi uninstall ~/.settings ~
+
+  # only list what would be removed in all of ~/.local
+  dfi uninstall -r -n ~/.settings ~/.local`,
+		Args: usageArgs(cobra.ExactArgs(2)),
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			links, stateDir, err := findStatus(args, opts.recursive)
+			if err != nil {
+				return err
+			}
+
+			n := 0
+			for _, ls := range links {
+				if ls.Status == df.StatusOK {
+					n++
+				}
+			}
+
+			if len(links) > 0 && !opts.dryRun {
+				ok := opts.yes
+				if !ok && n > 0 {
+					if err = printStatus(cmd.ErrOrStderr(), links, false); err != nil {
+						return err
+					}
+					question := fmt.Sprintf("remove %d links?", n)
+					if ok, err = confirm(cmd.InOrStdin(), cmd.ErrOrStderr(), question); err != nil {
+						return err
+					}
+				}
+
+				if ok || n == 0 {
+					if err = df.Uninstall(ppath.NewOsFs(), stateDir, links); err != nil {
+						return err
+					}
+				}
+			}
+
+			return printStatus(cmd.OutOrStdout(), links, opts.json)
+		},
+	}
+
+	uninstallCmd.Flags().BoolVarP(&opts.recursive, "recursive", "r", false, "Also look in directories below dest")
+	uninstallCmd.Flags().BoolVarP(&opts.yes, "yes", "y", false, "Remove the links without asking")
+	uninstallCmd.Flags().BoolVarP(&opts.dryRun, "dry-run", "n", false, "Only list the links, don't remove them")
+	uninstallCmd.Flags().BoolVar(&opts.json, "json", false, "Print the result as JSON")
+
+	return uninstallCmd
+}
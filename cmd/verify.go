@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/spf13/cobra"
+
+	df "github.com/slyphon/dfi/internal/dotfile"
+	ppath "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+type verifyOpts struct {
+	all  bool
+	json bool
+}
+
+func printChecks(out io.Writer, checks []df.SourceCheck, opts *verifyOpts) error {
+	if opts.json {
+		if checks == nil {
+			checks = []df.SourceCheck{}
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(checks)
+	}
+
+	for _, sc := range checks {
+		if sc.Status != df.VerifyOK || opts.all {
+			fmt.Fprintf(out, "%s\t%s\n", sc.Status, sc.Vpath)
+		}
+	}
+	return nil
+}
+
+func newVerifyCommand() *cobra.Command {
+	opts := &verifyOpts{}
+
+	verifyCmd := &cobra.Command{
+		Use:   "verify [flags] [source-root...]",
+		Short: "Checks that sources haven't changed since they were installed",
+		Long: `Usage: dfi verify [flags] [source-root...]
+
+Every time dfi links a source, it records a checksum of its contents (of
+everything in it, for a directory) in a lockfile. verify hashes the sources
+again and lists the ones that have changed or gone missing since, eg.
+because an application rewrote ~/.bashrc through the link. Only the sources
+in the given source roots are checked, or all of them if none are given.
+
+It exits with code 8 if anything changed, so it can be used in a git
+pre-commit hook.
+`,
+		Example: `  # list the sources in ~/.settings that changed since they were installed
+  dfi verify ~/.settings
+
+  # all of them, as JSON
+  dfi verify --json`,
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			stateDir, err := df.StateDir()
+			if err != nil {
+				return err
+			}
+
+			checks, verr := df.Verify(ppath.NewOsFs(), stateDir, args)
+			if checks == nil && verr != nil {
+				return verr
+			}
+			if err = printChecks(cmd.OutOrStdout(), checks, opts); err != nil {
+				return err
+			}
+			return verr
+		},
+	}
+
+	verifyCmd.Flags().BoolVarP(&opts.all, "all", "a", false, "Also list the sources that haven't changed")
+	verifyCmd.Flags().BoolVar(&opts.json, "json", false, "Print the result as JSON")
+
+	return verifyCmd
+}
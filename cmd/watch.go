@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+
+	df "github.com/slyphon/dfi/internal/dotfile"
+)
+
+func newWatchCommand(watchFn df.WatchFn, opts *rootOpts) *cobra.Command {
+	watchSettings := &df.WatchSettings{}
+
+	if watchFn == nil {
+		watchFn = df.Watch
+	}
+
+	watchCmd := &cobra.Command{
+		Use:   "watch [flags] source-dirs... dest",
+		Short: "Keeps the links in dest in sync with the contents of the source directories",
+		Long: `Usage: dfi watch [flags] source-dirs... dest
+
+Links every entry in each of the source directories into dest (as if you'd
+run 'dfi source-dir/* dest'), then watches the source directories. When
+entries are added, removed or renamed, new links are created and links to
+entries that are gone are removed. A burst of changes, like a 'git pull',
+is only acted on once things have been quiet for --debounce.
+
+Runs until interrupted.
+`,
+		Example: `  dfi watch --prefix . ~/.settings/dotfiles ~
+  dfi watch --debounce 2s ~/.settings/bin ~/.local/bin`,
+		Args: usageArgs(cobra.MinimumNArgs(2)),
+
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			if err = opts.resolve(); err != nil {
+				return err
+			}
+
+			watchSettings.Settings = *opts.settings
+			watchSettings.DestPath = args[len(args)-1]
+			watchSettings.SourceDirs = args[:len(args)-1]
+
+			stop := make(chan struct{})
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			defer signal.Stop(signals)
+
+			go func() {
+				<-signals
+				close(stop)
+			}()
+
+			return watchFn(watchSettings, stop)
+		},
+	}
+
+	watchCmd.Flags().DurationVar(
+		&watchSettings.Debounce,
+		"debounce", df.DefaultDebounce,
+		"How long the source directories must be unchanged before syncing",
+	)
+
+	watchCmd.Flags().BoolVarP(
+		&opts.settings.KeepGoing,
+		"keep-going", "k", false,
+		"Carry on after a link fails, the failures are logged",
+	)
+
+	watchCmd.Flags().BoolVar(
+		&opts.settings.Atomic,
+		"atomic", false,
+		"Rename new links over files and symlinks in the way, so the link path never goes missing",
+	)
+
+	watchCmd.Flags().IntVarP(
+		&opts.settings.Workers,
+		"jobs", "j", 1,
+		"How many links to create at once",
+	)
+
+	return watchCmd
+}
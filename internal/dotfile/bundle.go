@@ -0,0 +1,408 @@
+package dotfile
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	fp "path/filepath"
+	"sort"
+	str "strings"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	ppath "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+type (
+	// BundleSettings are the options for InstallBundle, which unpacks a
+	// bundle made by WriteBundle and links its groups into place
+	BundleSettings struct {
+		// Settings are used for each group, with its sources, dest and prefix
+		Settings
+
+		// Bundle is the path of the bundle, or the hash (or a prefix of it)
+		// of one that was installed before
+		Bundle string
+
+		// DataDir is where bundles are unpacked, see DataDir
+		DataDir string
+
+		// Groups are the names of the groups to link, all of them if empty
+		Groups []string
+	}
+
+	InstallBundleFn func(s *BundleSettings) (dir string, err error)
+)
+
+const (
+	bundlesDirName = "bundles"
+
+	// how many hex digits of the bundle's sha256 name its directory
+	bundleHashLen = 16
+)
+
+// DataDir returns $XDG_DATA_HOME/dfi, falling back to ~/.local/share/dfi
+func DataDir() (string, error) {
+	if xdg := os.Getenv("XDG_DATA_HOME"); xdg != "" {
+		return fp.Join(xdg, "dfi"), nil
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to find the home directory")
+	}
+	return fp.Join(home, ".local", "share", "dfi"), nil
+}
+
+// bundleEntries returns the paths of the sources of m, and everything
+// below them, relative to manifestDir and sorted. sources have to be
+// inside of manifestDir, or the bundle wouldn't be portable.
+func bundleEntries(m *Manifest, manifestDir string) ([]string, error) {
+	seen := map[string]bool{}
+	var entries []string
+
+	for _, g := range m.Groups {
+		for _, src := range g.SourcePaths(manifestDir) {
+			if !isUnder(src, manifestDir) || src == manifestDir {
+				return nil, errors.Errorf("source %#v of group %#v isn't inside of %#v", src, g.Name, manifestDir)
+			}
+
+			err := ppath.NewPosixPath(src).Walk(func(pp ppath.PosixPath, info ppath.RichFileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				rel, err := fp.Rel(manifestDir, pp.String())
+				if err != nil {
+					return err
+				}
+				if !seen[rel] {
+					seen[rel] = true
+					entries = append(entries, rel)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to walk source %#v", src)
+			}
+		}
+	}
+
+	// the directories a source is in are needed too
+	for _, e := range append([]string(nil), entries...) {
+		for d := fp.Dir(e); d != "."; d = fp.Dir(d) {
+			if !seen[d] {
+				seen[d] = true
+				entries = append(entries, d)
+			}
+		}
+	}
+
+	sort.Strings(entries)
+	return entries, nil
+}
+
+// WriteBundle writes a tar archive of the manifest at manifestPath and the
+// sources of its groups to w, or only of the named groups if there are
+// any. the entries are in order with no owners or times, so the same
+// sources always make the same bundle.
+func WriteBundle(manifestPath string, groups []string, w io.Writer) (err error) {
+	if manifestPath, err = fp.Abs(manifestPath); err != nil {
+		return errors.Wrap(err, "failed to Abs manifest path")
+	}
+	manifestDir := fp.Dir(manifestPath)
+
+	b, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read manifest %#v", manifestPath)
+	}
+	m, err := parseManifest(b, manifestPath)
+	if err != nil {
+		return err
+	}
+
+	// the manifest is copied as is, unless some of it is left out
+	if len(groups) > 0 {
+		if m, err = m.Select(groups); err != nil {
+			return err
+		}
+		if b, err = m.encode(); err != nil {
+			return err
+		}
+	}
+
+	entries, err := bundleEntries(m, manifestDir)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+
+	hdr := &tar.Header{Typeflag: tar.TypeReg, Name: ManifestFileName, Mode: 0o644, Size: int64(len(b)), ModTime: time.Unix(0, 0)}
+	if err = tw.WriteHeader(hdr); err != nil {
+		return errors.Wrap(err, "failed to write bundle")
+	}
+	if _, err = tw.Write(b); err != nil {
+		return errors.Wrap(err, "failed to write bundle")
+	}
+
+	for _, rel := range entries {
+		if err = writeBundleEntry(tw, manifestDir, rel); err != nil {
+			return err
+		}
+	}
+
+	return errors.Wrap(tw.Close(), "failed to write bundle")
+}
+
+func writeBundleEntry(tw *tar.Writer, root, rel string) error {
+	path := fp.Join(root, rel)
+	pp := ppath.NewPosixPath(path)
+
+	info, err := pp.Lstat()
+	if err != nil {
+		return errors.Wrapf(err, "failed to stat %#v", path)
+	}
+
+	hdr := &tar.Header{Name: rel, Mode: int64(info.Mode().Perm()), ModTime: time.Unix(0, 0)}
+	switch {
+	case info.IsDir():
+		hdr.Typeflag, hdr.Name = tar.TypeDir, rel+"/"
+	case info.IsSymlink():
+		data, err := pp.Readlink()
+		if err != nil {
+			return errors.Wrapf(err, "failed to readlink %#v", path)
+		}
+		hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, data.String()
+	case info.Mode().IsRegular():
+		hdr.Typeflag, hdr.Size = tar.TypeReg, info.Size()
+	default:
+		return errors.WithStack(&UnsupportedFileTypeError{Path: path, Mode: info.Mode(), Action: "bundle"})
+	}
+
+	if err = tw.WriteHeader(hdr); err != nil {
+		return errors.Wrapf(err, "failed to write %#v to bundle", rel)
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %#v", path)
+	}
+	defer f.Close()
+
+	_, err = io.CopyN(tw, f, hdr.Size)
+	return errors.Wrapf(err, "failed to write %#v to bundle", rel)
+}
+
+// ReadBundleManifest returns the manifest in the bundle at path
+func ReadBundleManifest(path string) (*Manifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open bundle %#v", path)
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, errors.Errorf("bundle %#v has no %s", path, ManifestFileName)
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "failed to read bundle %#v", path)
+		}
+		if hdr.Typeflag != tar.TypeReg || fp.Clean(hdr.Name) != ManifestFileName {
+			continue
+		}
+
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read bundle %#v", path)
+		}
+		return parseManifest(b, path+":"+ManifestFileName)
+	}
+}
+
+// hashFileAt returns the hex sha256 of the file at path
+func hashFileAt(path string) (string, error) {
+	h := sha256.New()
+	if err := hashFile(ppath.NewOsFs(), path, h); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// unpackBundle extracts the bundle at path into dir, which mustn't exist.
+// it's extracted next to dir first, so dir only appears once it's complete.
+func unpackBundle(path, dir string) (err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open bundle %#v", path)
+	}
+	defer f.Close()
+
+	if err = os.MkdirAll(fp.Dir(dir), 0o755); err != nil {
+		return errors.Wrapf(err, "failed to create %#v", fp.Dir(dir))
+	}
+	tmp, err := ioutil.TempDir(fp.Dir(dir), fp.Base(dir)+".dfi_tmp_")
+	if err != nil {
+		return errors.Wrap(err, "failed to create a temporary directory")
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(tmp)
+		}
+	}()
+
+	symlinks := map[string]bool{}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrapf(err, "failed to read bundle %#v", path)
+		}
+
+		// nothing may be written outside of tmp, or through a symlink
+		name := fp.Clean(hdr.Name)
+		if fp.IsAbs(name) || name == ".." || str.HasPrefix(name, "../") {
+			return errors.Errorf("bundle %#v has an entry outside of it: %#v", path, hdr.Name)
+		}
+		for d := fp.Dir(name); d != "."; d = fp.Dir(d) {
+			if symlinks[d] {
+				return errors.Errorf("bundle %#v has an entry inside of a symlink: %#v", path, hdr.Name)
+			}
+		}
+
+		target := fp.Join(tmp, name)
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, mode|0o700)
+		case tar.TypeSymlink:
+			symlinks[name] = true
+			err = os.Symlink(hdr.Linkname, target)
+		case tar.TypeReg:
+			err = extractFile(tr, target, mode)
+		default:
+			err = errors.Errorf("unsupported entry type %q", hdr.Typeflag)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to extract %#v from bundle %#v", hdr.Name, path)
+		}
+	}
+
+	return errors.Wrapf(os.Rename(tmp, dir), "failed to move bundle into %#v", dir)
+}
+
+func extractFile(r io.Reader, path string, mode os.FileMode) error {
+	if err := os.MkdirAll(fp.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// findBundle returns the directory of the unpacked bundle whose hash starts
+// with prefix
+func findBundle(bundlesDir, prefix string) (string, error) {
+	matches, err := fp.Glob(fp.Join(bundlesDir, prefix+"*"))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to look for bundle %#v", prefix)
+	}
+
+	var dirs []string
+	for _, m := range matches {
+		if base := fp.Base(m); len(base) == bundleHashLen && ppath.NewPosixPath(m).IsDir() {
+			dirs = append(dirs, m)
+		}
+	}
+	switch len(dirs) {
+	case 0:
+		return "", errors.Errorf("no bundle file or installed bundle %#v", prefix)
+	case 1:
+		return dirs[0], nil
+	default:
+		return "", errors.Errorf("%#v matches %d installed bundles", prefix, len(dirs))
+	}
+}
+
+// unpacked returns the directory s.Bundle is unpacked in, unpacking it if
+// it hasn't been already
+func (s *BundleSettings) unpacked(bundlesDir string) (string, error) {
+	if !ppath.NewPosixPath(s.Bundle).IsFile() {
+		return findBundle(bundlesDir, s.Bundle)
+	}
+
+	sum, err := hashFileAt(s.Bundle)
+	if err != nil {
+		return "", err
+	}
+	dir := fp.Join(bundlesDir, sum[:bundleHashLen])
+	if ppath.NewPosixPath(dir).IsDir() {
+		log.WithField("dir", dir).Info("bundle is already unpacked")
+		return dir, nil
+	}
+
+	if err = unpackBundle(s.Bundle, dir); err != nil {
+		return "", err
+	}
+	log.WithFields(log.Fields{"bundle": s.Bundle, "dir": dir}).Info("unpacked bundle")
+	return dir, nil
+}
+
+// InstallBundle unpacks s.Bundle into its own directory, named by its hash,
+// under s.DataDir and links each group in its manifest (or each of
+// s.Groups) from there, all as one run. Bundles
+// that were installed before are kept, so installing one again (by file or
+// by hash) rolls back to it. Returns the directory the bundle is in.
+func InstallBundle(s *BundleSettings) (dir string, err error) {
+	if s.DataDir == "" {
+		if s.DataDir, err = DataDir(); err != nil {
+			return "", err
+		}
+	}
+	bundlesDir := fp.Join(s.DataDir, bundlesDirName)
+
+	if dir, err = s.unpacked(bundlesDir); err != nil {
+		return "", err
+	}
+
+	m, err := ReadManifest(fp.Join(dir, ManifestFileName))
+	if err != nil {
+		return dir, err
+	}
+	if m, err = m.Select(s.Groups); err != nil {
+		return dir, err
+	}
+
+	// links into another bundle are switched over as part of the run, so
+	// they're rolled back with the rest if a link fails
+	ss := make([]*Settings, len(m.Groups))
+	for i, g := range m.Groups {
+		gs := s.Settings
+		gs.Prefix, gs.SourcePaths, gs.replaceInto = g.Prefix, g.SourcePaths(dir), bundlesDir
+		if gs.DestPath, err = g.DestPath(); err != nil {
+			return dir, errors.Wrapf(err, "failed to expand dest of group %#v", g.Name)
+		}
+		ss[i] = &gs
+	}
+
+	return dir, errors.WithMessagef(RunAll(ss), "failed to install bundle %#v", s.Bundle)
+}
+
+var _ InstallBundleFn = InstallBundle
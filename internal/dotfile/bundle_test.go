@@ -0,0 +1,208 @@
+package dotfile
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	fp "path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+func (s *InstallerSuite) writeBundleManifest() string {
+	m := &Manifest{Groups: []ManifestGroup{
+		{Name: "dotfiles", Sources: []string{"dotfiles/bashrc", "dotfiles/vimrc"}, Dest: s.fsFix.HomeDir.String(), Prefix: "."},
+		{Name: "bin", Sources: []string{"bin/cat", "bin/ls"}, Dest: s.fsFix.LocalBinDir.String()},
+	}}
+	path := s.fsFix.SettingsDir.Join(ManifestFileName).String()
+	s.Require().NoError(m.Write(path))
+	return path
+}
+
+func (s *InstallerSuite) TestWriteBundleIsReproducible() {
+	r := s.Require()
+	manifest := s.writeBundleManifest()
+
+	var a, b bytes.Buffer
+	r.NoError(WriteBundle(manifest, nil, &a))
+	r.NoError(WriteBundle(manifest, nil, &b))
+	s.Equal(a.Bytes(), b.Bytes())
+
+	var names []string
+	tr := tar.NewReader(&a)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, hdr.Name)
+	}
+	s.Equal([]string{
+		ManifestFileName, "bin/", "bin/cat", "bin/ls", "dotfiles/", "dotfiles/bashrc", "dotfiles/vimrc",
+	}, names)
+
+	// sources outside of the manifest's directory aren't portable
+	m := &Manifest{Groups: []ManifestGroup{{Name: "x", Sources: []string{"../.bashrc"}, Dest: "~"}}}
+	r.NoError(m.Write(manifest))
+	s.Error(WriteBundle(manifest, nil, &a))
+}
+
+func (s *InstallerSuite) TestBundleGroups() {
+	r := s.Require()
+	manifest := s.writeBundleManifest()
+	path := s.fsFix.TempDir.Join("bin.tar").String()
+
+	f, err := os.Create(path)
+	r.NoError(err)
+	r.NoError(WriteBundle(manifest, []string{"bin"}, f))
+	r.NoError(f.Close())
+
+	m, err := ReadBundleManifest(path)
+	r.NoError(err)
+	s.Equal([]string{"bin"}, m.GroupNames())
+
+	var buf bytes.Buffer
+	s.Error(WriteBundle(manifest, []string{"nope"}, &buf), "unknown groups are an error")
+
+	bs := &BundleSettings{
+		Settings: Settings{OnConflict: Rename, StateDir: s.fsFix.TempDir.Join("state").String()},
+		Bundle:   path,
+		DataDir:  s.fsFix.TempDir.Join("data").String(),
+		Groups:   []string{"dotfiles"},
+	}
+	_, err = InstallBundle(bs)
+	s.Error(err, "the group wasn't packed")
+
+	bs.Groups = []string{"bin"}
+	_, err = InstallBundle(bs)
+	r.NoError(err)
+	s.True(s.fsFix.LocalBinDir.Join("cat").IsSymlink())
+	s.False(s.fsFix.HomeDir.Join(".bashrc").IsSymlink())
+}
+
+func (s *InstallerSuite) TestInstallBundle() {
+	r := s.Require()
+	manifest := s.writeBundleManifest()
+	tmp := s.fsFix.TempDir
+	home := s.fsFix.HomeDir
+
+	bundle := func(name string) string {
+		path := tmp.Join(name).String()
+		f, err := os.Create(path)
+		r.NoError(err)
+		r.NoError(WriteBundle(manifest, nil, f))
+		r.NoError(f.Close())
+		return path
+	}
+
+	bs := &BundleSettings{
+		Settings: Settings{OnConflict: Rename, StateDir: tmp.Join("state").String()},
+		Bundle:   bundle("first.tar"),
+		DataDir:  tmp.Join("data").String(),
+	}
+	first, err := InstallBundle(bs)
+	r.NoError(err)
+	s.Equal(tmp.Join("data", "bundles").String(), fp.Dir(first))
+	s.Len(fp.Base(first), bundleHashLen)
+
+	linksTo := func(link, dir string) {
+		target, err := fp.EvalSymlinks(home.Join(link).String())
+		r.NoError(err)
+		s.Equal(dir, target[:len(dir)], link)
+	}
+	linksTo(".bashrc", first)
+	linksTo(".local/bin/cat", first)
+
+	// installing it again changes nothing
+	again, err := InstallBundle(bs)
+	r.NoError(err)
+	s.Equal(first, again)
+
+	r.NoError(ioutil.WriteFile(s.fsFix.DotfileDir.Join("bashrc").String(), []byte("changed"), 0o644))
+	bs.Bundle = bundle("second.tar")
+	second, err := InstallBundle(bs)
+	r.NoError(err)
+	s.NotEqual(first, second)
+	linksTo(".bashrc", second)
+	linksTo(".local/bin/cat", second)
+
+	backups, err := fp.Glob(home.Join(".*.dfi_*").String())
+	r.NoError(err)
+	s.Empty(backups, "links into the old bundle are switched, not backed up")
+	s.True(tmp.Join("data", "bundles", fp.Base(first)).IsDir(), "old bundles are kept")
+
+	// roll back by hash
+	bs.Bundle = fp.Base(first)[:8]
+	rolledBack, err := InstallBundle(bs)
+	r.NoError(err)
+	s.Equal(first, rolledBack)
+	linksTo(".bashrc", first)
+}
+
+func (s *InstallerSuite) TestInstallBundleIsOneRun() {
+	r := s.Require()
+	manifest := s.writeBundleManifest()
+	tmp := s.fsFix.TempDir
+	home := s.fsFix.HomeDir
+
+	bundle := func(name string) string {
+		path := tmp.Join(name).String()
+		f, err := os.Create(path)
+		r.NoError(err)
+		r.NoError(WriteBundle(manifest, nil, f))
+		r.NoError(f.Close())
+		return path
+	}
+
+	bs := &BundleSettings{
+		Settings: Settings{OnConflict: Fail, StateDir: tmp.Join("state").String()},
+		Bundle:   bundle("first.tar"),
+		DataDir:  tmp.Join("data").String(),
+	}
+	first, err := InstallBundle(bs)
+	r.NoError(err)
+
+	// the second bundle has a source in the bin group whose link path is
+	// taken, which fails the run
+	r.NoError(ioutil.WriteFile(s.fsFix.BinDir.Join("extra").String(), nil, 0o755))
+	r.NoError(ioutil.WriteFile(s.fsFix.LocalBinDir.Join("extra").String(), nil, 0o644))
+	m, err := ReadManifest(manifest)
+	r.NoError(err)
+	m.Groups[1].Sources = append(m.Groups[1].Sources, "bin/extra")
+	r.NoError(m.Write(manifest))
+	r.NoError(ioutil.WriteFile(s.fsFix.DotfileDir.Join("bashrc").String(), []byte("changed"), 0o644))
+
+	bs.Bundle = bundle("second.tar")
+	_, err = InstallBundle(bs)
+	var conflict *ConflictError
+	r.True(errors.As(err, &conflict), "%+v", err)
+
+	for _, link := range []string{".bashrc", ".local/bin/cat"} {
+		target, err := fp.EvalSymlinks(home.Join(link).String())
+		r.NoError(err)
+		s.True(isUnder(target, first), "%s was switched back to the first bundle", link)
+	}
+}
+
+func (s *InstallerSuite) TestUnpackBundleStaysInside() {
+	r := s.Require()
+	for _, hdrs := range [][]tar.Header{
+		{{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0o644}},
+		{{Name: "/abs", Typeflag: tar.TypeReg, Mode: 0o644}},
+		{{Name: "dir", Typeflag: tar.TypeSymlink, Linkname: "/tmp"}, {Name: "dir/x", Typeflag: tar.TypeReg, Mode: 0o644}},
+	} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for i := range hdrs {
+			r.NoError(tw.WriteHeader(&hdrs[i]))
+		}
+		r.NoError(tw.Close())
+
+		path := s.fsFix.TempDir.Join("evil.tar").String()
+		r.NoError(ioutil.WriteFile(path, buf.Bytes(), 0o644))
+		dir := s.fsFix.TempDir.Join("unpacked").String()
+		s.Error(unpackBundle(path, dir), hdrs[0].Name)
+		s.False(s.fsFix.TempDir.Join("unpacked").Lexists())
+	}
+}
@@ -5,16 +5,19 @@ import (
 	"os"
 	fp "path/filepath"
 	str "strings"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+
+	ppath "github.com/slyphon/dfi/pkg/pathlib"
 )
 
 type (
 	OnConflict int
 	ConflictHandler interface {
-		Handle(linkPath string) (skip bool, err error)
+		Handle(fsys ppath.Fs, linkPath string) (skip bool, err error)
 	}
 )
 
@@ -46,8 +49,8 @@ func isSymlink(fm os.FileMode) bool {
 	return fm&os.ModeSymlink != 0
 }
 
-func nameForMode(fi os.FileInfo) string {
-	switch m := fi.Mode(); {
+func modeName(m os.FileMode) string {
+	switch {
 	case m.IsDir():
 		return "directory"
 	case m.IsRegular():
@@ -69,10 +72,10 @@ func nameForMode(fi os.FileInfo) string {
 	}
 }
 
-func canRename(path string) (err error) {
+func canRename(fsys ppath.Fs, path string) (err error) {
 	var info os.FileInfo
 
-	if info, err = os.Lstat(path); err != nil {
+	if info, err = ppath.NewPosixPathFs(fsys, path).Lstat(); err != nil {
 		if os.IsNotExist(err) {
 			// ok, well, now, it doesn't exist so I guess
 			// we just continue?
@@ -85,51 +88,219 @@ func canRename(path string) (err error) {
 	mode := info.Mode()
 
 	if !(isSymlink(mode) || mode.IsRegular() || mode.IsDir()) {
-		return errors.Errorf("dest path %#v is a %s, cannot back up", path, nameForMode(info))
+		return errors.WithStack(&UnsupportedFileTypeError{Path: path, Mode: mode, Action: "back up"})
 	}
 
 	return nil
 }
 
-func doRename(path string) (err error) {
-	if err = canRename(path); err != nil {
-		return err
-	}
-
+// nextTo calls fn with unused names next to path until it succeeds,
+// and returns the name it succeeded with. the names have kind in them,
+// eg. "dfi" for backups
+func nextTo(fsys ppath.Fs, path, kind string, fn func(name string) error) (string, error) {
 	for i := 0; i < 100; i++ {
-		bak := fp.Join(fp.Dir(path), fmt.Sprintf("%s.dfi_%s_%d", fp.Base(path), timestamp(), i))
-		if err = os.Rename(path, bak); err != nil && !os.IsExist(err) {
-			return errors.Wrapf(err, "falied to rename dest path %#v to %#v", path, bak)
+		name := fp.Join(fp.Dir(path), fmt.Sprintf("%s.%s_%s_%d", fp.Base(path), kind, timestamp(), i))
+
+		// rename(2) will happily replace an existing file, so check first
+		if ppath.NewPosixPathFs(fsys, name).Lexists() {
+			continue
+		}
+
+		if err := fn(name); err != nil && !os.IsExist(errors.Cause(err)) {
+			return "", err
 		} else if err == nil {
-			return nil
+			return name, nil
+		}
+	}
+
+	return "", errors.Errorf("failed to find a free name next to path %#v", path)
+}
+
+// moveAside renames path to a unique backup name next to it, and returns that name
+func moveAside(fsys ppath.Fs, path string) (bak string, err error) {
+	return nextTo(fsys, path, "dfi", func(bak string) error {
+		return errors.Wrapf(fsys.Rename(path, bak), "falied to rename dest path %#v to %#v", path, bak)
+	})
+}
+
+// copyAside backs up the file or symlink at path under a unique name next
+// to it, while leaving it where it is, and returns the backup's name. a
+// file is hard linked, or copied if it can't be, a symlink is copied.
+func copyAside(fsys ppath.Fs, path string) (bak string, err error) {
+	pp := ppath.NewPosixPathFs(fsys, path)
+
+	var info os.FileInfo
+	if info, err = pp.Lstat(); err != nil {
+		return "", errors.Wrapf(err, "failed to stat path %#v", path)
+	}
+
+	link := func(bak string) error {
+		err := fsys.Link(path, bak)
+		if err == nil || os.IsExist(err) {
+			return err
+		}
+		// eg. EXDEV on an overlay, or EPERM where hard links are
+		// restricted, a copy with the same mode will do
+		if _, err = pp.Copy(bak); err != nil {
+			_ = fsys.Remove(bak)
+		}
+		return err
+	}
+	if isSymlink(info.Mode()) {
+		target, err := fsys.Readlink(path)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to read link %#v", path)
 		}
+		link = func(bak string) error { return fsys.Symlink(target, bak) }
+	}
+
+	return nextTo(fsys, path, "dfi", func(bak string) error {
+		return errors.Wrapf(link(bak), "failed to back up dest path %#v to %#v", path, bak)
+	})
+}
+
+func doRename(fsys ppath.Fs, path string, j *journal) (err error) {
+	if err = canRename(fsys, path); err != nil {
+		return err
 	}
 
-	return errors.Errorf("failed to back up path %#v", path)
+	var bak string
+	if bak, err = moveAside(fsys, path); err != nil {
+		return err
+	}
+	j.movedAside(path, bak, true)
+	return nil
+}
+
+// canReplace returns an error if path is a directory with something in it
+func canReplace(fsys ppath.Fs, path string) error {
+	info, err := ppath.NewPosixPathFs(fsys, path).Lstat()
+	if err != nil || !info.IsDir() {
+		return nil
+	}
+
+	f, err := fsys.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to remove %#v", path)
+	}
+	defer f.Close()
+
+	if names, _ := f.Readdirnames(1); len(names) > 0 {
+		return errors.Wrapf(
+			&os.PathError{Op: "remove", Path: path, Err: syscall.ENOTEMPTY}, "failed to remove %#v", path)
+	}
+	return nil
 }
 
 // tis is actually 'unlink' as we remove the path that's in our way
-// we will not remove a directory.
-func doReplace(path string) error {
-	return errors.Wrapf(os.Remove(path), "failed to remove %#v", path)
+// we will not remove a directory. if we have a journal, the path is moved
+// aside and only removed once the run succeeds, so it can be put back.
+func doReplace(fsys ppath.Fs, path string, j *journal) error {
+	if j == nil {
+		return errors.Wrapf(fsys.Remove(path), "failed to remove %#v", path)
+	}
+
+	if err := canReplace(fsys, path); err != nil {
+		return err
+	}
+
+	bak, err := moveAside(fsys, path)
+	if err != nil {
+		return err
+	}
+	j.movedAside(path, bak, false)
+	return nil
 }
 
-func (oc OnConflict) Handle(linkPath string) (skip bool, err error) {
+// linkOver makes linkPath, a file or a symlink, into a symlink to target
+// without it ever going missing: the new link is created under a temporary
+// name and renamed over linkPath. what was there is backed up first for
+// Rename, or so it can be put back if we have a journal, and Replace removes
+// it once the run succeeds.
+func (oc OnConflict) linkOver(fsys ppath.Fs, linkPath, target string, j *journal) (err error) {
+	keep := oc == Rename
+
+	var bak string
+	if keep || j != nil {
+		if bak, err = copyAside(fsys, linkPath); err != nil {
+			return err
+		}
+	}
+
+	// if the link can't be put in place, nothing has changed, so the
+	// backup isn't needed
+	cleanup := func(paths ...string) {
+		for _, p := range paths {
+			if p == "" {
+				continue
+			}
+			if e := fsys.Remove(p); e != nil {
+				log.WithFields(log.Fields{"path": p, "err": e.Error()}).Warn("failed to clean up")
+			}
+		}
+	}
+
+	tmp, err := nextTo(fsys, linkPath, "dfi_tmp", func(tmp string) error {
+		return fsys.Symlink(target, tmp)
+	})
+	if err != nil {
+		cleanup(bak)
+		return errors.Wrapf(err, "failed to create link %#v", linkPath)
+	}
+
+	if err = fsys.Rename(tmp, linkPath); err != nil {
+		cleanup(tmp, bak)
+		return errors.Wrapf(err, "failed to create link %#v", linkPath)
+	}
+
+	if bak != "" {
+		j.replaced(linkPath, bak, keep)
+	}
+	return nil
+}
+
+// atomic returns true if a conflict at a path with the given mode can be
+// dealt with by linkOver
+func (oc OnConflict) atomic(mode os.FileMode) bool {
+	return oc.mutates() && (isSymlink(mode) || mode.IsRegular())
+}
+
+func (oc OnConflict) Handle(fsys ppath.Fs, linkPath string) (skip bool, err error) {
+	return oc.handle(fsys, linkPath, nil)
+}
+
+// handle is Handle, recording any changes in j so they can be rolled back
+func (oc OnConflict) handle(fsys ppath.Fs, linkPath string, j *journal) (skip bool, err error) {
 	switch oc {
 	case Rename:
-		return false, doRename(linkPath)
+		return false, doRename(fsys, linkPath, j)
 	case Replace:
-		return false, doReplace(linkPath)
+		return false, doReplace(fsys, linkPath, j)
 	case Warn:
 		log.Warnf("Destination %+v exists, skipping", linkPath)
 		return true, nil
 	case Fail:
-		return false, errors.Errorf("Destination %#v exists, exiting", linkPath)
+		return false, errors.WithStack(&ConflictError{LinkPath: linkPath})
 	default:
 		panic(fmt.Sprintf("should never reach here: oc value: %#v", oc))
 	}
 }
 
+// mutates returns true if handling a conflict with this strategy
+// will change the filesystem
+func (oc OnConflict) mutates() bool {
+	return oc == Rename || oc == Replace
+}
+
+// OnConflictNames returns the names OnConflictForString accepts
+func OnConflictNames() []string {
+	names := make([]string, 0, Fail+1)
+	for oc := Rename; oc <= Fail; oc++ {
+		names = append(names, str.ToLower(oc.String()))
+	}
+	return names
+}
+
 func OnConflictForString(s string) (OnConflict, error) {
 	switch str.ToLower(s) {
 	case "rename":
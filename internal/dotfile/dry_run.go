@@ -7,6 +7,6 @@ func dryRunApply(ld LinkData) error {
 func NewDryRunInstaller(prefix string, onConflict OnConflict) *Installer {
 	var apply = dryRunApply
 
-	return &Installer{prefix, onConflict, apply}
+	return &Installer{prefix: prefix, onConflict: onConflict, apply: apply}
 }
 
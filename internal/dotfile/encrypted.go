@@ -0,0 +1,655 @@
+package dotfile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	fp "path/filepath"
+	"sort"
+	str "strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+
+	ppath "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+type (
+	// Identity is the age identity encrypted sources are decrypted with,
+	// it's kept in a local file, see GenerateIdentity
+	Identity struct {
+		Path       string
+		identities []age.Identity
+		// recipients are who Encrypt encrypts to, the identity itself and
+		// any that were added with AddRecipients
+		recipients []age.Recipient
+		// how many of recipients were added
+		added int
+	}
+
+	// Keys are where the identity, and the other recipients sources are
+	// encrypted to, come from
+	Keys struct {
+		// Identity is the path of the identity file, IdentityPath if empty
+		Identity string
+
+		// Recipients are age public keys (age1...), and RecipientsFiles
+		// are files of them, one per line
+		Recipients      []string
+		RecipientsFiles []string
+	}
+
+	// SecretState is whether the decrypted copy of an encrypted source is
+	// still the same as when it was decrypted, and the source too
+	SecretState string
+
+	// copyInfo is kept next to a decrypted copy, to tell whether it or its
+	// source changed since it was decrypted, and how many recipients other
+	// than the identity the source was encrypted to, so reencrypting it
+	// doesn't leave them out. age files don't say who they're for, only
+	// how many.
+	copyInfo struct {
+		Source          string `json:"source"`
+		SourceSHA256    string `json:"source_sha256"`
+		SHA256          string `json:"sha256"`
+		OtherRecipients int    `json:"other_recipients,omitempty"`
+	}
+
+	// recipientCounter is an age.Identity that unwraps with ids, counting
+	// the recipients of the file that aren't one of them on the way
+	recipientCounter struct {
+		ids    []age.Identity
+		others int
+	}
+
+	// Reencrypted is a decrypted copy that was edited, and whose edits were
+	// (or, in a dry run, would be) encrypted back into its source
+	Reencrypted struct {
+		Source string      `json:"source"`
+		Copy   string      `json:"copy"`
+		State  SecretState `json:"state"`
+	}
+)
+
+const (
+	// EncryptedSuffix marks a source encrypted with age, eg. by EncryptFile.
+	// It's decrypted into DecryptedDir when it's installed, and its link,
+	// which doesn't have the suffix, points at the decrypted copy.
+	EncryptedSuffix = ".age"
+
+	// SecretCurrent is a decrypted copy that's the same as its source
+	SecretCurrent SecretState = "current"
+	// SecretStale is a decrypted copy whose source has changed since, it's
+	// brought up to date by installing the source again
+	SecretStale SecretState = "stale"
+	// SecretEdited is a decrypted copy that has been edited, 'dfi
+	// reencrypt' writes the edits back to its source
+	SecretEdited SecretState = "edited"
+	// SecretDiverged is a decrypted copy that has been edited, whose
+	// source has changed as well, which has to be sorted out by hand
+	SecretDiverged SecretState = "diverged"
+
+	identityFileName = "identity"
+	decryptedDirName = "decrypted"
+	copyInfoName     = ".dfi-source.json"
+
+	// how many hex digits of the sha256 of a source's path name the
+	// directory its decrypted copy is in
+	decryptedIDLen = 16
+)
+
+// IdentityPath returns the default location of the identity,
+// $XDG_DATA_HOME/dfi/identity
+func IdentityPath() (string, error) {
+	dir, err := DataDir()
+	if err != nil {
+		return "", err
+	}
+	return fp.Join(dir, identityFileName), nil
+}
+
+// DecryptedDir returns the directory encrypted sources are decrypted into,
+// $XDG_DATA_HOME/dfi/decrypted
+func DecryptedDir() (string, error) {
+	dir, err := DataDir()
+	if err != nil {
+		return "", err
+	}
+	return fp.Join(dir, decryptedDirName), nil
+}
+
+// GenerateIdentity writes a new age X25519 identity to path, which mustn't
+// exist yet, readable only by the user. It's in the same format as
+// age-keygen's, so the age tool can use it too.
+func GenerateIdentity(path string) error {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		return errors.Wrap(err, "failed to generate an identity")
+	}
+
+	if err = os.MkdirAll(fp.Dir(path), 0o700); err != nil {
+		return errors.Wrapf(err, "failed to create the directory of %#v", path)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create identity %#v", path)
+	}
+
+	fmt.Fprintf(f, "# created: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(f, "# public key: %s\n", id.Recipient())
+	fmt.Fprintf(f, "%s\n", id)
+	return errors.Wrapf(f.Close(), "failed to write identity %#v", path)
+}
+
+// ReadIdentity reads the age identities in the file at path, ignoring
+// lines that start with '#'. What's encrypted with it is encrypted to
+// them.
+func ReadIdentity(path string) (*Identity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read identity %#v, see 'dfi keygen'", path)
+	}
+	defer f.Close()
+
+	ids, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse identity %#v", path)
+	}
+
+	id := &Identity{Path: path, identities: ids}
+	for _, i := range ids {
+		if x, ok := i.(*age.X25519Identity); ok {
+			id.recipients = append(id.recipients, x.Recipient())
+		}
+	}
+	return id, nil
+}
+
+// PublicKey returns the public key of the receiver's first identity, which
+// others encrypt to, or "" if it isn't an X25519 one
+func (id *Identity) PublicKey() string {
+	if x, ok := id.identities[0].(*age.X25519Identity); ok {
+		return x.Recipient().String()
+	}
+	return ""
+}
+
+// AddRecipients adds the age public keys in keys, and in the files at
+// paths, to who the receiver encrypts to
+func (id *Identity) AddRecipients(keys, paths []string) error {
+	for _, key := range keys {
+		r, err := age.ParseX25519Recipient(key)
+		if err != nil {
+			return errors.Wrapf(err, "invalid recipient %#v", key)
+		}
+		id.recipients = append(id.recipients, r)
+		id.added++
+	}
+
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read recipients file %#v", path)
+		}
+		rs, err := age.ParseRecipients(bytes.NewReader(b))
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse recipients file %#v", path)
+		}
+		id.recipients = append(id.recipients, rs...)
+		id.added += len(rs)
+	}
+	return nil
+}
+
+// Load reads the identity, and adds the recipients to it
+func (k Keys) Load() (*Identity, error) {
+	path := k.Identity
+	if path == "" {
+		var err error
+		if path, err = IdentityPath(); err != nil {
+			return nil, err
+		}
+	}
+
+	id, err := ReadIdentity(path)
+	if err != nil {
+		return nil, err
+	}
+	return id, id.AddRecipients(k.Recipients, k.RecipientsFiles)
+}
+
+// Encrypt returns plain encrypted with age to the receiver's recipients
+func (id *Identity) Encrypt(plain []byte) ([]byte, error) {
+	if len(id.recipients) == 0 {
+		return nil, errors.Errorf("identity %#v has no recipients to encrypt to", id.Path)
+	}
+
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, id.recipients...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encrypt")
+	}
+	if _, err = w.Write(plain); err != nil {
+		return nil, errors.Wrap(err, "failed to encrypt")
+	}
+	if err = w.Close(); err != nil {
+		return nil, errors.Wrap(err, "failed to encrypt")
+	}
+	return buf.Bytes(), nil
+}
+
+// Decrypt returns the contents of data, an age file in binary or armored
+// form, which was encrypted to the receiver
+func (id *Identity) Decrypt(data []byte) ([]byte, error) {
+	plain, _, err := id.decrypt(data)
+	return plain, err
+}
+
+// decrypt is Decrypt, that also returns how many recipients other than the
+// receiver data was encrypted to
+func (id *Identity) decrypt(data []byte) (plain []byte, others int, err error) {
+	var src io.Reader = bytes.NewReader(data)
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(armor.Header)) {
+		src = armor.NewReader(src)
+	}
+
+	counter := &recipientCounter{ids: id.identities}
+	r, err := age.Decrypt(src, counter)
+	var noMatch *age.NoIdentityMatchError
+	switch {
+	case errors.As(err, &noMatch):
+		return nil, 0, errors.Errorf("failed to decrypt with identity %#v, it's not one of the recipients this was encrypted to", id.Path)
+	case err != nil:
+		return nil, 0, errors.Wrap(err, "failed to decrypt, it's not an age file or it's corrupt")
+	}
+
+	plain, err = ioutil.ReadAll(r)
+	return plain, counter.others, errors.Wrap(err, "failed to decrypt, the file is corrupt")
+}
+
+// Unwrap counts the stanzas, one per recipient, that none of the
+// receiver's identities can unwrap, then unwraps the file key with them
+func (c *recipientCounter) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	c.others = 0
+	for _, s := range stanzas {
+		ours := false
+		for _, id := range c.ids {
+			if _, err := id.Unwrap([]*age.Stanza{s}); err == nil {
+				ours = true
+				break
+			}
+		}
+		if !ours {
+			c.others++
+		}
+	}
+
+	for _, id := range c.ids {
+		fileKey, err := id.Unwrap(stanzas)
+		if errors.Is(err, age.ErrIncorrectIdentity) {
+			continue
+		}
+		return fileKey, err
+	}
+	return nil, age.ErrIncorrectIdentity
+}
+
+// EncryptFile writes path, encrypted, to path + EncryptedSuffix, which
+// mustn't exist yet, and returns the path it wrote. The plain file is left
+// as it is, it shouldn't be committed.
+func EncryptFile(id *Identity, path string) (string, error) {
+	plain, err := afero.ReadFile(ppath.NewOsFs(), path)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read %#v", path)
+	}
+	data, err := id.Encrypt(plain)
+	if err != nil {
+		return "", err
+	}
+
+	out := path + EncryptedSuffix
+	f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create %#v", out)
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return "", errors.Wrapf(err, "failed to write %#v", out)
+	}
+	return out, errors.Wrapf(f.Close(), "failed to write %#v", out)
+}
+
+// isEncrypted returns true if vpath is an encrypted source
+func isEncrypted(vpath string) bool {
+	return str.HasSuffix(vpath, EncryptedSuffix) && fp.Base(vpath) != EncryptedSuffix
+}
+
+// linkName returns the name the link for a source with name will have
+func linkName(name string) string {
+	if isEncrypted(name) {
+		return str.TrimSuffix(name, EncryptedSuffix)
+	}
+	return name
+}
+
+// copyPathFor returns where the decrypted copy of source goes in
+// decryptedDir. each source gets its own directory, so copies of sources
+// with the same name don't collide.
+func copyPathFor(decryptedDir, source string) string {
+	sum := sha256.Sum256([]byte(source))
+	id := hex.EncodeToString(sum[:])[:decryptedIDLen]
+	return fp.Join(decryptedDir, id, linkName(fp.Base(source)))
+}
+
+// writeAtomic replaces the file at path with data, so a reader never sees
+// half of it
+func writeAtomic(fsys ppath.Fs, path string, data []byte, perm os.FileMode) error {
+	tmp := fmt.Sprintf("%s.tmp_%d", path, os.Getpid())
+	if err := afero.WriteFile(fsys, tmp, data, perm); err != nil {
+		return errors.Wrapf(err, "failed to write %#v", tmp)
+	}
+	if err := fsys.Rename(tmp, path); err != nil {
+		_ = fsys.Remove(tmp)
+		return errors.Wrapf(err, "failed to replace %#v", path)
+	}
+	return nil
+}
+
+func readCopyInfo(fsys ppath.Fs, copyPath string) (*copyInfo, error) {
+	path := fp.Join(fp.Dir(copyPath), copyInfoName)
+	b, err := afero.ReadFile(fsys, path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %#v", path)
+	}
+	info := &copyInfo{}
+	return info, errors.Wrapf(json.Unmarshal(b, info), "failed to parse %#v", path)
+}
+
+func writeCopyInfo(fsys ppath.Fs, copyPath string, info *copyInfo) error {
+	b, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return writeAtomic(fsys, fp.Join(fp.Dir(copyPath), copyInfoName), append(b, '\n'), 0o600)
+}
+
+// secretState compares the decrypted copy at copyPath, and its source,
+// with how they were when it was decrypted. state is empty if there's no
+// copy.
+func secretState(fsys ppath.Fs, copyPath string) (state SecretState, info *copyInfo, err error) {
+	if _, err = fsys.Stat(copyPath); os.IsNotExist(err) {
+		return "", nil, nil
+	}
+	if info, err = readCopyInfo(fsys, copyPath); err != nil {
+		return "", nil, err
+	}
+
+	sum, err := hashSource(fsys, copyPath)
+	if err != nil {
+		return "", nil, err
+	}
+	edited := sum != info.SHA256
+
+	// a source that's gone counts as changed
+	srcSum, err := hashSource(fsys, info.Source)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return "", nil, err
+	}
+	stale := srcSum != info.SourceSHA256
+
+	switch {
+	case edited && stale:
+		return SecretDiverged, info, nil
+	case edited:
+		return SecretEdited, info, nil
+	case stale:
+		return SecretStale, info, nil
+	}
+	return SecretCurrent, info, nil
+}
+
+// decrypt decrypts source into its copy in decryptedDir, unless the copy
+// is already current, and returns the copy's path. a copy that was edited
+// isn't overwritten.
+func decrypt(fsys ppath.Fs, id *Identity, decryptedDir, source string) (string, error) {
+	copyPath := copyPathFor(decryptedDir, source)
+	ctx := log.WithFields(log.Fields{"source": source, "copy": copyPath})
+
+	state, _, err := secretState(fsys, copyPath)
+	switch {
+	case err != nil:
+		return "", err
+	case state == SecretCurrent:
+		return copyPath, nil
+	case state == SecretEdited || state == SecretDiverged:
+		return "", errors.Errorf(
+			"the decrypted copy %#v of %#v has been edited, run 'dfi reencrypt' or remove it", copyPath, source)
+	}
+
+	data, err := afero.ReadFile(fsys, source)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read %#v", source)
+	}
+	plain, others, err := id.decrypt(data)
+	if err != nil {
+		return "", errors.WithMessagef(err, "%#v", source)
+	}
+
+	// the directories are made private even if they were already there,
+	// as the copy is only as safe as they are
+	for _, dir := range []string{decryptedDir, fp.Dir(copyPath)} {
+		if err = fsys.MkdirAll(dir, 0o700); err != nil {
+			return "", errors.Wrapf(err, "failed to create %#v", dir)
+		}
+		if err = fsys.Chmod(dir, 0o700); err != nil {
+			return "", errors.Wrapf(err, "failed to chmod %#v", dir)
+		}
+	}
+	if err = writeAtomic(fsys, copyPath, plain, 0o600); err != nil {
+		return "", err
+	}
+
+	info := &copyInfo{Source: source, SourceSHA256: sha256Hex(data), SHA256: sha256Hex(plain), OtherRecipients: others}
+	if err = writeCopyInfo(fsys, copyPath, info); err != nil {
+		return "", err
+	}
+	ctx.Info("decrypted source")
+	return copyPath, nil
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// copyLink returns the link for the encrypted source ld, pointing at
+// where its decrypted copy goes in decryptedDir. a link that points at a
+// copy already, eg. from a plan, is returned as it is.
+func copyLink(ld LinkData, decryptedDir string) LinkData {
+	if ld.Source != "" {
+		return ld
+	}
+	copyPath := copyPathFor(decryptedDir, ld.Vpath)
+	return LinkData{
+		Vpath:    copyPath,
+		LinkPath: str.TrimSuffix(ld.LinkPath, EncryptedSuffix),
+		LinkData: copyPath,
+		Source:   ld.Vpath,
+		Commit:   ld.Commit,
+	}
+}
+
+// copyLinks returns linkData with the links for encrypted sources pointing
+// at where their decrypted copies go, without decrypting anything
+func copyLinks(linkData []LinkData) ([]LinkData, error) {
+	var decryptedDir string
+	out := make([]LinkData, len(linkData))
+
+	for i, ld := range linkData {
+		if !isEncrypted(ld.Vpath) || ld.Source != "" {
+			out[i] = ld
+			continue
+		}
+		if decryptedDir == "" {
+			var err error
+			if decryptedDir, err = DecryptedDir(); err != nil {
+				return nil, err
+			}
+		}
+		out[i] = copyLink(ld, decryptedDir)
+	}
+	return out, nil
+}
+
+// decryptSources decrypts the encrypted sources in linkData, and returns
+// it with their links pointing at the decrypted copies instead. links
+// that point at a copy already, from a plan, have theirs decrypted too.
+// the identity is only read if there are any.
+func (n *Installer) decryptSources(linkData []LinkData) ([]LinkData, error) {
+	var id *Identity
+	var decryptedDir string
+	out := make([]LinkData, len(linkData))
+
+	for i, ld := range linkData {
+		if !isEncrypted(ld.Vpath) && ld.Source == "" {
+			out[i] = ld
+			continue
+		}
+
+		if id == nil {
+			var err error
+			if id, decryptedDir, err = n.loadIdentity(); err != nil {
+				return nil, err
+			}
+		}
+
+		cl := copyLink(ld, decryptedDir)
+		copyPath, err := decrypt(n.fsys(), id, decryptedDir, cl.Source)
+		if err != nil {
+			return nil, err
+		}
+		if copyPath != cl.Vpath {
+			return nil, errors.Errorf(
+				"the decrypted copy of %#v is %#v, not %#v as planned", cl.Source, copyPath, cl.Vpath)
+		}
+		out[i] = cl
+	}
+	return out, nil
+}
+
+// loadIdentity reads the receiver's identity, and finds the decrypted dir
+func (n *Installer) loadIdentity() (*Identity, string, error) {
+	id, err := Keys{Identity: n.identity}.Load()
+	if err != nil {
+		return nil, "", err
+	}
+	dir, err := DecryptedDir()
+	return id, dir, err
+}
+
+// Reencrypt finds the decrypted copies on fsys of the sources of the links
+// in the state in stateDir that have been edited, and unless dryRun,
+// encrypts each back into its source, to the identity and recipients in
+// keys. Copies whose sources have changed too are returned, but left alone,
+// with an error saying so. A source that was encrypted to more recipients
+// than keys has besides the identity isn't reencrypted, as some of them
+// would be left out, it's an error.
+func Reencrypt(fsys ppath.Fs, stateDir string, keys Keys, dryRun bool) ([]Reencrypted, error) {
+	st, err := ReadState(fsys, stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	var found []Reencrypted
+	for _, rec := range st.Links {
+		if rec.Source == "" || seen[rec.Vpath] {
+			continue
+		}
+		seen[rec.Vpath] = true
+
+		state, _, err := secretState(fsys, rec.Vpath)
+		if err != nil {
+			return nil, err
+		}
+		if state == SecretEdited || state == SecretDiverged {
+			found = append(found, Reencrypted{Source: rec.Source, Copy: rec.Vpath, State: state})
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Source < found[j].Source })
+
+	var id *Identity
+	if len(found) > 0 && !dryRun {
+		if id, err = keys.Load(); err != nil {
+			return found, err
+		}
+	}
+
+	diverged := 0
+	for _, re := range found {
+		switch {
+		case re.State == SecretDiverged:
+			diverged++
+			log.WithFields(log.Fields{"source": re.Source, "copy": re.Copy}).Warn(
+				"both the decrypted copy and its source have changed, not reencrypting")
+		case !dryRun:
+			if err = reencryptOne(fsys, id, re); err != nil {
+				return found, err
+			}
+		}
+	}
+
+	if diverged > 0 {
+		return found, errors.Errorf(
+			"%d decrypted copies have been edited, and their sources have changed too, merge them by hand", diverged)
+	}
+	return found, nil
+}
+
+// reencryptOne encrypts the copy of re into its source, keeping the
+// source's mode, and records that they're the same again
+func reencryptOne(fsys ppath.Fs, id *Identity, re Reencrypted) error {
+	old, err := readCopyInfo(fsys, re.Copy)
+	if err != nil {
+		return err
+	}
+	if old.OtherRecipients > id.added {
+		return errors.Errorf(
+			"%#v was encrypted to %d recipient(s) besides identity %#v, but only %d were given, "+
+				"add them with --recipient, --recipients-file or in the config file so they aren't left out",
+			re.Source, old.OtherRecipients, id.Path, id.added)
+	}
+
+	plain, err := afero.ReadFile(fsys, re.Copy)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %#v", re.Copy)
+	}
+	data, err := id.Encrypt(plain)
+	if err != nil {
+		return err
+	}
+
+	perm := os.FileMode(0o644)
+	if info, err := fsys.Stat(re.Source); err == nil {
+		perm = info.Mode().Perm()
+	}
+	if err = writeAtomic(fsys, re.Source, data, perm); err != nil {
+		return err
+	}
+
+	info := &copyInfo{Source: re.Source, SourceSHA256: sha256Hex(data), SHA256: sha256Hex(plain), OtherRecipients: id.added}
+	if err = writeCopyInfo(fsys, re.Copy, info); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"source": re.Source, "copy": re.Copy}).Info("reencrypted source")
+	return nil
+}
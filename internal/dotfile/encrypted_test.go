@@ -0,0 +1,261 @@
+package dotfile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+
+	"filippo.io/age/armor"
+
+	pl "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+func (s *InstallerSuite) TestEncryptedSources() {
+	r := s.Require()
+	tmp := s.fsFix.TempDir
+	r.NoError(os.Setenv("XDG_DATA_HOME", tmp.Join("data").String()))
+	defer os.Unsetenv("XDG_DATA_HOME")
+
+	identity := tmp.Join("identity").String()
+	r.NoError(GenerateIdentity(identity))
+	s.Error(GenerateIdentity(identity), "doesn't overwrite an identity")
+	id, err := ReadIdentity(identity)
+	r.NoError(err)
+
+	plain := s.fsFix.DotfileDir.Join("netrc").String()
+	source := plain + EncryptedSuffix
+	encrypt := func(contents string) {
+		r.NoError(ioutil.WriteFile(plain, []byte(contents), 0o600))
+		os.Remove(source)
+		_, err := EncryptFile(id, plain)
+		r.NoError(err)
+		r.NoError(os.Remove(plain))
+	}
+	encrypt("machine a")
+
+	stateDir := tmp.Join("state").String()
+	run := func() error {
+		return Run(&Settings{
+			Prefix:      ".",
+			OnConflict:  Rename,
+			SourcePaths: []string{source},
+			DestPath:    s.fsFix.HomeDir.String(),
+			StateDir:    stateDir,
+			Identity:    identity,
+		})
+	}
+	link := s.fsFix.HomeDir.Join(".netrc").String()
+	secret := func() SecretState {
+		found, err := Status(pl.NewOsFs(), stateDir, s.fsFix.SettingsDir.String(), s.fsFix.HomeDir.String(), false)
+		r.NoError(err)
+		r.Len(found, 1)
+		s.Equal(StatusOK, found[0].Status)
+		return found[0].Secret
+	}
+	contents := func(path string) string {
+		b, err := ioutil.ReadFile(path)
+		r.NoError(err)
+		return string(b)
+	}
+
+	r.NoError(run())
+	decryptedDir := tmp.Join("data", "dfi", decryptedDirName).String()
+	copyPath, err := os.Readlink(link)
+	r.NoError(err)
+	s.Equal(copyPathFor(decryptedDir, source), copyPath)
+	s.Equal("machine a", contents(link))
+	for path, mode := range map[string]os.FileMode{copyPath: 0o600, decryptedDir: 0o700} {
+		info, err := os.Stat(path)
+		r.NoError(err)
+		s.Equal(mode, info.Mode().Perm(), path)
+	}
+	s.Equal(SecretCurrent, secret())
+
+	// a changed source makes the copy stale, until it's installed again
+	encrypt("machine b")
+	s.Equal(SecretStale, secret())
+	r.NoError(run())
+	s.Equal("machine b", contents(link))
+	s.Equal(SecretCurrent, secret())
+
+	// edits to the copy aren't overwritten, but can be encrypted back
+	r.NoError(ioutil.WriteFile(link, []byte("machine c"), 0o600))
+	s.Equal(SecretEdited, secret())
+	s.Error(run())
+
+	found, err := Reencrypt(pl.NewOsFs(), stateDir, Keys{Identity: identity}, true)
+	r.NoError(err)
+	s.Equal([]Reencrypted{{Source: source, Copy: copyPath, State: SecretEdited}}, found)
+	_, err = Reencrypt(pl.NewOsFs(), stateDir, Keys{Identity: identity}, false)
+	r.NoError(err)
+	s.Equal(SecretCurrent, secret())
+
+	data, err := ioutil.ReadFile(source)
+	r.NoError(err)
+	b, err := id.Decrypt(data)
+	r.NoError(err)
+	s.Equal("machine c", string(b))
+
+	// both changed has to be sorted out by hand
+	encrypt("machine d")
+	r.NoError(ioutil.WriteFile(link, []byte("machine e"), 0o600))
+	s.Equal(SecretDiverged, secret())
+	found, err = Reencrypt(pl.NewOsFs(), stateDir, Keys{Identity: identity}, false)
+	s.Error(err)
+	s.Equal(SecretDiverged, found[0].State)
+	s.Equal("machine e", contents(link))
+}
+
+func (s *InstallerSuite) TestReencryptKeepsRecipients() {
+	r := s.Require()
+	tmp := s.fsFix.TempDir
+	r.NoError(os.Setenv("XDG_DATA_HOME", tmp.Join("data").String()))
+	defer os.Unsetenv("XDG_DATA_HOME")
+
+	a, b := tmp.Join("a").String(), tmp.Join("b").String()
+	r.NoError(GenerateIdentity(a))
+	r.NoError(GenerateIdentity(b))
+	ida, err := ReadIdentity(a)
+	r.NoError(err)
+	idb, err := ReadIdentity(b)
+	r.NoError(err)
+
+	// a teammate's key is a recipient too
+	plain := s.fsFix.DotfileDir.Join("netrc").String()
+	r.NoError(ioutil.WriteFile(plain, []byte("machine a"), 0o600))
+	r.NoError(ida.AddRecipients([]string{idb.PublicKey()}, nil))
+	source, err := EncryptFile(ida, plain)
+	r.NoError(err)
+	r.NoError(os.Remove(plain))
+
+	stateDir := tmp.Join("state").String()
+	r.NoError(Run(&Settings{
+		Prefix:      ".",
+		OnConflict:  Rename,
+		SourcePaths: []string{source},
+		DestPath:    s.fsFix.HomeDir.String(),
+		StateDir:    stateDir,
+		Identity:    a,
+	}))
+	r.NoError(ioutil.WriteFile(s.fsFix.HomeDir.Join(".netrc").String(), []byte("machine b"), 0o600))
+
+	before, err := ioutil.ReadFile(source)
+	r.NoError(err)
+	_, err = Reencrypt(pl.NewOsFs(), stateDir, Keys{Identity: a}, false)
+	s.Error(err, "the teammate would be left out")
+	s.Contains(err.Error(), "1 recipient(s) besides identity")
+	after, err := ioutil.ReadFile(source)
+	r.NoError(err)
+	s.Equal(before, after)
+
+	_, err = Reencrypt(pl.NewOsFs(), stateDir, Keys{Identity: a, Recipients: []string{idb.PublicKey()}}, false)
+	r.NoError(err)
+	data, err := ioutil.ReadFile(source)
+	r.NoError(err)
+	for _, id := range []*Identity{ida, idb} {
+		b, err := id.Decrypt(data)
+		r.NoError(err)
+		s.Equal("machine b", string(b))
+	}
+}
+
+func (s *InstallerSuite) TestDecryptWithWrongIdentity() {
+	r := s.Require()
+	a, b := s.fsFix.TempDir.Join("a").String(), s.fsFix.TempDir.Join("b").String()
+	r.NoError(GenerateIdentity(a))
+	r.NoError(GenerateIdentity(b))
+	ida, err := ReadIdentity(a)
+	r.NoError(err)
+	idb, err := ReadIdentity(b)
+	r.NoError(err)
+
+	data, err := ida.Encrypt([]byte("secret"))
+	r.NoError(err)
+	_, err = idb.Decrypt(data)
+	s.Error(err)
+	_, err = ida.Decrypt([]byte("secret"))
+	s.Error(err)
+
+	// unless it's one of the recipients
+	r.NoError(ida.AddRecipients([]string{idb.PublicKey()}, nil))
+	data, err = ida.Encrypt([]byte("secret"))
+	r.NoError(err)
+	for _, id := range []*Identity{ida, idb} {
+		b, err := id.Decrypt(data)
+		r.NoError(err)
+		s.Equal("secret", string(b))
+	}
+	s.Error(ida.AddRecipients([]string{"not-a-key"}, nil))
+
+	// files from the age tool are often armored
+	var buf bytes.Buffer
+	w := armor.NewWriter(&buf)
+	_, err = w.Write(data)
+	r.NoError(err)
+	r.NoError(w.Close())
+	plain, err := idb.Decrypt(buf.Bytes())
+	r.NoError(err)
+	s.Equal("secret", string(plain))
+
+	dup := areLinkNamesUnique([]string{"/a/netrc", "/b/netrc" + EncryptedSuffix})
+	r.NotNil(dup)
+	s.Equal("netrc", dup.Name)
+}
+
+func (s *InstallerSuite) TestPlanEncryptedSources() {
+	r := s.Require()
+	if _, err := exec.LookPath("git"); err != nil {
+		s.T().Skip("git is not installed")
+	}
+	tmp := s.fsFix.TempDir
+	r.NoError(os.Setenv("XDG_DATA_HOME", tmp.Join("data").String()))
+	defer os.Unsetenv("XDG_DATA_HOME")
+
+	identity := tmp.Join("identity").String()
+	r.NoError(GenerateIdentity(identity))
+	id, err := ReadIdentity(identity)
+	r.NoError(err)
+
+	plain := s.fsFix.DotfileDir.Join("netrc").String()
+	r.NoError(ioutil.WriteFile(plain, []byte("machine a"), 0o600))
+	source, err := EncryptFile(id, plain)
+	r.NoError(err)
+	r.NoError(os.Remove(plain))
+
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=dfi", "-c", "user.email=dfi@example.com"}, args...)...)
+		cmd.Dir = s.fsFix.SettingsDir.String()
+		out, err := cmd.CombinedOutput()
+		r.NoError(err, string(out))
+	}
+	git("init", "-q")
+	git("add", ".")
+	git("commit", "-q", "-m", "settings")
+
+	settings := &Settings{
+		Prefix:      ".",
+		OnConflict:  Rename,
+		SourcePaths: []string{source},
+		DestPath:    s.fsFix.HomeDir.String(),
+		StateDir:    tmp.Join("state").String(),
+		Identity:    identity,
+		GitCheck:    GitCheckFail,
+	}
+
+	// planning doesn't decrypt anything
+	p, err := MakePlan(settings)
+	r.NoError(err)
+	r.Len(p.Links, 1)
+	decryptedDir := tmp.Join("data", "dfi", decryptedDirName)
+	s.Equal(copyPathFor(decryptedDir.String(), source), p.Links[0].Vpath)
+	s.Equal(source, p.Links[0].Source)
+	s.Equal(s.fsFix.HomeDir.Join(".netrc").String(), p.Links[0].LinkPath)
+	s.False(decryptedDir.Lexists())
+
+	// applying it does, and the git check is of the source, not the copy
+	r.NoError(ApplyPlan(settings, p))
+	b, err := ioutil.ReadFile(s.fsFix.HomeDir.Join(".netrc").String())
+	r.NoError(err)
+	s.Equal("machine a", string(b))
+}
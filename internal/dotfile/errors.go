@@ -0,0 +1,151 @@
+package dotfile
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// These are the errors callers may want to handle, they can be found with
+// errors.As through any wrapping.
+type (
+	// ConflictError is returned when something exists at the link path
+	// and the OnConflict strategy is Fail
+	ConflictError struct {
+		LinkPath string
+	}
+
+	// DuplicateNameError is returned when two sources would have the same
+	// link name, or be moved to the same place by Init
+	DuplicateNameError struct {
+		Name   string
+		First  string
+		Second string
+	}
+
+	// DestNotDirError is returned when the destination doesn't
+	// exist, or isn't a directory
+	DestNotDirError struct {
+		Path    string
+		Missing bool
+	}
+
+	// UnsupportedFileTypeError is returned when we're asked to do something
+	// to a path that's a fifo, socket, device, etc. and not a file, directory
+	// or symlink
+	UnsupportedFileTypeError struct {
+		Path string
+		Mode os.FileMode
+		// Action is what we were trying to do, eg. "back up"
+		Action string
+	}
+
+	// LockedError is returned when another run holds the lock on the
+	// destination, and didn't let it go in time
+	LockedError struct {
+		Dest     string
+		LockPath string
+		// PID is the process holding the lock, 0 if we couldn't tell
+		PID int
+	}
+
+	// ModifiedSourcesError is returned by Verify when sources have changed,
+	// or gone missing, since they were installed
+	ModifiedSourcesError struct {
+		Changed int
+		Missing int
+	}
+
+	// PlanMismatch is a link path that isn't the way it was when a plan
+	// was made
+	PlanMismatch struct {
+		LinkPath string
+		Planned  PathState
+		Found    PathState
+	}
+
+	// PlanMismatchError is returned when a plan is applied, but some of
+	// its link paths have changed since it was made
+	PlanMismatchError struct {
+		Mismatches []PlanMismatch
+	}
+
+	// InsecureDirError is returned when a secret would be linked into a
+	// directory that's group or world writable
+	InsecureDirError struct {
+		LinkPath string
+		Dir      string
+		Mode     os.FileMode
+	}
+
+	// LinkFailure is a link that couldn't be created in a keep-going run
+	LinkFailure struct {
+		LinkData
+		Err error
+	}
+
+	// FailedLinksError is returned by a keep-going run when some of
+	// the links couldn't be created
+	FailedLinksError struct {
+		Failures []LinkFailure
+		// Total is the number of links the run tried to create
+		Total int
+	}
+)
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("Destination %#v exists, exiting", e.LinkPath)
+}
+
+func (e *DuplicateNameError) Error() string {
+	return fmt.Sprintf("duplicate names detected in input: %#v and %#v are both %#v", e.First, e.Second, e.Name)
+}
+
+func (e *DestNotDirError) Error() string {
+	if e.Missing {
+		return fmt.Sprintf("dest did not exist: %v", e.Path)
+	}
+	return fmt.Sprintf("dest is not a directory: %v", e.Path)
+}
+
+// Unwrap lets errors.Is match os.ErrNotExist or syscall.ENOTDIR
+func (e *DestNotDirError) Unwrap() error {
+	if e.Missing {
+		return os.ErrNotExist
+	}
+	return syscall.ENOTDIR
+}
+
+func (e *UnsupportedFileTypeError) Error() string {
+	return fmt.Sprintf("%#v is a %s, cannot %s", e.Path, modeName(e.Mode), e.Action)
+}
+
+func (e *FailedLinksError) Error() string {
+	return fmt.Sprintf("%d of %d links failed", len(e.Failures), e.Total)
+}
+
+func (e *LockedError) Error() string {
+	holder := "an unknown process"
+	if e.PID != 0 {
+		holder = fmt.Sprintf("pid %d", e.PID)
+	}
+	return fmt.Sprintf("%#v is locked by another dfi run (%s), see %v or use --no-lock", e.Dest, holder, e.LockPath)
+}
+
+func (e *ModifiedSourcesError) Error() string {
+	return fmt.Sprintf("%d source(s) changed and %d missing since they were installed", e.Changed, e.Missing)
+}
+
+func (e *PlanMismatchError) Error() string {
+	m := e.Mismatches[0]
+	more := ""
+	if len(e.Mismatches) > 1 {
+		more = fmt.Sprintf(" (and %d more)", len(e.Mismatches)-1)
+	}
+	return fmt.Sprintf("%#v was a %s when planned, and is now a %s%s, make a new plan",
+		m.LinkPath, m.Planned.Type, m.Found.Type, more)
+}
+
+func (e *InsecureDirError) Error() string {
+	return fmt.Sprintf("refusing to link secret %#v, %#v is %s, which others can write to", e.LinkPath, e.Dir, e.Mode)
+}
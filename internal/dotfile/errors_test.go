@@ -0,0 +1,62 @@
+package dotfile
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+
+	pl "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+func (s *InstallerSuite) TestConflictError() {
+	mfs := newMemHome(s.Require())
+	err := NewInstaller(".", ConflictHandlers.Fail).WithFs(mfs).Run(memSources, "/home/user")
+
+	var conflict *ConflictError
+	s.Require().True(errors.As(err, &conflict))
+	s.Equal("/home/user/.bashrc", conflict.LinkPath)
+}
+
+func (s *InstallerSuite) TestDuplicateNameError() {
+	mfs := newMemHome(s.Require())
+	s.NoError(mfs.MkdirAll("/other", 0o755))
+
+	err := NewInstaller(".", ConflictHandlers.Fail).
+		WithFs(mfs).
+		Run([]string{"/home/user/.settings/dotfiles/vimrc", "/other/vimrc"}, "/home/user")
+
+	var dup *DuplicateNameError
+	s.Require().True(errors.As(err, &dup))
+	s.Equal(DuplicateNameError{Name: "vimrc", First: "/home/user/.settings/dotfiles/vimrc", Second: "/other/vimrc"}, *dup)
+}
+
+func (s *InstallerSuite) TestDestNotDirError() {
+	mfs := newMemHome(s.Require())
+
+	var notDir *DestNotDirError
+	err := NewInstaller(".", ConflictHandlers.Fail).WithFs(mfs).Run(memSources, "/home/nobody")
+	s.Require().True(errors.As(err, &notDir))
+	s.Equal(DestNotDirError{Path: "/home/nobody", Missing: true}, *notDir)
+	s.True(errors.Is(err, os.ErrNotExist))
+
+	err = NewInstaller(".", ConflictHandlers.Fail).WithFs(mfs).Run(memSources, "/home/user/.bashrc")
+	s.Require().True(errors.As(err, &notDir))
+	s.Equal(DestNotDirError{Path: "/home/user/.bashrc"}, *notDir)
+	s.True(errors.Is(err, syscall.ENOTDIR))
+	s.True(pl.IsNotDir(err))
+}
+
+func (s *InstallerSuite) TestUnsupportedFileTypeError() {
+	mfs := newMemHome(s.Require())
+	s.NoError(mfs.Remove("/home/user/.bashrc"))
+	s.NoError(mfs.Mknod("/home/user/.bashrc", os.ModeNamedPipe|0o644))
+
+	err := NewInstaller(".", ConflictHandlers.Rename).WithFs(mfs).Run(memSources, "/home/user")
+
+	var unsupported *UnsupportedFileTypeError
+	s.Require().True(errors.As(err, &unsupported))
+	s.Equal("/home/user/.bashrc", unsupported.Path)
+	s.Equal("back up", unsupported.Action)
+	s.Contains(err.Error(), `"/home/user/.bashrc" is a fifo, cannot back up`)
+}
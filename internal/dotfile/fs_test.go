@@ -0,0 +1,482 @@
+package dotfile
+
+import (
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	fsf "github.com/slyphon/dfi/internal/fsfixture"
+	pl "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+// recordingFs passes everything through to the OS, and records the
+// calls that modify the filesystem
+type recordingFs struct {
+	pl.Fs
+	mu    sync.Mutex
+	calls []string
+}
+
+func newRecordingFs() *recordingFs {
+	return &recordingFs{Fs: pl.NewOsFs()}
+}
+
+func (r *recordingFs) record(op, path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, op+" "+path)
+}
+
+func (r *recordingFs) Symlink(old, new string) error {
+	r.record("symlink", new)
+	return r.Fs.Symlink(old, new)
+}
+
+func (r *recordingFs) Rename(old, new string) error {
+	r.record("rename", old)
+	return r.Fs.Rename(old, new)
+}
+
+func (r *recordingFs) Remove(name string) error {
+	r.record("remove", name)
+	return r.Fs.Remove(name)
+}
+
+func (s *InstallerSuite) TestInstallerUsesInjectedFs() {
+	r := s.Require()
+	home := s.fsFix.HomeDir
+	home.Join(".bashrc").Must().Touch(0o644, false)
+	home.Join(".vimrc").Must().Touch(0o644, false)
+
+	rfs := newRecordingFs()
+	err := NewInstaller(".", ConflictHandlers.Rename).
+		WithFs(rfs).
+		Run(pl.PosixSliceStringer(s.fsFix.Dotfiles), home.String())
+	r.NoError(err)
+
+	r.Equal(
+		[]string{
+			"rename " + home.Join(".bashrc").String(),
+			"symlink " + home.Join(".bashrc").String(),
+			"symlink " + home.Join(".config").String(),
+			"rename " + home.Join(".vimrc").String(),
+			"symlink " + home.Join(".vimrc").String(),
+			"symlink " + home.Join(".zshrc").String(),
+		},
+		rfs.calls,
+	)
+
+	rfs = newRecordingFs()
+	err = NewInstaller(".", ConflictHandlers.Replace).
+		WithFs(rfs).
+		Run(pl.PosixSliceStringer(s.fsFix.Binfiles), home.String())
+	r.NoError(err)
+	r.Len(rfs.calls, 3)
+}
+
+func (s *InstallerSuite) TestConcurrentInstallers() {
+	const n = 4
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+
+	for i := 0; i < n; i++ {
+		fix := fsf.NewFsFixture()
+		defer fix.Cleanup()
+
+		wg.Add(1)
+		go func(i int, fix fsf.FsFixture) {
+			defer wg.Done()
+			errs[i] = NewInstaller(".", ConflictHandlers.Fail).
+				WithFs(newRecordingFs()).
+				Run(pl.PosixSliceStringer(fix.Dotfiles), fix.HomeDir.String())
+		}(i, fix)
+	}
+
+	wg.Wait()
+	for _, err := range errs {
+		s.NoError(err)
+	}
+}
+
+// newMemHome builds a settings dir with three dotfiles on a MemFs, and a home
+// dir with a file, a stale link and a correct link in the way
+func newMemHome(r *require.Assertions) *pl.MemFs {
+	mfs := pl.NewMemFs()
+	r.NoError(mfs.MkdirAll("/home/user/.settings/dotfiles", 0o755))
+	for _, name := range []string{"bashrc", "vimrc", "zshrc"} {
+		f, err := mfs.Create("/home/user/.settings/dotfiles/" + name)
+		r.NoError(err)
+		r.NoError(f.Close())
+	}
+
+	f, err := mfs.Create("/home/user/.bashrc")
+	r.NoError(err)
+	r.NoError(f.Close())
+	r.NoError(mfs.Symlink("/nowhere/vimrc", "/home/user/.vimrc"))
+	r.NoError(mfs.Symlink(".settings/dotfiles/zshrc", "/home/user/.zshrc"))
+	return mfs
+}
+
+func (s *InstallerSuite) TestConflictsOnMemFs() {
+	sources := memSources
+
+	linksOk := func(mfs *pl.MemFs, names ...string) {
+		for _, name := range names {
+			target, err := mfs.Readlink("/home/user/" + name)
+			s.NoError(err)
+			s.Equal(".settings/dotfiles/"+name[1:], target)
+		}
+	}
+
+	backups := func(mfs *pl.MemFs) []string {
+		matches, err := mfs.Glob("/home/user/.*.dfi_*")
+		s.NoError(err)
+		return matches
+	}
+
+	mfs := newMemHome(s.Require())
+	s.NoError(NewInstaller(".", ConflictHandlers.Rename).WithFs(mfs).Run(sources, "/home/user"))
+	linksOk(mfs, ".bashrc", ".vimrc", ".zshrc")
+	s.Len(backups(mfs), 2)
+
+	mfs = newMemHome(s.Require())
+	s.NoError(NewInstaller(".", ConflictHandlers.Replace).WithFs(mfs).Run(sources, "/home/user"))
+	linksOk(mfs, ".bashrc", ".vimrc", ".zshrc")
+	s.Empty(backups(mfs))
+
+	mfs = newMemHome(s.Require())
+	s.NoError(NewInstaller(".", ConflictHandlers.Warn).WithFs(mfs).Run(sources, "/home/user"))
+	linksOk(mfs, ".zshrc")
+	target, err := mfs.Readlink("/home/user/.vimrc")
+	s.NoError(err)
+	s.Equal("/nowhere/vimrc", target)
+
+	mfs = newMemHome(s.Require())
+	err = NewInstaller(".", ConflictHandlers.Fail).WithFs(mfs).Run(sources, "/home/user")
+	s.Error(err)
+	s.Contains(err.Error(), "/home/user/.bashrc")
+}
+
+var memSources = []string{
+	"/home/user/.settings/dotfiles/bashrc",
+	"/home/user/.settings/dotfiles/vimrc",
+	"/home/user/.settings/dotfiles/zshrc",
+}
+
+// requireUntouched checks the home dir built by newMemHome is as it was
+func requireUntouched(r *require.Assertions, mfs *pl.MemFs) {
+	info, _, err := mfs.LstatIfPossible("/home/user/.bashrc")
+	r.NoError(err)
+	r.True(info.Mode().IsRegular(), ".bashrc was not put back")
+
+	target, err := mfs.Readlink("/home/user/.vimrc")
+	r.NoError(err)
+	r.Equal("/nowhere/vimrc", target)
+
+	target, err = mfs.Readlink("/home/user/.zshrc")
+	r.NoError(err)
+	r.Equal(".settings/dotfiles/zshrc", target)
+
+	backups, err := mfs.Glob("/home/user/.*.dfi_*")
+	r.NoError(err)
+	r.Empty(backups)
+}
+
+func (s *InstallerSuite) TestRollbackWhenSymlinkFails() {
+	for _, oc := range []OnConflict{ConflictHandlers.Rename, ConflictHandlers.Replace} {
+		mfs := newMemHome(s.Require())
+		ffs := pl.NewFaultFs(mfs).
+			Inject(pl.Fault{Op: pl.FaultSymlink, Pattern: "**/.vimrc", Err: syscall.EACCES})
+
+		err := NewInstaller(".", oc).WithFs(ffs).Run(memSources, "/home/user")
+		s.Error(err)
+		s.True(os.IsPermission(errors.Cause(err)))
+		s.Contains(err.Error(), "/home/user/.vimrc")
+		s.Contains(err.Error(), "rolled back 3 change(s)")
+
+		requireUntouched(s.Require(), mfs)
+	}
+}
+
+func (s *InstallerSuite) TestRollbackWhenOutOfSpace() {
+	mfs := newMemHome(s.Require())
+	r := s.Require()
+	r.NoError(mfs.Remove("/home/user/.bashrc"))
+
+	// the first link is created, then the disk fills up
+	ffs := pl.NewFaultFs(mfs).
+		Inject(pl.Fault{Op: pl.FaultSymlink, After: 1, Err: syscall.ENOSPC})
+
+	err := NewInstaller(".", ConflictHandlers.Rename).WithFs(ffs).Run(memSources, "/home/user")
+	r.Error(err)
+	r.Equal(syscall.ENOSPC, errors.Cause(err).(*os.LinkError).Err)
+
+	r.False(pl.NewPosixPathFs(mfs, "/home/user/.bashrc").Lexists())
+	target, err := mfs.Readlink("/home/user/.vimrc")
+	r.NoError(err)
+	r.Equal("/nowhere/vimrc", target)
+}
+
+func (s *InstallerSuite) TestBackupRenameFails() {
+	mfs := newMemHome(s.Require())
+	ffs := pl.NewFaultFs(mfs).
+		Inject(pl.Fault{Op: pl.FaultRename, Pattern: "**/.vimrc.dfi_*", Err: syscall.EXDEV})
+
+	err := NewInstaller(".", ConflictHandlers.Rename).WithFs(ffs).Run(memSources, "/home/user")
+	s.Error(err)
+	s.Equal(syscall.EXDEV, errors.Cause(err).(*os.LinkError).Err)
+	s.Contains(err.Error(), "falied to rename dest path \"/home/user/.vimrc\"")
+
+	requireUntouched(s.Require(), mfs)
+}
+
+func (s *InstallerSuite) TestLstatFails() {
+	mfs := newMemHome(s.Require())
+	ffs := pl.NewFaultFs(mfs).
+		Inject(pl.Fault{Op: pl.FaultLstat, Pattern: "**/.vimrc", Err: syscall.EACCES})
+
+	err := NewInstaller(".", ConflictHandlers.Rename).WithFs(ffs).Run(memSources, "/home/user")
+	s.Error(err)
+	s.True(os.IsPermission(errors.Cause(err)))
+	s.Contains(err.Error(), "failed to lstat link path \"/home/user/.vimrc\"")
+
+	requireUntouched(s.Require(), mfs)
+}
+
+func (s *InstallerSuite) TestRollbackFailureIsReported() {
+	mfs := newMemHome(s.Require())
+	// backing up .bashrc works, putting it back doesn't
+	ffs := pl.NewFaultFs(mfs).
+		Inject(pl.Fault{Op: pl.FaultSymlink, Pattern: "**/.vimrc", Err: syscall.EACCES}).
+		Inject(pl.Fault{Op: pl.FaultRename, Pattern: "**/.bashrc.dfi_*", After: 1, Err: syscall.EROFS})
+
+	err := NewInstaller(".", ConflictHandlers.Rename).WithFs(ffs).Run(memSources, "/home/user")
+	s.Error(err)
+	s.True(os.IsPermission(errors.Cause(err)))
+	s.Equal(1, ffs.Triggered(pl.FaultRename))
+
+	// the error says where the backup was left
+	backups, err2 := mfs.Glob("/home/user/.bashrc.dfi_*")
+	s.NoError(err2)
+	s.Len(backups, 1)
+	s.Contains(err.Error(), "failed to roll back 1 of 3 change(s)")
+	s.Contains(err.Error(), "move /home/user/.bashrc to "+backups[0])
+
+	s.False(pl.NewPosixPathFs(mfs, "/home/user/.bashrc").Lexists())
+	target, err := mfs.Readlink("/home/user/.vimrc")
+	s.NoError(err)
+	s.Equal("/nowhere/vimrc", target)
+}
+
+func (s *InstallerSuite) TestReplacedFilesAreRemovedOnSuccess() {
+	mfs := newMemHome(s.Require())
+	s.NoError(mfs.Mkdir("/home/user/.settings/dotfiles/config", 0o755))
+	s.NoError(mfs.MkdirAll("/home/user/.config/nvim", 0o755))
+
+	// we won't remove a directory with something in it
+	err := NewInstaller(".", ConflictHandlers.Replace).
+		WithFs(mfs).
+		Run(append(memSources, "/home/user/.settings/dotfiles/config"), "/home/user")
+	s.Error(err)
+	s.Equal(syscall.ENOTEMPTY, errors.Cause(err).(*os.PathError).Err)
+	requireUntouched(s.Require(), mfs)
+
+	s.NoError(mfs.Remove("/home/user/.config/nvim"))
+	err = NewInstaller(".", ConflictHandlers.Replace).
+		WithFs(mfs).
+		Run(append(memSources, "/home/user/.settings/dotfiles/config"), "/home/user")
+	s.NoError(err)
+
+	backups, err := mfs.Glob("/home/user/.*.dfi_*")
+	s.NoError(err)
+	s.Empty(backups)
+	s.True(pl.NewPosixPathFs(mfs, "/home/user/.config").IsSymlink())
+}
+
+func (s *InstallerSuite) TestKeepGoing() {
+	mfs := newMemHome(s.Require())
+	s.NoError(mfs.Mknod("/home/user/.settings/dotfiles/fifo", os.ModeNamedPipe|0o644))
+	s.NoError(mfs.Mknod("/home/user/.fifo", os.ModeNamedPipe|0o644))
+
+	ffs := pl.NewFaultFs(mfs).
+		Inject(pl.Fault{Op: pl.FaultSymlink, Pattern: "**/.vimrc", Err: syscall.EACCES})
+
+	sources := append(memSources, "/home/user/.settings/dotfiles/fifo")
+	err := NewInstaller(".", ConflictHandlers.Rename).
+		WithFs(ffs).
+		WithKeepGoing(true).
+		Run(sources, "/home/user")
+
+	var failed *FailedLinksError
+	s.Require().True(errors.As(err, &failed))
+	s.Equal(4, failed.Total)
+	s.Require().Len(failed.Failures, 2)
+
+	s.Equal("/home/user/.vimrc", failed.Failures[0].LinkPath)
+	s.True(os.IsPermission(errors.Cause(failed.Failures[0].Err)))
+	s.Contains(failed.Failures[0].Err.Error(), "rolled back 1 change(s)")
+
+	var unsupported *UnsupportedFileTypeError
+	s.Equal("/home/user/.fifo", failed.Failures[1].LinkPath)
+	s.True(errors.As(failed.Failures[1].Err, &unsupported))
+
+	// the links that could be made were, and the failed one was put back
+	target, err := mfs.Readlink("/home/user/.bashrc")
+	s.NoError(err)
+	s.Equal(".settings/dotfiles/bashrc", target)
+	target, err = mfs.Readlink("/home/user/.vimrc")
+	s.NoError(err)
+	s.Equal("/nowhere/vimrc", target)
+
+	backups, err := mfs.Glob("/home/user/.*.dfi_*")
+	s.NoError(err)
+	s.Len(backups, 1)
+}
+
+// presentFs checks that a set of paths exist after every change to the
+// filesystem, and records the changes after which one didn't
+type presentFs struct {
+	pl.Fs
+	paths   []string
+	missing []string
+}
+
+func (p *presentFs) check(op string, err error) error {
+	for _, path := range p.paths {
+		if !pl.NewPosixPathFs(p.Fs, path).Lexists() {
+			p.missing = append(p.missing, op+": "+path)
+		}
+	}
+	return err
+}
+
+func (p *presentFs) Symlink(old, new string) error {
+	return p.check("symlink "+new, p.Fs.Symlink(old, new))
+}
+
+func (p *presentFs) Rename(old, new string) error {
+	return p.check("rename "+old, p.Fs.Rename(old, new))
+}
+
+func (p *presentFs) Remove(name string) error {
+	return p.check("remove "+name, p.Fs.Remove(name))
+}
+
+func (s *InstallerSuite) TestAtomicReplace() {
+	paths := []string{"/home/user/.bashrc", "/home/user/.vimrc", "/home/user/.zshrc"}
+
+	for _, oc := range []OnConflict{ConflictHandlers.Rename, ConflictHandlers.Replace} {
+		mfs := newMemHome(s.Require())
+		pfs := &presentFs{Fs: mfs, paths: paths}
+
+		s.NoError(NewInstaller(".", oc).WithFs(pfs).WithAtomic(true).Run(memSources, "/home/user"))
+		s.Empty(pfs.missing, oc.String())
+
+		for _, p := range paths {
+			target, err := mfs.Readlink(p)
+			s.NoError(err)
+			s.Equal(".settings/dotfiles/"+p[len("/home/user/."):], target)
+		}
+
+		tmps, err := mfs.Glob("/home/user/.*.dfi_tmp_*")
+		s.NoError(err)
+		s.Empty(tmps)
+
+		backups, err := mfs.Glob("/home/user/.*.dfi_*")
+		s.NoError(err)
+		if oc == ConflictHandlers.Replace {
+			s.Empty(backups)
+			continue
+		}
+
+		// the backups are what was there before
+		s.Require().Len(backups, 2)
+		info, _, err := mfs.LstatIfPossible(backups[0])
+		s.NoError(err)
+		s.True(info.Mode().IsRegular(), backups[0])
+		target, err := mfs.Readlink(backups[1])
+		s.NoError(err)
+		s.Equal("/nowhere/vimrc", target)
+	}
+
+	// without it, there's a moment when .bashrc has been moved and the
+	// link isn't there yet
+	pfs := &presentFs{Fs: newMemHome(s.Require()), paths: paths}
+	s.NoError(NewInstaller(".", ConflictHandlers.Rename).WithFs(pfs).Run(memSources, "/home/user"))
+	s.Contains(pfs.missing, "rename /home/user/.bashrc: /home/user/.bashrc")
+}
+
+func (s *InstallerSuite) TestAtomicBackupWithoutHardLinks() {
+	mfs := newMemHome(s.Require())
+	s.NoError(afero.WriteFile(mfs, "/home/user/.bashrc", []byte("export A=1\n"), 0o640))
+	s.NoError(mfs.Chmod("/home/user/.bashrc", 0o640))
+
+	// eg. an overlay or a filesystem that doesn't do hard links
+	for _, errno := range []syscall.Errno{syscall.EXDEV, syscall.EPERM} {
+		ffs := pl.NewFaultFs(mfs).
+			Inject(pl.Fault{Op: pl.FaultLink, Pattern: "**/.bashrc", Err: errno})
+
+		s.NoError(NewInstaller(".", ConflictHandlers.Rename).WithFs(ffs).WithAtomic(true).Run(memSources, "/home/user"))
+		s.Equal(1, ffs.Triggered(pl.FaultLink), errno.Error())
+
+		backups, err := mfs.Glob("/home/user/.bashrc.dfi_*")
+		s.NoError(err)
+		s.Require().Len(backups, 1)
+		info, _, err := mfs.LstatIfPossible(backups[0])
+		s.NoError(err)
+		s.Equal(os.FileMode(0o640), info.Mode())
+		data, err := afero.ReadFile(mfs, backups[0])
+		s.NoError(err)
+		s.Equal("export A=1\n", string(data))
+
+		// put it back for the next round
+		s.NoError(mfs.Rename(backups[0], "/home/user/.bashrc"))
+	}
+}
+
+func (s *InstallerSuite) TestAtomicRollback() {
+	for _, oc := range []OnConflict{ConflictHandlers.Rename, ConflictHandlers.Replace} {
+		// the link for .vimrc can't be created
+		mfs := newMemHome(s.Require())
+		ffs := pl.NewFaultFs(mfs).
+			Inject(pl.Fault{Op: pl.FaultSymlink, Pattern: "**/.vimrc.dfi_tmp_*", Err: syscall.EACCES})
+
+		err := NewInstaller(".", oc).WithFs(ffs).WithAtomic(true).Run(memSources, "/home/user")
+		s.Error(err)
+		s.True(os.IsPermission(errors.Cause(err)))
+		s.Contains(err.Error(), "failed to create link \"/home/user/.vimrc\"")
+		s.Contains(err.Error(), "rolled back 1 change(s)")
+		requireUntouched(s.Require(), mfs)
+
+		// or it can't be put in place
+		mfs = newMemHome(s.Require())
+		ffs = pl.NewFaultFs(mfs).
+			Inject(pl.Fault{Op: pl.FaultRename, Pattern: "**/.vimrc.dfi_tmp_*", Err: syscall.EIO})
+
+		err = NewInstaller(".", oc).WithFs(ffs).WithAtomic(true).Run(memSources, "/home/user")
+		s.Error(err)
+		s.Equal(syscall.EIO, errors.Cause(err).(*os.LinkError).Err)
+		requireUntouched(s.Require(), mfs)
+	}
+}
+
+func (s *InstallerSuite) TestStateOnMemFs() {
+	mfs := newMemHome(s.Require())
+	stateDir := "/home/user/.local/state/dfi"
+	s.NoError(NewInstaller(".", ConflictHandlers.Replace).WithFs(mfs).WithState(stateDir).Run(memSources, "/home/user"))
+
+	st, err := ReadState(mfs, stateDir)
+	s.NoError(err)
+	s.Len(st.Links, 3)
+
+	lf, err := ReadLockfile(mfs, stateDir)
+	s.NoError(err)
+	s.Len(lf.Sources, 3)
+
+	_, err = os.Lstat(stateDir)
+	s.True(os.IsNotExist(err), "nothing is written to the real disk")
+}
@@ -0,0 +1,161 @@
+package dotfile
+
+import (
+	"fmt"
+	fp "path/filepath"
+	str "strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/slyphon/dfi/internal/gitrepo"
+)
+
+// GitCheck is what to do when a source is not a clean, tracked file
+// in a git repository
+type GitCheck int
+
+const (
+	GitCheckOff GitCheck = iota
+	GitCheckWarn
+	GitCheckFail
+)
+
+func (g GitCheck) String() string {
+	switch g {
+	case GitCheckOff:
+		return "off"
+	case GitCheckWarn:
+		return "warn"
+	case GitCheckFail:
+		return "fail"
+	default:
+		return fmt.Sprintf("GitCheck(%d)", int(g))
+	}
+}
+
+// GitCheckNames returns the names GitCheckForString accepts
+func GitCheckNames() []string {
+	return []string{GitCheckOff.String(), GitCheckWarn.String(), GitCheckFail.String()}
+}
+
+func GitCheckForString(s string) (GitCheck, error) {
+	switch str.ToLower(s) {
+	case "", "off":
+		return GitCheckOff, nil
+	case "warn":
+		return GitCheckWarn, nil
+	case "fail":
+		return GitCheckFail, nil
+	default:
+		return -1, errors.Errorf("invalid GitCheck string: %v", s)
+	}
+}
+
+// sourceChecker caches the repositories we've seen so each index is only
+// read once per run
+type sourceChecker struct {
+	check GitCheck
+	repos map[string]*gitrepo.Repo
+	// the repository each source that's in one is in, see LinkData.source
+	sourceRepos map[string]*gitrepo.Repo
+}
+
+func newSourceChecker(check GitCheck) *sourceChecker {
+	return &sourceChecker{
+		check:       check,
+		repos:       make(map[string]*gitrepo.Repo),
+		sourceRepos: make(map[string]*gitrepo.Repo),
+	}
+}
+
+func (c *sourceChecker) problem(ld LinkData, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+
+	if c.check == GitCheckFail {
+		return errors.Errorf("source %#v %s", ld.source(), msg)
+	}
+
+	log.WithField("Vpath", ld.source()).Warnf("source %s", msg)
+	return nil
+}
+
+func (c *sourceChecker) repoFor(vpath string) (*gitrepo.Repo, error) {
+	repo, err := gitrepo.Find(fp.Dir(vpath))
+	if err != nil {
+		return nil, err
+	}
+
+	if seen, ok := c.repos[repo.GitDir]; ok {
+		return seen, nil
+	}
+
+	c.repos[repo.GitDir] = repo
+	return repo, nil
+}
+
+// checkOne checks the source of ld, which for a decrypted copy is the
+// encrypted source in the settings, not the copy
+func (c *sourceChecker) checkOne(ld LinkData) error {
+	source := ld.source()
+	repo, err := c.repoFor(source)
+	if errors.Cause(err) == gitrepo.ErrNotFound {
+		return c.problem(ld, "is not in a git repository")
+	} else if err != nil {
+		return err
+	}
+	c.sourceRepos[source] = repo
+
+	status, err := repo.Status(source)
+	if err != nil {
+		return err
+	}
+
+	switch status {
+	case gitrepo.Clean:
+		return nil
+	case gitrepo.Modified:
+		return c.problem(ld, "has uncommitted modifications")
+	default:
+		return c.problem(ld, "is %s in %#v", status, repo.WorkTree)
+	}
+}
+
+// checkSources validates every source according to check, and logs the
+// commit each repository is at. It returns linkData with the Commit of
+// each source that's in a repository set, so it's recorded with the run.
+func checkSources(linkData []LinkData, check GitCheck) ([]LinkData, error) {
+	if check == GitCheckOff {
+		return linkData, nil
+	}
+
+	c := newSourceChecker(check)
+
+	for _, ld := range linkData {
+		if err := c.checkOne(ld); err != nil {
+			return nil, err
+		}
+	}
+
+	commits := make(map[string]string, len(c.repos))
+	for gitDir, repo := range c.repos {
+		commit, err := repo.Head()
+		if err != nil {
+			return nil, err
+		}
+		commits[gitDir] = commit
+		log.WithFields(log.Fields{
+			"repo":   repo.WorkTree,
+			"commit": commit,
+		}).Info("installing from git repository")
+	}
+
+	out := make([]LinkData, len(linkData))
+	for i, ld := range linkData {
+		if repo, ok := c.sourceRepos[ld.source()]; ok {
+			ld.Commit = commits[repo.GitDir]
+		}
+		out[i] = ld
+	}
+	return out, nil
+}
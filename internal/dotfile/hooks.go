@@ -0,0 +1,134 @@
+package dotfile
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	ppath "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+type (
+	// LinkHook is a set of shell commands that are run around the
+	// installation of a link, but only if the link was actually changed.
+	// Match is an extended glob (see github.com/gobwas/glob) that is matched
+	// against the LinkPath, an empty Match will match every link.
+	LinkHook struct {
+		Match string   `mapstructure:"match"`
+		Pre   []string `mapstructure:"pre"`
+		Post  []string `mapstructure:"post"`
+	}
+
+	// Hooks are the shell commands run before and after an Installer.Run
+	// (PreRun, PostRun) and around each link that is changed (Link).
+	Hooks struct {
+		PreRun  []string   `mapstructure:"pre_run"`
+		PostRun []string   `mapstructure:"post_run"`
+		Link    []LinkHook `mapstructure:"link"`
+	}
+
+	// HookRunner executes a single hook command with the given additional
+	// environment variables
+	HookRunner func(command string, env []string) error
+)
+
+const (
+	EnvVpath    = "DFI_VPATH"
+	EnvLinkPath = "DFI_LINK_PATH"
+	EnvLinkData = "DFI_LINK_DATA"
+	EnvDestPath = "DFI_DEST_PATH"
+	EnvPrefix   = "DFI_PREFIX"
+)
+
+// ShellHookRunner runs the command with 'sh -c', with the current process'
+// environment plus env, and stdout and stderr connected to ours.
+func ShellHookRunner(command string, env []string) error {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+var _ HookRunner = ShellHookRunner
+
+func envFor(key, value string) string {
+	return key + "=" + value
+}
+
+func (ld LinkData) environ() []string {
+	return []string{
+		envFor(EnvVpath, ld.Vpath),
+		envFor(EnvLinkPath, ld.LinkPath),
+		envFor(EnvLinkData, ld.LinkData),
+	}
+}
+
+func (h Hooks) IsEmpty() bool {
+	return len(h.PreRun) == 0 && len(h.PostRun) == 0 && len(h.Link) == 0
+}
+
+func (lh LinkHook) matches(ld LinkData) (bool, error) {
+	if lh.Match == "" {
+		return true, nil
+	}
+	b, err := ppath.NewPurePath(ld.LinkPath).ExMatch(lh.Match)
+	return b, errors.Wrapf(err, "invalid hook match pattern %#v", lh.Match)
+}
+
+func runHookCommands(runner HookRunner, commands []string, env []string) error {
+	for _, c := range commands {
+		log.WithField("hook", c).Debug("running hook")
+		if err := runner(c, env); err != nil {
+			return errors.Wrapf(err, "hook %#v failed", c)
+		}
+	}
+	return nil
+}
+
+func (h Hooks) runLink(runner HookRunner, ld LinkData, post bool) error {
+	for _, lh := range h.Link {
+		switch ok, err := lh.matches(ld); {
+		case err != nil:
+			return err
+		case !ok:
+			continue
+		}
+
+		commands := lh.Pre
+		if post {
+			commands = lh.Post
+		}
+
+		if err := runHookCommands(runner, commands, ld.environ()); err != nil {
+			return errors.WithMessagef(err, "link hook for %#v", ld.LinkPath)
+		}
+	}
+	return nil
+}
+
+// PreLink runs the Pre commands of every LinkHook that matches ld
+func (h Hooks) PreLink(runner HookRunner, ld LinkData) error {
+	return h.runLink(runner, ld, false)
+}
+
+// PostLink runs the Post commands of every LinkHook that matches ld
+func (h Hooks) PostLink(runner HookRunner, ld LinkData) error {
+	return h.runLink(runner, ld, true)
+}
+
+func runEnviron(destPath, prefix string) []string {
+	return []string{envFor(EnvDestPath, destPath), envFor(EnvPrefix, prefix)}
+}
+
+func (h Hooks) BeforeRun(runner HookRunner, destPath, prefix string) error {
+	return errors.WithMessage(
+		runHookCommands(runner, h.PreRun, runEnviron(destPath, prefix)), "pre-run hook")
+}
+
+func (h Hooks) AfterRun(runner HookRunner, destPath, prefix string) error {
+	return errors.WithMessage(
+		runHookCommands(runner, h.PostRun, runEnviron(destPath, prefix)), "post-run hook")
+}
@@ -0,0 +1,234 @@
+package dotfile
+
+import (
+	"os"
+	fp "path/filepath"
+	"sort"
+	str "strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	ppath "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+type (
+	// InitSettings are the options for Init, which moves existing dotfiles
+	// into a settings directory and links them back to where they were
+	InitSettings struct {
+		// Paths are the existing files or directories to move
+		Paths []string
+
+		// SettingsDir is the directory the files are moved into
+		SettingsDir string
+
+		// Prefix is stripped from the names of the Paths, and is used
+		// when linking them back
+		Prefix string
+
+		OnConflict OnConflict
+
+		// ManifestPath is where the starter manifest is written, by default
+		// next to SettingsDir. If it already exists, the new groups are
+		// added to it.
+		ManifestPath string
+
+		// StateDir is where the links are recorded, see StateDir
+		StateDir string
+
+		// Fs is as in Settings
+		Fs ppath.Fs
+	}
+
+	InitFn func(s *InitSettings) error
+
+	// a path to move, and where it's going
+	initMove struct {
+		from string
+		to   string
+	}
+)
+
+const settingsDirPerms os.FileMode = 0o755
+
+var _ InitFn = Init
+
+// fsys returns s.Fs, or the real filesystem if it's not set
+func (s *InitSettings) fsys() ppath.Fs {
+	if s.Fs == nil {
+		return ppath.NewOsFs()
+	}
+	return s.Fs
+}
+
+// planInit checks that every path can be moved without clobbering
+// anything before we touch the filesystem
+func planInit(s *InitSettings) ([]initMove, error) {
+	moves := make([]initMove, 0, len(s.Paths))
+	seen := make(map[string]string)
+
+	for _, p := range s.Paths {
+		from, err := fp.Abs(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to Abs(%#v)", p)
+		}
+
+		info, err := ppath.NewPosixPathFs(s.fsys(), from).Lstat()
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot init from %#v", p)
+		}
+
+		if info.IsSymlink() {
+			return nil, errors.Errorf("%#v is already a symlink", p)
+		} else if !(info.Mode().IsRegular() || info.IsDir()) {
+			return nil, errors.WithStack(&UnsupportedFileTypeError{Path: p, Mode: info.Mode(), Action: "init"})
+		}
+
+		base := fp.Base(from)
+		if !str.HasPrefix(base, s.Prefix) || base == s.Prefix {
+			return nil, errors.Errorf("name of %#v does not start with the prefix %#v", p, s.Prefix)
+		}
+
+		name := str.TrimPrefix(base, s.Prefix)
+		if prev, ok := seen[name]; ok {
+			return nil, errors.WithStack(&DuplicateNameError{Name: name, First: prev, Second: p})
+		}
+		seen[name] = p
+
+		to := fp.Join(s.SettingsDir, name)
+		if ppath.NewPosixPathFs(s.fsys(), to).Lexists() {
+			return nil, errors.Errorf("%#v already exists in the settings directory", to)
+		}
+
+		moves = append(moves, initMove{from: from, to: to})
+	}
+
+	return moves, nil
+}
+
+// undoMoves moves the files on fsys back, in the reverse order, removing
+// the link to each that's in its way, if it was made
+func undoMoves(fsys ppath.Fs, moves []initMove) {
+	for i := len(moves) - 1; i >= 0; i-- {
+		m := moves[i]
+		from := ppath.NewPosixPathFs(fsys, m.from)
+		if data, err := from.Readlink(); err == nil {
+			target := data.String()
+			if !fp.IsAbs(target) {
+				target = fp.Join(fp.Dir(m.from), target)
+			}
+			if target != m.to {
+				log.WithField("path", m.from).Error("something else is where a file was, not moving it back")
+				continue
+			}
+			if err = from.Remove(); err != nil {
+				log.WithFields(log.Fields{"link": m.from, "err": err.Error()}).Error("failed to remove link")
+			}
+		}
+
+		if _, err := ppath.NewPosixPathFs(fsys, m.to).Rename(m.from); err != nil {
+			log.WithFields(log.Fields{
+				"from": m.to,
+				"to":   m.from,
+				"err":  err.Error(),
+			}).Error("failed to move file back")
+		}
+	}
+}
+
+// Init moves each of the paths into the settings directory with the prefix
+// stripped, links them back into place, and writes a starter manifest.
+func Init(s *InitSettings) (err error) {
+	if s.SettingsDir, err = fp.Abs(s.SettingsDir); err != nil {
+		return errors.Wrap(err, "failed to Abs settings directory")
+	}
+
+	if s.ManifestPath == "" {
+		s.ManifestPath = fp.Join(fp.Dir(s.SettingsDir), ManifestFileName)
+	} else if s.ManifestPath, err = fp.Abs(s.ManifestPath); err != nil {
+		return errors.Wrap(err, "failed to Abs manifest path")
+	}
+
+	if s.StateDir == "" {
+		if s.StateDir, err = StateDir(); err != nil {
+			return err
+		}
+	}
+
+	var moves []initMove
+	if moves, err = planInit(s); err != nil {
+		return err
+	}
+
+	if err = s.fsys().MkdirAll(s.SettingsDir, settingsDirPerms); err != nil {
+		return errors.Wrapf(err, "failed to create settings directory %#v", s.SettingsDir)
+	}
+
+	// group the sources by the directory they came from
+	byDest := make(map[string][]string)
+
+	for i, m := range moves {
+		if _, err = ppath.NewPosixPathFs(s.fsys(), m.from).Rename(m.to); err != nil {
+			undoMoves(s.fsys(), moves[:i])
+			return errors.Wrapf(err, "failed to move %#v to %#v", m.from, m.to)
+		}
+		log.Infof("moved %s to %s", m.from, m.to)
+
+		dest := fp.Dir(m.from)
+		byDest[dest] = append(byDest[dest], m.to)
+	}
+
+	dests := make([]string, 0, len(byDest))
+	for d := range byDest {
+		dests = append(dests, d)
+	}
+	sort.Strings(dests)
+
+	// all of the links are made in one run, so if any fails, none are left,
+	// and everything can be moved back where it was
+	runs := make([]*Settings, len(dests))
+	for i, d := range dests {
+		runs[i] = &Settings{
+			Prefix: s.Prefix, OnConflict: s.OnConflict, SourcePaths: byDest[d], DestPath: d, StateDir: s.StateDir,
+			Fs: s.Fs,
+		}
+	}
+	if err = RunAll(runs); err != nil {
+		undoMoves(s.fsys(), moves)
+		return errors.WithMessage(err, "failed to link files back into place, moved them back")
+	}
+
+	return writeInitManifest(s, dests, byDest)
+}
+
+func writeInitManifest(s *InitSettings, dests []string, byDest map[string][]string) (err error) {
+	manifestDir := fp.Dir(s.ManifestPath)
+
+	m := &Manifest{}
+	if _, err = s.fsys().Stat(s.ManifestPath); err == nil {
+		if m, err = readManifest(s.fsys(), s.ManifestPath); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range dests {
+		g := ManifestGroup{Name: fp.Base(s.SettingsDir), Dest: tildify(d), Prefix: s.Prefix}
+
+		for _, src := range byDest[d] {
+			rel, err := fp.Rel(manifestDir, src)
+			if err != nil {
+				return errors.Wrapf(err, "failed to relativize %#v", src)
+			}
+			g.Sources = append(g.Sources, fp.ToSlash(rel))
+		}
+
+		m.AddGroup(g)
+	}
+
+	if err = m.write(s.fsys(), s.ManifestPath); err != nil {
+		return err
+	}
+
+	log.Infof("wrote manifest %s", s.ManifestPath)
+	return nil
+}
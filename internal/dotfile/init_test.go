@@ -0,0 +1,131 @@
+package dotfile
+
+import (
+	"io/ioutil"
+	"os"
+	fp "path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type InitSuite struct {
+	RequireSuite
+	home string
+}
+
+func TestInit(t *testing.T) {
+	s := new(InitSuite)
+	s.AddBeforeHook(func(a, b string) {
+		var err error
+		s.home, err = ioutil.TempDir("", "initsuite")
+		s.Require().NoError(err)
+		s.Require().NoError(os.Setenv("XDG_STATE_HOME", fp.Join(s.home, ".local", "state")))
+	})
+	s.AddAfterHook(func(a, b string) {
+		os.Unsetenv("XDG_STATE_HOME")
+		_ = os.RemoveAll(s.home)
+	})
+	suite.Run(t, s)
+}
+
+func (s *InitSuite) write(name, content string) string {
+	path := fp.Join(s.home, name)
+	s.Require().NoError(ioutil.WriteFile(path, []byte(content), 0o644))
+	return path
+}
+
+func (s *InitSuite) TestInit() {
+	r := s.Require()
+	bashrc := s.write(".bashrc", "echo bash")
+	vimrc := s.write(".vimrc", "set nocp")
+	settingsDir := fp.Join(s.home, ".settings", "dotfiles")
+
+	r.NoError(Init(&InitSettings{
+		Paths:       []string{bashrc, vimrc},
+		SettingsDir: settingsDir,
+		Prefix:      ".",
+		OnConflict:  Fail,
+	}))
+
+	for name, content := range map[string]string{"bashrc": "echo bash", "vimrc": "set nocp"} {
+		b, err := ioutil.ReadFile(fp.Join(settingsDir, name))
+		r.NoError(err)
+		r.Equal(content, string(b))
+
+		target, err := os.Readlink(fp.Join(s.home, "."+name))
+		r.NoError(err)
+		r.Equal(".settings/dotfiles/"+name, target)
+	}
+
+	m, err := ReadManifest(fp.Join(s.home, ".settings", ManifestFileName))
+	r.NoError(err)
+	r.Len(m.Groups, 1)
+	r.Equal("dotfiles", m.Groups[0].Name)
+	r.Equal(".", m.Groups[0].Prefix)
+	r.Equal([]string{"dotfiles/bashrc", "dotfiles/vimrc"}, m.Groups[0].Sources)
+	dest, err := m.Groups[0].DestPath()
+	r.NoError(err)
+	r.Equal(s.home, dest)
+
+	// a second init adds to the manifest
+	zshrc := s.write(".zshrc", "")
+	r.NoError(Init(&InitSettings{Paths: []string{zshrc}, SettingsDir: settingsDir, Prefix: "."}))
+	m, err = ReadManifest(fp.Join(s.home, ".settings", ManifestFileName))
+	r.NoError(err)
+	r.Equal([]string{"dotfiles", "dotfiles-2"}, m.GroupNames())
+}
+
+func (s *InitSuite) TestInitMovesBackWhenLinkingFails() {
+	r := s.Require()
+	bashrc := s.write(".bashrc", "echo bash")
+	r.NoError(os.MkdirAll(fp.Join(s.home, ".config"), 0o755))
+	gitconfig := s.write(".config/.gitconfig", "[user]")
+	settingsDir := fp.Join(s.home, ".settings", "dotfiles")
+
+	// the links are made, but can't be recorded, as the state is a directory
+	stateDir := fp.Join(s.home, "state")
+	r.NoError(os.MkdirAll(fp.Join(stateDir, StateFileName), 0o755))
+
+	err := Init(&InitSettings{
+		Paths:       []string{bashrc, gitconfig},
+		SettingsDir: settingsDir,
+		Prefix:      ".",
+		OnConflict:  Fail,
+		StateDir:    stateDir,
+	})
+	r.Error(err)
+	s.Contains(err.Error(), "moved them back")
+
+	for path, content := range map[string]string{bashrc: "echo bash", gitconfig: "[user]"} {
+		info, err := os.Lstat(path)
+		r.NoError(err)
+		s.True(info.Mode().IsRegular(), path)
+		b, err := ioutil.ReadFile(path)
+		r.NoError(err)
+		s.Equal(content, string(b))
+	}
+	entries, err := ioutil.ReadDir(settingsDir)
+	r.NoError(err)
+	s.Empty(entries)
+}
+
+func (s *InitSuite) TestInitRefusesBeforeMovingAnything() {
+	r := s.Require()
+	bashrc := s.write(".bashrc", "")
+	profile := s.write("profile", "")
+	settingsDir := fp.Join(s.home, "settings")
+
+	err := Init(&InitSettings{Paths: []string{bashrc, profile}, SettingsDir: settingsDir, Prefix: "."})
+	r.Error(err)
+	r.Contains(err.Error(), "does not start with the prefix")
+	r.FileExists(bashrc)
+	_, err = os.Stat(settingsDir)
+	r.True(os.IsNotExist(err))
+
+	r.NoError(os.Mkdir(settingsDir, 0o755))
+	s.write("settings/bashrc", "")
+	err = Init(&InitSettings{Paths: []string{bashrc}, SettingsDir: settingsDir, Prefix: "."})
+	r.Error(err)
+	r.Contains(err.Error(), "already exists in the settings directory")
+}
@@ -1,6 +1,7 @@
 package dotfile
 
 import (
+	"os"
 	fp "path/filepath"
 
 	"github.com/pkg/errors"
@@ -13,9 +14,38 @@ type (
 	ApplyFn func(ld LinkData) error
 
 	Installer struct {
+		fs         ppath.Fs
 		prefix     string
 		onConflict OnConflict
 		apply      ApplyFn
+		hooks      Hooks
+		runHook    HookRunner
+		gitCheck   GitCheck
+		keepGoing  bool
+		workers    int
+		atomic     bool
+		// where the links we make are recorded, not at all if empty
+		stateDir string
+		secrets  []SecretPolicy
+		fixPerms bool
+		// the identity encrypted sources are decrypted with, IdentityPath
+		// if empty
+		identity string
+		// symlinks in the way that point in here are replaced, see
+		// WithReplaceInto
+		replaceInto string
+	}
+
+	// linker creates the links for a run, it's shared by the workers
+	linker struct {
+		fs       ppath.Fs
+		conflict OnConflict
+		hooks    Hooks
+		runHook  HookRunner
+		dirLocks *dirLocks
+		atomic   bool
+		// symlinks into it are replaced, whatever conflict is
+		replaceInto string
 	}
 
 	// for testing, collects the LinkData Run calls us with
@@ -36,140 +66,407 @@ func newApplyCollector() *applyCollector {
 	return ac
 }
 
-// the real implementation that creates the links
-func runApply(ld LinkData, conflict OnConflict) (err error) {
+// how many times we look at a link path before giving up, when it keeps
+// changing under us
+const maxApplyAttempts = 5
+
+// the real implementation that creates the links, recording the changes
+// in j. the link hooks are only run if we actually change something on
+// the filesystem, and the post link hooks only once j is committed, so
+// they never see a link that gets rolled back
+func (l *linker) apply(ld LinkData, j *journal) (err error) {
+	fsys, conflict, hooks, runHook := l.fs, l.conflict, l.hooks, l.runHook
 	var fn func() error
+	changed := false
+
+	// called right before we modify the filesystem
+	beforeChange := func() error {
+		if changed {
+			return nil
+		}
+		changed = true
+		return hooks.PreLink(runHook, ld)
+	}
+
+	vpath := ppath.NewPosixPathFs(fsys, ld.Vpath)
+	lpath := ppath.NewPosixPathFs(fsys, ld.LinkPath)
+	attempts := 0
 
 	fn = func() error {
-		vpath := ppath.NewPosixPath(ld.Vpath)
-		lpath := ppath.NewPosixPath(ld.LinkPath)
+		// the link path is looked at once per attempt. something else may
+		// change it before we do, so it's looked at again right before it's
+		// moved out of the way, and creating the link fails if anything
+		// has appeared. either way, we start over.
+		if attempts++; attempts > maxApplyAttempts {
+			return errors.Errorf("link path %#v kept changing, giving up", ld.LinkPath)
+		}
 
-		ctx := log.WithFields(log.Fields{
-			"Vpath":    ld.Vpath,
-			"LinkPath": ld.LinkPath,
-			"LinkData": ld.LinkData,
-		})
+		snap, err := lpath.Snapshot()
+		if err != nil {
+			return errors.Wrapf(err, "failed to lstat link path %#v", ld.LinkPath)
+		}
 
-		conflictFn := func() error {
-			switch skip, err := conflict.Handle(lpath.String()); {
-			case err != nil:
+		state, err := classify(snap, vpath)
+		if err != nil {
+			return err
+		}
+
+		switch state {
+		case linkDone:
+			return nil
+
+		case linkMissing:
+			if err := beforeChange(); err != nil {
 				return err
-			case skip: // the handler wants us to ignore this path
-				return nil
-			default: // the handler (re)moved the lpath, so try again
+			}
+			switch err := lpath.SymlinkTo(ld.LinkData); {
+			case os.IsExist(err):
 				return fn()
+			case err != nil:
+				return errors.Wrapf(err, "failed to create link %#v", ld.LinkPath)
 			}
+			j.linked(ld.LinkPath)
+			return nil
 		}
 
-		// if the path doesn't exist or it's a symlink
-		if !lpath.Exists() || lpath.IsSymlink() {
-			// if the path isn't a symlink we can create it and return
-			if !lpath.IsSymlink() {
-				return lpath.SymlinkTo(ld.LinkData)
-			}
-
-			// the path is a symlink, so we have to figure out what to do
-			ctx.Debug("found symlink")
+		// a file, a directory, a symlink that goes somewhere else, or
+		// something stranger (eg. a fifo) which the handler may refuse
+		// to deal with
+		log.WithFields(log.Fields{
+			"LinkPath": ld.LinkPath,
+			"Mode":     snap.Info.Mode().String(),
+		}).Debug("found conflict")
 
-			// if the symlink points to the versioned file, we're done
-			if same, err := lpath.SameFile(vpath); err != nil || same {
+		if conflict.mutates() || l.replaces(snap) {
+			if err := beforeChange(); err != nil {
 				return err
 			}
+		}
 
-			// otherwise it's bad, and we delegate to the onConflict.handler
-			// to tell us what to do
-			return conflictFn()
-		} else if lpath.IsFile() || lpath.IsDir() {
-			return conflictFn()
-		} else {
-			ctx.Panic("could not handle conflict")
+		// links in the same directory may be handled concurrently,
+		// so only one at a time gets to move things out of the way
+		unlock := l.dirLocks.lock(lpath.Parent().String())
+		done, err := l.handleIfUnchanged(snap, ld, j)
+		unlock()
+
+		switch {
+		case err != nil:
+			return err
+		case done: // the handler wants us to ignore this path, or linked over it
+			return nil
+		default: // the handler (re)moved the lpath, or something else did, so try again
+			return fn()
 		}
+	}
 
-		return nil
+	if err = fn(); err != nil || !changed {
+		return err
 	}
 
-	return fn()
+	return j.onCommit(ld, func() error { return hooks.PostLink(runHook, ld) })
 }
 
+// NewInstaller returns an Installer that creates links on the real
+// filesystem, use WithFs to change that
 func NewInstaller(prefix string, onConflict OnConflict) *Installer {
-	var applyFn ApplyFn
-	applyFn = func(ld LinkData) error {
-		return runApply(ld, onConflict)
+	n := &Installer{
+		fs:         ppath.NewOsFs(),
+		prefix:     prefix,
+		onConflict: onConflict,
+		runHook:    ShellHookRunner,
+		workers:    1,
 	}
-	return &Installer{prefix, onConflict, applyFn}
+	return n
+}
+
+// WithFs sets the filesystem the receiver operates on, and returns it
+func (n *Installer) WithFs(fsys ppath.Fs) *Installer {
+	n.fs = fsys
+	return n
 }
 
-type conflictingNamePair struct {
-	a string
-	b string
+// WithHooks sets the hooks that will be run by the receiver, and returns it
+func (n *Installer) WithHooks(hooks Hooks) *Installer {
+	n.hooks = hooks
+	return n
 }
 
-func areLinkNamesUnique(srcPaths []string) *conflictingNamePair {
+// WithKeepGoing sets whether the receiver carries on after a link fails,
+// and returns it. The failures are returned together in a FailedLinksError.
+func (n *Installer) WithKeepGoing(keepGoing bool) *Installer {
+	n.keepGoing = keepGoing
+	return n
+}
+
+// WithWorkers sets how many links the receiver creates at once, and
+// returns it. Note that link hooks may then run concurrently.
+func (n *Installer) WithWorkers(workers int) *Installer {
+	n.workers = workers
+	return n
+}
+
+// WithAtomic sets whether the receiver replaces files and symlinks in
+// the way by renaming the new link over them, rather than moving them
+// first, so the link path never goes missing. It returns the receiver.
+func (n *Installer) WithAtomic(atomic bool) *Installer {
+	n.atomic = atomic
+	return n
+}
+
+// WithState sets the directory of the state the receiver records the
+// links it manages in, and returns it
+func (n *Installer) WithState(stateDir string) *Installer {
+	n.stateDir = stateDir
+	return n
+}
+
+// WithSecrets sets the permission policies for secrets the receiver checks
+// before linking, and whether it fixes what's too permissive. It returns
+// the receiver.
+func (n *Installer) WithSecrets(secrets []SecretPolicy, fixPerms bool) *Installer {
+	n.secrets = secrets
+	n.fixPerms = fixPerms
+	return n
+}
+
+// WithIdentity sets the path of the identity the receiver decrypts
+// encrypted sources with, and returns it
+func (n *Installer) WithIdentity(path string) *Installer {
+	n.identity = path
+	return n
+}
+
+// WithReplaceInto sets a directory, symlinks into which are replaced by
+// the new links as part of the run, rather than handled as conflicts. It
+// returns the receiver.
+func (n *Installer) WithReplaceInto(dir string) *Installer {
+	n.replaceInto = dir
+	return n
+}
+
+// WithGitCheck sets how the receiver validates that sources are
+// committed to git, and returns it
+func (n *Installer) WithGitCheck(check GitCheck) *Installer {
+	n.gitCheck = check
+	return n
+}
+
+func areLinkNamesUnique(srcPaths []string) *DuplicateNameError {
 	seen := make(map[string]string)
 
 	for _, sp := range srcPaths {
-		pp := ppath.NewPurePath(sp)
-		if prev, ok := seen[pp.Name()]; ok {
-			return &conflictingNamePair{a: prev, b: sp}
+		name := linkName(ppath.NewPurePath(sp).Name())
+		if prev, ok := seen[name]; ok {
+			return &DuplicateNameError{Name: name, First: prev, Second: sp}
 		} else {
-			seen[pp.Name()] = sp
+			seen[name] = sp
 		}
 	}
 	return nil
 }
 
-func destIsDir(dest string) error {
-	pp := ppath.NewPosixPath(dest)
+func destIsDir(fsys ppath.Fs, dest string) error {
+	pp := ppath.NewPosixPathFs(fsys, dest)
 
 	if !pp.Exists() {
-		return errors.Errorf("dest did not exist: %v", dest)
+		return errors.WithStack(&DestNotDirError{Path: dest, Missing: true})
 	}
 
 	if !pp.IsDir() {
-		return errors.Errorf("dest is not a directory: %v", dest)
+		return errors.WithStack(&DestNotDirError{Path: dest})
 	}
 
 	return nil
 }
 
-func (n *Installer) Run(sourcePaths []string, destPath string) (err error) {
+// fsys returns the filesystem to use, Installers built by hand
+// in tests may not have one set
+func (n *Installer) fsys() ppath.Fs {
+	if n.fs == nil {
+		return ppath.NewOsFs()
+	}
+	return n.fs
+}
+
+// linkData works out the links for sourcePaths in destPath, returning
+// them and the absolute destPath
+func (n *Installer) linkData(sourcePaths []string, destPath string) (linkData []LinkData, dst string, err error) {
 	var src []string
-	var dst string
 
-	if err = destIsDir(destPath); err != nil {
-		return err
+	if err = destIsDir(n.fsys(), destPath); err != nil {
+		return nil, "", err
 	}
 
 	if src, err = mkAbs(sourcePaths); err != nil {
-		return err
+		return nil, "", err
 	}
 
-	if cnp := areLinkNamesUnique(src); cnp != nil {
-		return errors.Errorf("duplicate names detected in input: %+v", *cnp)
+	if dup := areLinkNamesUnique(src); dup != nil {
+		return nil, "", errors.WithStack(dup)
 	}
 
 	if dst, err = fp.Abs(destPath); err != nil {
-		return errors.Wrapf(err, "failed to Abs(%#v)", destPath)
+		return nil, "", errors.Wrapf(err, "failed to Abs(%#v)", destPath)
 	}
 
-	var linkData []LinkData
 	if linkData, err = LinkDataForList(src, dst, n.prefix); err != nil {
+		return nil, "", err
+	}
+	return linkData, dst, nil
+}
+
+func (n *Installer) Run(sourcePaths []string, destPath string) error {
+	linkData, dst, err := n.linkData(sourcePaths, destPath)
+	if err != nil {
 		return err
 	}
+	return n.runLinks(linkData, dst)
+}
 
-	for _, ld := range linkData {
-		if err = n.apply(ld); err != nil {
-			return err
+// prepare checks the sources in linkData, and decrypts those that are
+// encrypted, returning the links to make
+func (n *Installer) prepare(linkData []LinkData) ([]LinkData, error) {
+	linkData, err := checkSources(linkData, n.gitCheck)
+	if err != nil {
+		return nil, err
+	}
+
+	linkData, err = n.decryptSources(linkData)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = n.checkSecrets(linkData); err != nil {
+		return nil, err
+	}
+	return linkData, nil
+}
+
+// applyLinks creates the links in linkData, recording the changes in done.
+// if we're keeping going, the links that failed are returned, otherwise
+// the first failure is, and the caller rolls back done.
+func (n *Installer) applyLinks(linkData []LinkData, done *journal) ([]LinkFailure, error) {
+	// the results are in the same order as linkData, however many workers
+	// there were. if we're keeping going, a failed link's own changes were
+	// already undone.
+	var failures []LinkFailure
+	results := n.applyAll(linkData)
+
+	for i, r := range results {
+		done.append(r.journal)
+
+		switch {
+		case r.err == nil:
+		case !n.keepGoing:
+			for _, rest := range results[i+1:] {
+				done.append(rest.journal)
+			}
+			return nil, r.err
+		default:
+			failures = append(failures, LinkFailure{LinkData: linkData[i], Err: r.err})
 		}
 	}
+	return failures, nil
+}
+
+// finish records the links in linkData that are in place, as part of the
+// run runID, once the run has been committed. already is from wereInPlace.
+func (n *Installer) finish(linkData []LinkData, already map[string]bool, runID string) error {
+	if n.stateDir == "" {
+		return nil
+	}
+	return n.record(linkData, already, runID)
+}
+
+// runLinks creates the links in linkData, whose LinkPaths are in dst
+func (n *Installer) runLinks(linkData []LinkData, dst string) (err error) {
+	if linkData, err = n.prepare(linkData); err != nil {
+		return err
+	}
+
+	already, err := n.wereInPlace(linkData)
+	if err != nil {
+		return err
+	}
 
+	if err = n.hooks.BeforeRun(n.runHook, dst, n.prefix); err != nil {
+		return err
+	}
+
+	// if a link fails, undo what this run has done so far
+	done := newJournal(n.fsys())
+	failures, err := n.applyLinks(linkData, done)
+	if err != nil {
+		return done.rollback(err)
+	}
+
+	// the links are in place once the run is committed, even if removing
+	// a backup or a post-link hook failed, so they're still recorded, and
+	// the run hooks still run
+	hookFailures, commitErr := done.commit()
+
+	if err = n.finish(linkData, already, newRunID()); err != nil {
+		return err
+	}
+
+	if err = n.hooks.AfterRun(n.runHook, dst, n.prefix); err != nil {
+		return err
+	}
+
+	return runResult(n.keepGoing, failures, hookFailures, commitErr, len(linkData))
+}
+
+// runResult is the outcome of a committed run of total links: an error
+// committing it, or the links that failed. the post-link hooks that failed
+// are among the failures of a keep-going run, and stop any other.
+func runResult(keepGoing bool, failures, hookFailures []LinkFailure, commitErr error, total int) error {
+	if commitErr != nil {
+		return commitErr
+	}
+
+	if keepGoing {
+		failures = append(failures, hookFailures...)
+	} else if len(hookFailures) > 0 {
+		errs := make([]error, 0, len(hookFailures))
+		for _, f := range hookFailures {
+			errs = append(errs, f.Err)
+		}
+		return combine(errs)
+	}
+
+	if len(failures) > 0 {
+		return errors.WithStack(&FailedLinksError{Failures: failures, Total: total})
+	}
 	return nil
 }
 
 type RunFn func(s *Settings) error
 
+// installer returns an Installer for the settings, that records the
+// links it makes in stateDir
+func (s *Settings) installer(stateDir string) *Installer {
+	return NewInstaller(s.Prefix, s.OnConflict).
+		WithFs(s.fsys()).
+		WithState(stateDir).
+		WithHooks(s.Hooks).
+		WithGitCheck(s.GitCheck).
+		WithKeepGoing(s.KeepGoing).
+		WithWorkers(s.Workers).
+		WithAtomic(s.Atomic).
+		WithSecrets(s.Secrets, s.FixPerms).
+		WithIdentity(s.Identity).
+		WithReplaceInto(s.replaceInto)
+}
+
 func Run(s *Settings) error {
-	return NewInstaller(s.Prefix, s.OnConflict).Run(s.SourcePaths, s.DestPath)
+	stateDir, err := s.stateDir()
+	if err != nil {
+		return err
+	}
+
+	return s.locked(func() error {
+		return s.installer(stateDir).Run(s.SourcePaths, s.DestPath)
+	})
 }
 
 var _ RunFn = Run
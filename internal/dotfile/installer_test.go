@@ -2,9 +2,13 @@ package dotfile
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 	"sort"
+	str "strings"
 	"testing"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/suite"
 
 	fsf "github.com/slyphon/dfi/internal/fsfixture"
@@ -154,3 +158,149 @@ func (s *InstallerSuite) TestInstallerBinFiles() {
 		s.Equal(expectNames[i], pp.Name())
 	}
 }
+
+func (s *InstallerSuite) TestLinkHooksOnlyRunOnChange() {
+	r := s.Require()
+	var ran []string
+
+	// link hooks are told the link path and run hooks the prefix, in
+	// whatever order their environments list them
+	runner := func(command string, env []string) error {
+		for _, e := range env {
+			if str.HasPrefix(e, EnvLinkPath+"=") || str.HasPrefix(e, EnvPrefix+"=") {
+				ran = append(ran, command+" "+e)
+			}
+		}
+		return nil
+	}
+
+	hooks := Hooks{
+		PreRun:  []string{"pre-run"},
+		PostRun: []string{"post-run"},
+		Link: []LinkHook{
+			{Match: "**/.vimrc", Pre: []string{"pre-vim"}, Post: []string{"post-vim"}},
+		},
+	}
+
+	i := NewInstaller(".", ConflictHandlers.Replace).WithHooks(hooks)
+	i.runHook = runner
+
+	home := s.fsFix.HomeDir
+	vimrc := home.Join(".vimrc").String()
+
+	r.NoError(i.Run(pl.PosixSliceStringer(s.fsFix.Dotfiles), home.String()))
+	r.Equal(
+		[]string{
+			"pre-run " + EnvPrefix + "=.",
+			"pre-vim " + EnvLinkPath + "=" + vimrc,
+			"post-vim " + EnvLinkPath + "=" + vimrc,
+			"post-run " + EnvPrefix + "=.",
+		},
+		ran,
+	)
+
+	// everything is already linked, so only the run hooks fire
+	ran = nil
+	r.NoError(i.Run(pl.PosixSliceStringer(s.fsFix.Dotfiles), home.String()))
+	r.Equal([]string{"pre-run " + EnvPrefix + "=.", "post-run " + EnvPrefix + "=."}, ran)
+}
+
+func (s *InstallerSuite) TestLinkHookFailureIsAnError() {
+	i := NewInstaller(".", ConflictHandlers.Replace).
+		WithHooks(Hooks{Link: []LinkHook{{Post: []string{"exit 3"}}}})
+
+	err := i.Run(pl.PosixSliceStringer(s.fsFix.Dotfiles), s.fsFix.HomeDir.String())
+	s.Error(err)
+	s.Contains(err.Error(), `hook "exit 3" failed`)
+}
+
+func (s *InstallerSuite) TestPostLinkHooksWaitForCommit() {
+	r := s.Require()
+	var ran []string
+
+	i := NewInstaller(".", ConflictHandlers.Fail).
+		WithHooks(Hooks{Link: []LinkHook{{Post: []string{"post"}}}})
+	i.runHook = func(command string, env []string) error {
+		ran = append(ran, command)
+		return nil
+	}
+
+	// the last link fails, so the ones before it are rolled back, and
+	// their post link hooks never run
+	dotfiles := s.fsFix.Dotfiles
+	last := s.fsFix.HomeDir.Join("." + dotfiles[len(dotfiles)-1].Name()).String()
+	r.NoError(ioutil.WriteFile(last, []byte("in the way"), 0o644))
+
+	s.Error(i.Run(pl.PosixSliceStringer(dotfiles), s.fsFix.HomeDir.String()))
+	s.Empty(ran)
+	s.False(s.fsFix.HomeDir.Join("." + dotfiles[0].Name()).Lexists())
+
+	r.NoError(os.Remove(last))
+	r.NoError(i.Run(pl.PosixSliceStringer(dotfiles), s.fsFix.HomeDir.String()))
+	s.Len(ran, len(dotfiles))
+}
+
+func (s *InstallerSuite) TestFailedPostLinkHooksStillRecordLinks() {
+	r := s.Require()
+	stateDir := s.fsFix.TempDir.Join("state").String()
+	home := s.fsFix.HomeDir
+	bashrc, vimrc := home.Join(".bashrc").String(), home.Join(".vimrc").String()
+
+	var afterRun int
+	installer := func() *Installer {
+		i := NewInstaller(".", ConflictHandlers.Replace).
+			WithState(stateDir).
+			WithHooks(Hooks{
+				PostRun: []string{"post-run"},
+				Link:    []LinkHook{{Match: "**/.bashrc", Post: []string{"exit 3"}}},
+			})
+		i.runHook = func(command string, env []string) error {
+			if command == "post-run" {
+				afterRun++
+				return nil
+			}
+			return fmt.Errorf("hook %#v failed", command)
+		}
+		return i
+	}
+
+	// the links are in place by the time the hook fails, so they're
+	// recorded, and the post-run hook still runs
+	err := installer().Run(pl.PosixSliceStringer(s.fsFix.Dotfiles), home.String())
+	r.Error(err)
+	s.Contains(err.Error(), `hook "exit 3" failed`)
+	s.Equal(1, afterRun)
+
+	st, err := ReadState(pl.NewOsFs(), stateDir)
+	r.NoError(err)
+	s.Contains(st.Links, bashrc)
+	s.Contains(st.Links, vimrc)
+
+	// a keep-going run reports the hook among its failures
+	r.NoError(home.Join(".bashrc").Remove())
+	err = installer().WithKeepGoing(true).Run(pl.PosixSliceStringer(s.fsFix.Dotfiles), home.String())
+	var failed *FailedLinksError
+	r.True(errors.As(err, &failed), "%+v", err)
+	r.Len(failed.Failures, 1)
+	s.Equal(bashrc, failed.Failures[0].LinkPath)
+	s.True(home.Join(".bashrc").IsSymlink())
+	s.Equal(2, afterRun)
+}
+
+func (s *InstallerSuite) TestGitCheck() {
+	// the fixture lives in a temp dir, not a git repository
+	src := pl.PosixSliceStringer(s.fsFix.Binfiles)
+
+	err := NewInstaller("", ConflictHandlers.Fail).
+		WithGitCheck(GitCheckFail).
+		Run(src, s.fsFix.LocalBinDir.String())
+	s.Error(err)
+	s.Contains(err.Error(), "is not in a git repository")
+	s.False(s.fsFix.LocalBinDir.Join("cat").Lexists(), "nothing should have been linked")
+
+	err = NewInstaller("", ConflictHandlers.Fail).
+		WithGitCheck(GitCheckWarn).
+		Run(src, s.fsFix.LocalBinDir.String())
+	s.NoError(err)
+	s.True(s.fsFix.LocalBinDir.Join("cat").IsSymlink())
+}
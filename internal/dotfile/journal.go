@@ -0,0 +1,173 @@
+package dotfile
+
+import (
+	str "strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	ppath "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+type (
+	// journal records the changes a run makes to the filesystem, so if
+	// a link fails the changes can be undone, leaving things the way they
+	// were before the run. a nil journal records nothing.
+	journal struct {
+		fs      ppath.Fs
+		changes []change
+		// afterCommit is run once the changes are committed, in order
+		afterCommit []queued
+	}
+
+	// queued is something to do for a link once the run is committed
+	queued struct {
+		ld LinkData
+		fn func() error
+	}
+
+	change struct {
+		desc string
+		undo func() error
+		// done is called once the run has succeeded
+		done func() error
+	}
+)
+
+func newJournal(fsys ppath.Fs) *journal {
+	return &journal{fs: fsys}
+}
+
+// linked records that we created the symlink at path
+func (j *journal) linked(path string) {
+	if j == nil {
+		return
+	}
+	j.changes = append(j.changes, change{
+		desc: "link " + path,
+		undo: func() error { return j.fs.Remove(path) },
+	})
+}
+
+// movedAside records that path was renamed to bak. if keep is false
+// bak is removed once the run succeeds.
+func (j *journal) movedAside(path, bak string, keep bool) {
+	j.backedUp("move "+path+" to "+bak, path, bak, keep)
+}
+
+// replaced records that path was backed up to bak, and a link was put in
+// its place. if keep is false bak is removed once the run succeeds.
+func (j *journal) replaced(path, bak string, keep bool) {
+	j.backedUp("replace "+path+", backed up to "+bak, path, bak, keep)
+}
+
+// backedUp records a change that can be undone by renaming bak to path
+func (j *journal) backedUp(desc, path, bak string, keep bool) {
+	if j == nil {
+		return
+	}
+	c := change{
+		desc: desc,
+		undo: func() error { return j.fs.Rename(bak, path) },
+	}
+	if !keep {
+		c.done = func() error {
+			return errors.Wrapf(j.fs.Remove(bak), "failed to remove replaced path %#v", bak)
+		}
+	}
+	j.changes = append(j.changes, c)
+}
+
+// onCommit queues fn to be run for ld once the changes are committed, eg.
+// a hook that shouldn't see a link the run might still roll back. with a
+// nil journal, fn is run straight away.
+func (j *journal) onCommit(ld LinkData, fn func() error) error {
+	if j == nil {
+		return fn()
+	}
+	j.afterCommit = append(j.afterCommit, queued{ld: ld, fn: fn})
+	return nil
+}
+
+// commit finishes the changes, after which they can't be rolled back, and
+// then runs everything that was queued with onCommit, even if something
+// fails. the links whose queued functions failed are returned, along with
+// the combined errors from finishing the changes.
+func (j *journal) commit() (failed []LinkFailure, err error) {
+	if j == nil {
+		return nil, nil
+	}
+	defer func() { j.changes, j.afterCommit = nil, nil }()
+
+	var errs []error
+	for _, c := range j.changes {
+		if c.done == nil {
+			continue
+		}
+		if err := c.done(); err != nil {
+			log.WithFields(log.Fields{"change": c.desc, "err": err.Error()}).Error("failed to finish")
+			errs = append(errs, err)
+		}
+	}
+
+	for _, q := range j.afterCommit {
+		if err := q.fn(); err != nil {
+			failed = append(failed, LinkFailure{LinkData: q.ld, Err: err})
+		}
+	}
+	return failed, combine(errs)
+}
+
+// append adds the changes recorded in other to the receiver
+func (j *journal) append(other *journal) {
+	if j == nil || other == nil {
+		return
+	}
+	j.changes = append(j.changes, other.changes...)
+	j.afterCommit = append(j.afterCommit, other.afterCommit...)
+}
+
+// rollback undoes the changes in reverse order because cause stopped
+// the run, and returns cause with a note of what was, or wasn't, undone
+func (j *journal) rollback(cause error) error {
+	if j == nil {
+		return cause
+	}
+	// nothing that was queued happened, as far as anyone else can tell
+	j.afterCommit = nil
+	if len(j.changes) == 0 {
+		return cause
+	}
+	defer func() { j.changes = nil }()
+
+	var failed []string
+	for i := len(j.changes) - 1; i >= 0; i-- {
+		c := j.changes[i]
+		if err := c.undo(); err != nil {
+			log.WithFields(log.Fields{"change": c.desc, "err": err.Error()}).Error("failed to roll back")
+			failed = append(failed, c.desc+": "+err.Error())
+		}
+	}
+
+	if len(failed) > 0 {
+		return errors.WithMessagef(cause,
+			"failed to roll back %d of %d change(s) (%s)", len(failed), len(j.changes), str.Join(failed, "; "))
+	}
+	return errors.WithMessagef(cause, "rolled back %d change(s)", len(j.changes))
+}
+
+// combine returns errs as one error, the first with a note of the rest
+func combine(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+
+	rest := make([]string, 0, len(errs)-1)
+	for _, err := range errs[1:] {
+		rest = append(rest, err.Error())
+	}
+	return errors.WithMessagef(errs[0], "%d more error(s) (%s)", len(rest), str.Join(rest, "; "))
+}
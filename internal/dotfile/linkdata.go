@@ -6,6 +6,8 @@ import (
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+
+	ppath "github.com/slyphon/dfi/pkg/pathlib"
 )
 
 const SLASH uint8 = 0x2f
@@ -33,6 +35,23 @@ type LinkData struct {
 
 	// LinkData is the contents of the symlink
 	LinkData string
+
+	// Source is the encrypted source Vpath is the decrypted copy of, if
+	// it's one
+	Source string
+
+	// Commit is the commit of the git repository the source is in, if
+	// it was checked, see checkSources
+	Commit string
+}
+
+// source returns the path of the source in the settings, which is Source
+// for a decrypted copy and Vpath otherwise
+func (d LinkData) source() string {
+	if d.Source != "" {
+		return d.Source
+	}
+	return d.Vpath
 }
 
 func (d LinkData) mapPaths(fn func(path string) (string, error), skipLinkData bool) (rv *LinkData, err error) {
@@ -80,7 +99,7 @@ func LinkDataForList(vpaths []string, targetDir string, prefix string) (data []L
 }
 
 func LinkDataFor(vpath string, targetDir string, prefix string) (LinkData, error) {
-	linkPath := fp.Join(targetDir, prefix+fp.Base(vpath))
+	linkPath := ppath.NewPurePath(targetDir).Join(prefix + ppath.NewPurePath(vpath).Name()).String()
 
 	common := FindCommonRoot(vpath, linkPath)
 	// we found a common root, now relativize the link data to point at the
@@ -100,7 +119,7 @@ func LinkDataFor(vpath string, targetDir string, prefix string) (LinkData, error
 			return emptyLinkData, errors.WithStack(err)
 		}
 
-		vpRel, err := fp.Rel(common, vpath)
+		vpRel, err := ppath.NewPurePath(vpath).RelativeTo(common)
 		if err != nil {
 			ctx.Error("failed to relativize common with vpath")
 			return emptyLinkData, errors.WithStack(err)
@@ -109,7 +128,7 @@ func LinkDataFor(vpath string, targetDir string, prefix string) (LinkData, error
 		return LinkData{
 			Vpath:    vpath,
 			LinkPath: linkPath,
-			LinkData: fp.Join(rel, vpRel),
+			LinkData: ppath.NewPurePath(rel).Join(vpRel.String()).String(),
 		}, nil
 	}
 
@@ -0,0 +1,85 @@
+package dotfile
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	ppath "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+// linkState is what we found at a link path
+type linkState int
+
+const (
+	// nothing is there, the link can be created
+	linkMissing linkState = iota
+	// there's a symlink to the versioned file already
+	linkDone
+	// anything else, including a dangling symlink, is for the
+	// OnConflict handler to deal with
+	linkConflict
+)
+
+// classify decides what to do about the link path in snap. The versioned
+// file is only stat'ed if the link path is a symlink that leads somewhere.
+func classify(snap *ppath.Snapshot, vpath ppath.PosixPath) (linkState, error) {
+	switch {
+	case !snap.Lexists():
+		return linkMissing, nil
+	case !snap.IsSymlink():
+		return linkConflict, nil
+	case snap.IsDangling():
+		if os.IsNotExist(snap.TargetErr) {
+			return linkConflict, nil
+		}
+		return linkConflict, snap.TargetErr
+	}
+
+	vinfo, err := vpath.Stat()
+	switch {
+	case os.IsNotExist(err):
+		return linkConflict, nil
+	case err != nil:
+		return linkConflict, err
+	case snap.SameFile(vinfo):
+		return linkDone, nil
+	}
+	return linkConflict, nil
+}
+
+// replaces returns true if snap is a symlink into l.replaceInto, which is
+// switched over to the new link whatever the OnConflict strategy is
+func (l *linker) replaces(snap *ppath.Snapshot) bool {
+	if l.replaceInto == "" || !snap.IsSymlink() {
+		return false
+	}
+	data, err := snap.Path.Readlink()
+	if err != nil {
+		return false
+	}
+	return isUnder(linkTarget(snap.Path.String(), data.String()), l.replaceInto)
+}
+
+// handleIfUnchanged has the handler deal with the conflict at snap.Path,
+// unless it's changed since the snapshot was taken, and we have to look
+// at it again. in atomic mode, a file or symlink is replaced by the link
+// in one step, and done is true, as is a symlink into l.replaceInto.
+func (l *linker) handleIfUnchanged(snap *ppath.Snapshot, ld LinkData, j *journal) (done bool, err error) {
+	switch moved, err := snap.Changed(); {
+	case err != nil:
+		return false, errors.Wrapf(err, "failed to lstat link path %#v", snap.Path.String())
+	case moved:
+		return false, nil
+	}
+
+	switch {
+	case l.replaces(snap):
+		log.WithFields(log.Fields{"LinkPath": ld.LinkPath, "to": ld.LinkData}).Info("switching link")
+		return true, Replace.linkOver(l.fs, snap.Path.String(), ld.LinkData, j)
+	case l.atomic && l.conflict.atomic(snap.Info.Mode()):
+		return true, l.conflict.linkOver(l.fs, snap.Path.String(), ld.LinkData, j)
+	}
+	return l.conflict.handle(l.fs, snap.Path.String(), j)
+}
@@ -0,0 +1,211 @@
+package dotfile
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	pl "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+// statFs counts the Stat and Lstat calls made on each path, and can call
+// a function before one of them to simulate something else changing
+// the filesystem at the wrong moment
+type statFs struct {
+	pl.Fs
+	mu        sync.Mutex
+	stats     map[string]int
+	lstats    map[string]int
+	onLstat   func(name string, n int)
+	onSymlink func(name string)
+}
+
+func newStatFs(fsys pl.Fs) *statFs {
+	return &statFs{Fs: fsys, stats: map[string]int{}, lstats: map[string]int{}}
+}
+
+func (c *statFs) Stat(name string) (os.FileInfo, error) {
+	c.mu.Lock()
+	c.stats[name]++
+	c.mu.Unlock()
+	return c.Fs.Stat(name)
+}
+
+func (c *statFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	c.mu.Lock()
+	c.lstats[name]++
+	n := c.lstats[name]
+	c.mu.Unlock()
+
+	if c.onLstat != nil {
+		c.onLstat(name, n)
+	}
+	return c.Fs.LstatIfPossible(name)
+}
+
+func (c *statFs) Symlink(old, new string) error {
+	if c.onSymlink != nil {
+		c.onSymlink(new)
+	}
+	return c.Fs.Symlink(old, new)
+}
+
+func (s *InstallerSuite) TestLinkPathIsStatedOnce() {
+	mfs := newMemHome(s.Require())
+	s.NoError(mfs.Remove("/home/user/.bashrc"))
+	sfs := newStatFs(mfs)
+
+	s.NoError(NewInstaller(".", ConflictHandlers.Warn).WithFs(sfs).Run(memSources, "/home/user"))
+
+	// missing: one lstat, then the link is created
+	s.Equal(1, sfs.lstats["/home/user/.bashrc"])
+	s.Equal(0, sfs.stats["/home/user/.bashrc"])
+	// already linked: an lstat, then a stat to see where it leads
+	s.Equal(1, sfs.lstats["/home/user/.zshrc"])
+	s.Equal(1, sfs.stats["/home/user/.zshrc"])
+	// dangling: the same, and one more lstat right before the conflict is handled
+	s.Equal(2, sfs.lstats["/home/user/.vimrc"])
+	s.Equal(1, sfs.stats["/home/user/.vimrc"])
+}
+
+func (s *InstallerSuite) TestLinkPathChangesBeforeConflictIsHandled() {
+	mfs := newMemHome(s.Require())
+	sfs := newStatFs(mfs)
+
+	// between the snapshot and handling the conflict, someone else fixes
+	// .bashrc, so there's nothing left to back up
+	sfs.onLstat = func(name string, n int) {
+		if name == "/home/user/.bashrc" && n == 2 {
+			s.NoError(mfs.Remove(name))
+			s.NoError(mfs.Symlink(".settings/dotfiles/bashrc", name))
+		}
+	}
+
+	s.NoError(NewInstaller(".", ConflictHandlers.Rename).WithFs(sfs).Run(memSources, "/home/user"))
+	backups, err := mfs.Glob("/home/user/.bashrc.dfi_*")
+	s.NoError(err)
+	s.Empty(backups)
+	s.Equal(3, sfs.lstats["/home/user/.bashrc"])
+}
+
+func (s *InstallerSuite) TestLinkPathAppearsBeforeLinkIsCreated() {
+	mfs := newMemHome(s.Require())
+	s.NoError(mfs.Remove("/home/user/.bashrc"))
+	sfs := newStatFs(mfs)
+
+	// .bashrc is missing when we look, and there when we try to link it
+	appeared := false
+	sfs.onSymlink = func(name string) {
+		if name == "/home/user/.bashrc" && !appeared {
+			appeared = true
+			pl.NewPosixPathFs(mfs, name).Must().Touch(0o644, false)
+		}
+	}
+
+	s.NoError(NewInstaller(".", ConflictHandlers.Rename).WithFs(sfs).Run(memSources, "/home/user"))
+	target, err := mfs.Readlink("/home/user/.bashrc")
+	s.NoError(err)
+	s.Equal(".settings/dotfiles/bashrc", target)
+
+	backups, err := mfs.Glob("/home/user/.bashrc.dfi_*")
+	s.NoError(err)
+	s.Len(backups, 1)
+}
+
+func (s *InstallerSuite) TestLinkPathKeepsChanging() {
+	mfs := newMemHome(s.Require())
+	sfs := newStatFs(mfs)
+
+	// .bashrc is replaced before every check
+	sfs.onLstat = func(name string, n int) {
+		if name == "/home/user/.bashrc" && n%2 == 0 {
+			s.NoError(mfs.Remove(name))
+			pl.NewPosixPathFs(mfs, name).Must().Touch(0o644, false)
+		}
+	}
+
+	err := NewInstaller(".", ConflictHandlers.Rename).WithFs(sfs).Run(memSources, "/home/user")
+	s.Error(err)
+	s.Contains(err.Error(), "link path \"/home/user/.bashrc\" kept changing")
+	s.Equal(2*maxApplyAttempts, sfs.lstats["/home/user/.bashrc"])
+	requireUntouched(s.Require(), mfs)
+}
+
+func TestClassify(t *testing.T) {
+	mfs := newMemHome(require.New(t))
+	vpath := pl.NewPosixPathFs(mfs, "/home/user/.settings/dotfiles/zshrc")
+
+	for path, want := range map[string]linkState{
+		"/home/user/.missing": linkMissing,
+		"/home/user/.bashrc":  linkConflict,
+		"/home/user/.vimrc":   linkConflict,
+		"/home/user/.zshrc":   linkDone,
+		"/home/user":          linkConflict,
+	} {
+		snap, err := pl.NewPosixPathFs(mfs, path).Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := classify(snap, vpath); err != nil || got != want {
+			t.Errorf("classify(%#v) = %v, %v, want %v", path, got, err, want)
+		}
+	}
+
+	// a symlink that can't be followed for some other reason is an error
+	snap := &pl.Snapshot{
+		Path:      pl.NewPosixPathFs(mfs, "/home/user/.vimrc"),
+		TargetErr: &os.PathError{Op: "stat", Path: "/home/user/.vimrc", Err: os.ErrPermission},
+	}
+	snap.Info, _ = snap.Path.Lstat()
+	if _, err := classify(snap, vpath); !os.IsPermission(errors.Cause(err)) {
+		t.Errorf("classify of an unreadable link returned %v", err)
+	}
+}
+
+// BenchmarkClassify looks at a link that's already correct, the
+// common case when dfi is run again
+func BenchmarkClassify(b *testing.B) {
+	fsFix := newBenchFixture(b, 1)
+	defer fsFix.Cleanup()
+
+	lpath := fsFix.LocalBinDir.Join("bench000")
+	vpath := fsFix.Binfiles[0]
+	if err := lpath.SymlinkTo(vpath.String()); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		snap, err := lpath.Snapshot()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if state, err := classify(snap, vpath); err != nil || state != linkDone {
+			b.Fatal(state, err)
+		}
+	}
+}
+
+// BenchmarkRerun runs the installer over links that are already correct
+func BenchmarkRerun(b *testing.B) {
+	fsFix := newBenchFixture(b, 200)
+	defer fsFix.Cleanup()
+
+	sources := pl.PosixSliceStringer(fsFix.Binfiles)
+	fsFix.LocalBinDir.Must().RemoveAll()
+	fsFix.LocalBinDir.Must().MkdirAll(0o755)
+	install := func() {
+		if err := NewInstaller("", ConflictHandlers.Fail).Run(sources, fsFix.LocalBinDir.String()); err != nil {
+			b.Fatal(err)
+		}
+	}
+	install()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		install()
+	}
+}
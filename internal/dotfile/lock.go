@@ -0,0 +1,176 @@
+package dotfile
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	fp "path/filepath"
+	"strconv"
+	str "strings"
+	"syscall"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+
+	ppath "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+const (
+	// DefaultLockTimeout is how long a run waits for another run on the
+	// same destination to finish
+	DefaultLockTimeout = 10 * time.Second
+
+	// how often we try the lock while we wait
+	lockPollInterval = 50 * time.Millisecond
+)
+
+// runLock is an advisory lock on a destination directory, so overlapping
+// runs (eg. a login script and 'dfi watch') take turns instead of racing
+// to back up the same files
+type runLock struct {
+	f    afero.File
+	dest string
+}
+
+// StateDir returns $XDG_STATE_HOME/dfi, falling back to ~/.local/state/dfi
+func StateDir() (string, error) {
+	if xdg := os.Getenv("XDG_STATE_HOME"); xdg != "" {
+		return fp.Join(xdg, "dfi"), nil
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to find the home directory")
+	}
+	return fp.Join(home, ".local", "state", "dfi"), nil
+}
+
+// lockPath returns the path of the lock file for dest in stateDir. the
+// name is a hash of dest, so it's the same however dest was spelled.
+func lockPath(fsys ppath.Fs, stateDir, dest string) (string, error) {
+	abs, err := fp.Abs(dest)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := ppath.NewPosixPathFs(fsys, abs).Resolve(); err == nil {
+		abs = resolved.String()
+	}
+	return fp.Join(stateDir, "locks", fmt.Sprintf("%x", sha1.Sum([]byte(abs)))[:16]+".lock"), nil
+}
+
+// lockDest takes the lock on dest, waiting up to timeout for whoever
+// holds it. the lock file is kept in stateDir, and holds the PID of
+// the holder so we can say who it is.
+func lockDest(fsys ppath.Fs, stateDir, dest string, timeout time.Duration) (*runLock, error) {
+	path, err := lockPath(fsys, stateDir, dest)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to find the lock file for %#v", dest)
+	}
+	return lockFile(fsys, path, dest, timeout)
+}
+
+// lockFile takes the lock on the file at path on fsys, which is created if
+// it doesn't exist. dest is what the lock protects, for the errors.
+func lockFile(fsys ppath.Fs, path, dest string, timeout time.Duration) (*runLock, error) {
+	if err := fsys.MkdirAll(fp.Dir(path), 0o700); err != nil {
+		return nil, errors.Wrapf(err, "failed to create lock dir for %#v", dest)
+	}
+
+	f, err := fsys.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open lock file %#v", path)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err = ppath.Flock(f, syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != syscall.EWOULDBLOCK || !time.Now().Before(deadline) {
+			break
+		}
+		log.WithFields(log.Fields{"dest": dest, "lock": path}).Debug("waiting for lock")
+		time.Sleep(lockPollInterval)
+	}
+
+	switch {
+	case err == syscall.EWOULDBLOCK:
+		pid := readLockPID(f)
+		f.Close()
+		return nil, errors.WithStack(&LockedError{Dest: dest, LockPath: path, PID: pid})
+	case err != nil:
+		f.Close()
+		return nil, errors.Wrapf(&os.PathError{Op: "flock", Path: path, Err: err}, "failed to lock %#v", dest)
+	}
+
+	if err = f.Truncate(0); err == nil {
+		_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"lock": path, "err": err.Error()}).Warn("failed to write our PID to the lock file")
+	}
+
+	return &runLock{f: f, dest: dest}, nil
+}
+
+// readLockPID returns the PID written in the lock file, or 0 if there isn't one
+func readLockPID(f afero.File) int {
+	data, err := ioutil.ReadAll(io.NewSectionReader(f, 0, 32))
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(str.TrimSpace(string(data)))
+	return pid
+}
+
+// unlock releases the lock. the file is left in place, removing it would
+// let a run that's waiting lock a file nobody else can see
+func (l *runLock) unlock() error {
+	if err := l.f.Truncate(0); err != nil {
+		log.WithFields(log.Fields{"lock": l.f.Name(), "err": err.Error()}).Warn("failed to clear the lock file")
+	}
+	if err := ppath.Flock(l.f, syscall.LOCK_UN); err != nil {
+		l.f.Close()
+		return errors.Wrapf(err, "failed to unlock %#v", l.dest)
+	}
+	return l.f.Close()
+}
+
+// stateDir returns s.StateDir, or the default
+func (s *Settings) stateDir() (string, error) {
+	if s.StateDir != "" {
+		return s.StateDir, nil
+	}
+	return StateDir()
+}
+
+// locked calls fn while holding the lock on s.DestPath, unless s.NoLock is set
+func (s *Settings) locked(fn func() error) (err error) {
+	if s.NoLock {
+		return fn()
+	}
+
+	stateDir, err := s.stateDir()
+	if err != nil {
+		return err
+	}
+
+	timeout := s.LockTimeout
+	if timeout == 0 {
+		timeout = DefaultLockTimeout
+	}
+
+	l, err := lockDest(s.fsys(), stateDir, s.DestPath, timeout)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := l.unlock(); err == nil {
+			err = e
+		}
+	}()
+
+	return fn()
+}
@@ -0,0 +1,72 @@
+package dotfile
+
+import (
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	pl "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+func (s *InstallerSuite) TestLockDest() {
+	r := s.Require()
+	stateDir := s.fsFix.TempDir.Join("state").String()
+	home := s.fsFix.HomeDir.String()
+
+	l, err := lockDest(pl.NewOsFs(), stateDir, home, time.Second)
+	r.NoError(err)
+
+	// the same dest, however it's spelled, can't be locked again
+	r.NoError(s.fsFix.TempDir.Join("homelink").SymlinkTo(home))
+	for _, dest := range []string{home, home + "/", s.fsFix.TempDir.Join("homelink").String()} {
+		_, err = lockDest(pl.NewOsFs(), stateDir, dest, 100*time.Millisecond)
+
+		var locked *LockedError
+		r.True(errors.As(err, &locked), dest)
+		s.Equal(dest, locked.Dest)
+		s.Equal(os.Getpid(), locked.PID)
+		s.Contains(err.Error(), "locked by another dfi run (pid ")
+	}
+
+	// but other dests can
+	other, err := lockDest(pl.NewOsFs(), stateDir, s.fsFix.LocalBinDir.String(), 0)
+	r.NoError(err)
+	r.NoError(other.unlock())
+
+	// a run that's waiting gets the lock when it's let go
+	go func(held *runLock) {
+		time.Sleep(100 * time.Millisecond)
+		s.NoError(held.unlock())
+	}(l)
+	l, err = lockDest(pl.NewOsFs(), stateDir, home, 5*time.Second)
+	r.NoError(err)
+	r.NoError(l.unlock())
+}
+
+func (s *InstallerSuite) TestRunIsLocked() {
+	r := s.Require()
+	settings := &Settings{
+		Prefix:      ".",
+		OnConflict:  Rename,
+		SourcePaths: pl.PosixSliceStringer(s.fsFix.Dotfiles),
+		DestPath:    s.fsFix.HomeDir.String(),
+		StateDir:    s.fsFix.TempDir.Join("state").String(),
+		LockTimeout: 100 * time.Millisecond,
+	}
+
+	l, err := lockDest(pl.NewOsFs(), settings.StateDir, settings.DestPath, 0)
+	r.NoError(err)
+
+	err = Run(settings)
+	var locked *LockedError
+	r.True(errors.As(err, &locked))
+	s.False(s.fsFix.HomeDir.Join(".bashrc").Lexists())
+
+	settings.NoLock = true
+	r.NoError(Run(settings))
+	s.True(s.fsFix.HomeDir.Join(".bashrc").IsSymlink())
+
+	r.NoError(l.unlock())
+	settings.NoLock = false
+	r.NoError(Run(settings))
+}
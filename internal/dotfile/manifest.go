@@ -0,0 +1,173 @@
+package dotfile
+
+import (
+	"os"
+	fp "path/filepath"
+	"strconv"
+	str "strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/pelletier/go-toml"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+
+	ppath "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+type (
+	// ManifestGroup is a set of sources that are linked into the same
+	// destination with the same prefix
+	ManifestGroup struct {
+		Name string `toml:"name"`
+
+		// Sources are relative to the directory containing the manifest
+		Sources []string `toml:"sources"`
+
+		// Dest may start with '~' to refer to the user's home directory
+		Dest   string `toml:"dest"`
+		Prefix string `toml:"prefix"`
+	}
+
+	// Manifest describes what is installed from a settings repository
+	Manifest struct {
+		Groups []ManifestGroup `toml:"group"`
+	}
+)
+
+const (
+	ManifestFileName = "dfi.toml"
+
+	manifestHeader = "# dfi manifest, describes which files in this directory are linked where\n"
+)
+
+func ReadManifest(path string) (*Manifest, error) {
+	return readManifest(ppath.NewOsFs(), path)
+}
+
+// readManifest reads the manifest at path on fsys
+func readManifest(fsys ppath.Fs, path string) (*Manifest, error) {
+	b, err := afero.ReadFile(fsys, path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read manifest %#v", path)
+	}
+	return parseManifest(b, path)
+}
+
+// parseManifest parses the manifest b, read from path
+func parseManifest(b []byte, path string) (*Manifest, error) {
+	m := &Manifest{}
+	if err := toml.Unmarshal(b, m); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse manifest %#v", path)
+	}
+	return m, nil
+}
+
+// encode returns the manifest as it's written to a file
+func (m *Manifest) encode() ([]byte, error) {
+	b, err := toml.Marshal(*m)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode manifest")
+	}
+	return append([]byte(manifestHeader), b...), nil
+}
+
+func (m *Manifest) Write(path string) error {
+	return m.write(ppath.NewOsFs(), path)
+}
+
+// write writes the manifest to path on fsys
+func (m *Manifest) write(fsys ppath.Fs, path string) error {
+	b, err := m.encode()
+	if err != nil {
+		return err
+	}
+	return errors.Wrapf(afero.WriteFile(fsys, path, b, 0o644), "failed to write manifest %#v", path)
+}
+
+// Group returns the group with the given name, or nil if there isn't one
+func (m *Manifest) Group(name string) *ManifestGroup {
+	for i := range m.Groups {
+		if m.Groups[i].Name == name {
+			return &m.Groups[i]
+		}
+	}
+	return nil
+}
+
+// GroupNames returns the names of all groups, in the order they appear
+func (m *Manifest) GroupNames() []string {
+	names := make([]string, len(m.Groups))
+	for i, g := range m.Groups {
+		names[i] = g.Name
+	}
+	return names
+}
+
+// Select returns a manifest with only the named groups, in the order they
+// appear in the receiver, or the receiver itself if names is empty. It's an
+// error if one of names isn't a group.
+func (m *Manifest) Select(names []string) (*Manifest, error) {
+	if len(names) == 0 {
+		return m, nil
+	}
+
+	want := map[string]bool{}
+	for _, name := range names {
+		if m.Group(name) == nil {
+			return nil, errors.Errorf("no group %#v in manifest, expected one of %s", name, str.Join(m.GroupNames(), ", "))
+		}
+		want[name] = true
+	}
+
+	sel := &Manifest{}
+	for _, g := range m.Groups {
+		if want[g.Name] {
+			sel.Groups = append(sel.Groups, g)
+		}
+	}
+	return sel, nil
+}
+
+// AddGroup appends g, renaming it with a numeric suffix if a group with
+// that name already exists
+func (m *Manifest) AddGroup(g ManifestGroup) {
+	name := g.Name
+	for i := 2; m.Group(g.Name) != nil; i++ {
+		g.Name = name + "-" + strconv.Itoa(i)
+	}
+	m.Groups = append(m.Groups, g)
+}
+
+// tildify replaces the user's home directory at the start of path with '~'
+func tildify(path string) string {
+	home, err := homedir.Dir()
+	if err != nil || home == "" {
+		return path
+	}
+
+	if path == home {
+		return "~"
+	} else if str.HasPrefix(path, home+string(os.PathSeparator)) {
+		return "~" + str.TrimPrefix(path, home)
+	}
+	return path
+}
+
+// SourcePaths returns the absolute source paths of the group, given the
+// directory the manifest is in
+func (g ManifestGroup) SourcePaths(manifestDir string) []string {
+	paths := make([]string, len(g.Sources))
+	for i, s := range g.Sources {
+		if fp.IsAbs(s) {
+			paths[i] = s
+		} else {
+			paths[i] = fp.Join(manifestDir, s)
+		}
+	}
+	return paths
+}
+
+// DestPath returns the group's Dest with '~' expanded
+func (g ManifestGroup) DestPath() (string, error) {
+	return homedir.Expand(g.Dest)
+}
@@ -0,0 +1,227 @@
+package dotfile
+
+import (
+	"os"
+	fp "path/filepath"
+	"sort"
+	str "strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+)
+
+type (
+	// Mapping is a set of sources to link into a dest, one of several
+	// made in one run by RunAll
+	Mapping struct {
+		// Sources is a glob of the sources
+		Sources string
+		Dest    string
+		// Prefix is only used if HasPrefix, otherwise the run's is
+		Prefix    string
+		HasPrefix bool
+	}
+
+	// RunAllFn links the sources of each of the settings into its dest,
+	// as one run
+	RunAllFn func(ss []*Settings) error
+
+	// batch is the links to make for one of the settings in a RunAll
+	batch struct {
+		n        *Installer
+		linkData []LinkData
+		dst      string
+		// the LinkPaths that were in place before the run
+		already map[string]bool
+	}
+)
+
+// ParseMapping parses a mapping of the form SRC_GLOB:DEST[:PREFIX]. A
+// leading '~' in the glob or dest is expanded.
+func ParseMapping(spec string) (m Mapping, err error) {
+	parts := str.SplitN(spec, ":", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return m, errors.Errorf("invalid mapping %#v, expected SRC_GLOB:DEST[:PREFIX]", spec)
+	}
+
+	if m.Sources, err = homedir.Expand(parts[0]); err != nil {
+		return m, errors.Wrapf(err, "failed to expand %#v", parts[0])
+	}
+	if m.Dest, err = homedir.Expand(parts[1]); err != nil {
+		return m, errors.Wrapf(err, "failed to expand %#v", parts[1])
+	}
+	if len(parts) == 3 {
+		m.Prefix, m.HasPrefix = parts[2], true
+	}
+	return m, nil
+}
+
+// Settings returns a copy of base with the mapping's sources, dest and
+// prefix. It's an error if the glob doesn't match anything.
+func (m Mapping) Settings(base *Settings) (*Settings, error) {
+	sources, err := fp.Glob(m.Sources)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid glob %#v", m.Sources)
+	}
+	if len(sources) == 0 {
+		return nil, errors.Errorf("no sources match %#v", m.Sources)
+	}
+
+	s := *base
+	s.SourcePaths, s.DestPath = sources, m.Dest
+	if m.HasPrefix {
+		s.Prefix = m.Prefix
+	}
+	return &s, nil
+}
+
+// uniqueLinkPaths checks that no two of the links in batches, which may
+// be for the same dest, have the same path
+func uniqueLinkPaths(batches []batch) error {
+	seen := map[string]string{}
+	for _, b := range batches {
+		for _, ld := range b.linkData {
+			lp := linkName(ld.LinkPath)
+			if prev, ok := seen[lp]; ok {
+				return errors.WithStack(&DuplicateNameError{Name: fp.Base(lp), First: prev, Second: ld.Vpath})
+			}
+			seen[lp] = ld.Vpath
+		}
+	}
+	return nil
+}
+
+// runDests returns the dests of batches for the run hooks, in order and
+// separated like $PATH
+func runDests(batches []batch) string {
+	seen := map[string]bool{}
+	var dsts []string
+	for _, b := range batches {
+		if !seen[b.dst] {
+			seen[b.dst] = true
+			dsts = append(dsts, b.dst)
+		}
+	}
+	return str.Join(dsts, string(os.PathListSeparator))
+}
+
+// runBatches creates the links in batches as one run: if a link fails,
+// everything that was done in all of them is undone, and the failures
+// of a keep-going run are reported together. the links are all recorded
+// with the same run ID, and the run hooks, which are the same for all of
+// the batches, are run once, with all of the dests and the first prefix.
+func runBatches(batches []batch) (err error) {
+	for i := range batches {
+		b := &batches[i]
+		if b.linkData, err = b.n.prepare(b.linkData); err != nil {
+			return err
+		}
+		if b.already, err = b.n.wereInPlace(b.linkData); err != nil {
+			return err
+		}
+	}
+
+	first, dests := batches[0].n, runDests(batches)
+	if err = first.hooks.BeforeRun(first.runHook, dests, first.prefix); err != nil {
+		return err
+	}
+
+	var failures []LinkFailure
+	total := 0
+	done := newJournal(first.fsys())
+
+	for _, b := range batches {
+		f, err := b.n.applyLinks(b.linkData, done)
+		if err != nil {
+			return done.rollback(err)
+		}
+		failures = append(failures, f...)
+		total += len(b.linkData)
+	}
+
+	// as in runLinks, the links are in place whatever commit returns
+	hookFailures, commitErr := done.commit()
+
+	runID := newRunID()
+	for _, b := range batches {
+		if err = b.n.finish(b.linkData, b.already, runID); err != nil {
+			return err
+		}
+	}
+
+	if err = first.hooks.AfterRun(first.runHook, dests, first.prefix); err != nil {
+		return err
+	}
+
+	return runResult(first.keepGoing, failures, hookFailures, commitErr, total)
+}
+
+// RunAll links the sources of each of ss into its dest, as one run. Link
+// paths have to be unique across all of them, the dests are all locked
+// for the length of the run, and if a link fails, nothing is left changed
+// in any of them. The run hooks of the first of ss are run once, for all
+// of them.
+func RunAll(ss []*Settings) error {
+	if len(ss) == 0 {
+		return nil
+	}
+
+	batches := make([]batch, len(ss))
+	for i, s := range ss {
+		stateDir, err := s.stateDir()
+		if err != nil {
+			return err
+		}
+
+		n := s.installer(stateDir)
+		linkData, dst, err := n.linkData(s.SourcePaths, s.DestPath)
+		if err != nil {
+			return err
+		}
+		batches[i] = batch{n: n, linkData: linkData, dst: dst}
+	}
+
+	if err := uniqueLinkPaths(batches); err != nil {
+		return err
+	}
+
+	return lockedAll(ss, func() error {
+		return runBatches(batches)
+	})
+}
+
+var _ RunAllFn = RunAll
+
+// lockedAll calls fn while holding the locks on the dests of all of ss,
+// see Settings.locked. they're taken in the order of their lock files, so
+// two runs can't each hold a lock the other is waiting for, and only once
+// for dests that are the same directory.
+func lockedAll(ss []*Settings, fn func() error) error {
+	byPath := map[string]*Settings{}
+	for _, s := range ss {
+		stateDir, err := s.stateDir()
+		if err != nil {
+			return err
+		}
+		path, err := lockPath(s.fsys(), stateDir, s.DestPath)
+		if err != nil {
+			return errors.Wrapf(err, "failed to find the lock file for %#v", s.DestPath)
+		}
+		byPath[path] = s
+	}
+
+	paths := make([]string, 0, len(byPath))
+	for path := range byPath {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var lockFrom func(i int) error
+	lockFrom = func(i int) error {
+		if i == len(paths) {
+			return fn()
+		}
+		return byPath[paths[i]].locked(func() error { return lockFrom(i + 1) })
+	}
+	return lockFrom(0)
+}
@@ -0,0 +1,124 @@
+package dotfile
+
+import (
+	"io/ioutil"
+	"os"
+	fp "path/filepath"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+
+	pl "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+func (s *InstallerSuite) TestParseMapping() {
+	home, err := homedir.Dir()
+	s.Require().NoError(err)
+
+	for spec, want := range map[string]Mapping{
+		"dotfiles/*:~:.":  {Sources: "dotfiles/*", Dest: home, Prefix: ".", HasPrefix: true},
+		"bin/*:/a/bin":    {Sources: "bin/*", Dest: "/a/bin"},
+		"~/bin/*:/a/bin:": {Sources: fp.Join(home, "bin/*"), Dest: "/a/bin", HasPrefix: true},
+		"etc/*:/a:x-:y":   {Sources: "etc/*", Dest: "/a", Prefix: "x-:y", HasPrefix: true},
+	} {
+		m, err := ParseMapping(spec)
+		s.NoError(err, spec)
+		s.Equal(want, m, spec)
+	}
+
+	for _, spec := range []string{"", "bin/*", ":/a", "bin/*:"} {
+		_, err := ParseMapping(spec)
+		s.Error(err, spec)
+	}
+}
+
+func (s *InstallerSuite) runAllSettings(onConflict OnConflict) []*Settings {
+	r := s.Require()
+	base := &Settings{Prefix: "-", OnConflict: onConflict, StateDir: s.fsFix.TempDir.Join("state").String()}
+
+	var ss []*Settings
+	for _, spec := range []string{
+		s.fsFix.DotfileDir.Join("*").String() + ":" + s.fsFix.HomeDir.String() + ":.",
+		s.fsFix.BinDir.Join("*").String() + ":" + s.fsFix.LocalBinDir.String(),
+	} {
+		m, err := ParseMapping(spec)
+		r.NoError(err)
+		st, err := m.Settings(base)
+		r.NoError(err)
+		ss = append(ss, st)
+	}
+	return ss
+}
+
+func (s *InstallerSuite) TestRunAll() {
+	r := s.Require()
+	ss := s.runAllSettings(Rename)
+	s.Equal(".", ss[0].Prefix)
+	s.Equal("-", ss[1].Prefix, "the run's prefix is used if the mapping has none")
+	ss[1].Prefix = ""
+
+	r.NoError(RunAll(ss))
+	for _, link := range []string{
+		s.fsFix.HomeDir.Join(".bashrc").String(),
+		s.fsFix.LocalBinDir.Join("cat").String(),
+	} {
+		info, err := os.Lstat(link)
+		r.NoError(err)
+		s.NotZero(info.Mode()&os.ModeSymlink, link)
+	}
+
+	st, err := ReadState(pl.NewOsFs(), ss[0].StateDir)
+	r.NoError(err)
+	s.Contains(st.Links, s.fsFix.LocalBinDir.Join("cat").String())
+
+	// two mappings can't make the same link
+	r.NoError(ioutil.WriteFile(s.fsFix.BinDir.Join("bashrc").String(), nil, 0o755))
+	ss = s.runAllSettings(Rename)
+	ss[1].DestPath, ss[1].Prefix = ss[0].DestPath, "."
+	var dup *DuplicateNameError
+	s.True(errors.As(RunAll(ss), &dup))
+}
+
+func (s *InstallerSuite) TestRunAllRollsBack() {
+	r := s.Require()
+	ss := s.runAllSettings(Fail)
+	ss[1].Prefix = ""
+
+	// the bin mapping fails, so the dotfiles aren't linked either
+	r.NoError(ioutil.WriteFile(s.fsFix.LocalBinDir.Join("ls").String(), []byte("in the way"), 0o755))
+	var conflict *ConflictError
+	s.True(errors.As(RunAll(ss), &conflict))
+
+	_, err := os.Readlink(s.fsFix.HomeDir.Join(".vimrc").String())
+	s.Error(err)
+	_, err = os.Readlink(s.fsFix.LocalBinDir.Join("cat").String())
+	s.Error(err)
+}
+
+func (s *InstallerSuite) TestRunAllIsOneRun() {
+	r := s.Require()
+	ss := s.runAllSettings(Rename)
+	log := s.fsFix.TempDir.Join("hooks.log").String()
+	hooks := Hooks{
+		PreRun:  []string{`echo "pre $DFI_DEST_PATH $DFI_PREFIX" >> ` + log},
+		PostRun: []string{`echo "post $DFI_DEST_PATH $DFI_PREFIX" >> ` + log},
+	}
+	for _, st := range ss {
+		st.Hooks = hooks
+	}
+
+	r.NoError(RunAll(ss))
+
+	b, err := ioutil.ReadFile(log)
+	r.NoError(err)
+	dests := s.fsFix.HomeDir.String() + string(os.PathListSeparator) + s.fsFix.LocalBinDir.String()
+	s.Equal("pre "+dests+" .\npost "+dests+" .\n", string(b), "the run hooks run once")
+
+	st, err := ReadState(pl.NewOsFs(), ss[0].StateDir)
+	r.NoError(err)
+	runIDs := map[string]bool{}
+	for _, rec := range st.Links {
+		runIDs[rec.RunID] = true
+	}
+	s.Len(runIDs, 1, "the links of all the mappings are recorded as one run")
+}
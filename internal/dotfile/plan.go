@@ -0,0 +1,238 @@
+package dotfile
+
+import (
+	"encoding/json"
+	"io"
+	str "strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	ppath "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+type (
+	// PathState is what was at a link path when a plan was made
+	PathState struct {
+		// Type is one of missing, symlink, file, dir or other
+		Type string `json:"type"`
+		// LinkData is the contents of a symlink
+		LinkData string `json:"link_data,omitempty"`
+		// SHA256 is the checksum of a file or dir, see hashSource
+		SHA256 string `json:"sha256,omitempty"`
+	}
+
+	// PlannedLink is a link in a plan, and what will be done about it
+	PlannedLink struct {
+		Vpath    string `json:"vpath"`
+		LinkPath string `json:"link_path"`
+		LinkData string `json:"link_data"`
+		// Action is 'none' if the link is already in place, 'link' if
+		// nothing is in the way, or the OnConflict strategy for what is
+		Action   string    `json:"action"`
+		Existing PathState `json:"existing"`
+		// Source is the encrypted source Vpath is the decrypted copy of
+		Source string `json:"source,omitempty"`
+	}
+
+	// Plan is the links a run would make, so it can be reviewed and
+	// applied later
+	Plan struct {
+		Version    int           `json:"version"`
+		Prefix     string        `json:"prefix"`
+		OnConflict string        `json:"on_conflict"`
+		Atomic     bool          `json:"atomic"`
+		Dest       string        `json:"dest"`
+		Links      []PlannedLink `json:"links"`
+	}
+
+	// PlanFn makes a plan for a run with the settings
+	PlanFn func(s *Settings) (*Plan, error)
+
+	// ApplyPlanFn applies a plan, with the hooks and such from the settings
+	ApplyPlanFn func(s *Settings, p *Plan) error
+)
+
+const (
+	planVersion = 1
+
+	ActionNone = "none"
+	ActionLink = "link"
+)
+
+// pathStateOf describes what's at the path of snap
+func pathStateOf(fsys ppath.Fs, snap *ppath.Snapshot) (ps PathState, err error) {
+	switch {
+	case !snap.Lexists():
+		ps.Type = "missing"
+	case snap.IsSymlink():
+		ps.Type = "symlink"
+		var data ppath.PosixPath
+		if data, err = snap.Path.Readlink(); err != nil {
+			return ps, errors.Wrapf(err, "failed to readlink %#v", snap.Path.String())
+		}
+		ps.LinkData = data.String()
+	case snap.Info.IsDir() || snap.Info.Mode().IsRegular():
+		ps.Type = "file"
+		if snap.Info.IsDir() {
+			ps.Type = "dir"
+		}
+		ps.SHA256, err = hashSource(fsys, snap.Path.String())
+	default:
+		ps.Type = "other"
+	}
+	return ps, err
+}
+
+// planLink works out what will be done about ld
+func (n *Installer) planLink(ld LinkData) (PlannedLink, error) {
+	pl := PlannedLink{Vpath: ld.Vpath, LinkPath: ld.LinkPath, LinkData: ld.LinkData, Source: ld.Source}
+
+	snap, err := ppath.NewPosixPathFs(n.fsys(), ld.LinkPath).Snapshot()
+	if err != nil {
+		return pl, errors.Wrapf(err, "failed to lstat link path %#v", ld.LinkPath)
+	}
+	if pl.Existing, err = pathStateOf(n.fsys(), snap); err != nil {
+		return pl, err
+	}
+
+	state, err := classify(snap, ppath.NewPosixPathFs(n.fsys(), ld.Vpath))
+	switch {
+	case err != nil:
+		return pl, err
+	case state == linkDone:
+		pl.Action = ActionNone
+	case state == linkMissing:
+		pl.Action = ActionLink
+	case n.onConflict == Fail:
+		return pl, errors.WithStack(&ConflictError{LinkPath: ld.LinkPath})
+	default:
+		pl.Action = str.ToLower(n.onConflict.String())
+	}
+	return pl, nil
+}
+
+// Plan works out the links Run would make for sourcePaths in destPath, and
+// what it would do about anything in the way, without changing anything
+func (n *Installer) Plan(sourcePaths []string, destPath string) (*Plan, error) {
+	linkData, dst, err := n.linkData(sourcePaths, destPath)
+	if err != nil {
+		return nil, err
+	}
+	if linkData, err = checkSources(linkData, n.gitCheck); err != nil {
+		return nil, err
+	}
+	// the links are planned to where the copies go, they're only
+	// decrypted when the plan is applied
+	if linkData, err = copyLinks(linkData); err != nil {
+		return nil, err
+	}
+
+	p := &Plan{
+		Version:    planVersion,
+		Prefix:     n.prefix,
+		OnConflict: str.ToLower(n.onConflict.String()),
+		Atomic:     n.atomic,
+		Dest:       dst,
+		Links:      make([]PlannedLink, 0, len(linkData)),
+	}
+	for _, ld := range linkData {
+		pl, err := n.planLink(ld)
+		if err != nil {
+			return nil, err
+		}
+		p.Links = append(p.Links, pl)
+	}
+	return p, nil
+}
+
+// MakePlan makes a plan for a run with the settings
+func MakePlan(s *Settings) (*Plan, error) {
+	return s.installer("").Plan(s.SourcePaths, s.DestPath)
+}
+
+var _ PlanFn = MakePlan
+
+// ReadPlan reads a plan written by Plan.Write
+func ReadPlan(r io.Reader) (*Plan, error) {
+	p := &Plan{}
+	if err := json.NewDecoder(r).Decode(p); err != nil {
+		return nil, errors.Wrap(err, "failed to parse plan")
+	}
+	if p.Version != planVersion {
+		return nil, errors.Errorf("plan is version %d, we only understand %d", p.Version, planVersion)
+	}
+	return p, nil
+}
+
+// Write writes the plan to w as JSON
+func (p *Plan) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return errors.Wrap(enc.Encode(p), "failed to write plan")
+}
+
+// mismatches returns the links whose paths aren't the way they were when
+// the plan was made
+func (n *Installer) mismatches(p *Plan) ([]PlanMismatch, error) {
+	var found []PlanMismatch
+	for _, pl := range p.Links {
+		snap, err := ppath.NewPosixPathFs(n.fsys(), pl.LinkPath).Snapshot()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to lstat link path %#v", pl.LinkPath)
+		}
+		ps, err := pathStateOf(n.fsys(), snap)
+		if err != nil {
+			return nil, err
+		}
+		if ps != pl.Existing {
+			found = append(found, PlanMismatch{LinkPath: pl.LinkPath, Planned: pl.Existing, Found: ps})
+		}
+	}
+	return found, nil
+}
+
+// ApplyPlan makes exactly the links in p, with the receiver's hooks, state
+// and so on. If any of the link paths aren't the way they were when the
+// plan was made, nothing is done and a PlanMismatchError is returned.
+func (n *Installer) ApplyPlan(p *Plan) error {
+	if err := destIsDir(n.fsys(), p.Dest); err != nil {
+		return err
+	}
+
+	found, err := n.mismatches(p)
+	switch {
+	case err != nil:
+		return err
+	case len(found) > 0:
+		return errors.WithStack(&PlanMismatchError{Mismatches: found})
+	}
+
+	linkData := make([]LinkData, len(p.Links))
+	for i, pl := range p.Links {
+		linkData[i] = LinkData{Vpath: pl.Vpath, LinkPath: pl.LinkPath, LinkData: pl.LinkData, Source: pl.Source}
+	}
+	log.WithFields(log.Fields{"dest": p.Dest, "links": len(linkData)}).Debug("applying plan")
+	return n.runLinks(linkData, p.Dest)
+}
+
+// ApplyPlan applies p with the hooks, state and so on from s. The prefix,
+// conflict strategy, dest and atomic mode are the plan's.
+func ApplyPlan(s *Settings, p *Plan) (err error) {
+	ps := *s
+	ps.Prefix, ps.DestPath, ps.Atomic = p.Prefix, p.Dest, p.Atomic
+	if ps.OnConflict, err = OnConflictForString(p.OnConflict); err != nil {
+		return err
+	}
+
+	stateDir, err := ps.stateDir()
+	if err != nil {
+		return err
+	}
+
+	return ps.locked(func() error {
+		return ps.installer(stateDir).ApplyPlan(p)
+	})
+}
+
+var _ ApplyPlanFn = ApplyPlan
@@ -0,0 +1,87 @@
+package dotfile
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+func (s *InstallerSuite) TestPlanAndApply() {
+	r := s.Require()
+	mfs := newMemHome(r)
+	n := NewInstaller(".", Rename).WithFs(mfs)
+
+	p, err := n.Plan(memSources, "/home/user")
+	r.NoError(err)
+	s.Equal("rename", p.OnConflict)
+	s.Equal("/home/user", p.Dest)
+
+	actions := map[string]string{}
+	existing := map[string]string{}
+	for _, pl := range p.Links {
+		actions[pl.LinkPath] = pl.Action
+		existing[pl.LinkPath] = pl.Existing.Type
+	}
+	s.Equal(map[string]string{
+		"/home/user/.bashrc": "rename",
+		"/home/user/.vimrc":  "rename",
+		"/home/user/.zshrc":  ActionNone,
+	}, actions)
+	s.Equal(map[string]string{
+		"/home/user/.bashrc": "file",
+		"/home/user/.vimrc":  "symlink",
+		"/home/user/.zshrc":  "symlink",
+	}, existing)
+
+	// planning changes nothing
+	target, err := mfs.Readlink("/home/user/.vimrc")
+	r.NoError(err)
+	s.Equal("/nowhere/vimrc", target)
+
+	var buf bytes.Buffer
+	r.NoError(p.Write(&buf))
+	read, err := ReadPlan(&buf)
+	r.NoError(err)
+	s.Equal(p, read)
+
+	r.NoError(n.ApplyPlan(read))
+	for _, name := range []string{"bashrc", "vimrc", "zshrc"} {
+		target, err := mfs.Readlink("/home/user/." + name)
+		r.NoError(err)
+		s.Equal(".settings/dotfiles/"+name, target)
+	}
+}
+
+func (s *InstallerSuite) TestApplyRefusesChangedPlan() {
+	r := s.Require()
+	mfs := newMemHome(r)
+	n := NewInstaller(".", Replace).WithFs(mfs)
+
+	p, err := n.Plan(memSources, "/home/user")
+	r.NoError(err)
+
+	// the file in the way was edited, and a link appeared
+	r.NoError(afero.WriteFile(mfs, "/home/user/.bashrc", []byte("edited"), 0o644))
+	r.NoError(mfs.Remove("/home/user/.vimrc"))
+	r.NoError(mfs.Symlink("/elsewhere/vimrc", "/home/user/.vimrc"))
+
+	err = n.ApplyPlan(p)
+	var mismatch *PlanMismatchError
+	r.True(errors.As(err, &mismatch))
+	r.Len(mismatch.Mismatches, 2)
+	s.Equal("/home/user/.bashrc", mismatch.Mismatches[0].LinkPath)
+	s.Equal("/elsewhere/vimrc", mismatch.Mismatches[1].Found.LinkData)
+
+	b, err := afero.ReadFile(mfs, "/home/user/.bashrc")
+	r.NoError(err)
+	s.Equal("edited", string(b), "nothing is changed")
+}
+
+func (s *InstallerSuite) TestPlanFailsOnConflict() {
+	mfs := newMemHome(s.Require())
+	_, err := NewInstaller(".", Fail).WithFs(mfs).Plan(memSources, "/home/user")
+
+	var conflict *ConflictError
+	s.True(errors.As(err, &conflict))
+}
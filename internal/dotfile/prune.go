@@ -0,0 +1,235 @@
+package dotfile
+
+import (
+	"os"
+	fp "path/filepath"
+	str "strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	ppath "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+// DanglingLink is a symlink that points into a source root, at
+// something that no longer exists
+type DanglingLink struct {
+	// LinkPath is the location of the symlink
+	LinkPath string `json:"link_path"`
+
+	// LinkData is the contents of the symlink
+	LinkData string `json:"link_data"`
+
+	// Target is the absolute path LinkData refers to
+	Target string `json:"target"`
+
+	// SourceRoot is the source root Target was found inside of
+	SourceRoot string `json:"source_root"`
+
+	Removed bool `json:"removed"`
+
+	// Foreign is set if dfi didn't make the link, see State
+	Foreign bool `json:"foreign"`
+}
+
+// linkTarget returns the absolute, cleaned path the symlink at linkPath
+// with the contents linkData refers to. Relative link data is relative to
+// the directory containing the link, as in LinkDataFor.
+func linkTarget(linkPath, linkData string) string {
+	if fp.IsAbs(linkData) {
+		return fp.Clean(linkData)
+	}
+	return fp.Join(fp.Dir(linkPath), linkData)
+}
+
+// isUnder returns true if path is root or is inside of it
+func isUnder(path, root string) bool {
+	return path == root || str.HasPrefix(path, root+string(os.PathSeparator))
+}
+
+// linkInto returns the contents of the symlink at path on fsys, and the
+// absolute path they refer to, if it's a symlink into sourceRoot. data is
+// empty if it isn't.
+func linkInto(fsys ppath.Fs, path, sourceRoot string) (data, target string, err error) {
+	pp := ppath.NewPosixPathFs(fsys, path)
+
+	info, err := pp.Lstat()
+	if err != nil {
+		return "", "", errors.Wrapf(err, "failed to stat %#v", path)
+	}
+
+	if !info.IsSymlink() {
+		return "", "", nil
+	}
+
+	ld, err := pp.Readlink()
+	if err != nil {
+		return "", "", errors.Wrapf(err, "failed to readlink %#v", path)
+	}
+
+	target = linkTarget(path, ld.String())
+	if !isUnder(target, sourceRoot) {
+		return "", "", nil
+	}
+	return ld.String(), target, nil
+}
+
+// checkDangling returns a DanglingLink for path on fsys if it is a symlink
+// into sourceRoot whose target does not exist
+func checkDangling(fsys ppath.Fs, path, sourceRoot string) (*DanglingLink, error) {
+	data, target, err := linkInto(fsys, path, sourceRoot)
+	if err != nil || data == "" {
+		return nil, err
+	}
+
+	if _, err = ppath.NewPosixPathFs(fsys, target).Lstat(); err == nil || !(os.IsNotExist(err) || ppath.IsNotDir(err)) {
+		return nil, nil
+	}
+
+	return &DanglingLink{LinkPath: path, LinkData: data, Target: target, SourceRoot: sourceRoot}, nil
+}
+
+// absRoots returns sourceRoot and destPath made absolute, checking that
+// destPath is a directory on fsys
+func absRoots(fsys ppath.Fs, sourceRoot, destPath string) (string, string, error) {
+	var err error
+	if sourceRoot, err = fp.Abs(sourceRoot); err != nil {
+		return "", "", errors.Wrap(err, "failed to Abs source root")
+	}
+	if destPath, err = fp.Abs(destPath); err != nil {
+		return "", "", errors.Wrap(err, "failed to Abs dest")
+	}
+	return sourceRoot, destPath, destIsDir(fsys, destPath)
+}
+
+// eachEntry calls fn with the path of each entry of destPath on fsys that
+// isn't a directory, and if recursive, of the directories below it.
+// symlinked directories are not followed and sourceRoot is skipped.
+func eachEntry(fsys ppath.Fs, sourceRoot, destPath string, recursive bool, fn func(path string) error) error {
+	dest := ppath.NewPosixPathFs(fsys, destPath)
+
+	if !recursive {
+		entries, err := dest.ReadDir()
+		if err != nil {
+			return errors.Wrapf(err, "failed to read dir %#v", destPath)
+		}
+		for _, e := range entries {
+			if err = fn(e.String()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err := dest.Walk(func(pp ppath.PosixPath, info ppath.RichFileInfo, err error) error {
+		switch path := pp.String(); {
+		case err != nil:
+			return err
+		case info.IsDir() && path != destPath && isUnder(path, sourceRoot):
+			return fp.SkipDir
+		case info.IsDir():
+			return nil
+		default:
+			return fn(path)
+		}
+	})
+	return errors.Wrapf(err, "failed to walk %#v", destPath)
+}
+
+// FindDangling looks in destPath on fsys (and below it, if recursive) for
+// symlinks that point inside of sourceRoot at files that no longer exist.
+// sourceRoot itself does not have to exist. When recursing, symlinked
+// directories are not followed and sourceRoot is skipped.
+func FindDangling(fsys ppath.Fs, sourceRoot, destPath string, recursive bool) (found []DanglingLink, err error) {
+	if sourceRoot, destPath, err = absRoots(fsys, sourceRoot, destPath); err != nil {
+		return nil, err
+	}
+
+	err = eachEntry(fsys, sourceRoot, destPath, recursive, func(path string) error {
+		dl, err := checkDangling(fsys, path, sourceRoot)
+		if dl != nil {
+			found = append(found, *dl)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// RemoveDangling removes each of the links from fsys, checking first that
+// it's still a dangling symlink into the same source root with the same
+// contents. Removed is set on each link that was removed.
+func RemoveDangling(fsys ppath.Fs, links []DanglingLink) error {
+	for i := range links {
+		dl := &links[i]
+
+		root := dl.SourceRoot
+		if root == "" {
+			root = fp.Dir(dl.Target)
+		}
+
+		switch current, err := checkDangling(fsys, dl.LinkPath, root); {
+		case os.IsNotExist(errors.Cause(err)):
+			continue // someone beat us to it
+		case err != nil:
+			return err
+		case current == nil || current.LinkData != dl.LinkData:
+			log.WithField("LinkPath", dl.LinkPath).Warn("link changed since it was found, not removing")
+			continue
+		}
+
+		if err := ppath.NewPosixPathFs(fsys, dl.LinkPath).Remove(); err != nil {
+			return errors.Wrapf(err, "failed to remove %#v", dl.LinkPath)
+		}
+
+		dl.Removed = true
+		log.WithFields(log.Fields{
+			"LinkPath": dl.LinkPath,
+			"LinkData": dl.LinkData,
+		}).Info("removed dangling link")
+	}
+
+	return nil
+}
+
+// MarkForeign sets Foreign on each of the links the receiver has no
+// record of
+func (st *State) MarkForeign(links []DanglingLink) {
+	for i := range links {
+		links[i].Foreign = !st.Managed(links[i].LinkPath, links[i].LinkData)
+	}
+}
+
+// PruneDangling removes the links on fsys that dfi manages, according to
+// the state in stateDir, and forgets them. Foreign links are marked, and
+// only removed if includeForeign is set.
+func PruneDangling(fsys ppath.Fs, stateDir string, links []DanglingLink, includeForeign bool) error {
+	st, err := ReadState(fsys, stateDir)
+	if err != nil {
+		return err
+	}
+	st.MarkForeign(links)
+
+	var removed []string
+	for i := range links {
+		if links[i].Foreign && !includeForeign {
+			continue
+		}
+		if err = RemoveDangling(fsys, links[i:i+1]); err != nil {
+			break
+		}
+		if links[i].Removed {
+			removed = append(removed, links[i].LinkPath)
+		}
+	}
+	if len(removed) == 0 {
+		return err
+	}
+
+	if e := UpdateState(fsys, stateDir, func(st *State) error { st.Forget(removed...); return nil }); err == nil {
+		err = e
+	}
+	return err
+}
@@ -0,0 +1,93 @@
+package dotfile
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	fsf "github.com/slyphon/dfi/internal/fsfixture"
+	pl "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+type PruneSuite struct {
+	RequireSuite
+	fsFix fsf.FsFixture
+}
+
+func TestPrune(t *testing.T) {
+	s := new(PruneSuite)
+	s.AddBeforeHook(func(a, b string) { s.fsFix = fsf.NewFsFixture() })
+	s.AddAfterHook(func(a, b string) { s.fsFix.Cleanup() })
+	suite.Run(t, s)
+}
+
+func (s *PruneSuite) symlink(data, path string) {
+	s.Require().NoError(os.Symlink(data, path))
+}
+
+func (s *PruneSuite) TestFindAndRemoveDangling() {
+	r := s.Require()
+	home := s.fsFix.HomeDir
+	settings := s.fsFix.SettingsDir
+
+	s.symlink("settings/dotfiles/bashrc", home.Join(".bashrc").String()) // fine
+	s.symlink("settings/dotfiles/oldrc", home.Join(".oldrc").String())   // dangling
+	s.symlink("/nonexistent/elsewhere", home.Join(".other").String())    // not ours
+	s.symlink("../../settings/bin/gone", home.Join(".local/bin/gone").String())
+
+	found, err := FindDangling(pl.NewOsFs(), settings.String(), home.String(), false)
+	r.NoError(err)
+	r.Len(found, 1)
+	r.Equal(home.Join(".oldrc").String(), found[0].LinkPath)
+	r.Equal("settings/dotfiles/oldrc", found[0].LinkData)
+	r.Equal(settings.Join("dotfiles/oldrc").String(), found[0].Target)
+	r.Equal(settings.String(), found[0].SourceRoot)
+
+	found, err = FindDangling(pl.NewOsFs(), settings.String(), home.String(), true)
+	r.NoError(err)
+	r.Len(found, 2)
+	r.Equal(home.Join(".local/bin/gone").String(), found[0].LinkPath)
+
+	r.NoError(RemoveDangling(pl.NewOsFs(), found))
+	r.True(found[0].Removed)
+	r.True(found[1].Removed)
+	r.False(home.Join(".oldrc").Lexists())
+	r.False(home.Join(".local/bin/gone").Lexists())
+	r.True(home.Join(".bashrc").Lexists())
+	r.True(home.Join(".other").Lexists())
+}
+
+func (s *PruneSuite) TestSourceRootNeedNotExist() {
+	r := s.Require()
+	home := s.fsFix.HomeDir
+
+	s.symlink("old-settings/vimrc", home.Join(".vimrc").String())
+
+	found, err := FindDangling(pl.NewOsFs(), home.Join("old-settings").String(), home.String(), false)
+	r.NoError(err)
+	r.Len(found, 1)
+}
+
+func (s *PruneSuite) TestRemoveDanglingRechecksSourceRoot() {
+	r := s.Require()
+	home := s.fsFix.HomeDir
+	settings := s.fsFix.SettingsDir
+
+	s.symlink("settings/dotfiles/oldrc", home.Join(".oldrc").String())
+
+	found, err := FindDangling(pl.NewOsFs(), settings.String(), home.String(), false)
+	r.NoError(err)
+	r.Len(found, 1)
+
+	// the link is still dangling, but not into the root it was found in
+	found[0].SourceRoot = home.Join("elsewhere").String()
+	r.NoError(RemoveDangling(pl.NewOsFs(), found))
+	r.False(found[0].Removed)
+	r.True(home.Join(".oldrc").Lexists())
+
+	found[0].SourceRoot = settings.String()
+	r.NoError(RemoveDangling(pl.NewOsFs(), found))
+	r.True(found[0].Removed)
+	r.False(home.Join(".oldrc").Lexists())
+}
@@ -0,0 +1,319 @@
+package dotfile
+
+import (
+	"os"
+	fp "path/filepath"
+	"sort"
+	str "strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	ppath "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+type (
+	// RelinkSettings are the options for Relink, which points the links
+	// into a settings directory that moved at its new location
+	RelinkSettings struct {
+		// From is where the settings directory was, it needn't exist anymore
+		From string
+
+		// To is where it is now
+		To string
+
+		// Dests are directories to look for links in, as well as the ones
+		// the state says we've made links in
+		Dests []string
+
+		// Recursive also looks in the directories below Dests
+		Recursive bool
+
+		DryRun bool
+
+		// StateDir is where the links are recorded, see StateDir
+		StateDir string
+
+		// NoLock and LockTimeout are as in Settings. the dests that links
+		// are changed in are locked while they're relinked.
+		NoLock      bool
+		LockTimeout time.Duration
+
+		// Fs is as in Settings
+		Fs ppath.Fs
+	}
+
+	// Relinked is a link that was pointed at the new location
+	Relinked struct {
+		LinkPath string `json:"link_path"`
+		// OldData and NewData are the contents of the link before and after
+		OldData string `json:"old_data"`
+		NewData string `json:"new_data"`
+		// Vpath is what the link points at now
+		Vpath string `json:"vpath"`
+		// Dangling is set if there's nothing at Vpath
+		Dangling bool `json:"dangling"`
+	}
+)
+
+// relinkData returns the contents of a link at linkPath for vpath. absolute
+// links stay absolute, relative ones are worked out like LinkDataFor does.
+func relinkData(linkPath, vpath, oldData string) (string, error) {
+	if fp.IsAbs(oldData) {
+		return vpath, nil
+	}
+
+	// the link's name is the prefix and the name of what it points at
+	name, base := fp.Base(linkPath), fp.Base(vpath)
+	if str.HasSuffix(name, base) {
+		ld, err := LinkDataFor(vpath, fp.Dir(linkPath), str.TrimSuffix(name, base))
+		if err != nil {
+			return "", err
+		}
+		if ld.LinkPath == linkPath {
+			return ld.LinkData, nil
+		}
+	}
+
+	rel, err := fp.Rel(fp.Dir(linkPath), vpath)
+	return rel, errors.Wrapf(err, "failed to relativize %#v", vpath)
+}
+
+// knownDests returns the directories the links in the state are in
+func (st *State) knownDests() []string {
+	seen := map[string]bool{}
+	var dests []string
+	for lp := range st.Links {
+		if d := fp.Dir(lp); !seen[d] {
+			seen[d] = true
+			dests = append(dests, d)
+		}
+	}
+	sort.Strings(dests)
+	return dests
+}
+
+// findRelinks returns the links in dests on fsys that point under from,
+// with the contents they need to point at the same place under to
+func findRelinks(fsys ppath.Fs, from, to string, dests []string, recursive bool) ([]Relinked, error) {
+	seen := map[string]bool{}
+	var found []Relinked
+
+	for _, dest := range dests {
+		if !ppath.NewPosixPathFs(fsys, dest).IsDir() {
+			log.WithField("dest", dest).Debug("skipping dest that's not a directory")
+			continue
+		}
+
+		err := eachEntry(fsys, from, dest, recursive, func(path string) error {
+			if seen[path] {
+				return nil
+			}
+			seen[path] = true
+
+			data, target, err := linkInto(fsys, path, from)
+			if err != nil || data == "" {
+				return err
+			}
+
+			rel, err := fp.Rel(from, target)
+			if err != nil {
+				return errors.Wrapf(err, "failed to relativize %#v", target)
+			}
+			vpath := fp.Join(to, rel)
+
+			newData, err := relinkData(path, vpath, data)
+			if err != nil {
+				return err
+			}
+			found = append(found, Relinked{
+				LinkPath: path,
+				OldData:  data,
+				NewData:  newData,
+				Vpath:    vpath,
+				Dangling: !ppath.NewPosixPathFs(fsys, vpath).Lexists(),
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool { return found[i].LinkPath < found[j].LinkPath })
+	return found, nil
+}
+
+// Relink finds the links in s.Dests, and the directories we've made links
+// in, that point under s.From, and points them at the same place under s.To.
+// Each link is replaced by renaming the new one over it, so it never goes
+// missing, while the dest it's in is locked. The records of the links, the
+// encrypted sources they were decrypted from and the checksums of their
+// sources are moved along with them. Returns the links that were, or with DryRun would
+// be, changed.
+func Relink(s *RelinkSettings) (relinked []Relinked, err error) {
+	if s.From, err = fp.Abs(s.From); err != nil {
+		return nil, errors.Wrap(err, "failed to Abs --from")
+	}
+	if s.To, err = fp.Abs(s.To); err != nil {
+		return nil, errors.Wrap(err, "failed to Abs --to")
+	}
+	if s.From == s.To || isUnder(s.To, s.From) {
+		return nil, errors.Errorf("can't relink %#v to %#v, which is inside of it", s.From, s.To)
+	}
+
+	dests, err := mkAbs(s.Dests)
+	if err != nil {
+		return nil, err
+	}
+	if s.StateDir == "" {
+		if s.StateDir, err = StateDir(); err != nil {
+			return nil, err
+		}
+	}
+
+	st, err := ReadState(s.fsys(), s.StateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	found, err := findRelinks(s.fsys(), s.From, s.To, append(dests, st.knownDests()...), s.Recursive)
+	if err != nil || s.DryRun {
+		return found, err
+	}
+
+	err = lockedAll(s.destSettings(found), func() (err error) {
+		relinked, err = s.relinkAll(found)
+		if e := s.moveRecords(relinked); err == nil {
+			err = e
+		}
+		return err
+	})
+	return relinked, err
+}
+
+// destSettings returns the settings to lock each of the dests the links
+// in found are in with
+func (s *RelinkSettings) destSettings(found []Relinked) []*Settings {
+	seen := map[string]bool{}
+	var ss []*Settings
+	for _, rl := range found {
+		if d := fp.Dir(rl.LinkPath); !seen[d] {
+			seen[d] = true
+			ss = append(ss, &Settings{
+				DestPath: d, StateDir: s.StateDir, NoLock: s.NoLock, LockTimeout: s.LockTimeout, Fs: s.Fs,
+			})
+		}
+	}
+	return ss
+}
+
+// relinkAll points each of the links in found at its new location, unless
+// it has changed since it was found. Returns the links that were changed.
+func (s *RelinkSettings) relinkAll(found []Relinked) (relinked []Relinked, err error) {
+	fsys := s.fsys()
+	for _, rl := range found {
+		if data, _, err := linkInto(fsys, rl.LinkPath, s.From); err != nil || data != rl.OldData {
+			log.WithField("LinkPath", rl.LinkPath).Warn("link changed since it was found, not relinking")
+			continue
+		}
+
+		if err = Replace.linkOver(fsys, rl.LinkPath, rl.NewData, nil); err != nil {
+			return relinked, err
+		}
+		relinked = append(relinked, rl)
+		log.WithFields(log.Fields{
+			"LinkPath": rl.LinkPath,
+			"OldData":  rl.OldData,
+			"NewData":  rl.NewData,
+		}).Info("relinked")
+	}
+	return relinked, nil
+}
+
+// fsys returns s.Fs, or the real filesystem if it's not set
+func (s *RelinkSettings) fsys() ppath.Fs {
+	if s.Fs == nil {
+		return ppath.NewOsFs()
+	}
+	return s.Fs
+}
+
+// moved returns where path is under To, if it was under From
+func (s *RelinkSettings) moved(path string) (string, bool) {
+	if !isUnder(path, s.From) {
+		return path, false
+	}
+	return s.To + str.TrimPrefix(path, s.From), true
+}
+
+// moveRecords updates the state for the relinked links we manage, moves
+// the encrypted sources under From that the links we manage were decrypted
+// from, and moves the checksums of all the sources under From to To
+func (s *RelinkSettings) moveRecords(relinked []Relinked) error {
+	var copies []string
+	err := UpdateState(s.fsys(), s.StateDir, func(st *State) error {
+		for _, rl := range relinked {
+			if rec, ok := st.Links[rl.LinkPath]; ok && rec.LinkData == rl.OldData {
+				rec.Vpath, rec.LinkData = rl.Vpath, rl.NewData
+				st.Links[rl.LinkPath] = rec
+			}
+		}
+
+		// links to decrypted copies don't move, but their sources do
+		for lp, rec := range st.Links {
+			if source, ok := s.moved(rec.Source); ok {
+				rec.Source = source
+				st.Links[lp] = rec
+				copies = append(copies, rec.Vpath)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = s.moveCopySources(copies); err != nil {
+		return err
+	}
+
+	return UpdateLockfile(s.fsys(), s.StateDir, func(lf *Lockfile) error {
+		moved := map[string]SourceSum{}
+		for vpath, sum := range lf.Sources {
+			if to, ok := s.moved(vpath); ok {
+				delete(lf.Sources, vpath)
+				moved[to] = sum
+			}
+		}
+		for vpath, sum := range moved {
+			lf.Sources[vpath] = sum
+		}
+		return nil
+	})
+}
+
+// moveCopySources points the info kept next to each of the decrypted
+// copies at the new location of its source, see copyInfo
+func (s *RelinkSettings) moveCopySources(copies []string) error {
+	fsys := s.fsys()
+	for _, copyPath := range copies {
+		info, err := readCopyInfo(fsys, copyPath)
+		if os.IsNotExist(errors.Cause(err)) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		source, ok := s.moved(info.Source)
+		if !ok {
+			continue
+		}
+		info.Source = source
+		if err = writeCopyInfo(fsys, copyPath, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
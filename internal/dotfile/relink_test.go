@@ -0,0 +1,140 @@
+package dotfile
+
+import (
+	"os"
+	fp "path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+
+	ppath "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+func (s *InstallerSuite) TestRelinkData() {
+	for _, tc := range []struct{ linkPath, vpath, oldData, want string }{
+		{"/home/me/.bashrc", "/home/me/src/dotfiles/bashrc", ".settings/bashrc", "src/dotfiles/bashrc"},
+		{"/home/me/.bashrc", "/opt/dotfiles/bashrc", ".settings/bashrc", "/opt/dotfiles/bashrc"},
+		{"/home/me/.bashrc", "/home/me/src/bashrc", "/home/me/.settings/bashrc", "/home/me/src/bashrc"},
+		{"/home/me/.local/bin/ls", "/home/me/src/bin/ls", "../../.settings/bin/ls", "../../src/bin/ls"},
+		// a link whose name isn't the source's
+		{"/home/me/.vim", "/home/me/src/vim-config", ".settings/vim-config", "src/vim-config"},
+	} {
+		got, err := relinkData(tc.linkPath, tc.vpath, tc.oldData)
+		s.NoError(err)
+		s.Equal(tc.want, got, tc.linkPath)
+	}
+}
+
+func (s *InstallerSuite) TestRelink() {
+	r := s.Require()
+	stateDir := s.fsFix.TempDir.Join("state").String()
+	home := s.fsFix.HomeDir
+
+	s.runWithState(stateDir)
+	r.NoError(home.Join(".local/bin/cat").SymlinkTo("../../settings/bin/cat"))
+
+	moved := home.Join("src", "dotfiles").String()
+	r.NoError(os.MkdirAll(fp.Dir(moved), 0o755))
+	r.NoError(os.Rename(s.fsFix.SettingsDir.String(), moved))
+
+	rs := &RelinkSettings{
+		From:     s.fsFix.SettingsDir.String(),
+		To:       moved,
+		Dests:    []string{home.Join(".local").String()},
+		DryRun:   true,
+		StateDir: stateDir,
+	}
+
+	// the dests given are only looked in recursively if asked
+	found, err := Relink(rs)
+	r.NoError(err)
+	r.Len(found, len(s.fsFix.Dotfiles))
+	target, err := home.Join(".bashrc").Readlink()
+	r.NoError(err)
+	s.Equal("settings/dotfiles/bashrc", target.String(), "dry run changes nothing")
+
+	rs.DryRun, rs.Recursive = false, true
+	relinked, err := Relink(rs)
+	r.NoError(err)
+	r.Len(relinked, len(s.fsFix.Dotfiles)+1)
+	for _, rl := range relinked {
+		s.False(rl.Dangling, rl.LinkPath)
+	}
+
+	for link, want := range map[string]string{
+		".bashrc":        "src/dotfiles/dotfiles/bashrc",
+		".local/bin/cat": "../../src/dotfiles/bin/cat",
+	} {
+		target, err = home.Join(link).Readlink()
+		r.NoError(err)
+		s.Equal(want, target.String())
+		s.True(home.Join(link).Exists())
+	}
+
+	st, err := ReadState(ppath.NewOsFs(), stateDir)
+	r.NoError(err)
+	rec := st.Links[home.Join(".bashrc").String()]
+	s.Equal(fp.Join(moved, "dotfiles", "bashrc"), rec.Vpath)
+	s.Equal("src/dotfiles/dotfiles/bashrc", rec.LinkData)
+
+	checks, err := Verify(ppath.NewOsFs(), stateDir, []string{moved})
+	r.NoError(err)
+	r.Len(checks, len(s.fsFix.Dotfiles))
+
+	// running it again finds nothing to do
+	relinked, err = Relink(rs)
+	r.NoError(err)
+	s.Empty(relinked)
+}
+
+func (s *InstallerSuite) TestRelinkLocksAndMovesSources() {
+	r := s.Require()
+	stateDir := s.fsFix.TempDir.Join("state").String()
+	home := s.fsFix.HomeDir
+
+	s.runWithState(stateDir)
+
+	// a link to a decrypted copy of an encrypted source in the settings
+	copyPath := s.fsFix.TempDir.Join("decrypted", "netrc").String()
+	source := s.fsFix.SettingsDir.Join("dotfiles", "netrc"+EncryptedSuffix).String()
+	r.NoError(UpdateState(ppath.NewOsFs(), stateDir, func(st *State) error {
+		st.Links[home.Join(".netrc").String()] = LinkRecord{Vpath: copyPath, LinkData: copyPath, Source: source}
+		return nil
+	}))
+	r.NoError(os.MkdirAll(fp.Dir(copyPath), 0o700))
+	r.NoError(writeCopyInfo(ppath.NewOsFs(), copyPath, &copyInfo{Source: source}))
+
+	moved := home.Join("src", "dotfiles").String()
+	r.NoError(os.MkdirAll(fp.Dir(moved), 0o755))
+	r.NoError(os.Rename(s.fsFix.SettingsDir.String(), moved))
+
+	rs := &RelinkSettings{
+		From:        s.fsFix.SettingsDir.String(),
+		To:          moved,
+		StateDir:    stateDir,
+		LockTimeout: 100 * time.Millisecond,
+	}
+
+	l, err := lockDest(ppath.NewOsFs(), stateDir, home.String(), 0)
+	r.NoError(err)
+	_, err = Relink(rs)
+	var locked *LockedError
+	r.True(errors.As(err, &locked))
+	target, err := home.Join(".bashrc").Readlink()
+	r.NoError(err)
+	s.Equal("settings/dotfiles/bashrc", target.String(), "nothing is changed in a locked dest")
+	r.NoError(l.unlock())
+
+	relinked, err := Relink(rs)
+	r.NoError(err)
+	r.Len(relinked, len(s.fsFix.Dotfiles))
+
+	st, err := ReadState(ppath.NewOsFs(), stateDir)
+	r.NoError(err)
+	newSource := fp.Join(moved, "dotfiles", "netrc"+EncryptedSuffix)
+	s.Equal(newSource, st.Links[home.Join(".netrc").String()].Source)
+
+	info, err := readCopyInfo(ppath.NewOsFs(), copyPath)
+	r.NoError(err)
+	s.Equal(newSource, info.Source)
+}
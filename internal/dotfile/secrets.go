@@ -0,0 +1,154 @@
+package dotfile
+
+import (
+	"os"
+	fp "path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	ppath "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+// SecretPolicy is the permissions that sources whose links match Match, an
+// extended glob like LinkHook.Match, must have. Modes are octal strings.
+// A source may not be more permissive than Mode, or DirMode if it's a
+// directory, and the directory its link is in not more permissive than
+// DirMode. Empty modes default to 0600 and 0700.
+type SecretPolicy struct {
+	Match   string `mapstructure:"match"`
+	Mode    string `mapstructure:"mode"`
+	DirMode string `mapstructure:"dir_mode"`
+}
+
+const (
+	defaultSecretMode    os.FileMode = 0o600
+	defaultSecretDirMode os.FileMode = 0o700
+)
+
+func parseMode(s string, dflt os.FileMode) (os.FileMode, error) {
+	if s == "" {
+		return dflt, nil
+	}
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || m > 0o777 {
+		return 0, errors.Errorf("invalid mode %#v, expected an octal mode like 0600", s)
+	}
+	return os.FileMode(m), nil
+}
+
+// modes returns the parsed Mode and DirMode
+func (sp SecretPolicy) modes() (mode, dirMode os.FileMode, err error) {
+	if mode, err = parseMode(sp.Mode, defaultSecretMode); err != nil {
+		return 0, 0, err
+	}
+	dirMode, err = parseMode(sp.DirMode, defaultSecretDirMode)
+	return mode, dirMode, err
+}
+
+// policyFor returns the first of policies that matches ld, or nil
+func policyFor(policies []SecretPolicy, ld LinkData) (*SecretPolicy, error) {
+	for i, sp := range policies {
+		if sp.Match == "" {
+			return &policies[i], nil
+		}
+		ok, err := ppath.NewPurePath(ld.LinkPath).ExMatch(sp.Match)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid secrets match pattern %#v", sp.Match)
+		}
+		if ok {
+			return &policies[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// tooOpen returns the permission bits of perm that allowed doesn't have
+func tooOpen(perm, allowed os.FileMode) os.FileMode {
+	return perm.Perm() &^ allowed
+}
+
+// checkSecrets checks the modes of the sources in linkData that match one
+// of the receiver's secret policies, and of the directories their links
+// are in. With fixPerms, a source that's too permissive is chmod'ed to take
+// away the extra bits, otherwise it's logged. The directories are only
+// logged, they're usually $HOME, which isn't ours to chmod. A link into a
+// directory that's group or world writable is refused, as anyone who can
+// write there can replace the link.
+func (n *Installer) checkSecrets(linkData []LinkData) error {
+	if len(n.secrets) == 0 {
+		return nil
+	}
+	fsys := n.fsys()
+
+	for _, ld := range linkData {
+		sp, err := policyFor(n.secrets, ld)
+		if err != nil {
+			return err
+		}
+		if sp == nil {
+			continue
+		}
+		mode, dirMode, err := sp.modes()
+		if err != nil {
+			return err
+		}
+
+		// a directory needs its search bits, which Mode doesn't have
+		info, err := fsys.Stat(ld.Vpath)
+		if err != nil {
+			return errors.Wrapf(err, "failed to stat %#v", ld.Vpath)
+		}
+		if info.IsDir() {
+			err = n.checkMode(fsys, ld.Vpath, dirMode, "secret directory", n.fixPerms)
+		} else {
+			err = n.checkMode(fsys, ld.Vpath, mode, "secret", n.fixPerms)
+		}
+		if err != nil {
+			return err
+		}
+
+		dir := fp.Dir(ld.LinkPath)
+		if err = n.checkMode(fsys, dir, dirMode, "directory of secret", false); err != nil {
+			return err
+		}
+		if info, err = fsys.Stat(dir); err != nil {
+			return errors.Wrapf(err, "failed to stat %#v", dir)
+		}
+		if info.Mode().Perm()&0o022 != 0 {
+			return errors.WithStack(&InsecureDirError{LinkPath: ld.LinkPath, Dir: dir, Mode: info.Mode().Perm()})
+		}
+	}
+	return nil
+}
+
+// checkMode makes sure path is no more permissive than allowed, fixing it
+// if fix is set, or warning about it. what is what path is, for the log.
+func (n *Installer) checkMode(fsys ppath.Fs, path string, allowed os.FileMode, what string, fix bool) error {
+	info, err := fsys.Stat(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to stat %#v", path)
+	}
+	perm := info.Mode().Perm()
+	extra := tooOpen(perm, allowed)
+	if extra == 0 {
+		return nil
+	}
+
+	ctx := log.WithFields(log.Fields{"path": path, "mode": perm.String(), "allowed": allowed.String()})
+	if fix {
+		if err = fsys.Chmod(path, perm&^extra); err != nil {
+			return errors.Wrapf(err, "failed to chmod %#v", path)
+		}
+		ctx.Infof("fixed the mode of %s", what)
+		return nil
+	}
+
+	if perm&0o004 != 0 {
+		ctx.Warnf("%s is world-readable", what)
+	} else {
+		ctx.Warnf("%s is more permissive than allowed", what)
+	}
+	return nil
+}
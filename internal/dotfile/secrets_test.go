@@ -0,0 +1,88 @@
+package dotfile
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+
+	pl "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+func (s *InstallerSuite) TestSecretModes() {
+	r := s.Require()
+	secrets := []SecretPolicy{{Match: "**/.bashrc"}}
+	src := "/home/user/.settings/dotfiles/bashrc"
+
+	mode := func(mfs *pl.MemFs, path string) os.FileMode {
+		info, err := mfs.Stat(path)
+		r.NoError(err)
+		return info.Mode().Perm()
+	}
+	setup := func(srcMode, homeMode os.FileMode) *pl.MemFs {
+		mfs := newMemHome(r)
+		r.NoError(mfs.Remove("/home/user/.bashrc"))
+		r.NoError(mfs.Chmod(src, srcMode))
+		r.NoError(mfs.Chmod("/home/user/.settings/dotfiles/vimrc", 0o644))
+		r.NoError(mfs.Chmod("/home/user", homeMode))
+		return mfs
+	}
+
+	// too permissive is only logged
+	mfs := setup(0o644, 0o755)
+	r.NoError(NewInstaller(".", Rename).WithFs(mfs).WithSecrets(secrets, false).Run(memSources, "/home/user"))
+	s.Equal(os.FileMode(0o644), mode(mfs, src))
+	s.Equal(os.FileMode(0o755), mode(mfs, "/home/user"))
+
+	// or fixed, only for the sources that match. the dest dir is only
+	// warned about, $HOME isn't ours to chmod.
+	mfs = setup(0o644, 0o755)
+	r.NoError(NewInstaller(".", Rename).WithFs(mfs).WithSecrets(secrets, true).Run(memSources, "/home/user"))
+	s.Equal(os.FileMode(0o600), mode(mfs, src))
+	s.Equal(os.FileMode(0o755), mode(mfs, "/home/user"))
+	s.Equal(os.FileMode(0o644), mode(mfs, "/home/user/.settings/dotfiles/vimrc"))
+
+	// modes that are stricter than the policy are left alone
+	mfs = setup(0o400, 0o700)
+	r.NoError(NewInstaller(".", Rename).WithFs(mfs).WithSecrets(secrets, true).Run(memSources, "/home/user"))
+	s.Equal(os.FileMode(0o400), mode(mfs, src))
+}
+
+func (s *InstallerSuite) TestSecretDirKeepsSearchBits() {
+	r := s.Require()
+	mfs := newMemHome(r)
+	src := "/home/user/.settings/dotfiles/ssh"
+	r.NoError(mfs.MkdirAll(src, 0o755))
+	r.NoError(mfs.Chmod("/home/user", 0o700))
+
+	secrets := []SecretPolicy{{Match: "**/.ssh"}}
+	r.NoError(NewInstaller(".", Rename).WithFs(mfs).WithSecrets(secrets, true).Run([]string{src}, "/home/user"))
+
+	info, err := mfs.Stat(src)
+	r.NoError(err)
+	s.Equal(os.FileMode(0o700), info.Mode().Perm(), "a directory is held to the dir mode")
+}
+
+func (s *InstallerSuite) TestSecretsRefuseWritableDir() {
+	r := s.Require()
+	mfs := newMemHome(r)
+	r.NoError(mfs.Chmod("/home/user", 0o775))
+
+	err := NewInstaller(".", Rename).
+		WithFs(mfs).
+		WithSecrets([]SecretPolicy{{Match: "**/.zshrc", DirMode: "0775"}}, false).
+		Run(memSources, "/home/user")
+
+	var insecure *InsecureDirError
+	r.True(errors.As(err, &insecure))
+	s.Equal("/home/user/.zshrc", insecure.LinkPath)
+	s.Equal("/home/user", insecure.Dir)
+	info, _, err := mfs.LstatIfPossible("/home/user/.bashrc")
+	r.NoError(err)
+	s.Zero(info.Mode()&os.ModeSymlink, "nothing is linked")
+
+	err = NewInstaller(".", Rename).
+		WithFs(mfs).
+		WithSecrets([]SecretPolicy{{Mode: "0999"}}, false).
+		Run(memSources, "/home/user")
+	s.Contains(err.Error(), "invalid mode")
+}
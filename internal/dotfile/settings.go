@@ -3,6 +3,9 @@ package dotfile
 import (
 	"github.com/pkg/errors"
 	fp "path/filepath"
+	"time"
+
+	ppath "github.com/slyphon/dfi/pkg/pathlib"
 )
 
 type Settings struct {
@@ -11,6 +14,24 @@ type Settings struct {
 	DryRun      bool
 	SourcePaths []string
 	DestPath    string
+	Hooks       Hooks
+	GitCheck    GitCheck
+	KeepGoing   bool
+	Workers     int
+	Atomic      bool
+	NoLock      bool
+	LockTimeout time.Duration
+	StateDir    string
+	Secrets     []SecretPolicy
+	FixPerms    bool
+	Identity    string
+
+	// Fs is the filesystem the links, state and locks are on, the real
+	// one if it's nil
+	Fs ppath.Fs
+
+	// symlinks into it are replaced by the new links, see WithReplaceInto
+	replaceInto string
 }
 
 func mkAbs(paths []string) ([]string, error) {
@@ -38,6 +59,14 @@ func mkAbsSettings(s *Settings) (*Settings, error) {
 	return s, nil
 }
 
+// fsys returns s.Fs, or the real filesystem if it's not set
+func (s *Settings) fsys() ppath.Fs {
+	if s.Fs == nil {
+		return ppath.NewOsFs()
+	}
+	return s.Fs
+}
+
 // AbsPaths returns a reference to a copy of the receiver with
 // SourcePaths and DestPaths converted to absolute paths
 //
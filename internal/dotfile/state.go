@@ -0,0 +1,237 @@
+package dotfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	fp "path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+
+	ppath "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+type (
+	// LinkRecord is what we know about a link dfi manages
+	LinkRecord struct {
+		// Vpath is the versioned file the link is for
+		Vpath string `json:"vpath"`
+
+		// LinkData is the contents of the link
+		LinkData string `json:"link_data"`
+
+		// Source is the encrypted source Vpath was decrypted from, if any
+		Source string `json:"source,omitempty"`
+
+		// Commit is the commit the source's git repository was at when
+		// the link was made, if the run checked it with --git-check
+		Commit string `json:"commit,omitempty"`
+
+		// RunID identifies the run that created the link, see newRunID
+		RunID   string    `json:"run_id"`
+		Created time.Time `json:"created"`
+	}
+
+	// State is the links dfi manages, keyed by LinkPath. Links that
+	// aren't in it are foreign, even if they point into a source root.
+	State struct {
+		Version int                   `json:"version"`
+		Links   map[string]LinkRecord `json:"links"`
+	}
+)
+
+const (
+	StateFileName = "links.json"
+	stateVersion  = 1
+)
+
+// newRunID returns an ID for a run that's unique enough to tell runs apart
+func newRunID() string {
+	return fmt.Sprintf("%s-%d", timestamp(), os.Getpid())
+}
+
+func statePath(stateDir string) string {
+	return fp.Join(stateDir, StateFileName)
+}
+
+// ReadState reads the state in stateDir on fsys, an empty state if there's
+// none yet
+func ReadState(fsys ppath.Fs, stateDir string) (*State, error) {
+	st := &State{Version: stateVersion, Links: map[string]LinkRecord{}}
+
+	b, err := afero.ReadFile(fsys, statePath(stateDir))
+	switch {
+	case os.IsNotExist(err):
+		return st, nil
+	case err != nil:
+		return nil, errors.Wrapf(err, "failed to read state %#v", statePath(stateDir))
+	}
+
+	if err = json.Unmarshal(b, st); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse state %#v", statePath(stateDir))
+	}
+	if st.Version > stateVersion {
+		return nil, errors.Errorf("state %#v is version %d, we only understand up to %d",
+			statePath(stateDir), st.Version, stateVersion)
+	}
+	if st.Links == nil {
+		st.Links = map[string]LinkRecord{}
+	}
+	return st, nil
+}
+
+// writeJSON replaces the file at path on fsys with v as JSON, so a reader
+// never sees half of it
+func writeJSON(fsys ppath.Fs, path string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode %#v", path)
+	}
+
+	tmp := fmt.Sprintf("%s.tmp_%d", path, os.Getpid())
+	if err = afero.WriteFile(fsys, tmp, append(b, '\n'), 0o600); err != nil {
+		return errors.Wrapf(err, "failed to write %#v", tmp)
+	}
+	if err = fsys.Rename(tmp, path); err != nil {
+		fsys.Remove(tmp)
+		return errors.Wrapf(err, "failed to replace %#v", path)
+	}
+	return nil
+}
+
+// withFileLocked calls fn while holding the lock on the file at path on
+// fsys, so runs on different destinations don't lose each other's changes
+// to it
+func withFileLocked(fsys ppath.Fs, path string, fn func() error) (err error) {
+	l, err := lockFile(fsys, path+".lock", path, DefaultLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := l.unlock(); err == nil {
+			err = e
+		}
+	}()
+
+	return fn()
+}
+
+// UpdateState reads the state in stateDir on fsys, calls fn to change it,
+// and writes it back, holding the lock on it while we do
+func UpdateState(fsys ppath.Fs, stateDir string, fn func(st *State) error) error {
+	return withFileLocked(fsys, statePath(stateDir), func() error {
+		st, err := ReadState(fsys, stateDir)
+		if err != nil {
+			return err
+		}
+		if err = fn(st); err != nil {
+			return err
+		}
+		return writeJSON(fsys, statePath(stateDir), st)
+	})
+}
+
+// Managed returns true if the link at linkPath is one we made, and it still
+// has the contents we gave it
+func (st *State) Managed(linkPath, linkData string) bool {
+	rec, ok := st.Links[linkPath]
+	return ok && rec.LinkData == linkData
+}
+
+// Forget removes the records of the links at paths
+func (st *State) Forget(paths ...string) {
+	for _, p := range paths {
+		delete(st.Links, p)
+	}
+}
+
+// linkPaths returns the LinkPaths of the records that are for a source in
+// sourceRoot, and a link in destPath (or below it, if recursive), sorted
+func (st *State) linkPaths(sourceRoot, destPath string, recursive bool) []string {
+	var paths []string
+	for lp, rec := range st.Links {
+		inDest := fp.Dir(lp) == destPath || (recursive && isUnder(lp, destPath))
+		src := rec.Vpath
+		if rec.Source != "" {
+			src = rec.Source
+		}
+		if inDest && isUnder(src, sourceRoot) {
+			paths = append(paths, lp)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// inPlace returns the links in linkData that are in place
+func (n *Installer) inPlace(linkData []LinkData) ([]LinkData, error) {
+	var inPlace []LinkData
+	for _, ld := range linkData {
+		snap, err := ppath.NewPosixPathFs(n.fsys(), ld.LinkPath).Snapshot()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to lstat link path %#v", ld.LinkPath)
+		}
+		if state, err := classify(snap, ppath.NewPosixPathFs(n.fsys(), ld.Vpath)); err == nil && state == linkDone {
+			inPlace = append(inPlace, ld)
+		}
+	}
+	return inPlace, nil
+}
+
+// wereInPlace returns the LinkPaths of the links in linkData that are in
+// place before the run, so their sources' checksums are left alone, or nil
+// if we're not recording the run
+func (n *Installer) wereInPlace(linkData []LinkData) (map[string]bool, error) {
+	if n.stateDir == "" {
+		return nil, nil
+	}
+
+	inPlace, err := n.inPlace(linkData)
+	if err != nil {
+		return nil, err
+	}
+
+	already := make(map[string]bool, len(inPlace))
+	for _, ld := range inPlace {
+		already[ld.LinkPath] = true
+	}
+	return already, nil
+}
+
+// record adds the links in linkData that are in place to the state, and
+// the checksums of their sources to the lockfile. already is from
+// wereInPlace.
+func (n *Installer) record(linkData []LinkData, already map[string]bool, runID string) error {
+	inPlace, err := n.inPlace(linkData)
+	if err != nil {
+		return err
+	}
+	if err = n.recordLinks(inPlace, runID); err != nil {
+		return err
+	}
+	return n.recordSums(inPlace, already, runID)
+}
+
+// recordLinks adds the links in inPlace to the state, so we know we manage
+// them. links that were already correct are claimed too, as we've been
+// asked to manage them, but keep their original record.
+func (n *Installer) recordLinks(inPlace []LinkData, runID string) error {
+	return UpdateState(n.fsys(), n.stateDir, func(st *State) error {
+		now := time.Now().UTC()
+		for _, ld := range inPlace {
+			if st.Managed(ld.LinkPath, ld.LinkData) {
+				continue
+			}
+			st.Links[ld.LinkPath] = LinkRecord{
+				Vpath: ld.Vpath, LinkData: ld.LinkData, Source: ld.Source, Commit: ld.Commit,
+				RunID: runID, Created: now,
+			}
+			log.WithFields(log.Fields{"LinkPath": ld.LinkPath, "RunID": runID}).Debug("recorded link")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,156 @@
+package dotfile
+
+import (
+	"os"
+	"os/exec"
+	str "strings"
+
+	pl "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+func (s *InstallerSuite) runWithState(stateDir string) {
+	s.Require().NoError(Run(&Settings{
+		Prefix:      ".",
+		OnConflict:  Rename,
+		SourcePaths: pl.PosixSliceStringer(s.fsFix.Dotfiles),
+		DestPath:    s.fsFix.HomeDir.String(),
+		StateDir:    stateDir,
+	}))
+}
+
+func (s *InstallerSuite) TestRunRecordsLinks() {
+	r := s.Require()
+	stateDir := s.fsFix.TempDir.Join("state").String()
+
+	st, err := ReadState(pl.NewOsFs(), stateDir)
+	r.NoError(err)
+	r.Empty(st.Links)
+
+	s.runWithState(stateDir)
+	st, err = ReadState(pl.NewOsFs(), stateDir)
+	r.NoError(err)
+	r.Len(st.Links, len(s.fsFix.Dotfiles))
+
+	bashrc := s.fsFix.HomeDir.Join(".bashrc").String()
+	rec := st.Links[bashrc]
+	s.Equal(s.fsFix.DotfileDir.Join("bashrc").String(), rec.Vpath)
+	s.Equal("settings/dotfiles/bashrc", rec.LinkData)
+	s.NotEmpty(rec.RunID)
+	s.True(st.Managed(bashrc, "settings/dotfiles/bashrc"))
+	s.False(st.Managed(bashrc, "elsewhere"))
+
+	// a second run claims nothing new, so the records are kept as they were
+	s.runWithState(stateDir)
+	st, err = ReadState(pl.NewOsFs(), stateDir)
+	r.NoError(err)
+	s.Equal(rec, st.Links[bashrc])
+}
+
+func (s *InstallerSuite) TestStatusAndUninstall() {
+	r := s.Require()
+	stateDir := s.fsFix.TempDir.Join("state").String()
+	home, settings := s.fsFix.HomeDir, s.fsFix.SettingsDir
+
+	s.runWithState(stateDir)
+	r.NoError(home.Join(".vimrc").Remove())
+	r.NoError(home.Join(".zshrc").Remove())
+	r.NoError(home.Join(".zshrc").SymlinkTo("elsewhere"))
+	r.NoError(home.Join(".local/bin/cat").SymlinkTo("../../settings/bin/cat"))
+
+	statuses := func(links []LinkStatus) map[string]StatusName {
+		m := map[string]StatusName{}
+		for _, ls := range links {
+			m[ls.LinkPath] = ls.Status
+		}
+		return m
+	}
+
+	found, err := Status(pl.NewOsFs(), stateDir, settings.String(), home.String(), false)
+	r.NoError(err)
+	s.Equal(map[string]StatusName{
+		home.Join(".bashrc").String(): StatusOK,
+		home.Join(".config").String(): StatusOK,
+		home.Join(".vimrc").String():  StatusMissing,
+		home.Join(".zshrc").String():  StatusChanged,
+	}, statuses(found))
+
+	found, err = Status(pl.NewOsFs(), stateDir, settings.String(), home.String(), true)
+	r.NoError(err)
+	r.Len(found, 5)
+	s.Equal(StatusForeign, statuses(found)[home.Join(".local/bin/cat").String()])
+
+	r.NoError(Uninstall(pl.NewOsFs(), stateDir, found))
+	for _, ls := range found {
+		s.Equal(ls.Status == StatusOK, ls.Removed, ls.LinkPath)
+	}
+	s.False(home.Join(".bashrc").Lexists())
+	s.True(home.Join(".zshrc").IsSymlink(), "changed links are left alone")
+	s.True(home.Join(".local/bin/cat").IsSymlink(), "foreign links are left alone")
+
+	st, err := ReadState(pl.NewOsFs(), stateDir)
+	r.NoError(err)
+	s.Empty(st.Links)
+}
+
+func (s *InstallerSuite) TestPruneOnlyManagedLinks() {
+	r := s.Require()
+	stateDir := s.fsFix.TempDir.Join("state").String()
+	home, settings := s.fsFix.HomeDir, s.fsFix.SettingsDir
+
+	s.runWithState(stateDir)
+	r.NoError(os.Remove(s.fsFix.DotfileDir.Join("vimrc").String()))
+	r.NoError(home.Join(".oldrc").SymlinkTo("settings/dotfiles/oldrc"))
+
+	found, err := FindDangling(pl.NewOsFs(), settings.String(), home.String(), false)
+	r.NoError(err)
+	r.Len(found, 2)
+
+	r.NoError(PruneDangling(pl.NewOsFs(), stateDir, found, false))
+	s.Equal(home.Join(".oldrc").String(), found[0].LinkPath)
+	s.True(found[0].Foreign)
+	s.False(found[0].Removed)
+	s.False(found[1].Foreign)
+	s.True(found[1].Removed)
+	s.True(home.Join(".oldrc").IsSymlink())
+
+	st, err := ReadState(pl.NewOsFs(), stateDir)
+	r.NoError(err)
+	s.NotContains(st.Links, home.Join(".vimrc").String())
+
+	r.NoError(PruneDangling(pl.NewOsFs(), stateDir, found[:1], true))
+	s.True(found[0].Removed)
+	s.False(home.Join(".oldrc").Lexists())
+}
+
+func (s *InstallerSuite) TestRunRecordsCommits() {
+	r := s.Require()
+	if _, err := exec.LookPath("git"); err != nil {
+		s.T().Skip("git is not installed")
+	}
+
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=dfi", "-c", "user.email=dfi@example.com"}, args...)...)
+		cmd.Dir = s.fsFix.SettingsDir.String()
+		out, err := cmd.CombinedOutput()
+		r.NoError(err, string(out))
+		return str.TrimSpace(string(out))
+	}
+	git("init", "-q")
+	git("add", ".")
+	git("commit", "-q", "-m", "settings")
+	head := git("rev-parse", "HEAD")
+
+	stateDir := s.fsFix.TempDir.Join("state").String()
+	r.NoError(Run(&Settings{
+		Prefix:      ".",
+		OnConflict:  Rename,
+		SourcePaths: pl.PosixSliceStringer(s.fsFix.Dotfiles),
+		DestPath:    s.fsFix.HomeDir.String(),
+		StateDir:    stateDir,
+		GitCheck:    GitCheckFail,
+	}))
+
+	st, err := ReadState(pl.NewOsFs(), stateDir)
+	r.NoError(err)
+	s.Equal(head, st.Links[s.fsFix.HomeDir.Join(".bashrc").String()].Commit)
+}
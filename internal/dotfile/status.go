@@ -0,0 +1,162 @@
+package dotfile
+
+import (
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	ppath "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+// StatusName says what we found at the LinkPath of a LinkStatus
+type StatusName string
+
+const (
+	// StatusOK is a managed link that's still the way we made it
+	StatusOK StatusName = "ok"
+	// StatusMissing is a managed link that's been removed
+	StatusMissing StatusName = "missing"
+	// StatusChanged is a managed link that's been replaced with something else
+	StatusChanged StatusName = "changed"
+	// StatusForeign is a symlink into the source root that dfi didn't make
+	StatusForeign StatusName = "foreign"
+)
+
+// LinkStatus is the state of a link in a destination
+type LinkStatus struct {
+	LinkPath string     `json:"link_path"`
+	LinkData string     `json:"link_data"`
+	Vpath    string     `json:"vpath,omitempty"`
+	RunID    string     `json:"run_id,omitempty"`
+	Commit   string     `json:"commit,omitempty"`
+	Status   StatusName `json:"status"`
+	Removed  bool       `json:"removed"`
+	// Secret is the state of the decrypted copy an ok link to one
+	// points at
+	Secret SecretState `json:"secret,omitempty"`
+}
+
+// managedStatus compares what's at the path of rec on fsys with it
+func managedStatus(fsys ppath.Fs, linkPath string, rec LinkRecord) (LinkStatus, error) {
+	ls := LinkStatus{LinkPath: linkPath, LinkData: rec.LinkData, Vpath: rec.Vpath, RunID: rec.RunID, Commit: rec.Commit}
+
+	pp := ppath.NewPosixPathFs(fsys, linkPath)
+	info, err := pp.Lstat()
+	switch {
+	case os.IsNotExist(err) || ppath.IsNotDir(err):
+		ls.Status = StatusMissing
+		return ls, nil
+	case err != nil:
+		return ls, errors.Wrapf(err, "failed to stat %#v", linkPath)
+	case !info.IsSymlink():
+		ls.Status = StatusChanged
+		return ls, nil
+	}
+
+	data, err := pp.Readlink()
+	if err != nil {
+		return ls, errors.Wrapf(err, "failed to readlink %#v", linkPath)
+	}
+	if data.String() != rec.LinkData {
+		ls.Status = StatusChanged
+		return ls, nil
+	}
+
+	ls.Status = StatusOK
+	if rec.Source != "" {
+		ls.Secret, _, err = secretState(fsys, rec.Vpath)
+	}
+	return ls, err
+}
+
+// Status returns the state of the links dfi manages in destPath on fsys
+// (and below it, if recursive) for sources in sourceRoot, according to the
+// state in stateDir, and of the symlinks into sourceRoot it found there that
+// it doesn't manage. They're sorted by LinkPath.
+func Status(fsys ppath.Fs, stateDir, sourceRoot, destPath string, recursive bool) (found []LinkStatus, err error) {
+	if sourceRoot, destPath, err = absRoots(fsys, sourceRoot, destPath); err != nil {
+		return nil, err
+	}
+
+	st, err := ReadState(fsys, stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, lp := range st.linkPaths(sourceRoot, destPath, recursive) {
+		ls, err := managedStatus(fsys, lp, st.Links[lp])
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, ls)
+	}
+
+	err = eachEntry(fsys, sourceRoot, destPath, recursive, func(path string) error {
+		if _, ok := st.Links[path]; ok {
+			return nil
+		}
+		data, target, err := linkInto(fsys, path, sourceRoot)
+		if data != "" {
+			found = append(found, LinkStatus{LinkPath: path, LinkData: data, Vpath: target, Status: StatusForeign})
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(found, func(i, j int) bool { return found[i].LinkPath < found[j].LinkPath })
+	return found, nil
+}
+
+// Uninstall removes each of the managed links on fsys that are ok, checking
+// first that they haven't changed, and sets Removed on them. dfi stops
+// managing the links it removed, and those that are missing or changed.
+// Foreign links are left alone.
+func Uninstall(fsys ppath.Fs, stateDir string, links []LinkStatus) error {
+	var forget []string
+	var err error
+
+	for i := range links {
+		ls := &links[i]
+		if ls.Status == StatusForeign {
+			continue
+		}
+		if ls.Status != StatusOK {
+			forget = append(forget, ls.LinkPath)
+			continue
+		}
+
+		var current LinkStatus
+		if current, err = managedStatus(fsys, ls.LinkPath, LinkRecord{LinkData: ls.LinkData}); err != nil {
+			break
+		}
+		if current.Status != StatusOK {
+			log.WithField("LinkPath", ls.LinkPath).Warn("link changed since it was found, not removing")
+			forget = append(forget, ls.LinkPath)
+			continue
+		}
+
+		if err = ppath.NewPosixPathFs(fsys, ls.LinkPath).Remove(); err != nil {
+			err = errors.Wrapf(err, "failed to remove %#v", ls.LinkPath)
+			break
+		}
+
+		ls.Removed = true
+		forget = append(forget, ls.LinkPath)
+		log.WithFields(log.Fields{
+			"LinkPath": ls.LinkPath,
+			"LinkData": ls.LinkData,
+		}).Info("removed link")
+	}
+
+	if len(forget) == 0 {
+		return err
+	}
+	if e := UpdateState(fsys, stateDir, func(st *State) error { st.Forget(forget...); return nil }); err == nil {
+		err = e
+	}
+	return err
+}
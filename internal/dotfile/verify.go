@@ -0,0 +1,260 @@
+package dotfile
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	fp "path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+
+	ppath "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+type (
+	// SourceSum is the checksum of a source when it was last installed
+	SourceSum struct {
+		// SHA256 is the hex digest of a file's contents, or for a directory
+		// of the names, types and contents of everything in it, see hashSource
+		SHA256    string    `json:"sha256"`
+		RunID     string    `json:"run_id"`
+		Installed time.Time `json:"installed"`
+	}
+
+	// Lockfile is the checksums of the sources that were installed, keyed
+	// by Vpath
+	Lockfile struct {
+		Version int                  `json:"version"`
+		Sources map[string]SourceSum `json:"sources"`
+	}
+
+	// VerifyStatus says how a source compares with its SourceSum
+	VerifyStatus string
+
+	// SourceCheck is the result of verifying a source
+	SourceCheck struct {
+		Vpath  string       `json:"vpath"`
+		Want   string       `json:"want"`
+		Got    string       `json:"got,omitempty"`
+		RunID  string       `json:"run_id"`
+		Status VerifyStatus `json:"status"`
+	}
+)
+
+const (
+	LockfileName    = "sums.json"
+	lockfileVersion = 1
+
+	// VerifyOK is a source that hasn't changed since it was installed
+	VerifyOK VerifyStatus = "ok"
+	// VerifyChanged is a source whose contents have changed
+	VerifyChanged VerifyStatus = "changed"
+	// VerifyMissing is a source that no longer exists
+	VerifyMissing VerifyStatus = "missing"
+)
+
+func lockfilePath(stateDir string) string {
+	return fp.Join(stateDir, LockfileName)
+}
+
+// ReadLockfile reads the lockfile in stateDir on fsys, an empty one if
+// there's none yet
+func ReadLockfile(fsys ppath.Fs, stateDir string) (*Lockfile, error) {
+	lf := &Lockfile{Version: lockfileVersion, Sources: map[string]SourceSum{}}
+
+	b, err := afero.ReadFile(fsys, lockfilePath(stateDir))
+	switch {
+	case os.IsNotExist(err):
+		return lf, nil
+	case err != nil:
+		return nil, errors.Wrapf(err, "failed to read lockfile %#v", lockfilePath(stateDir))
+	}
+
+	if err = json.Unmarshal(b, lf); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse lockfile %#v", lockfilePath(stateDir))
+	}
+	if lf.Version > lockfileVersion {
+		return nil, errors.Errorf("lockfile %#v is version %d, we only understand up to %d",
+			lockfilePath(stateDir), lf.Version, lockfileVersion)
+	}
+	if lf.Sources == nil {
+		lf.Sources = map[string]SourceSum{}
+	}
+	return lf, nil
+}
+
+// UpdateLockfile reads the lockfile in stateDir on fsys, calls fn to
+// change it, and writes it back, holding the lock on it while we do
+func UpdateLockfile(fsys ppath.Fs, stateDir string, fn func(lf *Lockfile) error) error {
+	return withFileLocked(fsys, lockfilePath(stateDir), func() error {
+		lf, err := ReadLockfile(fsys, stateDir)
+		if err != nil {
+			return err
+		}
+		if err = fn(lf); err != nil {
+			return err
+		}
+		return writeJSON(fsys, lockfilePath(stateDir), lf)
+	})
+}
+
+// hashFile writes the contents of the file at path to h
+func hashFile(fsys ppath.Fs, path string, h hash.Hash) error {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %#v", path)
+	}
+	defer f.Close()
+
+	_, err = io.Copy(h, f)
+	return errors.Wrapf(err, "failed to read %#v", path)
+}
+
+// hashSource returns the checksum of the source at vpath. a file's is the
+// sha256 of its contents, so it matches sha256sum. a directory's covers
+// the relative path, type and contents of everything below it, in order,
+// with symlinks hashed by their contents rather than followed.
+func hashSource(fsys ppath.Fs, vpath string) (string, error) {
+	h := sha256.New()
+	root := ppath.NewPosixPathFs(fsys, vpath)
+
+	info, err := root.Lstat()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to stat source %#v", vpath)
+	}
+	if !info.IsDir() {
+		if err = hashFile(fsys, vpath, h); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%x", h.Sum(nil)), nil
+	}
+
+	err = root.Walk(func(pp ppath.PosixPath, info ppath.RichFileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := fp.Rel(vpath, pp.String())
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case info.IsDir():
+			fmt.Fprintf(h, "d %s\x00", rel)
+		case info.IsSymlink():
+			data, err := pp.Readlink()
+			if err != nil {
+				return errors.Wrapf(err, "failed to readlink %#v", pp.String())
+			}
+			fmt.Fprintf(h, "l %s\x00%s\x00", rel, data.String())
+		case info.Mode().IsRegular():
+			fh := sha256.New()
+			if err := hashFile(fsys, pp.String(), fh); err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "f %s\x00%x\x00", rel, fh.Sum(nil))
+		default:
+			return errors.WithStack(&UnsupportedFileTypeError{Path: pp.String(), Mode: info.Mode(), Action: "hash"})
+		}
+		return nil
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to hash %#v", vpath)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// recordSums writes the checksums of the sources of the links in inPlace
+// to the lockfile. the sources of links that were already in place, in
+// already, keep the checksums they have, so one that was edited through its
+// link still shows up as modified.
+func (n *Installer) recordSums(inPlace []LinkData, already map[string]bool, runID string) error {
+	return UpdateLockfile(n.fsys(), n.stateDir, func(lf *Lockfile) error {
+		sums := make(map[string]string, len(inPlace))
+		for _, ld := range inPlace {
+			if _, ok := lf.Sources[ld.Vpath]; ok && already[ld.LinkPath] {
+				continue
+			}
+			sum, err := hashSource(n.fsys(), ld.Vpath)
+			if err != nil {
+				return err
+			}
+			sums[ld.Vpath] = sum
+		}
+
+		now := time.Now().UTC()
+		for vpath, sum := range sums {
+			if lf.Sources[vpath].SHA256 == sum {
+				continue
+			}
+			lf.Sources[vpath] = SourceSum{SHA256: sum, RunID: runID, Installed: now}
+			log.WithFields(log.Fields{"Vpath": vpath, "SHA256": sum}).Debug("recorded checksum")
+		}
+		return nil
+	})
+}
+
+// Verify hashes the sources on fsys in the lockfile in stateDir that are in
+// one of sourceRoots, or all of them if there are none, and compares them
+// with their checksums from when they were installed. The results are
+// sorted by Vpath. If any have changed or gone missing, a
+// ModifiedSourcesError is returned with them.
+func Verify(fsys ppath.Fs, stateDir string, sourceRoots []string) ([]SourceCheck, error) {
+	roots, err := mkAbs(sourceRoots)
+	if err != nil {
+		return nil, err
+	}
+
+	lf, err := ReadLockfile(fsys, stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	inRoots := func(vpath string) bool {
+		for _, r := range roots {
+			if isUnder(vpath, r) {
+				return true
+			}
+		}
+		return len(roots) == 0
+	}
+
+	var checks []SourceCheck
+	modified := &ModifiedSourcesError{}
+
+	for vpath, sum := range lf.Sources {
+		if !inRoots(vpath) {
+			continue
+		}
+
+		sc := SourceCheck{Vpath: vpath, Want: sum.SHA256, RunID: sum.RunID, Status: VerifyOK}
+		got, err := hashSource(fsys, vpath)
+		switch {
+		case os.IsNotExist(errors.Cause(err)) || ppath.IsNotDir(err):
+			sc.Status = VerifyMissing
+			modified.Missing++
+		case err != nil:
+			return nil, err
+		case got != sum.SHA256:
+			sc.Got, sc.Status = got, VerifyChanged
+			modified.Changed++
+		default:
+			sc.Got = got
+		}
+		checks = append(checks, sc)
+	}
+
+	sort.Slice(checks, func(i, j int) bool { return checks[i].Vpath < checks[j].Vpath })
+
+	if modified.Changed+modified.Missing > 0 {
+		return checks, errors.WithStack(modified)
+	}
+	return checks, nil
+}
@@ -0,0 +1,105 @@
+package dotfile
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+
+	pl "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+func (s *InstallerSuite) TestHashSource() {
+	r := s.Require()
+	mfs := pl.NewMemFs()
+	r.NoError(mfs.MkdirAll("/src/vim/colors", 0o755))
+	r.NoError(afero.WriteFile(mfs, "/src/vim/vimrc", []byte("set nocp"), 0o644))
+	r.NoError(afero.WriteFile(mfs, "/src/vim/colors/dark.vim", []byte("hi Normal"), 0o644))
+
+	// a file's is the same as sha256sum's
+	sum, err := hashSource(mfs, "/src/vim/vimrc")
+	r.NoError(err)
+	s.Equal(fmt.Sprintf("%x", sha256.Sum256([]byte("set nocp"))), sum)
+
+	before, err := hashSource(mfs, "/src/vim")
+	r.NoError(err)
+
+	// a directory's changes with the contents, names or links below it
+	changes := []func(){
+		func() { r.NoError(afero.WriteFile(mfs, "/src/vim/colors/dark.vim", []byte("hi Comment"), 0o644)) },
+		func() { r.NoError(mfs.Rename("/src/vim/colors/dark.vim", "/src/vim/colors/light.vim")) },
+		func() { r.NoError(mfs.Symlink("colors/light.vim", "/src/vim/light.vim")) },
+	}
+	for i, change := range changes {
+		change()
+		after, err := hashSource(mfs, "/src/vim")
+		r.NoError(err)
+		s.NotEqual(before, after, "change %d", i)
+		before = after
+	}
+}
+
+func (s *InstallerSuite) TestVerify() {
+	r := s.Require()
+	stateDir := s.fsFix.TempDir.Join("state").String()
+
+	s.runWithState(stateDir)
+	checks, err := Verify(pl.NewOsFs(), stateDir, nil)
+	r.NoError(err)
+	r.Len(checks, len(s.fsFix.Dotfiles))
+	for _, sc := range checks {
+		s.Equal(VerifyOK, sc.Status, sc.Vpath)
+	}
+
+	// an edit made through the link
+	r.NoError(ioutil.WriteFile(s.fsFix.HomeDir.Join(".bashrc").String(), []byte("rewritten"), 0o644))
+	r.NoError(s.fsFix.DotfileDir.Join("vimrc").Remove())
+
+	checks, err = Verify(pl.NewOsFs(), stateDir, []string{s.fsFix.SettingsDir.String()})
+	var modified *ModifiedSourcesError
+	r.True(errors.As(err, &modified))
+	s.Equal(ModifiedSourcesError{Changed: 1, Missing: 1}, *modified)
+
+	status := map[string]VerifyStatus{}
+	for _, sc := range checks {
+		status[sc.Vpath] = sc.Status
+	}
+	s.Equal(VerifyChanged, status[s.fsFix.DotfileDir.Join("bashrc").String()])
+	s.Equal(VerifyMissing, status[s.fsFix.DotfileDir.Join("vimrc").String()])
+	s.Equal(VerifyOK, status[s.fsFix.DotfileDir.Join("zshrc").String()])
+
+	// sources outside the given roots aren't checked
+	checks, err = Verify(pl.NewOsFs(), stateDir, []string{s.fsFix.BinDir.String()})
+	r.NoError(err)
+	r.Empty(checks)
+}
+
+func (s *InstallerSuite) TestVerifyAfterRerun() {
+	r := s.Require()
+	stateDir := s.fsFix.TempDir.Join("state").String()
+	s.runWithState(stateDir)
+
+	// an edit through a link that's still in place stays modified when
+	// the links are installed again
+	r.NoError(ioutil.WriteFile(s.fsFix.HomeDir.Join(".bashrc").String(), []byte("rewritten"), 0o644))
+
+	// a link the run has to make again records the source as it is now
+	r.NoError(ioutil.WriteFile(s.fsFix.DotfileDir.Join("zshrc").String(), []byte("edited"), 0o644))
+	r.NoError(s.fsFix.HomeDir.Join(".zshrc").Remove())
+
+	s.runWithState(stateDir)
+
+	checks, err := Verify(pl.NewOsFs(), stateDir, nil)
+	var modified *ModifiedSourcesError
+	r.True(errors.As(err, &modified), "%v", err)
+	s.Equal(ModifiedSourcesError{Changed: 1}, *modified)
+
+	status := map[string]VerifyStatus{}
+	for _, sc := range checks {
+		status[sc.Vpath] = sc.Status
+	}
+	s.Equal(VerifyChanged, status[s.fsFix.DotfileDir.Join("bashrc").String()])
+	s.Equal(VerifyOK, status[s.fsFix.DotfileDir.Join("zshrc").String()])
+}
@@ -0,0 +1,163 @@
+package dotfile
+
+import (
+	fp "path/filepath"
+	str "strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	ppath "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+type (
+	// WatchSettings configures Watch. The SourcePaths of the embedded
+	// Settings are ignored, instead every entry of each of the SourceDirs
+	// is linked into DestPath.
+	WatchSettings struct {
+		Settings
+
+		SourceDirs []string
+
+		// Debounce is how long to wait for the source directories to stop
+		// changing before we sync, so a burst of changes (eg. 'git pull')
+		// only causes one run.
+		Debounce time.Duration
+	}
+
+	WatchFn func(s *WatchSettings, stop <-chan struct{}) error
+
+	// changeNotifier tells us when the entries of a directory change,
+	// the implementation is platform specific, and polls when that can't
+	// watch the filesystem
+	changeNotifier interface {
+		// Changes sends the path of each entry that was added, removed or renamed
+		Changes() <-chan string
+		Errors() <-chan error
+		Close() error
+	}
+)
+
+const DefaultDebounce = 500 * time.Millisecond
+
+var _ WatchFn = Watch
+
+// sourcesIn lists the entries of dir on fsys the same way the shell would
+// expand 'dir/*', i.e. names starting with '.' are skipped
+func sourcesIn(fsys ppath.Fs, dir string) ([]string, error) {
+	entries, err := ppath.NewPosixPathFs(fsys, dir).ReadDir()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read source dir %#v", dir)
+	}
+
+	sources := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !str.HasPrefix(e.Name(), ".") {
+			sources = append(sources, e.String())
+		}
+	}
+	return sources, nil
+}
+
+// syncLinks links every entry of the source dirs into the destination,
+// and removes any links in the destination to entries that are gone. the
+// destination is locked while we do, not for the whole time we're watching.
+func syncLinks(s *WatchSettings) error {
+	return s.locked(func() error { return doSyncLinks(s) })
+}
+
+func doSyncLinks(s *WatchSettings) error {
+	stateDir, err := s.stateDir()
+	if err != nil {
+		return err
+	}
+
+	var sources []string
+	for _, d := range s.SourceDirs {
+		entries, err := sourcesIn(s.fsys(), d)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, entries...)
+	}
+
+	if err = s.installer(stateDir).Run(sources, s.DestPath); err != nil {
+		return err
+	}
+
+	for _, d := range s.SourceDirs {
+		dangling, err := FindDangling(s.fsys(), d, s.DestPath, false)
+		if err != nil {
+			return err
+		}
+		if err = PruneDangling(s.fsys(), stateDir, dangling, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Watch syncs the links once, and then again every time the entries of
+// the source directories change, until stop is closed. Errors while syncing
+// are logged, errors watching the directories are returned.
+func Watch(s *WatchSettings, stop <-chan struct{}) (err error) {
+	if s.SourceDirs, err = mkAbs(s.SourceDirs); err != nil {
+		return err
+	}
+	if s.DestPath, err = fp.Abs(s.DestPath); err != nil {
+		return errors.Wrapf(err, "failed to Abs(%#v)", s.DestPath)
+	}
+	if s.Debounce <= 0 {
+		s.Debounce = DefaultDebounce
+	}
+
+	notifier, err := newChangeNotifier(s.fsys(), s.SourceDirs)
+	if err != nil {
+		return err
+	}
+	defer notifier.Close()
+
+	sync := func() {
+		if err := syncLinks(s); err != nil {
+			log.WithField("err", err.Error()).Error("failed to sync links")
+		}
+	}
+
+	sync()
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case err = <-notifier.Errors():
+			return err
+		case path := <-notifier.Changes():
+			log.WithField("path", path).Debug("source changed, waiting for things to settle")
+		}
+
+		// wait until nothing has changed for s.Debounce
+		timer := time.NewTimer(s.Debounce)
+	debounce:
+		for {
+			select {
+			case <-stop:
+				timer.Stop()
+				return nil
+			case err = <-notifier.Errors():
+				timer.Stop()
+				return err
+			case <-notifier.Changes():
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(s.Debounce)
+			case <-timer.C:
+				break debounce
+			}
+		}
+
+		sync()
+	}
+}
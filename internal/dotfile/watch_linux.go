@@ -0,0 +1,104 @@
+package dotfile
+
+import (
+	"bytes"
+	"os"
+	fp "path/filepath"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	ppath "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+const inotifyMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO |
+	unix.IN_DELETE_SELF | unix.IN_MOVE_SELF
+
+type inotifyNotifier struct {
+	file    *os.File
+	watches map[int32]string
+	changes chan string
+	errors  chan error
+	done    chan struct{}
+}
+
+var _ changeNotifier = &inotifyNotifier{}
+
+// newChangeNotifier watches dirs with inotify, or polls them if they're
+// not on the real filesystem
+func newChangeNotifier(fsys ppath.Fs, dirs []string) (changeNotifier, error) {
+	if !ppath.IsOsFs(fsys) {
+		return newPollNotifier(fsys, dirs)
+	}
+
+	// non-blocking, so the runtime poller manages it and Close interrupts Read
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, errors.Wrap(err, "inotify_init1 failed")
+	}
+
+	n := &inotifyNotifier{
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		watches: make(map[int32]string),
+		changes: make(chan string),
+		errors:  make(chan error, 1),
+		done:    make(chan struct{}),
+	}
+
+	for _, d := range dirs {
+		wd, err := unix.InotifyAddWatch(fd, d, inotifyMask)
+		if err != nil {
+			n.file.Close()
+			return nil, errors.Wrapf(err, "failed to watch %#v", d)
+		}
+		n.watches[int32(wd)] = d
+	}
+
+	go n.readEvents()
+
+	return n, nil
+}
+
+func (n *inotifyNotifier) Changes() <-chan string { return n.changes }
+func (n *inotifyNotifier) Errors() <-chan error   { return n.errors }
+
+func (n *inotifyNotifier) Close() error {
+	close(n.done)
+	return n.file.Close()
+}
+
+func (n *inotifyNotifier) readEvents() {
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+
+	for {
+		count, err := n.file.Read(buf)
+		if err != nil {
+			select {
+			case <-n.done: // we were closed
+			default:
+				n.errors <- errors.Wrap(err, "failed to read inotify events")
+			}
+			return
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= count; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + unix.SizeofInotifyEvent
+			name := bytes.TrimRight(buf[nameStart:nameStart+int(event.Len)], "\x00")
+			offset = nameStart + int(event.Len)
+
+			dir := n.watches[event.Wd]
+			if event.Mask&(unix.IN_DELETE_SELF|unix.IN_MOVE_SELF) != 0 {
+				n.errors <- errors.Errorf("source dir %#v was removed or renamed", dir)
+				return
+			}
+
+			select {
+			case n.changes <- fp.Join(dir, string(name)):
+			case <-n.done:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package dotfile
+
+import (
+	ppath "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+func newChangeNotifier(fsys ppath.Fs, dirs []string) (changeNotifier, error) {
+	return newPollNotifier(fsys, dirs)
+}
@@ -0,0 +1,103 @@
+package dotfile
+
+import (
+	"sort"
+	str "strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+
+	ppath "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+// without inotify, or a filesystem it can watch, we poll the directories
+// for changes in their entries
+const pollInterval = time.Second
+
+type pollNotifier struct {
+	fs      ppath.Fs
+	dirs    []string
+	last    map[string]string
+	changes chan string
+	errors  chan error
+	done    chan struct{}
+}
+
+var _ changeNotifier = &pollNotifier{}
+
+func newPollNotifier(fsys ppath.Fs, dirs []string) (changeNotifier, error) {
+	n := &pollNotifier{
+		fs:      fsys,
+		dirs:    dirs,
+		last:    make(map[string]string),
+		changes: make(chan string),
+		errors:  make(chan error, 1),
+		done:    make(chan struct{}),
+	}
+
+	for _, d := range dirs {
+		names, err := n.names(d)
+		if err != nil {
+			return nil, err
+		}
+		n.last[d] = names
+	}
+
+	go n.poll()
+
+	return n, nil
+}
+
+func (n *pollNotifier) Changes() <-chan string { return n.changes }
+func (n *pollNotifier) Errors() <-chan error   { return n.errors }
+
+func (n *pollNotifier) Close() error {
+	close(n.done)
+	return nil
+}
+
+func (n *pollNotifier) names(dir string) (string, error) {
+	entries, err := afero.ReadDir(n.fs, dir)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read source dir %#v", dir)
+	}
+
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name()
+	}
+	sort.Strings(names)
+	return str.Join(names, "\x00"), nil
+}
+
+func (n *pollNotifier) poll() {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+
+		for _, d := range n.dirs {
+			names, err := n.names(d)
+			if err != nil {
+				n.errors <- err
+				return
+			}
+			if names == n.last[d] {
+				continue
+			}
+			n.last[d] = names
+
+			select {
+			case n.changes <- d:
+			case <-n.done:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package dotfile
+
+import (
+	"time"
+
+	pl "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+// eventually polls cond until it's true or the timeout expires
+func eventually(cond func() bool) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func (s *InstallerSuite) TestWatch() {
+	r := s.Require()
+	home := s.fsFix.HomeDir
+	stop := make(chan struct{})
+	done := make(chan error)
+
+	go func() {
+		done <- Watch(&WatchSettings{
+			Settings: Settings{
+				Prefix:     ".",
+				OnConflict: Fail,
+				DestPath:   home.String(),
+				StateDir:   s.fsFix.TempDir.Join("state").String(),
+			},
+			SourceDirs: []string{s.fsFix.DotfileDir.String()},
+			Debounce:   20 * time.Millisecond,
+		}, stop)
+	}()
+
+	linked := func(p pl.PosixPath) func() bool {
+		return func() bool { return p.IsSymlink() }
+	}
+
+	r.True(eventually(linked(home.Join(".bashrc"))), "initial sync should link existing files")
+
+	s.fsFix.DotfileDir.Join("tmux.conf").Must().Touch(0o644, false)
+	r.True(eventually(linked(home.Join(".tmux.conf"))), "new source should be linked")
+
+	r.NoError(s.fsFix.DotfileDir.Join("vimrc").Remove())
+	r.True(eventually(func() bool { return !home.Join(".vimrc").Lexists() }), "link to removed source should be pruned")
+
+	close(stop)
+	r.NoError(<-done)
+}
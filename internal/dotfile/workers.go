@@ -0,0 +1,111 @@
+package dotfile
+
+import (
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type (
+	// linkResult is the outcome of applying one LinkData
+	linkResult struct {
+		// journal holds the changes that were made, nil if the link
+		// was never attempted because an earlier one failed
+		journal *journal
+		err     error
+	}
+
+	// dirLocks hands out a lock per directory
+	dirLocks struct {
+		mu    sync.Mutex
+		locks map[string]*sync.Mutex
+	}
+)
+
+func newDirLocks() *dirLocks {
+	return &dirLocks{locks: make(map[string]*sync.Mutex)}
+}
+
+// lock locks dir, and returns the function that unlocks it
+func (d *dirLocks) lock(dir string) (unlock func()) {
+	d.mu.Lock()
+	l, ok := d.locks[dir]
+	if !ok {
+		l = &sync.Mutex{}
+		d.locks[dir] = l
+	}
+	d.mu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// applyOne applies ld, using the receiver's ApplyFn if it has one
+func (n *Installer) applyOne(l *linker, ld LinkData, j *journal) error {
+	if n.apply != nil {
+		return n.apply(ld)
+	}
+	return l.apply(ld, j)
+}
+
+// applyAll applies each LinkData using up to n.workers goroutines, and
+// returns the results in the same order. Unless we're keeping going, links
+// that haven't been started when one fails are skipped. When we are, a
+// failed link's changes are rolled back straight away.
+func (n *Installer) applyAll(linkData []LinkData) []linkResult {
+	l := &linker{
+		fs:       n.fsys(),
+		conflict: n.onConflict,
+		hooks:    n.hooks,
+		runHook:  n.runHook,
+		dirLocks: newDirLocks(),
+		atomic:   n.atomic,
+
+		replaceInto: n.replaceInto,
+	}
+
+	workers := n.workers
+	if workers < 1 {
+		workers = 1
+	} else if workers > len(linkData) {
+		workers = len(linkData)
+	}
+
+	results := make([]linkResult, len(linkData))
+	indexes := make(chan int)
+	var failed int32
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if atomic.LoadInt32(&failed) != 0 {
+					continue
+				}
+
+				ld := linkData[i]
+				j := newJournal(l.fs)
+				err := n.applyOne(l, ld, j)
+
+				if err != nil && n.keepGoing {
+					err = j.rollback(err)
+					log.WithFields(log.Fields{"LinkPath": ld.LinkPath, "err": err.Error()}).Error("failed to link, keeping going")
+				} else if err != nil {
+					atomic.StoreInt32(&failed, 1)
+				}
+				results[i] = linkResult{journal: j, err: err}
+			}
+		}()
+	}
+
+	for i := range linkData {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return results
+}
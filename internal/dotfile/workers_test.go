@@ -0,0 +1,147 @@
+package dotfile
+
+import (
+	"fmt"
+	"os"
+	fp "path/filepath"
+	str "strings"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	fsf "github.com/slyphon/dfi/internal/fsfixture"
+	pl "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+// newBigMemHome is newMemHome with n more dotfiles, every other one of
+// which has a file in the way in the home dir
+func (s *InstallerSuite) newBigMemHome(n int) (*pl.MemFs, []string) {
+	mfs := newMemHome(s.Require())
+	sources := append([]string{}, memSources...)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("rc%03d", i)
+		src := pl.NewPosixPathFs(mfs, "/home/user/.settings/dotfiles/"+name)
+		src.Must().Touch(0o644, false)
+		sources = append(sources, src.String())
+
+		if i%2 == 0 {
+			pl.NewPosixPathFs(mfs, "/home/user/."+name).Must().Touch(0o644, false)
+		}
+	}
+	return mfs, sources
+}
+
+func (s *InstallerSuite) TestWorkersMatchSequentialRun() {
+	var trees [][]string
+	for _, workers := range []int{1, 8} {
+		mfs, sources := s.newBigMemHome(100)
+		s.NoError(NewInstaller(".", ConflictHandlers.Rename).
+			WithFs(mfs).
+			WithWorkers(workers).
+			Run(sources, "/home/user"))
+
+		var tree []string
+		pl.NewPosixPathFs(mfs, "/home/user").Must().Walk(func(p pl.PosixPath, info pl.RichFileInfo, err error) error {
+			s.NoError(err)
+			if info.IsDir() && p.Name() == ".settings" {
+				return fp.SkipDir
+			}
+			// backup names have a timestamp in them, so only the
+			// name they were backed up from is compared
+			if i := str.Index(p.String(), ".dfi_"); i >= 0 {
+				tree = append(tree, "backup of "+p.String()[:i])
+			} else if info.IsSymlink() {
+				tree = append(tree, p.String()+" -> "+p.Must().Readlink().String())
+			}
+			return nil
+		})
+		trees = append(trees, tree)
+	}
+
+	s.Len(trees[0], 103+52)
+	s.Equal(trees[0], trees[1])
+}
+
+func (s *InstallerSuite) TestWorkersKeepGoingFailuresAreInOrder() {
+	for i := 0; i < 5; i++ {
+		mfs, sources := s.newBigMemHome(100)
+		ffs := pl.NewFaultFs(mfs).
+			Inject(pl.Fault{Op: pl.FaultSymlink, Pattern: "**/.rc0[0-9]7", Err: syscall.EACCES})
+
+		err := NewInstaller(".", ConflictHandlers.Rename).
+			WithFs(ffs).
+			WithWorkers(8).
+			WithKeepGoing(true).
+			Run(sources, "/home/user")
+
+		var failed *FailedLinksError
+		s.Require().True(errors.As(err, &failed))
+		s.Equal(103, failed.Total)
+		s.Require().Len(failed.Failures, 10)
+		for j, f := range failed.Failures {
+			s.Equal(fmt.Sprintf("/home/user/.rc0%d7", j), f.LinkPath)
+			s.True(os.IsPermission(errors.Cause(f.Err)))
+		}
+	}
+}
+
+func (s *InstallerSuite) TestWorkersRollBackEverything() {
+	mfs, sources := s.newBigMemHome(100)
+	ffs := pl.NewFaultFs(mfs).
+		Inject(pl.Fault{Op: pl.FaultSymlink, Pattern: "**/.rc050", Err: syscall.EACCES})
+
+	err := NewInstaller(".", ConflictHandlers.Replace).
+		WithFs(ffs).
+		WithWorkers(8).
+		Run(sources, "/home/user")
+	s.Error(err)
+	s.True(os.IsPermission(errors.Cause(err)))
+	s.Contains(err.Error(), "/home/user/.rc050")
+
+	requireUntouched(s.Require(), mfs)
+	for i := 0; i < 100; i++ {
+		p := pl.NewPosixPathFs(mfs, fmt.Sprintf("/home/user/.rc%03d", i))
+		if i%2 == 0 {
+			s.True(p.IsFile(), p.String())
+		} else {
+			s.False(p.Lexists(), p.String())
+		}
+	}
+}
+
+// newBenchFixture returns an FsFixture whose Binfiles are n new files
+func newBenchFixture(b *testing.B, n int) fsf.FsFixture {
+	fsFix := fsf.NewFsFixture()
+	fsFix.Binfiles = nil
+	for i := 0; i < n; i++ {
+		p := fsFix.BinDir.Join(fmt.Sprintf("bench%03d", i))
+		p.Must().Touch(0o755, false)
+		fsFix.Binfiles = append(fsFix.Binfiles, p)
+	}
+	return fsFix
+}
+
+func BenchmarkInstaller(b *testing.B) {
+	fsFix := newBenchFixture(b, 200)
+	defer fsFix.Cleanup()
+	sources := pl.PosixSliceStringer(fsFix.Binfiles)
+
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				fsFix.LocalBinDir.Must().RemoveAll()
+				fsFix.LocalBinDir.Must().MkdirAll(fsf.DirPerms)
+				b.StartTimer()
+
+				err := NewInstaller("", ConflictHandlers.Rename).
+					WithWorkers(workers).
+					Run(sources, fsFix.LocalBinDir.String())
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
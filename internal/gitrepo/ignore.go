@@ -0,0 +1,250 @@
+package gitrepo
+
+import (
+	"bufio"
+	"os"
+	"path"
+	fp "path/filepath"
+	"strings"
+
+	"github.com/gobwas/glob"
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+
+	pl "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+type (
+	ignorePattern struct {
+		// base is the directory of the file the pattern came from, relative
+		// to the work tree ("" for the top level and info/exclude)
+		base     string
+		negate   bool
+		dirOnly  bool
+		anchored bool
+		globs    []glob.Glob
+	}
+
+	// ignoreStack lazily loads and caches the .gitignore of each directory
+	ignoreStack struct {
+		repo    *Repo
+		global  []ignorePattern
+		perDir  map[string][]ignorePattern
+		loadErr error
+		loaded  bool
+	}
+)
+
+func newIgnoreStack(r *Repo) *ignoreStack {
+	return &ignoreStack{repo: r, perDir: make(map[string][]ignorePattern)}
+}
+
+// escape the glob syntax gobwas supports that gitignore does not
+var braceEscaper = strings.NewReplacer("{", `\{`, "}", `\}`)
+
+func compileGlobs(pattern string) ([]glob.Glob, error) {
+	pattern = braceEscaper.Replace(pattern)
+	variants := []string{pattern}
+
+	// '**/' may also match nothing at all
+	if strings.HasPrefix(pattern, "**/") {
+		variants = append(variants, strings.TrimPrefix(pattern, "**/"))
+	}
+	if strings.Contains(pattern, "/**/") {
+		variants = append(variants, strings.Replace(pattern, "/**/", "/", -1))
+	}
+
+	globs := make([]glob.Glob, 0, len(variants))
+	for _, v := range variants {
+		g, err := glob.Compile(v, '/')
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid ignore pattern %#v", pattern)
+		}
+		globs = append(globs, g)
+	}
+	return globs, nil
+}
+
+func parseIgnoreLine(base, line string) (*ignorePattern, error) {
+	if !strings.HasSuffix(line, `\ `) {
+		line = strings.TrimRight(line, " ")
+	}
+
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+
+	p := &ignorePattern{base: base}
+
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	// a slash anywhere but the end anchors the pattern to base
+	if strings.Contains(line, "/") {
+		p.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+
+	if line == "" {
+		return nil, nil
+	}
+
+	var err error
+	if p.globs, err = compileGlobs(line); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func readIgnoreFile(path, base string) ([]ignorePattern, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) || pl.IsNotDir(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %#v", path)
+	}
+	defer f.Close()
+
+	var patterns []ignorePattern
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		p, err := parseIgnoreLine(base, scanner.Text())
+		if err != nil {
+			return nil, errors.WithMessagef(err, "in %#v", path)
+		}
+		if p != nil {
+			patterns = append(patterns, *p)
+		}
+	}
+	return patterns, errors.Wrapf(scanner.Err(), "failed to read %#v", path)
+}
+
+func (p ignorePattern) matches(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+
+	if p.base != "" {
+		if !strings.HasPrefix(rel, p.base+"/") {
+			return false
+		}
+		rel = strings.TrimPrefix(rel, p.base+"/")
+	}
+
+	subject := rel
+	if !p.anchored {
+		subject = path.Base(rel)
+	}
+
+	for _, g := range p.globs {
+		if g.Match(subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// lowest precedence patterns: the user's global excludes, and info/exclude
+func (s *ignoreStack) loadGlobal() ([]ignorePattern, error) {
+	if s.loaded {
+		return s.global, s.loadErr
+	}
+	s.loaded = true
+
+	var files []string
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		files = append(files, fp.Join(xdg, "git", "ignore"))
+	} else if home, err := homedir.Dir(); err == nil {
+		files = append(files, fp.Join(home, ".config", "git", "ignore"))
+	}
+	files = append(files, fp.Join(s.repo.CommonDir, "info", "exclude"))
+
+	for _, f := range files {
+		patterns, err := readIgnoreFile(f, "")
+		if err != nil {
+			s.loadErr = err
+			return nil, err
+		}
+		s.global = append(s.global, patterns...)
+	}
+	return s.global, nil
+}
+
+func (s *ignoreStack) forDir(dir string) ([]ignorePattern, error) {
+	if patterns, ok := s.perDir[dir]; ok {
+		return patterns, nil
+	}
+
+	base := dir
+	if dir == "." {
+		base = ""
+	}
+
+	patterns, err := readIgnoreFile(fp.Join(s.repo.WorkTree, fp.FromSlash(dir), ".gitignore"), base)
+	if err != nil {
+		return nil, err
+	}
+	s.perDir[dir] = patterns
+	return patterns, nil
+}
+
+// isExcluded applies all the patterns that are in effect for rel, the last
+// matching pattern wins.
+func (s *ignoreStack) isExcluded(rel string, isDir bool) (bool, error) {
+	patterns, err := s.loadGlobal()
+	if err != nil {
+		return false, err
+	}
+
+	// collect .gitignore files from the top of the work tree down to rel's parent
+	var dirs []string
+	for d := path.Dir(rel); ; d = path.Dir(d) {
+		dirs = append([]string{d}, dirs...)
+		if d == "." {
+			break
+		}
+	}
+
+	all := append([]ignorePattern(nil), patterns...)
+	for _, d := range dirs {
+		p, err := s.forDir(d)
+		if err != nil {
+			return false, err
+		}
+		all = append(all, p...)
+	}
+
+	excluded := false
+	for _, p := range all {
+		if p.matches(rel, isDir) {
+			excluded = !p.negate
+		}
+	}
+	return excluded, nil
+}
+
+// isIgnored returns true if rel, or any of its parent directories, is
+// excluded. As in git, a file can't be re-included if its parent directory
+// is excluded.
+func (s *ignoreStack) isIgnored(rel string, isDir bool) (bool, error) {
+	parts := strings.Split(rel, "/")
+
+	for i := 1; i <= len(parts); i++ {
+		last := i == len(parts)
+		if excluded, err := s.isExcluded(strings.Join(parts[:i], "/"), isDir || !last); err != nil {
+			return false, err
+		} else if excluded {
+			return true, nil
+		}
+	}
+	return false, nil
+}
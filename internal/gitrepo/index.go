@@ -0,0 +1,233 @@
+package gitrepo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	IndexEntry struct {
+		Path string
+		Mode uint32
+		Size uint32
+		Hash []byte
+	}
+
+	// Index is the list of entries in a git index (aka. the staging area),
+	// sorted by Path. Extensions are ignored.
+	Index struct {
+		Version uint32
+		Entries []IndexEntry
+	}
+)
+
+const (
+	indexSignature = "DIRC"
+
+	modeTypeMask = 0o170000
+	modeSymlink  = 0o120000
+	modeGitlink  = 0o160000
+
+	flagExtended = 0x4000
+	flagNameMask = 0x0fff
+
+	// ctime, mtime (8 bytes each), then dev, ino, mode, uid, gid, size
+	entryStatSize = 16 + 6*4
+)
+
+func (e IndexEntry) IsSymlink() bool { return e.Mode&modeTypeMask == modeSymlink }
+func (e IndexEntry) IsGitlink() bool { return e.Mode&modeTypeMask == modeGitlink }
+
+// ReadIndex parses the index file at path. A missing index (a repository
+// with nothing ever added) is returned as an empty Index.
+func ReadIndex(path string, hashSize int) (*Index, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &Index{Version: 2}, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to read index %#v", path)
+	}
+
+	idx, err := parseIndex(data, hashSize)
+	return idx, errors.Wrapf(err, "failed to parse index %#v", path)
+}
+
+type indexReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *indexReader) next(n int) ([]byte, error) {
+	if r.pos+n > len(r.data) {
+		return nil, errors.New("unexpected end of index")
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *indexReader) uint32() (uint32, error) {
+	b, err := r.next(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+func (r *indexReader) uint16() (uint16, error) {
+	b, err := r.next(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b), nil
+}
+
+// varint reads the offset encoding used by index v4 for path prefix lengths
+func (r *indexReader) varint() (int, error) {
+	b, err := r.next(1)
+	if err != nil {
+		return 0, err
+	}
+	val := int(b[0] & 0x7f)
+	for b[0]&0x80 != 0 {
+		if b, err = r.next(1); err != nil {
+			return 0, err
+		}
+		val = ((val + 1) << 7) | int(b[0]&0x7f)
+	}
+	return val, nil
+}
+
+func (r *indexReader) cstring() (string, error) {
+	end := bytes.IndexByte(r.data[r.pos:], 0)
+	if end < 0 {
+		return "", errors.New("unterminated path in index")
+	}
+	s := string(r.data[r.pos : r.pos+end])
+	r.pos += end + 1
+	return s, nil
+}
+
+func parseIndex(data []byte, hashSize int) (*Index, error) {
+	r := &indexReader{data: data}
+
+	sig, err := r.next(4)
+	if err != nil {
+		return nil, err
+	}
+	if string(sig) != indexSignature {
+		return nil, errors.Errorf("bad index signature %#v", string(sig))
+	}
+
+	idx := &Index{}
+	if idx.Version, err = r.uint32(); err != nil {
+		return nil, err
+	}
+	if idx.Version < 2 || idx.Version > 4 {
+		return nil, errors.Errorf("unsupported index version %d", idx.Version)
+	}
+
+	count, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+
+	idx.Entries = make([]IndexEntry, 0, count)
+	prevPath := ""
+
+	for i := uint32(0); i < count; i++ {
+		start := r.pos
+
+		stat, err := r.next(entryStatSize)
+		if err != nil {
+			return nil, err
+		}
+
+		e := IndexEntry{
+			Mode: binary.BigEndian.Uint32(stat[24:28]),
+			Size: binary.BigEndian.Uint32(stat[36:40]),
+		}
+
+		if e.Hash, err = r.next(hashSize); err != nil {
+			return nil, err
+		}
+
+		flags, err := r.uint16()
+		if err != nil {
+			return nil, err
+		}
+
+		if flags&flagExtended != 0 {
+			if idx.Version < 3 {
+				return nil, errors.New("extended flag set in a version 2 index")
+			}
+			if _, err = r.uint16(); err != nil {
+				return nil, err
+			}
+		}
+
+		if idx.Version == 4 {
+			strip, err := r.varint()
+			if err != nil {
+				return nil, err
+			}
+			if strip > len(prevPath) {
+				return nil, errors.New("invalid path prefix compression in index")
+			}
+			suffix, err := r.cstring()
+			if err != nil {
+				return nil, err
+			}
+			e.Path = prevPath[:len(prevPath)-strip] + suffix
+		} else {
+			nameLen := int(flags & flagNameMask)
+			if nameLen < flagNameMask {
+				name, err := r.next(nameLen)
+				if err != nil {
+					return nil, err
+				}
+				e.Path = string(name)
+				r.pos++ // the NUL terminator
+			} else if e.Path, err = r.cstring(); err != nil {
+				return nil, err
+			}
+
+			// entries are padded with NULs to a multiple of 8 bytes
+			if pad := (r.pos - start) % 8; pad != 0 {
+				r.pos += 8 - pad
+			}
+		}
+
+		prevPath = e.Path
+		idx.Entries = append(idx.Entries, e)
+	}
+
+	return idx, nil
+}
+
+// Under returns the entry for path and, if path is a directory, every
+// entry below it. rel should be relative to the work tree and use '/'.
+func (idx *Index) Under(rel string) []IndexEntry {
+	if rel == "." || rel == "" {
+		return idx.Entries
+	}
+
+	i := sort.Search(len(idx.Entries), func(i int) bool { return idx.Entries[i].Path >= rel })
+
+	var found []IndexEntry
+	for ; i < len(idx.Entries); i++ {
+		p := idx.Entries[i].Path
+		if p == rel || strings.HasPrefix(p, rel+"/") {
+			found = append(found, idx.Entries[i])
+		} else if !strings.HasPrefix(p, rel) {
+			break
+		}
+	}
+	return found
+}
@@ -0,0 +1,488 @@
+package gitrepo
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	fp "path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// treeEntry is a file, symlink, submodule or subtree in a tree object
+	treeEntry struct {
+		mode uint32
+		hash []byte
+	}
+
+	// tree is the entries of a tree object, by name
+	tree map[string]treeEntry
+
+	// packIndex is a version 2 pack index, which says where in its pack
+	// each object is
+	packIndex struct {
+		pack    string
+		fanout  []byte
+		hashes  []byte
+		offsets []byte
+		large   []byte
+	}
+)
+
+const (
+	objCommit   = 1
+	objTree     = 2
+	objBlob     = 3
+	objTag      = 4
+	objOfsDelta = 6
+	objRefDelta = 7
+
+	modeTree = 0o040000
+
+	// git won't chain deltas any deeper than this
+	maxDeltaDepth = 4095
+)
+
+var packIndexSignature = []byte{0xff, 't', 'O', 'c'}
+
+// headEntry returns the entry for the file at rel in HEAD's tree. ok is
+// false if HEAD has no such file, including when there are no commits.
+func (r *Repo) headEntry(rel string) (e treeEntry, ok bool, err error) {
+	t, err := r.headTree()
+	if err != nil || t == nil {
+		return treeEntry{}, false, err
+	}
+
+	names := strings.Split(rel, "/")
+	for i, name := range names {
+		if e, ok = t[name]; !ok {
+			return treeEntry{}, false, nil
+		}
+		isTree := e.mode&modeTypeMask == modeTree
+		if i == len(names)-1 {
+			return e, !isTree, nil
+		}
+		if !isTree {
+			return treeEntry{}, false, nil
+		}
+		if t, err = r.readTree(e.hash); err != nil {
+			return treeEntry{}, false, err
+		}
+	}
+	return treeEntry{}, false, nil
+}
+
+// headTree returns the root tree of the commit HEAD points at, reading it
+// on first use, or nil if there are no commits yet
+func (r *Repo) headTree() (tree, error) {
+	if r.headRead {
+		return r.head, nil
+	}
+
+	head, err := r.Head()
+	if err != nil {
+		return nil, err
+	}
+	if head == "" {
+		r.headRead = true
+		return nil, nil
+	}
+
+	id, err := hex.DecodeString(head)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid HEAD %#v", head)
+	}
+
+	typ, data, err := r.readObject(id)
+	if err != nil {
+		return nil, err
+	}
+	if typ != objCommit {
+		return nil, errors.Errorf("HEAD %s is not a commit", head)
+	}
+
+	// a commit starts with 'tree <id>'
+	line := data
+	if nl := bytes.IndexByte(data, '\n'); nl >= 0 {
+		line = data[:nl]
+	}
+	if !bytes.HasPrefix(line, []byte("tree ")) {
+		return nil, errors.Errorf("commit %s has no tree", head)
+	}
+	treeID, err := hex.DecodeString(string(line[len("tree "):]))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid tree in commit %s", head)
+	}
+
+	if r.head, err = r.readTree(treeID); err != nil {
+		return nil, err
+	}
+	r.headRead = true
+	return r.head, nil
+}
+
+// readTree reads and parses the tree object id, which are cached
+func (r *Repo) readTree(id []byte) (tree, error) {
+	if t, ok := r.trees[string(id)]; ok {
+		return t, nil
+	}
+
+	typ, data, err := r.readObject(id)
+	if err != nil {
+		return nil, err
+	}
+	if typ != objTree {
+		return nil, errors.Errorf("object %x is not a tree", id)
+	}
+
+	// each entry is '<octal mode> <name>\0<hash>'
+	t := tree{}
+	for len(data) > 0 {
+		sp := bytes.IndexByte(data, ' ')
+		nul := bytes.IndexByte(data, 0)
+		if sp < 0 || nul < sp || nul+1+r.hashSize() > len(data) {
+			return nil, errors.Errorf("malformed tree %x", id)
+		}
+		mode, err := strconv.ParseUint(string(data[:sp]), 8, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "malformed tree %x", id)
+		}
+		t[string(data[sp+1:nul])] = treeEntry{mode: uint32(mode), hash: data[nul+1 : nul+1+r.hashSize()]}
+		data = data[nul+1+r.hashSize():]
+	}
+
+	if r.trees == nil {
+		r.trees = map[string]tree{}
+	}
+	r.trees[string(id)] = t
+	return t, nil
+}
+
+// readObject returns the type and content of the object id, whether it's
+// loose or in a pack. Alternate object directories aren't searched.
+func (r *Repo) readObject(id []byte) (int, []byte, error) {
+	hexID := hex.EncodeToString(id)
+
+	f, err := os.Open(fp.Join(r.CommonDir, "objects", hexID[:2], hexID[2:]))
+	if err == nil {
+		defer f.Close()
+		typ, data, err := readLoose(f)
+		return typ, data, errors.Wrapf(err, "failed to read object %s", hexID)
+	} else if !os.IsNotExist(err) {
+		return 0, nil, errors.Wrapf(err, "failed to open object %s", hexID)
+	}
+
+	packs, err := r.packs()
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, p := range packs {
+		if offset, ok := p.find(id, r.hashSize()); ok {
+			typ, data, err := r.readPacked(p, offset)
+			return typ, data, errors.Wrapf(err, "failed to read object %s from %#v", hexID, p.pack)
+		}
+	}
+	return 0, nil, errors.Errorf("object %s not found", hexID)
+}
+
+// readLoose reads a loose object, which is zlib compressed and starts
+// with '<type> <size>\0'
+func readLoose(rd io.Reader) (int, []byte, error) {
+	zr, err := zlib.NewReader(rd)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer zr.Close()
+
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	nul := bytes.IndexByte(data, 0)
+	if nul < 0 {
+		return 0, nil, errors.New("malformed object header")
+	}
+	header := strings.Fields(string(data[:nul]))
+	if len(header) != 2 {
+		return 0, nil, errors.Errorf("malformed object header %#v", string(data[:nul]))
+	}
+
+	types := map[string]int{"commit": objCommit, "tree": objTree, "blob": objBlob, "tag": objTag}
+	typ, ok := types[header[0]]
+	if !ok {
+		return 0, nil, errors.Errorf("unknown object type %#v", header[0])
+	}
+	return typ, data[nul+1:], nil
+}
+
+// packs returns the indexes of the repository's packs, reading them on
+// first use
+func (r *Repo) packs() ([]*packIndex, error) {
+	if r.packIndexes != nil {
+		return r.packIndexes, nil
+	}
+
+	paths, err := fp.Glob(fp.Join(r.CommonDir, "objects", "pack", "*.idx"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list packs")
+	}
+
+	r.packIndexes = []*packIndex{}
+	for _, path := range paths {
+		p, err := readPackIndex(path, r.hashSize())
+		if err != nil {
+			return nil, err
+		}
+		r.packIndexes = append(r.packIndexes, p)
+	}
+	return r.packIndexes, nil
+}
+
+func readPackIndex(path string, hashSize int) (*packIndex, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read pack index %#v", path)
+	}
+
+	const fanoutSize = 256 * 4
+	if len(data) < 8+fanoutSize || !bytes.Equal(data[:4], packIndexSignature) {
+		return nil, errors.Errorf("unsupported pack index %#v", path)
+	}
+	if v := binary.BigEndian.Uint32(data[4:8]); v != 2 {
+		return nil, errors.Errorf("unsupported pack index version %d in %#v", v, path)
+	}
+
+	p := &packIndex{pack: packFor(path), fanout: data[8 : 8+fanoutSize]}
+	n := int(binary.BigEndian.Uint32(p.fanout[fanoutSize-4:]))
+
+	// the hashes, then their CRCs, then their offsets
+	pos := 8 + fanoutSize
+	if len(data) < pos+n*(hashSize+4+4) {
+		return nil, errors.Errorf("truncated pack index %#v", path)
+	}
+	p.hashes = data[pos : pos+n*hashSize]
+	pos += n*hashSize + n*4
+	p.offsets = data[pos : pos+n*4]
+	p.large = data[pos+n*4:]
+	return p, nil
+}
+
+// packFor returns the pack an index is for
+func packFor(idx string) string {
+	return strings.TrimSuffix(idx, ".idx") + ".pack"
+}
+
+// find returns the offset of id in the pack
+func (p *packIndex) find(id []byte, hashSize int) (int64, bool) {
+	lo := 0
+	if id[0] > 0 {
+		lo = int(binary.BigEndian.Uint32(p.fanout[(int(id[0])-1)*4:]))
+	}
+	hi := int(binary.BigEndian.Uint32(p.fanout[int(id[0])*4:]))
+	if hi > len(p.hashes)/hashSize || lo > hi {
+		return 0, false
+	}
+
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(p.hashes[(lo+i)*hashSize:(lo+i+1)*hashSize], id) >= 0
+	})
+	if i == hi || !bytes.Equal(p.hashes[i*hashSize:(i+1)*hashSize], id) {
+		return 0, false
+	}
+
+	// offsets that don't fit in 31 bits are in a table of 64 bit ones
+	offset := binary.BigEndian.Uint32(p.offsets[i*4:])
+	if offset&0x80000000 == 0 {
+		return int64(offset), true
+	}
+	j := int(offset&0x7fffffff) * 8
+	if j+8 > len(p.large) {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(p.large[j:])), true
+}
+
+// readPacked reads the object at offset in p's pack
+func (r *Repo) readPacked(p *packIndex, offset int64) (int, []byte, error) {
+	f, err := os.Open(p.pack)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+	return r.readPackedAt(f, offset, 0)
+}
+
+// readPackedAt reads the object at offset in pack, resolving deltas, which
+// are depth deep so far
+func (r *Repo) readPackedAt(pack io.ReaderAt, offset int64, depth int) (int, []byte, error) {
+	if depth > maxDeltaDepth {
+		return 0, nil, errors.New("delta chain is too long")
+	}
+
+	br := bufio.NewReader(io.NewSectionReader(pack, offset, 1<<62))
+
+	// the type is in bits 4-6 of the first byte, and the size is a varint
+	// that starts with its low 4 bits
+	c, err := br.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	typ, size := int(c>>4)&7, uint64(c&0x0f)
+	for shift := uint(4); c&0x80 != 0; shift += 7 {
+		if c, err = br.ReadByte(); err != nil {
+			return 0, nil, err
+		}
+		size |= uint64(c&0x7f) << shift
+	}
+
+	var baseType int
+	var base []byte
+
+	switch typ {
+	case objCommit, objTree, objBlob, objTag:
+		data, err := inflate(br, size)
+		return typ, data, err
+	case objOfsDelta:
+		// the base is this far back in the pack, encoded like the index
+		// v4 path prefixes
+		rel, err := readOffset(br)
+		if err != nil {
+			return 0, nil, err
+		}
+		if baseType, base, err = r.readPackedAt(pack, offset-rel, depth+1); err != nil {
+			return 0, nil, err
+		}
+	case objRefDelta:
+		id := make([]byte, r.hashSize())
+		if _, err = io.ReadFull(br, id); err != nil {
+			return 0, nil, err
+		}
+		if baseType, base, err = r.readObject(id); err != nil {
+			return 0, nil, err
+		}
+	default:
+		return 0, nil, errors.Errorf("unknown pack object type %d", typ)
+	}
+
+	delta, err := inflate(br, size)
+	if err != nil {
+		return 0, nil, err
+	}
+	data, err := applyDelta(base, delta)
+	return baseType, data, err
+}
+
+func readOffset(br io.ByteReader) (int64, error) {
+	c, err := br.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	val := int64(c & 0x7f)
+	for c&0x80 != 0 {
+		if c, err = br.ReadByte(); err != nil {
+			return 0, err
+		}
+		val = ((val + 1) << 7) | int64(c&0x7f)
+	}
+	return val, nil
+}
+
+// inflate decompresses size bytes from rd
+func inflate(rd io.Reader, size uint64) ([]byte, error) {
+	zr, err := zlib.NewReader(rd)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(zr, data)
+	return data, err
+}
+
+// applyDelta builds an object from base and a delta, which is the sizes of
+// base and the result, then instructions to copy from base or insert data
+func applyDelta(base, delta []byte) ([]byte, error) {
+	baseSize, delta, err := deltaSize(delta)
+	if err != nil {
+		return nil, err
+	}
+	if baseSize != uint64(len(base)) {
+		return nil, errors.New("delta base is the wrong size")
+	}
+	size, delta, err := deltaSize(delta)
+	if err != nil {
+		return nil, err
+	}
+
+	truncated := errors.New("truncated delta")
+	out := make([]byte, 0, size)
+
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+
+		switch {
+		case op&0x80 != 0:
+			// the low 4 bits say which bytes of the offset follow, the
+			// next 3 which bytes of the length
+			var off, n uint64
+			for i := uint(0); i < 7; i++ {
+				if op&(1<<i) == 0 {
+					continue
+				}
+				if len(delta) == 0 {
+					return nil, truncated
+				}
+				if i < 4 {
+					off |= uint64(delta[0]) << (8 * i)
+				} else {
+					n |= uint64(delta[0]) << (8 * (i - 4))
+				}
+				delta = delta[1:]
+			}
+			if n == 0 {
+				n = 0x10000
+			}
+			if off+n > uint64(len(base)) {
+				return nil, errors.New("delta copies past the end of its base")
+			}
+			out = append(out, base[off:off+n]...)
+		case op != 0:
+			if int(op) > len(delta) {
+				return nil, truncated
+			}
+			out = append(out, delta[:op]...)
+			delta = delta[op:]
+		default:
+			return nil, errors.New("invalid delta instruction")
+		}
+	}
+
+	if uint64(len(out)) != size {
+		return nil, errors.New("delta result is the wrong size")
+	}
+	return out, nil
+}
+
+// deltaSize reads a size from the start of a delta
+func deltaSize(delta []byte) (uint64, []byte, error) {
+	var size uint64
+	for i, shift := 0, uint(0); i < len(delta); i, shift = i+1, shift+7 {
+		size |= uint64(delta[i]&0x7f) << shift
+		if delta[i]&0x80 == 0 {
+			return size, delta[i+1:], nil
+		}
+	}
+	return 0, nil, errors.New("truncated delta")
+}
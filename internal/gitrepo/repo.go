@@ -0,0 +1,342 @@
+// Package gitrepo reads just enough of a local git repository's on-disk
+// format (HEAD, refs, objects, the index and ignore files) to tell whether a
+// path is tracked, ignored or modified, without shelling out to git or
+// touching the network.
+package gitrepo
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	fp "path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	pl "github.com/slyphon/dfi/pkg/pathlib"
+)
+
+type (
+	Repo struct {
+		// WorkTree is the top level directory of the checkout
+		WorkTree string
+
+		// GitDir is the repository's .git directory (or the per-worktree
+		// git directory when using 'git worktree')
+		GitDir string
+
+		// CommonDir is where refs and objects live, usually the same as GitDir
+		CommonDir string
+
+		sha256  bool
+		index   *Index
+		ignores *ignoreStack
+
+		// HEAD's tree, and the trees and packs read so far
+		headRead    bool
+		head        tree
+		trees       map[string]tree
+		packIndexes []*packIndex
+	}
+
+	Status int
+)
+
+const (
+	// Clean means the path is tracked and the same as in the index and HEAD
+	Clean Status = iota
+	// Modified means the path is tracked but differs from the index (or is
+	// missing), or the index entry differs from HEAD (or isn't committed)
+	Modified
+	// Untracked means the path is not in the index and not ignored
+	Untracked
+	// Ignored means the path is not in the index and matched by an ignore rule
+	Ignored
+)
+
+func (s Status) String() string {
+	switch s {
+	case Clean:
+		return "clean"
+	case Modified:
+		return "modified"
+	case Untracked:
+		return "untracked"
+	case Ignored:
+		return "ignored"
+	default:
+		return fmt.Sprintf("Status(%d)", int(s))
+	}
+}
+
+// ErrNotFound is returned by Find when a path is not inside a git repository
+var ErrNotFound = errors.New("not inside a git repository")
+
+// Find walks up from path looking for the repository that contains it.
+// path must be absolute.
+func Find(path string) (*Repo, error) {
+	dir := fp.Clean(path)
+
+	for {
+		dotGit := fp.Join(dir, ".git")
+		info, err := os.Stat(dotGit)
+
+		switch {
+		case err == nil && info.IsDir():
+			return open(dir, dotGit)
+		case err == nil:
+			// a file containing 'gitdir: <path>', used by worktrees and submodules
+			gitDir, err := readGitFile(dotGit)
+			if err != nil {
+				return nil, err
+			}
+			return open(dir, gitDir)
+		case !(os.IsNotExist(err) || pl.IsNotDir(err)):
+			return nil, errors.Wrapf(err, "failed to stat %#v", dotGit)
+		}
+
+		parent := fp.Dir(dir)
+		if parent == dir {
+			return nil, errors.Wrapf(ErrNotFound, "%#v", path)
+		}
+		dir = parent
+	}
+}
+
+func readGitFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read %#v", path)
+	}
+
+	line := strings.TrimSpace(string(b))
+	if !strings.HasPrefix(line, "gitdir: ") {
+		return "", errors.Errorf("invalid .git file %#v", path)
+	}
+
+	gitDir := strings.TrimPrefix(line, "gitdir: ")
+	if !fp.IsAbs(gitDir) {
+		gitDir = fp.Join(fp.Dir(path), gitDir)
+	}
+	return fp.Clean(gitDir), nil
+}
+
+func open(workTree, gitDir string) (*Repo, error) {
+	r := &Repo{WorkTree: workTree, GitDir: gitDir, CommonDir: gitDir}
+
+	if b, err := ioutil.ReadFile(fp.Join(gitDir, "commondir")); err == nil {
+		common := strings.TrimSpace(string(b))
+		if !fp.IsAbs(common) {
+			common = fp.Join(gitDir, common)
+		}
+		r.CommonDir = fp.Clean(common)
+	}
+
+	if b, err := ioutil.ReadFile(fp.Join(r.CommonDir, "config")); err == nil {
+		r.sha256 = bytes.Contains(bytes.ToLower(b), []byte("objectformat = sha256"))
+	}
+
+	return r, nil
+}
+
+func (r *Repo) newHash() hash.Hash {
+	if r.sha256 {
+		return sha256.New()
+	}
+	return sha1.New()
+}
+
+func (r *Repo) hashSize() int {
+	if r.sha256 {
+		return sha256.Size
+	}
+	return sha1.Size
+}
+
+// Head returns the commit hash HEAD points at. An empty string is returned
+// if HEAD refers to a branch that has no commits yet.
+func (r *Repo) Head() (string, error) {
+	b, err := ioutil.ReadFile(fp.Join(r.GitDir, "HEAD"))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read HEAD")
+	}
+
+	head := strings.TrimSpace(string(b))
+
+	// follow symbolic refs, with a limit in case of a loop
+	for i := 0; i < 10 && strings.HasPrefix(head, "ref: "); i++ {
+		if head, err = r.readRef(strings.TrimPrefix(head, "ref: ")); err != nil || head == "" {
+			return head, err
+		}
+	}
+
+	if strings.HasPrefix(head, "ref: ") {
+		return "", errors.Errorf("too many levels of symbolic refs in HEAD")
+	}
+
+	return head, nil
+}
+
+// readRef returns the contents of a loose ref, or its value from packed-refs
+func (r *Repo) readRef(name string) (string, error) {
+	for _, dir := range []string{r.GitDir, r.CommonDir} {
+		b, err := ioutil.ReadFile(fp.Join(dir, fp.FromSlash(name)))
+		if err == nil {
+			return strings.TrimSpace(string(b)), nil
+		} else if !os.IsNotExist(err) {
+			return "", errors.Wrapf(err, "failed to read ref %#v", name)
+		}
+	}
+
+	f, err := os.Open(fp.Join(r.CommonDir, "packed-refs"))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", errors.Wrap(err, "failed to open packed-refs")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") || strings.HasPrefix(line, "^") {
+			continue
+		}
+		if fields := strings.Fields(line); len(fields) == 2 && fields[1] == name {
+			return fields[0], nil
+		}
+	}
+
+	return "", errors.Wrap(scanner.Err(), "failed to read packed-refs")
+}
+
+// Rel returns path relative to the WorkTree, using '/' as the separator
+func (r *Repo) Rel(path string) (string, error) {
+	rel, err := fp.Rel(r.WorkTree, path)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to relativize %#v", path)
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(fp.Separator)) {
+		return "", errors.Errorf("%#v is outside of the work tree %#v", path, r.WorkTree)
+	}
+	return fp.ToSlash(rel), nil
+}
+
+// Index returns the parsed index of this repository, reading it on first use
+func (r *Repo) Index() (*Index, error) {
+	if r.index == nil {
+		idx, err := ReadIndex(fp.Join(r.GitDir, "index"), r.hashSize())
+		if err != nil {
+			return nil, err
+		}
+		r.index = idx
+	}
+	return r.index, nil
+}
+
+// Status classifies path, which may be a file, symlink or directory. A
+// directory is tracked if anything under it is in the index, and is
+// modified if any of those entries are modified, or staged but not
+// committed.
+func (r *Repo) Status(path string) (Status, error) {
+	rel, err := r.Rel(path)
+	if err != nil {
+		return Untracked, err
+	}
+
+	idx, err := r.Index()
+	if err != nil {
+		return Untracked, err
+	}
+
+	entries := idx.Under(rel)
+	if len(entries) == 0 {
+		if r.ignores == nil {
+			r.ignores = newIgnoreStack(r)
+		}
+
+		info, err := os.Lstat(path)
+		if err != nil {
+			return Untracked, errors.Wrapf(err, "failed to stat %#v", path)
+		}
+
+		if ignored, err := r.ignores.isIgnored(rel, info.IsDir()); err != nil {
+			return Untracked, err
+		} else if ignored {
+			return Ignored, nil
+		}
+		return Untracked, nil
+	}
+
+	for _, e := range entries {
+		if modified, err := r.isModified(e); err != nil {
+			return Untracked, err
+		} else if modified {
+			return Modified, nil
+		}
+	}
+
+	return Clean, nil
+}
+
+// isModified returns whether e differs from HEAD, or the work tree from e
+func (r *Repo) isModified(e IndexEntry) (bool, error) {
+	if staged, err := r.isStaged(e); err != nil || staged {
+		return staged, err
+	}
+
+	path := fp.Join(r.WorkTree, fp.FromSlash(e.Path))
+
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return true, nil // deleted
+	} else if err != nil {
+		return false, errors.Wrapf(err, "failed to stat %#v", path)
+	}
+
+	var content []byte
+
+	switch {
+	case e.IsSymlink() && info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to readlink %#v", path)
+		}
+		content = []byte(target)
+	case e.IsGitlink():
+		return false, nil // submodules are not checked
+	case info.Mode().IsRegular() && !e.IsSymlink():
+		if uint32(info.Size()) != e.Size { // the index only keeps the low 32 bits
+			return true, nil
+		}
+		if content, err = ioutil.ReadFile(path); err != nil {
+			return false, errors.Wrapf(err, "failed to read %#v", path)
+		}
+	default:
+		return true, nil // type changed
+	}
+
+	return !bytes.Equal(r.blobHash(content), e.Hash), nil
+}
+
+// isStaged returns whether e is missing from HEAD, or differs from it
+func (r *Repo) isStaged(e IndexEntry) (bool, error) {
+	committed, ok, err := r.headEntry(e.Path)
+	if err != nil || !ok {
+		return !ok, err
+	}
+	return committed.mode != e.Mode || !bytes.Equal(committed.hash, e.Hash), nil
+}
+
+// blobHash computes the object id git would give content as a blob
+func (r *Repo) blobHash(content []byte) []byte {
+	h := r.newHash()
+	fmt.Fprintf(h, "blob %d\x00", len(content))
+	h.Write(content)
+	return h.Sum(nil)
+}
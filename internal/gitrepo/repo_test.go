@@ -0,0 +1,199 @@
+package gitrepo
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	fp "path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/suite"
+
+	testhelp "github.com/slyphon/dfi/pkg/testhelper"
+)
+
+type RepoSuite struct {
+	testhelp.DFISuite
+	dir string
+}
+
+func TestRepoSuite(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	s := new(RepoSuite)
+	s.AddBeforeHook(func(a, b string) {
+		var err error
+		s.dir, err = ioutil.TempDir("", "gitreposuite")
+		s.Require().NoError(err)
+		// keep the user's global excludes out of the tests
+		s.Require().NoError(os.Setenv("XDG_CONFIG_HOME", s.dir))
+		s.git("init", "-q", "repo")
+	})
+	s.AddAfterHook(func(a, b string) {
+		_ = os.RemoveAll(s.dir)
+	})
+	suite.Run(t, s)
+}
+
+func (s *RepoSuite) repo() string { return fp.Join(s.dir, "repo") }
+
+func (s *RepoSuite) git(args ...string) string {
+	cmd := exec.Command("git", append([]string{"-c", "user.name=dfi", "-c", "user.email=dfi@example.com"}, args...)...)
+	cmd.Dir = s.repo()
+	if _, err := os.Stat(cmd.Dir); os.IsNotExist(err) {
+		cmd.Dir = s.dir
+	}
+	out, err := cmd.CombinedOutput()
+	s.Require().NoError(err, string(out))
+	return strings.TrimSpace(string(out))
+}
+
+func (s *RepoSuite) write(rel, content string) string {
+	path := fp.Join(s.repo(), rel)
+	s.Require().NoError(os.MkdirAll(fp.Dir(path), 0o755))
+	s.Require().NoError(ioutil.WriteFile(path, []byte(content), 0o644))
+	return path
+}
+
+func (s *RepoSuite) status(path string) Status {
+	r, err := Find(path)
+	s.Require().NoError(err)
+	st, err := r.Status(path)
+	s.Require().NoError(err)
+	return st
+}
+
+func (s *RepoSuite) commitAll() {
+	s.git("add", "-A")
+	s.git("commit", "-q", "-m", "commit")
+}
+
+func (s *RepoSuite) TestFindOutsideRepo() {
+	_, err := Find(s.dir)
+	s.Equal(ErrNotFound, errors.Cause(err))
+}
+
+func (s *RepoSuite) TestHead() {
+	r, err := Find(s.repo())
+	s.Require().NoError(err)
+
+	head, err := r.Head()
+	s.NoError(err)
+	s.Equal("", head) // no commits yet
+
+	s.write("bashrc", "echo hi\n")
+	s.commitAll()
+
+	head, err = r.Head()
+	s.NoError(err)
+	s.Equal(s.git("rev-parse", "HEAD"), head)
+
+	s.git("pack-refs", "--all", "--prune")
+	head, err = r.Head()
+	s.NoError(err)
+	s.Equal(s.git("rev-parse", "HEAD"), head)
+}
+
+func (s *RepoSuite) TestStatus() {
+	bashrc := s.write("dotfiles/bashrc", "echo hi\n")
+	vimrc := s.write("dotfiles/vimrc", "set nocp\n")
+	s.NoError(os.Symlink("bashrc", fp.Join(s.repo(), "dotfiles", "zshrc")))
+	s.commitAll()
+
+	s.Equal(Clean, s.status(bashrc))
+	s.Equal(Clean, s.status(fp.Join(s.repo(), "dotfiles", "zshrc")))
+	s.Equal(Clean, s.status(fp.Join(s.repo(), "dotfiles")))
+
+	s.write("dotfiles/vimrc", "set cp\n\n")
+	s.Equal(Modified, s.status(vimrc))
+	s.Equal(Modified, s.status(fp.Join(s.repo(), "dotfiles")))
+	s.Equal(Clean, s.status(bashrc))
+
+	untracked := s.write("dotfiles/tmux.conf", "")
+	s.Equal(Untracked, s.status(untracked))
+}
+
+func (s *RepoSuite) TestStatusStaged() {
+	bashrc := s.write("dotfiles/bashrc", "echo hi\n")
+	s.commitAll()
+
+	// the work tree matches the index, but the index doesn't match HEAD
+	s.write("dotfiles/bashrc", "echo bye\n")
+	s.git("add", "dotfiles/bashrc")
+	s.Equal(Modified, s.status(bashrc))
+	s.Equal(Modified, s.status(fp.Join(s.repo(), "dotfiles")))
+
+	s.git("commit", "-q", "-m", "bye")
+	s.Equal(Clean, s.status(bashrc))
+}
+
+func (s *RepoSuite) TestStatusAddedNotCommitted() {
+	// nothing has been committed yet
+	bashrc := s.write("dotfiles/bashrc", "echo hi\n")
+	s.git("add", "-A")
+	s.Equal(Modified, s.status(bashrc))
+
+	s.git("commit", "-q", "-m", "commit")
+	s.Equal(Clean, s.status(bashrc))
+
+	vimrc := s.write("dotfiles/vimrc", "set nocp\n")
+	s.git("add", "dotfiles/vimrc")
+	s.Equal(Modified, s.status(vimrc))
+	s.Equal(Clean, s.status(bashrc))
+}
+
+func (s *RepoSuite) TestStatusPacked() {
+	for i := 0; i < 20; i++ {
+		s.write(fmt.Sprintf("dotfiles/file%d", i), fmt.Sprintf("%d\n", i))
+	}
+	bashrc := s.write("dotfiles/bashrc", "")
+	for i := 0; i < 5; i++ {
+		s.write("dotfiles/bashrc", strings.Repeat("echo hi\n", i))
+		s.commitAll()
+	}
+
+	// git keeps the newest trees whole, and older ones as deltas of them
+	s.git("gc", "-q", "--aggressive")
+	s.git("checkout", "-q", "HEAD~2")
+	s.Equal(Clean, s.status(bashrc))
+	s.Equal(Clean, s.status(fp.Join(s.repo(), "dotfiles")))
+
+	s.write("dotfiles/bashrc", "echo bye\n")
+	s.git("add", "dotfiles/bashrc")
+	s.Equal(Modified, s.status(bashrc))
+}
+
+func (s *RepoSuite) TestIndexV4() {
+	bashrc := s.write("dotfiles/bashrc", "echo hi\n")
+	s.write("dotfiles/bash_profile", "echo hi\n")
+	s.write("bin/ls", "echo hi\n")
+	s.commitAll()
+	s.git("update-index", "--index-version", "4")
+
+	r, err := Find(bashrc)
+	s.Require().NoError(err)
+	idx, err := r.Index()
+	s.Require().NoError(err)
+	s.Equal(uint32(4), idx.Version)
+	s.Len(idx.Entries, 3)
+	s.Equal("dotfiles/bashrc", idx.Entries[2].Path)
+	s.Equal(Clean, s.status(bashrc))
+}
+
+func (s *RepoSuite) TestIgnored() {
+	s.write(".gitignore", "*.swp\n/build/\n!keep.swp\n")
+	s.write("dotfiles/.gitignore", "secret\n")
+	s.commitAll()
+
+	s.Equal(Ignored, s.status(s.write("dotfiles/vimrc.swp", "")))
+	s.Equal(Untracked, s.status(s.write("dotfiles/keep.swp", "")))
+	s.Equal(Ignored, s.status(s.write("build/out", "")))
+	s.Equal(Untracked, s.status(s.write("dotfiles/build/out", "")))
+	s.Equal(Ignored, s.status(s.write("dotfiles/secret", "")))
+	s.Equal(Untracked, s.status(s.write("secret", "")))
+}
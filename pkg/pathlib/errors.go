@@ -0,0 +1,31 @@
+package pathlib
+
+import "fmt"
+
+type (
+	// InvalidNameError is returned by WithName and WithSuffix when the
+	// path has no name to replace, or the replacement isn't valid
+	InvalidNameError struct {
+		Path string
+		// Name is the invalid name or suffix, empty if the path has no name
+		Name string
+	}
+
+	// NotRelativeError is returned by RelativeTo when Other isn't
+	// an ancestor of Path
+	NotRelativeError struct {
+		Path  string
+		Other string
+	}
+)
+
+func (e *InvalidNameError) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("%#v has an empty name", e.Path)
+	}
+	return fmt.Sprintf("invalid name %#v for %#v", e.Name, e.Path)
+}
+
+func (e *NotRelativeError) Error() string {
+	return fmt.Sprintf("%#v is not relative to %#v", e.Path, e.Other)
+}
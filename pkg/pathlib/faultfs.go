@@ -0,0 +1,163 @@
+package pathlib
+
+import (
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/gobwas/glob"
+)
+
+// FaultOp names an operation a FaultFs can be made to fail
+type FaultOp string
+
+const (
+	FaultSymlink FaultOp = "symlink"
+	FaultRename  FaultOp = "rename"
+	// FaultRemove covers both Remove and RemoveAll
+	FaultRemove FaultOp = "remove"
+	FaultLstat  FaultOp = "lstat"
+	FaultLink   FaultOp = "link"
+)
+
+// Fault describes which calls of a FaultFs should fail, and how
+type Fault struct {
+	Op FaultOp
+
+	// Pattern is a glob (see PurePath.ExMatch) the path must match for the
+	// fault to trigger, for Rename either path may match. Empty matches
+	// every path.
+	Pattern string
+
+	Err syscall.Errno
+
+	// After is the number of matching calls that succeed before the
+	// fault triggers
+	After int
+
+	// Times is how many times the fault triggers before calls succeed
+	// again, 0 means forever
+	Times int
+
+	glob  glob.Glob
+	calls int
+	hits  int
+}
+
+// FaultFs wraps another Fs and passes every call through to it, except
+// for the calls that match one of its Faults, which fail with that fault's
+// errno instead. The errors are the same types the os package returns.
+// It's for testing how code copes with EACCES, ENOSPC, EXDEV and the like.
+type FaultFs struct {
+	Fs
+	mu     sync.Mutex
+	faults []*Fault
+}
+
+var _ Fs = &FaultFs{}
+
+func NewFaultFs(fsys Fs) *FaultFs {
+	return &FaultFs{Fs: fsys}
+}
+
+// Inject adds a fault to the receiver and returns it. It panics if
+// the fault's Pattern isn't a valid glob.
+func (f *FaultFs) Inject(fault Fault) *FaultFs {
+	if fault.Pattern != "" {
+		fault.glob = glob.MustCompile(fault.Pattern, '/')
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = append(f.faults, &fault)
+	return f
+}
+
+// Triggered returns how many calls of op have been failed so far
+func (f *FaultFs) Triggered(op FaultOp) (n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, fault := range f.faults {
+		if fault.Op == op {
+			n += fault.hits
+		}
+	}
+	return n
+}
+
+func (fault *Fault) matches(paths []string) bool {
+	if fault.glob == nil {
+		return true
+	}
+	for _, p := range paths {
+		if fault.glob.Match(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns the errno for the first fault that triggers
+// for this call, or 0 if the call should go ahead
+func (f *FaultFs) check(op FaultOp, paths ...string) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, fault := range f.faults {
+		if fault.Op != op || !fault.matches(paths) {
+			continue
+		}
+
+		fault.calls++
+		if fault.calls <= fault.After || (fault.Times > 0 && fault.hits >= fault.Times) {
+			continue
+		}
+
+		fault.hits++
+		return fault.Err
+	}
+	return 0
+}
+
+func (f *FaultFs) Symlink(oldname, newname string) error {
+	if errno := f.check(FaultSymlink, newname); errno != 0 {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: errno}
+	}
+	return f.Fs.Symlink(oldname, newname)
+}
+
+func (f *FaultFs) Rename(oldname, newname string) error {
+	if errno := f.check(FaultRename, oldname, newname); errno != 0 {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: errno}
+	}
+	return f.Fs.Rename(oldname, newname)
+}
+
+func (f *FaultFs) Remove(name string) error {
+	if errno := f.check(FaultRemove, name); errno != 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: errno}
+	}
+	return f.Fs.Remove(name)
+}
+
+func (f *FaultFs) RemoveAll(name string) error {
+	if errno := f.check(FaultRemove, name); errno != 0 {
+		return &os.PathError{Op: "unlinkat", Path: name, Err: errno}
+	}
+	return f.Fs.RemoveAll(name)
+}
+
+func (f *FaultFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	if errno := f.check(FaultLstat, name); errno != 0 {
+		return nil, true, &os.PathError{Op: "lstat", Path: name, Err: errno}
+	}
+	return f.Fs.LstatIfPossible(name)
+}
+
+func (f *FaultFs) Link(oldname, newname string) error {
+	if errno := f.check(FaultLink, oldname, newname); errno != 0 {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: errno}
+	}
+	return f.Fs.Link(oldname, newname)
+}
@@ -0,0 +1,86 @@
+package pathlib
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type FaultFsSuite struct {
+	RequireSuite
+	mfs *MemFs
+}
+
+func TestFaultFs(t *testing.T) {
+	suite.Run(t, new(FaultFsSuite))
+}
+
+func (s *FaultFsSuite) SetupTest() {
+	s.mfs = NewMemFs()
+	s.NoError(s.mfs.MkdirAll("/home/user", 0o755))
+}
+
+func (s *FaultFsSuite) TestMatchingPaths() {
+	ffs := NewFaultFs(s.mfs).
+		Inject(Fault{Op: FaultSymlink, Pattern: "**/.bashrc", Err: syscall.EACCES})
+
+	err := ffs.Symlink("x", "/home/user/.bashrc")
+	s.Error(err)
+	le, ok := err.(*os.LinkError)
+	s.True(ok)
+	s.Equal(syscall.EACCES, le.Err)
+	s.True(os.IsPermission(err))
+	s.False(NewPosixPathFs(s.mfs, "/home/user/.bashrc").Lexists())
+
+	s.NoError(ffs.Symlink("x", "/home/user/.vimrc"))
+	s.Equal(1, ffs.Triggered(FaultSymlink))
+	s.Equal(0, ffs.Triggered(FaultRename))
+}
+
+func (s *FaultFsSuite) TestRenameMatchesEitherPath() {
+	ffs := NewFaultFs(s.mfs).
+		Inject(Fault{Op: FaultRename, Pattern: "/mnt/**", Err: syscall.EXDEV})
+
+	s.NoError(s.mfs.Mkdir("/mnt", 0o755))
+	s.NoError(s.mfs.Mkdir("/home/user/a", 0o755))
+
+	err := ffs.Rename("/home/user/a", "/mnt/a")
+	s.Error(err)
+	s.Equal(syscall.EXDEV, err.(*os.LinkError).Err)
+
+	s.NoError(ffs.Rename("/home/user/a", "/home/user/b"))
+}
+
+func (s *FaultFsSuite) TestAfterAndTimes() {
+	ffs := NewFaultFs(s.mfs).
+		Inject(Fault{Op: FaultSymlink, Err: syscall.ENOSPC, After: 2, Times: 1})
+
+	s.NoError(ffs.Symlink("x", "/home/user/1"))
+	s.NoError(ffs.Symlink("x", "/home/user/2"))
+
+	err := ffs.Symlink("x", "/home/user/3")
+	s.Error(err)
+	s.Equal(syscall.ENOSPC, err.(*os.LinkError).Err)
+
+	s.NoError(ffs.Symlink("x", "/home/user/3"))
+	s.Equal(1, ffs.Triggered(FaultSymlink))
+}
+
+func (s *FaultFsSuite) TestLstatAndRemove() {
+	ffs := NewFaultFs(s.mfs).
+		Inject(Fault{Op: FaultLstat, Pattern: "/home/user", Err: syscall.EACCES}).
+		Inject(Fault{Op: FaultRemove, Err: syscall.EBUSY})
+
+	_, err := NewPosixPathFs(ffs, "/home/user").Lstat()
+	s.True(os.IsPermission(err))
+	_, err = NewPosixPathFs(ffs, "/home").Lstat()
+	s.NoError(err)
+
+	err = ffs.Remove("/home/user")
+	s.Equal(syscall.EBUSY, err.(*os.PathError).Err)
+	err = ffs.RemoveAll("/home")
+	s.Equal(syscall.EBUSY, err.(*os.PathError).Err)
+	s.True(NewPosixPathFs(s.mfs, "/home/user").IsDir())
+}
@@ -0,0 +1,835 @@
+package pathlib
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// MemFs is an in-memory Fs with real symlink semantics: relative and
+// absolute symlinks, Readlink, Lstat that doesn't follow the last component
+// while Stat does, and ELOOP when resolving a path takes too many hops.
+// Permission bits are enforced as for the user set with SetUser, root by
+// default, who like the real one may do anything. It's safe for concurrent
+// use.
+type MemFs struct {
+	mu   sync.RWMutex
+	root *memNode
+	// the user and group the fs acts as, see SetUser
+	uid, gid int
+}
+
+type (
+	memNode struct {
+		mode     os.FileMode
+		modTime  time.Time
+		uid, gid int
+		data     []byte
+		target   string
+		children map[string]*memNode
+		// the open file holding the lock on the node, see memFile.Flock
+		lockedBy *memFile
+	}
+
+	memInfo struct {
+		name string
+		node *memNode
+		// a snapshot, so the info doesn't change under the caller
+		mode    os.FileMode
+		size    int64
+		modTime time.Time
+	}
+
+	// the result of resolving a path
+	memLookup struct {
+		dir     *memNode // the directory containing the entry, nil for '/'
+		dirPath string   // the physical path of dir
+		name    string   // the entry's name in dir
+		node    *memNode // the entry, nil if it doesn't exist
+	}
+)
+
+// linux's limit on the number of symlinks followed while resolving a path
+const maxSymlinkHops = 40
+
+// the permission bits checked by MemFs.may, for the owner
+const (
+	permRead  os.FileMode = 0o4
+	permWrite os.FileMode = 0o2
+	permExec  os.FileMode = 0o1
+)
+
+var (
+	_ Fs          = &MemFs{}
+	_ os.FileInfo = memInfo{}
+)
+
+func NewMemFs() *MemFs {
+	return &MemFs{root: newMemDir(0o755)}
+}
+
+// SetUser makes the fs act as the given user and group from now on: files
+// it creates are theirs, and it checks permissions as they would be checked
+// for them. uid 0 is root, who isn't checked.
+func (m *MemFs) SetUser(uid, gid int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.uid, m.gid = uid, gid
+}
+
+func newMemDir(perm os.FileMode) *memNode {
+	return &memNode{
+		mode:     os.ModeDir | perm.Perm(),
+		modTime:  time.Now(),
+		children: make(map[string]*memNode),
+	}
+}
+
+// newNode returns a node of the given mode owned by the fs's user
+func (m *MemFs) newNode(mode os.FileMode) *memNode {
+	if mode.IsDir() {
+		n := newMemDir(mode)
+		n.uid, n.gid = m.uid, m.gid
+		return n
+	}
+	return &memNode{mode: mode, modTime: time.Now(), uid: m.uid, gid: m.gid}
+}
+
+// may returns true if the fs's user has all the want bits on n, which are
+// given as for the owner, eg. permRead|permWrite
+func (m *MemFs) may(n *memNode, want os.FileMode) bool {
+	if m.uid == 0 {
+		return true
+	}
+
+	perm := n.mode.Perm()
+	switch {
+	case m.uid == n.uid:
+		perm >>= 6
+	case m.gid == n.gid:
+		perm >>= 3
+	}
+	return perm&want == want
+}
+
+// mayChange returns an EACCES error unless the user may add and remove
+// entries in dir
+func (m *MemFs) mayChange(op, name string, dir *memNode) error {
+	if !m.may(dir, permWrite|permExec) {
+		return pathErr(op, name, syscall.EACCES)
+	}
+	return nil
+}
+
+// mayOwn returns an EPERM error unless the user is root or owns n, as
+// needed to chmod it
+func (m *MemFs) mayOwn(op, name string, n *memNode) error {
+	if m.uid != 0 && m.uid != n.uid {
+		return pathErr(op, name, syscall.EPERM)
+	}
+	return nil
+}
+
+func (n *memNode) isDir() bool     { return n.mode.IsDir() }
+func (n *memNode) isSymlink() bool { return n.mode&os.ModeSymlink != 0 }
+
+func (n *memNode) info(name string) memInfo {
+	size := int64(len(n.data))
+	if n.isSymlink() {
+		size = int64(len(n.target))
+	}
+	return memInfo{name: name, node: n, mode: n.mode, size: size, modTime: n.modTime}
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) Mode() os.FileMode  { return i.mode }
+func (i memInfo) ModTime() time.Time { return i.modTime }
+func (i memInfo) IsDir() bool        { return i.mode.IsDir() }
+
+// Sys returns the underlying node, which identifies the file for SameFile
+func (i memInfo) Sys() interface{} { return i.node }
+
+func pathErr(op, name string, errno syscall.Errno) error {
+	return &os.PathError{Op: op, Path: name, Err: errno}
+}
+
+// splitPath breaks name into components, relative paths are relative to '/'.
+// The path is intentionally not cleaned, '..' must be resolved physically.
+func splitPath(name string) []string {
+	var comps []string
+	for _, c := range strings.Split(name, "/") {
+		if c != "" {
+			comps = append(comps, c)
+		}
+	}
+	return comps
+}
+
+// lookup resolves name, following symlinks in every component except
+// possibly the last. It's not an error for the last component to be missing,
+// in which case the returned node is nil. The caller must hold the lock.
+func (m *MemFs) lookup(op, name string, followLast bool) (*memLookup, error) {
+	hops := 0
+	comps := splitPath(name)
+
+restart:
+	stack := []*memNode{m.root}
+	physical := []string{}
+
+	for i := 0; i < len(comps); i++ {
+		c, last := comps[i], i == len(comps)-1
+		cur := stack[len(stack)-1]
+
+		if !cur.isDir() {
+			return nil, pathErr(op, name, syscall.ENOTDIR)
+		} else if !m.may(cur, permExec) {
+			return nil, pathErr(op, name, syscall.EACCES)
+		}
+
+		switch c {
+		case ".":
+			continue
+		case "..":
+			if len(stack) > 1 {
+				stack, physical = stack[:len(stack)-1], physical[:len(physical)-1]
+			}
+			continue
+		}
+
+		child := cur.children[c]
+
+		if child == nil {
+			if last {
+				return &memLookup{dir: cur, dirPath: "/" + path.Join(physical...), name: c}, nil
+			}
+			return nil, pathErr(op, name, syscall.ENOENT)
+		}
+
+		if child.isSymlink() && (!last || followLast) {
+			if hops++; hops > maxSymlinkHops {
+				return nil, pathErr(op, name, syscall.ELOOP)
+			}
+
+			rest := comps[i+1:]
+			target := splitPath(child.target)
+			if !path.IsAbs(child.target) {
+				target = append(append([]string{}, physical...), target...)
+			}
+			comps = append(target, rest...)
+			goto restart
+		}
+
+		if last {
+			return &memLookup{dir: cur, dirPath: "/" + path.Join(physical...), name: c, node: child}, nil
+		}
+
+		stack = append(stack, child)
+		physical = append(physical, c)
+	}
+
+	// the path was '/', or ended in '.' or '..'
+	if len(stack) == 1 {
+		return &memLookup{name: "/", dirPath: "/", node: m.root}, nil
+	}
+	return &memLookup{
+		dir:     stack[len(stack)-2],
+		dirPath: "/" + path.Join(physical[:len(physical)-1]...),
+		name:    physical[len(physical)-1],
+		node:    stack[len(stack)-1],
+	}, nil
+}
+
+// existing is lookup, but it's an error if the entry doesn't exist
+func (m *MemFs) existing(op, name string, followLast bool) (*memLookup, error) {
+	l, err := m.lookup(op, name, followLast)
+	if err == nil && l.node == nil {
+		return nil, pathErr(op, name, syscall.ENOENT)
+	}
+	return l, err
+}
+
+func (m *MemFs) Name() string { return "MemFs" }
+
+func (m *MemFs) Stat(name string) (os.FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	l, err := m.existing("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return l.node.info(l.name), nil
+}
+
+func (m *MemFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	l, err := m.existing("lstat", name, false)
+	if err != nil {
+		return nil, true, err
+	}
+	return l.node.info(l.name), true, nil
+}
+
+func (m *MemFs) Symlink(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	l, err := m.lookup("symlink", newname, false)
+	if err != nil {
+		return err
+	} else if l.node != nil {
+		return pathErr("symlink", newname, syscall.EEXIST)
+	} else if err = m.mayChange("symlink", newname, l.dir); err != nil {
+		return err
+	}
+
+	link := m.newNode(os.ModeSymlink | 0o777)
+	link.target = oldname
+	l.dir.children[l.name] = link
+	return nil
+}
+
+func (m *MemFs) Readlink(name string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	l, err := m.existing("readlink", name, false)
+	if err != nil {
+		return "", err
+	} else if !l.node.isSymlink() {
+		return "", pathErr("readlink", name, syscall.EINVAL)
+	}
+	return l.node.target, nil
+}
+
+func (m *MemFs) Glob(pattern string) ([]string, error) {
+	return afero.Glob(m, pattern)
+}
+
+func (m *MemFs) Mkdir(name string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.mkdir(name, perm)
+}
+
+func (m *MemFs) mkdir(name string, perm os.FileMode) error {
+	l, err := m.lookup("mkdir", name, false)
+	if err != nil {
+		return err
+	} else if l.node != nil {
+		return pathErr("mkdir", name, syscall.EEXIST)
+	} else if err = m.mayChange("mkdir", name, l.dir); err != nil {
+		return err
+	}
+
+	l.dir.children[l.name] = m.newNode(os.ModeDir | perm.Perm())
+	l.dir.modTime = time.Now()
+	return nil
+}
+
+func (m *MemFs) MkdirAll(name string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	comps := splitPath(name)
+	for i := range comps {
+		sub := "/" + strings.Join(comps[:i+1], "/")
+
+		switch l, err := m.lookup("mkdir", sub, true); {
+		case err != nil:
+			return err
+		case l.node == nil:
+			if err = m.mkdir(sub, perm); err != nil {
+				return err
+			}
+		case !l.node.isDir():
+			return pathErr("mkdir", sub, syscall.ENOTDIR)
+		}
+	}
+	return nil
+}
+
+// Mknod creates a file with the given type bits, eg. os.ModeNamedPipe or
+// os.ModeSocket, for testing how special files are handled
+func (m *MemFs) Mknod(name string, mode os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	l, err := m.lookup("mknod", name, false)
+	if err != nil {
+		return err
+	} else if l.node != nil {
+		return pathErr("mknod", name, syscall.EEXIST)
+	} else if err = m.mayChange("mknod", name, l.dir); err != nil {
+		return err
+	}
+
+	l.dir.children[l.name] = m.newNode(mode)
+	return nil
+}
+
+func (m *MemFs) Create(name string) (afero.File, error) {
+	return m.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o666)
+}
+
+func (m *MemFs) Open(name string) (afero.File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *MemFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// a dangling symlink is followed to create its target, so resolve
+	// with followLast, which leaves us at the missing final entry
+	l, err := m.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case l.node == nil && flag&os.O_CREATE == 0:
+		return nil, pathErr("open", name, syscall.ENOENT)
+	case l.node == nil:
+		if err = m.mayChange("open", name, l.dir); err != nil {
+			return nil, err
+		}
+		l.node = m.newNode(perm.Perm())
+		l.dir.children[l.name] = l.node
+		l.dir.modTime = time.Now()
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, pathErr("open", name, syscall.EEXIST)
+	case l.node.isDir() && flag&(os.O_WRONLY|os.O_RDWR) != 0:
+		return nil, pathErr("open", name, syscall.EISDIR)
+	case flag&os.O_WRONLY == 0 && !m.may(l.node, permRead),
+		flag&(os.O_WRONLY|os.O_RDWR) != 0 && !m.may(l.node, permWrite):
+		return nil, pathErr("open", name, syscall.EACCES)
+	}
+
+	if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 && l.node.mode.IsRegular() {
+		l.node.data = nil
+		l.node.modTime = time.Now()
+	}
+
+	return &memFile{fs: m, node: l.node, name: name, flag: flag}, nil
+}
+
+func (m *MemFs) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	l, err := m.existing("remove", name, false)
+	if err != nil {
+		return err
+	} else if l.dir == nil {
+		return pathErr("remove", name, syscall.EBUSY)
+	} else if l.node.isDir() && len(l.node.children) > 0 {
+		return pathErr("remove", name, syscall.ENOTEMPTY)
+	} else if err = m.mayChange("remove", name, l.dir); err != nil {
+		return err
+	}
+
+	delete(l.dir.children, l.name)
+	l.dir.modTime = time.Now()
+	return nil
+}
+
+func (m *MemFs) RemoveAll(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	l, err := m.lookup("removeall", name, false)
+	if os.IsNotExist(err) || IsNotDir(err) || (err == nil && l.node == nil) {
+		return nil
+	} else if err != nil {
+		return err
+	} else if l.dir == nil {
+		m.root.children = make(map[string]*memNode)
+		return nil
+	} else if err = m.mayChange("removeall", name, l.dir); err != nil {
+		return err
+	}
+
+	delete(l.dir.children, l.name)
+	l.dir.modTime = time.Now()
+	return nil
+}
+
+// contains returns true if n is dir or somewhere below it
+func contains(dir, n *memNode) bool {
+	if dir == n {
+		return true
+	}
+	for _, c := range dir.children {
+		if c.isDir() && contains(c, n) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemFs) Rename(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	src, err := m.existing("rename", oldname, false)
+	if err != nil {
+		return err
+	}
+
+	dst, err := m.lookup("rename", newname, false)
+	if err != nil {
+		return err
+	}
+
+	if src.node == dst.node {
+		return nil
+	}
+
+	switch {
+	case src.dir == nil || dst.dir == nil:
+		return pathErr("rename", oldname, syscall.EBUSY)
+	case src.node.isDir() && contains(src.node, dst.dir):
+		return pathErr("rename", oldname, syscall.EINVAL)
+	case dst.node == nil:
+	case src.node.isDir() && !dst.node.isDir():
+		return pathErr("rename", newname, syscall.ENOTDIR)
+	case !src.node.isDir() && dst.node.isDir():
+		return pathErr("rename", newname, syscall.EISDIR)
+	case dst.node.isDir() && len(dst.node.children) > 0:
+		return pathErr("rename", newname, syscall.ENOTEMPTY)
+	}
+
+	if err = m.mayChange("rename", oldname, src.dir); err != nil {
+		return err
+	} else if err = m.mayChange("rename", newname, dst.dir); err != nil {
+		return err
+	}
+
+	delete(src.dir.children, src.name)
+	dst.dir.children[dst.name] = src.node
+
+	now := time.Now()
+	src.dir.modTime, dst.dir.modTime = now, now
+	return nil
+}
+
+func (m *MemFs) Chmod(name string, mode os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	l, err := m.existing("chmod", name, true)
+	if err != nil {
+		return err
+	} else if err = m.mayOwn("chmod", name, l.node); err != nil {
+		return err
+	}
+
+	const chmodBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+	l.node.mode = (l.node.mode &^ chmodBits) | (mode & chmodBits)
+	return nil
+}
+
+func (m *MemFs) Chown(name string, uid, gid int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	l, err := m.existing("chown", name, true)
+	if err != nil {
+		return err
+	} else if m.uid != 0 && (uid != -1 || gid != -1) {
+		// only root may give files away, the group rules are left out
+		return pathErr("chown", name, syscall.EPERM)
+	}
+
+	// -1 means leave it alone, as for chown(2)
+	if uid != -1 {
+		l.node.uid = uid
+	}
+	if gid != -1 {
+		l.node.gid = gid
+	}
+	return nil
+}
+
+// Link makes newname another name for the node at oldname. as for
+// link(2), a symlink at oldname isn't followed and directories can't be linked
+func (m *MemFs) Link(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	src, err := m.existing("link", oldname, false)
+	if err != nil {
+		return err
+	} else if src.node.isDir() {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EPERM}
+	}
+
+	dst, err := m.lookup("link", newname, false)
+	if err != nil {
+		return err
+	} else if dst.node != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EEXIST}
+	} else if !m.may(dst.dir, permWrite|permExec) {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EACCES}
+	}
+
+	dst.dir.children[dst.name] = src.node
+	dst.dir.modTime = time.Now()
+	return nil
+}
+
+func (m *MemFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	l, err := m.existing("chtimes", name, true)
+	if err != nil {
+		return err
+	} else if err = m.mayOwn("chtimes", name, l.node); err != nil {
+		return err
+	}
+
+	l.node.modTime = mtime
+	return nil
+}
+
+// memFile is an open handle on a memNode
+type memFile struct {
+	fs     *MemFs
+	node   *memNode
+	name   string
+	flag   int
+	offset int64
+	dirPos int
+	closed bool
+}
+
+var (
+	_ afero.File = &memFile{}
+	_ Flocker    = &memFile{}
+)
+
+func (f *memFile) check(op string, write bool) error {
+	switch {
+	case f.closed:
+		return pathErr(op, f.name, syscall.EBADF)
+	case write && f.flag&(os.O_WRONLY|os.O_RDWR) == 0:
+		return pathErr(op, f.name, syscall.EBADF)
+	case !write && f.flag&os.O_WRONLY != 0:
+		return pathErr(op, f.name, syscall.EBADF)
+	case f.node.isDir() && op != "readdir":
+		return pathErr(op, f.name, syscall.EISDIR)
+	}
+	return nil
+}
+
+func (f *memFile) Name() string { return f.name }
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return pathErr("close", f.name, syscall.EBADF)
+	}
+	f.closed = true
+	if f.node.lockedBy == f {
+		f.node.lockedBy = nil
+	}
+	return nil
+}
+
+// Flock locks the file like flock(2), except that a shared lock is taken
+// as an exclusive one. Without LOCK_NB it waits for the lock, and closing
+// the file releases it.
+func (f *memFile) Flock(how int) error {
+	for {
+		f.fs.mu.Lock()
+		switch {
+		case f.closed:
+			f.fs.mu.Unlock()
+			return syscall.EBADF
+		case how&syscall.LOCK_UN != 0:
+			if f.node.lockedBy == f {
+				f.node.lockedBy = nil
+			}
+			f.fs.mu.Unlock()
+			return nil
+		case f.node.lockedBy == nil || f.node.lockedBy == f:
+			f.node.lockedBy = f
+			f.fs.mu.Unlock()
+			return nil
+		case how&syscall.LOCK_NB != 0:
+			f.fs.mu.Unlock()
+			return syscall.EWOULDBLOCK
+		}
+		f.fs.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (f *memFile) Sync() error { return nil }
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+	return f.node.info(path.Base(f.name)), nil
+}
+
+func (f *memFile) ReadAt(b []byte, off int64) (int, error) {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(b, f.node.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Read(b []byte) (int, error) {
+	n, err := f.ReadAt(b, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) WriteAt(b []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+
+	if end := off + int64(len(b)); end > int64(len(f.node.data)) {
+		data := make([]byte, end)
+		copy(data, f.node.data)
+		f.node.data = data
+	}
+
+	copy(f.node.data[off:], b)
+	f.node.modTime = time.Now()
+	return len(b), nil
+}
+
+func (f *memFile) Write(b []byte) (int, error) {
+	if f.flag&os.O_APPEND != 0 {
+		f.fs.mu.RLock()
+		f.offset = int64(len(f.node.data))
+		f.fs.mu.RUnlock()
+	}
+
+	n, err := f.WriteAt(b, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteString(s string) (int, error) { return f.Write([]byte(s)) }
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+
+	if f.closed {
+		return 0, pathErr("seek", f.name, syscall.EBADF)
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+
+	if offset < 0 {
+		return 0, pathErr("seek", f.name, syscall.EINVAL)
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("truncate", true); err != nil {
+		return err
+	} else if size < 0 {
+		return pathErr("truncate", f.name, syscall.EINVAL)
+	}
+
+	data := make([]byte, size)
+	copy(data, f.node.data)
+	f.node.data = data
+	f.node.modTime = time.Now()
+	return nil
+}
+
+// Readdir returns lstat style infos of the directory's entries, sorted by name
+func (f *memFile) Readdir(count int) ([]os.FileInfo, error) {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+
+	if f.closed {
+		return nil, pathErr("readdir", f.name, syscall.EBADF)
+	} else if !f.node.isDir() {
+		return nil, pathErr("readdir", f.name, syscall.ENOTDIR)
+	}
+
+	names := make([]string, 0, len(f.node.children))
+	for name := range f.node.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if f.dirPos > len(names) {
+		f.dirPos = len(names)
+	}
+	names = names[f.dirPos:]
+
+	if count > 0 {
+		if len(names) == 0 {
+			return nil, io.EOF
+		}
+		if count < len(names) {
+			names = names[:count]
+		}
+	}
+	f.dirPos += len(names)
+
+	infos := make([]os.FileInfo, len(names))
+	for i, name := range names {
+		infos[i] = f.node.children[name].info(name)
+	}
+	return infos, nil
+}
+
+func (f *memFile) Readdirnames(count int) ([]string, error) {
+	infos, err := f.Readdir(count)
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+	return names, err
+}
@@ -0,0 +1,260 @@
+package pathlib
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/suite"
+)
+
+type MemFsSuite struct {
+	RequireSuite
+	mfs *MemFs
+}
+
+func TestMemFs(t *testing.T) {
+	suite.Run(t, new(MemFsSuite))
+}
+
+func (s *MemFsSuite) SetupTest() {
+	s.mfs = NewMemFs()
+	s.NoError(s.mfs.MkdirAll("/home/user/.settings", 0o755))
+	s.writeFile("/home/user/.settings/bashrc", "export A=1\n")
+}
+
+func (s *MemFsSuite) writeFile(name, data string) {
+	f, err := s.mfs.Create(name)
+	s.NoError(err)
+	_, err = f.WriteString(data)
+	s.NoError(err)
+	s.NoError(f.Close())
+}
+
+func (s *MemFsSuite) readFile(name string) string {
+	f, err := s.mfs.Open(name)
+	s.NoError(err)
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	s.NoError(err)
+	return string(data)
+}
+
+func (s *MemFsSuite) errno(err error) syscall.Errno {
+	s.Error(err)
+	pe, ok := errors.Cause(err).(*os.PathError)
+	s.True(ok, "%#v is not a *os.PathError", err)
+	errno, ok := pe.Err.(syscall.Errno)
+	s.True(ok, "%#v is not a syscall.Errno", pe.Err)
+	return errno
+}
+
+func (s *MemFsSuite) TestRelativeAndAbsoluteSymlinks() {
+	s.NoError(s.mfs.Symlink(".settings/bashrc", "/home/user/.bashrc"))
+	s.NoError(s.mfs.Symlink("/home/user/.settings", "/home/user/settings"))
+
+	s.Equal("export A=1\n", s.readFile("/home/user/.bashrc"))
+	s.Equal("export A=1\n", s.readFile("/home/user/settings/bashrc"))
+
+	// a relative target is resolved against the directory the link is in,
+	// not the path we got there by
+	s.NoError(s.mfs.Symlink("/home/user/.settings", "/lnk"))
+	s.NoError(s.mfs.Symlink("../.settings/bashrc", "/home/user/.settings/up"))
+	s.Equal("export A=1\n", s.readFile("/lnk/up"))
+
+	// '..' is applied to the physical path too
+	s.Equal("export A=1\n", s.readFile("/lnk/../.settings/bashrc"))
+
+	target, err := s.mfs.Readlink("/home/user/.bashrc")
+	s.NoError(err)
+	s.Equal(".settings/bashrc", target)
+
+	_, err = s.mfs.Readlink("/home/user/.settings/bashrc")
+	s.Equal(syscall.EINVAL, s.errno(err))
+
+	s.Equal(syscall.EEXIST, s.errno(s.mfs.Symlink("x", "/home/user/.bashrc")))
+}
+
+func (s *MemFsSuite) TestLstatVsStat() {
+	s.NoError(s.mfs.Symlink(".settings/bashrc", "/home/user/.bashrc"))
+	s.NoError(s.mfs.Symlink("nowhere", "/home/user/.dangling"))
+
+	info, lstatCalled, err := s.mfs.LstatIfPossible("/home/user/.bashrc")
+	s.NoError(err)
+	s.True(lstatCalled)
+	s.True(info.Mode()&os.ModeSymlink != 0)
+	s.Equal(".bashrc", info.Name())
+
+	info, err = s.mfs.Stat("/home/user/.bashrc")
+	s.NoError(err)
+	s.True(info.Mode().IsRegular())
+	s.EqualValues(len("export A=1\n"), info.Size())
+
+	_, _, err = s.mfs.LstatIfPossible("/home/user/.dangling")
+	s.NoError(err)
+	_, err = s.mfs.Stat("/home/user/.dangling")
+	s.True(os.IsNotExist(err))
+
+	_, err = s.mfs.Stat("/home/user/.settings/bashrc/x")
+	s.Equal(syscall.ENOTDIR, s.errno(err))
+}
+
+func (s *MemFsSuite) TestSymlinkLoop() {
+	s.NoError(s.mfs.Symlink("b", "/a"))
+	s.NoError(s.mfs.Symlink("a", "/b"))
+	s.NoError(s.mfs.Symlink("self", "/self"))
+
+	_, err := s.mfs.Stat("/a")
+	s.Equal(syscall.ELOOP, s.errno(err))
+	_, err = s.mfs.Open("/self")
+	s.Equal(syscall.ELOOP, s.errno(err))
+	_, err = NewPosixPathFs(s.mfs, "/a").Resolve()
+	s.Equal(syscall.ELOOP, s.errno(err))
+
+	// lstat and readlink don't follow the link, so they're fine
+	_, _, err = s.mfs.LstatIfPossible("/a")
+	s.NoError(err)
+	_, err = s.mfs.Readlink("/self")
+	s.NoError(err)
+}
+
+func (s *MemFsSuite) TestPermissions() {
+	s.NoError(s.mfs.Chmod("/home/user/.settings/bashrc", 0o600))
+	info, err := s.mfs.Stat("/home/user/.settings/bashrc")
+	s.NoError(err)
+	s.Equal(os.FileMode(0o600), info.Mode())
+
+	s.NoError(s.mfs.Mkdir("/home/user/bin", 0o700))
+	info, err = s.mfs.Stat("/home/user/bin")
+	s.NoError(err)
+	s.Equal(os.ModeDir|0o700, info.Mode())
+
+	// chmod follows symlinks
+	s.NoError(s.mfs.Symlink(".settings/bashrc", "/home/user/.bashrc"))
+	s.NoError(s.mfs.Chmod("/home/user/.bashrc", 0o640))
+	info, err = s.mfs.Stat("/home/user/.settings/bashrc")
+	s.NoError(err)
+	s.Equal(os.FileMode(0o640), info.Mode())
+}
+
+func (s *MemFsSuite) TestPermissionsEnforced() {
+	s.NoError(s.mfs.Chown("/home/user", 1000, 1000))
+	s.NoError(s.mfs.Chown("/home/user/.settings", 1000, 1000))
+	s.NoError(s.mfs.Chown("/home/user/.settings/bashrc", 1000, 1000))
+	s.NoError(s.mfs.Mkdir("/etc", 0o755))
+	s.writeFile("/etc/shadow", "")
+	s.NoError(s.mfs.Chmod("/etc/shadow", 0o600))
+	s.mfs.SetUser(1000, 1000)
+
+	// files the user makes are theirs
+	s.writeFile("/home/user/notes", "x")
+	info, err := s.mfs.Stat("/home/user/notes")
+	s.NoError(err)
+	s.Equal(1000, info.Sys().(*memNode).uid)
+
+	_, err = s.mfs.Open("/etc/shadow")
+	s.Equal(syscall.EACCES, s.errno(err))
+	_, err = s.mfs.Create("/etc/passwd")
+	s.Equal(syscall.EACCES, s.errno(err))
+	s.Equal(syscall.EACCES, s.errno(s.mfs.Remove("/etc/shadow")))
+	s.Equal(syscall.EPERM, s.errno(s.mfs.Chmod("/etc/shadow", 0o644)))
+	s.Equal(syscall.EPERM, s.errno(s.mfs.Chown("/home/user/notes", 0, 0)))
+
+	s.NoError(s.mfs.Chmod("/home/user/.settings/bashrc", 0o400))
+	_, err = s.mfs.OpenFile("/home/user/.settings/bashrc", os.O_WRONLY, 0)
+	s.Equal(syscall.EACCES, s.errno(err))
+	s.Equal("export A=1\n", s.readFile("/home/user/.settings/bashrc"))
+
+	// a dir without write permission can't be changed, one without
+	// search permission can't be looked into
+	s.NoError(s.mfs.Chmod("/home/user/.settings", 0o500))
+	s.Equal(syscall.EACCES, s.errno(s.mfs.Symlink("bashrc", "/home/user/.settings/link")))
+	s.Equal(syscall.EACCES, s.errno(s.mfs.Rename("/home/user/notes", "/home/user/.settings/notes")))
+	s.NoError(s.mfs.Chmod("/home/user/.settings", 0o600))
+	_, err = s.mfs.Stat("/home/user/.settings/bashrc")
+	s.Equal(syscall.EACCES, s.errno(err))
+
+	// root may do anything
+	s.mfs.SetUser(0, 0)
+	_, err = s.mfs.Stat("/home/user/.settings/bashrc")
+	s.NoError(err)
+	s.NoError(s.mfs.Remove("/etc/shadow"))
+}
+
+func (s *MemFsSuite) TestGlob() {
+	s.writeFile("/home/user/.settings/vimrc", "")
+	s.writeFile("/home/user/.settings/.hidden", "")
+
+	matches, err := s.mfs.Glob("/home/user/.settings/*rc")
+	s.NoError(err)
+	s.Equal([]string{"/home/user/.settings/bashrc", "/home/user/.settings/vimrc"}, matches)
+}
+
+func (s *MemFsSuite) TestRenameAndRemove() {
+	s.NoError(s.mfs.Rename("/home/user/.settings/bashrc", "/home/user/bashrc.bak"))
+	s.Equal("export A=1\n", s.readFile("/home/user/bashrc.bak"))
+
+	s.Equal(syscall.ENOTEMPTY, s.errno(s.mfs.Remove("/home/user")))
+	s.Equal(syscall.EINVAL, s.errno(s.mfs.Rename("/home", "/home/user/x")))
+
+	// removing a symlink removes the link, not the target
+	s.NoError(s.mfs.Symlink("bashrc.bak", "/home/user/.bashrc"))
+	s.NoError(s.mfs.Remove("/home/user/.bashrc"))
+	_, err := s.mfs.Stat("/home/user/bashrc.bak")
+	s.NoError(err)
+
+	s.NoError(s.mfs.RemoveAll("/home"))
+	_, err = s.mfs.Stat("/home")
+	s.True(os.IsNotExist(err))
+}
+
+func (s *MemFsSuite) TestPosixPathOnMemFs() {
+	s.NoError(s.mfs.Symlink(".settings/bashrc", "/home/user/.bashrc"))
+	s.NoError(s.mfs.Symlink("/home/user/.settings", "/home/user/settings"))
+
+	link := NewPosixPathFs(s.mfs, "/home/user/.bashrc")
+	s.True(link.IsSymlink())
+	s.True(link.IsFile())
+	s.False(NewPosixPathFs(s.mfs, "/home/user/.settings/bashrc").IsSymlink())
+
+	resolved, err := NewPosixPathFs(s.mfs, "/home/user/settings/../.bashrc").Resolve()
+	s.NoError(err)
+	s.Equal("/home/user/.settings/bashrc", resolved.String())
+
+	resolved, err = NewPosixPathFs(s.mfs, "/home/user/settings/bashrc").Resolve()
+	s.NoError(err)
+	s.Equal("/home/user/.settings/bashrc", resolved.String())
+
+	same, err := link.SameFile(NewPosixPathFs(s.mfs, "/home/user/settings/bashrc"))
+	s.NoError(err)
+	s.True(same)
+
+	s.writeFile("/home/user/other", "export A=1\n")
+	same, err = link.SameFile(NewPosixPathFs(s.mfs, "/home/user/other"))
+	s.NoError(err)
+	s.False(same)
+}
+
+func (s *MemFsSuite) TestFlock() {
+	open := func() afero.File {
+		f, err := s.mfs.OpenFile("/home/user/lock", os.O_RDWR|os.O_CREATE, 0o600)
+		s.NoError(err)
+		return f
+	}
+
+	a, b := open(), open()
+	s.NoError(Flock(a, syscall.LOCK_EX|syscall.LOCK_NB))
+	s.NoError(Flock(a, syscall.LOCK_EX|syscall.LOCK_NB), "locking again is a no-op")
+	s.Equal(syscall.EWOULDBLOCK, Flock(b, syscall.LOCK_EX|syscall.LOCK_NB))
+
+	s.NoError(Flock(a, syscall.LOCK_UN))
+	s.NoError(Flock(b, syscall.LOCK_EX|syscall.LOCK_NB))
+
+	// closing the file releases its lock
+	s.NoError(b.Close())
+	s.NoError(Flock(a, syscall.LOCK_EX|syscall.LOCK_NB))
+	s.NoError(a.Close())
+}
@@ -17,6 +17,17 @@ type (
 		Remove()
 		RemoveAll()
 		Touch(perm os.FileMode, existOk bool)
+		Readlink() PosixPath
+		Rename(target string) PosixPath
+		Chmod(mode os.FileMode)
+		Chown(uid, gid int)
+		ReadDir() []PosixPath
+		Walk(fn WalkFunc)
+		ReadFile() []byte
+		WriteFile(data []byte, perm os.FileMode)
+		HardlinkTo(target string)
+		Copy(dest string) PosixPath
+		Snapshot() *Snapshot
 
 		// Match returns true if the pattern matches the last path component
 		// of this path. Note that ths wlll only blow up if the pattern itself
@@ -29,10 +40,12 @@ type (
 		ExMatch(pattern string) bool
 	}
 
-	mustPath string
+	mustPath struct {
+		posix posixPath
+	}
 )
 
-var _ MustActions = mustPath("")
+var _ MustActions = mustPath{}
 
 func must(err error) {
 	if err != nil {
@@ -40,17 +53,21 @@ func must(err error) {
 	}
 }
 
-func NewMustAction(s string) MustActions { return MustActions(mustPath(s)) }
+func NewMustAction(s string) MustActions { return MustActions(posix2must(posixPath{path: s})) }
 
 func (m mustPath) Mkdir(perm os.FileMode)               { must(m.Posix().Mkdir(perm)) }
 func (m mustPath) MkdirAll(perm os.FileMode)            { must(m.Posix().MkdirAll(perm)) }
 func (m mustPath) Remove()                              { must(m.Posix().Remove()) }
 func (m mustPath) RemoveAll()                           { must(m.Posix().RemoveAll()) }
 func (m mustPath) Touch(perm os.FileMode, existOk bool) { must(m.Posix().Touch(perm, existOk)) }
+func (m mustPath) Chmod(mode os.FileMode)               { must(m.Posix().Chmod(mode)) }
+func (m mustPath) Chown(uid, gid int)                   { must(m.Posix().Chown(uid, gid)) }
+func (m mustPath) Walk(fn WalkFunc)                     { must(m.Posix().Walk(fn)) }
+func (m mustPath) HardlinkTo(target string)             { must(m.Posix().HardlinkTo(target)) }
 func (m mustPath) Pure() PurePath                       { return must2posix(m).Pure() }
-func (m mustPath) Posix() PosixPath                     { return NewPosixPath(string(m)) }
+func (m mustPath) Posix() PosixPath                     { return m.posix }
 func (m mustPath) Must() MustActions                    { return m }
-func (m mustPath) String() string                       { return string(m) }
+func (m mustPath) String() string                       { return m.posix.path }
 
 func (m mustPath) Match(pattern string) bool {
 	b, e := must2posix(m).Match(pattern)
@@ -63,3 +80,43 @@ func (m mustPath) ExMatch(pattern string) bool {
 	must(e)
 	return b
 }
+
+func (m mustPath) Readlink() PosixPath {
+	p, e := must2posix(m).Readlink()
+	must(e)
+	return p
+}
+
+func (m mustPath) Rename(target string) PosixPath {
+	p, e := must2posix(m).Rename(target)
+	must(e)
+	return p
+}
+
+func (m mustPath) ReadDir() []PosixPath {
+	ps, e := must2posix(m).ReadDir()
+	must(e)
+	return ps
+}
+
+func (m mustPath) WriteFile(data []byte, perm os.FileMode) {
+	must(m.Posix().WriteFile(data, perm))
+}
+
+func (m mustPath) ReadFile() []byte {
+	b, e := must2posix(m).ReadFile()
+	must(e)
+	return b
+}
+
+func (m mustPath) Copy(dest string) PosixPath {
+	p, e := must2posix(m).Copy(dest)
+	must(e)
+	return p
+}
+
+func (m mustPath) Snapshot() *Snapshot {
+	snap, e := must2posix(m).Snapshot()
+	must(e)
+	return snap
+}
@@ -29,10 +29,10 @@ type (
 	}
 )
 
-func pure2posix(p pureStr) posixStr  { return posixStr(string(p)) }
-func posix2pure(p posixStr) pureStr  { return pureStr(string(p)) }
-func posix2must(p posixStr) mustPath { return mustPath(string(p)) }
-func must2posix(p mustPath) posixStr { return posixStr(string(p)) }
+func pure2posix(p pureStr) posixPath  { return posixPath{path: string(p)} }
+func posix2pure(p posixPath) pureStr  { return pureStr(p.path) }
+func posix2must(p posixPath) mustPath { return mustPath{p} }
+func must2posix(p mustPath) posixPath { return p.posix }
 
 func PosixSliceStringer(ps []PosixPath) (str []string) {
 	str = make([]string, len(ps))
@@ -1,8 +1,11 @@
 package pathlib
 
 import (
+	"os"
 	"testing"
 
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
@@ -88,3 +91,186 @@ func (s *PurePathSuite) TestSplit() {
 	s.Equal("c", tail)
 }
 
+
+func TestIsNotDir(t *testing.T) {
+	_, err := os.Stat("/dev/null/x")
+	require.True(t, IsNotDir(err))
+	require.False(t, IsNotDir(os.ErrNotExist))
+}
+
+func (s *PurePathSuite) TestStemAndSuffixes() {
+	tests := []struct {
+		path     string
+		stem     string
+		suffix   string
+		suffixes []string
+	}{
+		{"/a/b/file.txt", "file", ".txt", []string{".txt"}},
+		{"dist/pkg.tar.gz", "pkg.tar", ".gz", []string{".tar", ".gz"}},
+		{"/home/user/.bashrc", ".bashrc", "", nil},
+		{"/home/user/.vim.bak", ".vim", ".bak", []string{".bak"}},
+		{"trailing.", "trailing.", "", nil},
+		{"noext", "noext", "", nil},
+		{"/dir/file.txt/", "file", ".txt", []string{".txt"}},
+		{"/", "", "", nil},
+		{"", "", "", nil},
+	}
+
+	for _, tt := range tests {
+		p := NewPurePath(tt.path)
+		s.Equal(tt.stem, p.Stem(), "Stem of %#v", tt.path)
+		s.Equal(tt.suffix, p.Suffix(), "Suffix of %#v", tt.path)
+		s.Equal(tt.suffixes, p.Suffixes(), "Suffixes of %#v", tt.path)
+	}
+}
+
+func (s *PurePathSuite) TestWithNameAndSuffix() {
+	tests := []struct {
+		path   string
+		name   string
+		suffix string
+		// the expected results, "" means an error
+		withName   string
+		withSuffix string
+	}{
+		{"/a/b/file.txt", "other.md", ".md", "/a/b/other.md", "/a/b/file.md"},
+		{"pkg.tar.gz", "x", ".bz2", "x", "pkg.tar.bz2"},
+		{"/home/.bashrc", "bashrc", ".bak", "/home/bashrc", "/home/.bashrc.bak"},
+		{"/a/file.txt", "y", "", "/a/y", "/a/file"},
+		{"/a/file", "a/b", "txt", "", ""},
+		{"/a/file", "", "./", "", ""},
+		{"/a/file", ".", ".", "", ""},
+		{"/", "x", ".txt", "", ""},
+		{"", "x", ".txt", "", ""},
+	}
+
+	for _, tt := range tests {
+		p := NewPurePath(tt.path)
+
+		if named, err := p.WithName(tt.name); tt.withName == "" {
+			s.Error(err, "WithName(%#v) on %#v", tt.name, tt.path)
+		} else {
+			s.NoError(err)
+			s.Equal(tt.withName, named.String())
+		}
+
+		if suffixed, err := p.WithSuffix(tt.suffix); tt.withSuffix == "" {
+			s.Error(err, "WithSuffix(%#v) on %#v", tt.suffix, tt.path)
+		} else {
+			s.NoError(err)
+			s.Equal(tt.withSuffix, suffixed.String())
+		}
+	}
+}
+
+func (s *PurePathSuite) TestPartsAnchorAndParents() {
+	tests := []struct {
+		path    string
+		parts   []string
+		anchor  string
+		parents []string
+	}{
+		{"/a/b/c", []string{"/", "a", "b", "c"}, "/", []string{"/a/b", "/a", "/"}},
+		{"a/b", []string{"a", "b"}, "", []string{"a", "."}},
+		{"//a/./b/", []string{"/", "a", "b"}, "/", []string{"/a", "/"}},
+		{"a/../b", []string{"a", "..", "b"}, "", []string{"a/..", "a", "."}},
+		{"/", []string{"/"}, "/", []string{}},
+		{"", nil, "", []string{}},
+	}
+
+	for _, tt := range tests {
+		p := NewPurePath(tt.path)
+		s.Equal(tt.parts, p.Parts(), "Parts of %#v", tt.path)
+		s.Equal(tt.anchor, p.Anchor(), "Anchor of %#v", tt.path)
+		s.Equal(tt.anchor == "/", p.IsAbs(), "IsAbs of %#v", tt.path)
+
+		parents := []string{}
+		for _, pp := range p.Parents() {
+			parents = append(parents, pp.String())
+		}
+		s.Equal(tt.parents, parents, "Parents of %#v", tt.path)
+	}
+}
+
+func (s *PurePathSuite) TestRelativeTo() {
+	tests := []struct {
+		path  string
+		other string
+		// "" means an error
+		rel string
+	}{
+		{"/a/b/c", "/a", "b/c"},
+		{"/a/b/c", "/a/b/", "c"},
+		{"/a/b/c", "/a/b/c", "."},
+		{"/a/b/c", "/", "a/b/c"},
+		{"a/b", "a", "b"},
+		{"/a/bc", "/a/b", ""},
+		{"/a/b", "/a/b/c", ""},
+		{"/a/b", "/x/../a", ""},
+		{"/a/b", "a", ""},
+		{"a/b", "/a", ""},
+	}
+
+	for _, tt := range tests {
+		p := NewPurePath(tt.path)
+		rel, err := p.RelativeTo(tt.other)
+
+		if tt.rel == "" {
+			s.Error(err, "%#v relative to %#v", tt.path, tt.other)
+			s.False(p.IsRelativeTo(tt.other))
+		} else {
+			s.NoError(err)
+			s.Equal(tt.rel, rel.String(), "%#v relative to %#v", tt.path, tt.other)
+			s.True(p.IsRelativeTo(tt.other))
+		}
+	}
+}
+
+func (s *PurePathSuite) TestExpand() {
+	home, err := homedir.Dir()
+	s.NoError(err)
+	s.NoError(os.Setenv("DFI_TEST_DIR", "settings"))
+	defer os.Unsetenv("DFI_TEST_DIR")
+
+	tests := []struct {
+		path       string
+		expandUser string
+		expandVars string
+	}{
+		{"~", home, "~"},
+		{"~/.config", home + "/.config", "~/.config"},
+		{"/a/~/b", "/a/~/b", "/a/~/b"},
+		{"~/$DFI_TEST_DIR/x", home + "/$DFI_TEST_DIR/x", "~/settings/x"},
+		{"/${DFI_TEST_DIR}/$DFI_TEST_UNSET", "/${DFI_TEST_DIR}/$DFI_TEST_UNSET", "/settings/"},
+		{"~other/x", "", "~other/x"},
+	}
+
+	for _, tt := range tests {
+		p := NewPurePath(tt.path)
+
+		if expanded, err := p.Expanduser(); tt.expandUser == "" {
+			s.Error(err, "Expanduser of %#v", tt.path)
+		} else {
+			s.NoError(err)
+			s.Equal(tt.expandUser, expanded.String())
+		}
+
+		s.Equal(tt.expandVars, p.ExpandVars().String())
+	}
+}
+
+func (s *PurePathSuite) TestTypedErrors() {
+	var invalid *InvalidNameError
+	_, err := NewPurePath("/").WithName("x")
+	s.True(errors.As(err, &invalid))
+	s.Equal(InvalidNameError{Path: "/"}, *invalid)
+
+	_, err = NewPurePath("/a/b").WithSuffix("txt")
+	s.True(errors.As(err, &invalid))
+	s.Equal(InvalidNameError{Path: "/a/b", Name: "txt"}, *invalid)
+
+	var notRel *NotRelativeError
+	_, err = NewPurePath("/a/b").RelativeTo("/c")
+	s.True(errors.As(err, &notRel))
+	s.Equal(NotRelativeError{Path: "/a/b", Other: "/c"}, *notRel)
+}
@@ -2,6 +2,7 @@ package pathlib
 
 import (
 	"fmt"
+	"io"
 	"os"
 	fp "path/filepath"
 	"syscall"
@@ -48,90 +49,158 @@ type (
 		IsDir() bool
 		Glob(pattern string) ([]PosixPath, error)
 		Touch(perm os.FileMode, existOk bool) error
+
+		// Readlink returns the path the symlink points to, as it's
+		// stored in the link
+		Readlink() (PosixPath, error)
+
+		// Rename moves this path to target and returns the new path
+		Rename(target string) (PosixPath, error)
+
+		Chmod(mode os.FileMode) error
+		Chown(uid, gid int) error
+
+		// ReadDir returns the entries of this directory sorted by name
+		ReadDir() ([]PosixPath, error)
+
+		// Walk calls fn for this path and everything below it, like
+		// filepath.Walk. Symlinks are not followed.
+		Walk(fn WalkFunc) error
+
+		ReadFile() ([]byte, error)
+		WriteFile(data []byte, perm os.FileMode) error
+
+		// HardlinkTo makes this path a hard link to target
+		HardlinkTo(target string) error
+
+		// Copy copies the contents and permissions of this file to dest,
+		// which is overwritten if it exists, and returns dest. Symlinks
+		// are followed, directories can't be copied.
+		Copy(dest string) (PosixPath, error)
+
+		// Snapshot looks at the path once, see Snapshot
+		Snapshot() (*Snapshot, error)
+
+		// Fs returns the filesystem this path performs its actions on
+		Fs() Fs
 	}
 
-	posixStr string
+	// WalkFunc is called by PosixPath.Walk for each path, see filepath.WalkFunc
+	WalkFunc func(path PosixPath, info RichFileInfo, err error) error
+
+	posixPath struct {
+		// fs is nil for paths created with NewPosixPath, which means
+		// use the real filesystem
+		fs   Fs
+		path string
+	}
 )
 
-var _ PosixPath = posixStr("")
+var _ PosixPath = posixPath{}
+
+// NewPosixPath returns a path whose actions use the real filesystem
+func NewPosixPath(s string) PosixPath { return posixPath{path: s} }
+
+// NewPosixPathFs returns a path whose actions (and those of paths derived
+// from it with Join, Parent, etc.) are performed on fsys
+func NewPosixPathFs(fsys Fs, s string) PosixPath { return posixPath{fs: fsys, path: s} }
+
+func (p posixPath) with(path string) posixPath { return posixPath{fs: p.fs, path: path} }
+
+func (p posixPath) Fs() Fs {
+	if p.fs != nil {
+		return p.fs
+	}
+	return NewOsFs()
+}
+
+func (p posixPath) Name() string      { return posix2pure(p).Name() }
+func (p posixPath) Parent() PosixPath { return p.with(posix2pure(p).Parent().String()) }
+func (p posixPath) Clean() PosixPath  { return p.with(posix2pure(p).Clean().String()) }
+func (p posixPath) String() string    { return p.path }
+func (p posixPath) Pure() PurePath    { return posix2pure(p) }
+func (p posixPath) Posix() PosixPath  { return p }
 
-func NewPosixPath(s string) PosixPath             { return posixStr(s) }
-func (p posixStr) Name() string                   { return posix2pure(p).Name() }
-func (p posixStr) Parent() PosixPath              { return posix2pure(p).Parent().Posix() }
-func (p posixStr) Clean() PosixPath               { return posix2pure(p).Clean().Posix() }
-func (p posixStr) Join(names ...string) PosixPath { return posix2pure(p).Join(names...).Posix() }
-func (p posixStr) String() string                 { return string(p) }
-func (p posixStr) Pure() PurePath                 { return posix2pure(p) }
-func (p posixStr) Posix() PosixPath               { return p }
+func (p posixPath) Join(names ...string) PosixPath {
+	return p.with(posix2pure(p).Join(names...).String())
+}
 
-func (p posixStr) Match(pattern string) (matched bool, err error) {
+func (p posixPath) Match(pattern string) (matched bool, err error) {
 	return posix2pure(p).Match(pattern)
 }
 
-func (p posixStr) ExMatch(pattern string) (matched bool, err error) {
+func (p posixPath) ExMatch(pattern string) (matched bool, err error) {
 	return posix2pure(p).ExMatch(pattern)
 }
 
-func (p posixStr) Split() (dir PosixPath, file string) {
+func (p posixPath) Split() (dir PosixPath, file string) {
 	d, f := posix2pure(p).Split()
-	return d.Posix(), f
+	return p.with(d.String()), f
 }
 
-func (p posixStr) Stat() (RichFileInfo, error) {
-	info, err := fs.Stat(string(p))
+func (p posixPath) Stat() (RichFileInfo, error) {
+	info, err := p.Fs().Stat(p.path)
 	return richInfo{info}, err
 }
 
-func (p posixStr) Lstat() (RichFileInfo, error) {
-	info, didLstat, err := fs.LstatIfPossible(string(p))
+func (p posixPath) Lstat() (RichFileInfo, error) {
+	info, didLstat, err := p.Fs().LstatIfPossible(p.path)
 	if !didLstat {
-		return nil, errors.Errorf("Lstat not available on the filesystem %#v", fs.Name())
+		return nil, errors.Errorf("Lstat not available on the filesystem %#v", p.Fs().Name())
 	}
 	return richInfo{info}, err
 }
 
-func (p posixStr) SymlinkTo(path string) error {
-	return fs.Symlink(path, string(p))
+func (p posixPath) SymlinkTo(path string) error {
+	return p.Fs().Symlink(path, p.path)
 }
 
-func (p posixStr) Rel(other string) (PosixPath, error) {
-	pp, err := fp.Rel(string(p), other)
+func (p posixPath) Rel(other string) (PosixPath, error) {
+	pp, err := fp.Rel(p.path, other)
 	if err != nil {
 		return nil, err
 	}
-	return PosixPath(posixStr(pp)), nil
+	return p.with(pp), nil
 }
 
-func (p posixStr) Resolve() (PosixPath, error) {
-	pp, err := fp.EvalSymlinks(string(p))
+func (p posixPath) Resolve() (PosixPath, error) {
+	var pp string
+	var err error
+
+	if _, ok := p.Fs().(pathLibOsFs); ok {
+		pp, err = fp.EvalSymlinks(p.path)
+	} else {
+		pp, err = evalSymlinks(p.Fs(), p.path)
+	}
+
 	if err != nil {
 		return nil, err
 	}
-	return PosixPath(posixStr(pp)), nil
+	return p.with(pp), nil
 }
 
-func (p posixStr) Mkdir(perm os.FileMode) error {
-	return fs.Mkdir(string(p), perm)
+func (p posixPath) Mkdir(perm os.FileMode) error {
+	return p.Fs().Mkdir(p.path, perm)
 }
 
-func (p posixStr) MkdirAll(perm os.FileMode) error {
-	return fs.MkdirAll(string(p), perm)
+func (p posixPath) MkdirAll(perm os.FileMode) error {
+	return p.Fs().MkdirAll(p.path, perm)
 }
 
-func (p posixStr) Remove() error {
-	return fs.Remove(string(p))
+func (p posixPath) Remove() error {
+	return p.Fs().Remove(p.path)
 }
 
-func (p posixStr) RemoveAll() error {
-	return fs.RemoveAll(string(p))
+func (p posixPath) RemoveAll() error {
+	return p.Fs().RemoveAll(p.path)
 }
 
-func (p posixStr) Lexists() bool {
+func (p posixPath) Lexists() bool {
 	_, err := p.Lstat()
 	return err == nil
 }
 
-func (p posixStr) Exists() bool {
+func (p posixPath) Exists() bool {
 	_, err := p.Stat()
 	return !(os.IsNotExist(err) || IsNotDir(err)) || err == nil
 }
@@ -144,7 +213,7 @@ func getStatT(f os.FileInfo) (*syscall.Stat_t, error) {
 	return statT, nil
 }
 
-func (p posixStr) IsMount() bool {
+func (p posixPath) IsMount() bool {
 	var self os.FileInfo
 	var selfStatT *syscall.Stat_t
 	var err error
@@ -176,7 +245,7 @@ func (p posixStr) IsMount() bool {
 	return !isNotMnt
 }
 
-func (p posixStr) SameFile(other PosixPath) (b bool, err error) {
+func (p posixPath) SameFile(other PosixPath) (b bool, err error) {
 	this, err := p.Stat()
 	if err != nil {
 		return false, err
@@ -185,61 +254,61 @@ func (p posixStr) SameFile(other PosixPath) (b bool, err error) {
 	if err != nil {
 		return false, err
 	}
-	return os.SameFile(this.getInfo(), that.getInfo()), nil
+	return sameFile(this.getInfo(), that.getInfo()), nil
 }
 
-func (p posixStr) Glob(pattern string) ([]PosixPath, error) {
-	matches, err := fs.Glob(fp.Join(p.String(), pattern))
+func (p posixPath) Glob(pattern string) ([]PosixPath, error) {
+	matches, err := p.Fs().Glob(fp.Join(p.path, pattern))
 	if err != nil {
 		return nil, err
 	}
 	paths := make([]PosixPath, 0, len(matches))
 	for _, m := range matches {
-		paths = append(paths, NewPosixPath(m))
+		paths = append(paths, p.with(m))
 	}
 	return paths, err
 }
 
-func (p posixStr) IsBlockDevice() bool {
+func (p posixPath) IsBlockDevice() bool {
 	info, err := p.Stat()
 	return err == nil && info.IsBlockDevice()
 }
 
-func (p posixStr) IsCharDevice() bool {
+func (p posixPath) IsCharDevice() bool {
 	info, err := p.Stat()
 	return err == nil && info.IsCharDevice()
 }
 
-func (p posixStr) IsFifo() bool {
+func (p posixPath) IsFifo() bool {
 	info, err := p.Stat()
 	return err == nil && info.IsFifo()
 }
 
-func (p posixStr) IsFile() bool {
+func (p posixPath) IsFile() bool {
 	info, err := p.Stat()
 	return err == nil && info.IsFile()
 }
 
-func (p posixStr) IsSocket() bool {
+func (p posixPath) IsSocket() bool {
 	info, err := p.Stat()
 	return err == nil && info.IsSocket()
 }
 
-func (p posixStr) IsSymlink() bool {
+func (p posixPath) IsSymlink() bool {
 	info, err := p.Lstat()
 	return err == nil && info.IsSymlink()
 }
 
-func (p posixStr) IsDir() bool {
+func (p posixPath) IsDir() bool {
 	info, err := p.Stat()
 	return err == nil && info.IsDir()
 }
 
-func (p posixStr) Touch(perm os.FileMode, existOk bool) (err error) {
+func (p posixPath) Touch(perm os.FileMode, existOk bool) (err error) {
 	now := time.Now()
 
 	if existOk {
-		switch err = fs.Chtimes(p.String(), now, now); {
+		switch err = p.Fs().Chtimes(p.path, now, now); {
 		case os.IsNotExist(err): // guess we have to create it
 		case err == nil:
 			return nil // file existed, we changed the time, we're done here
@@ -254,7 +323,7 @@ func (p posixStr) Touch(perm os.FileMode, existOk bool) (err error) {
 	}
 
 	var file afero.File
-	file, err = fs.OpenFile(p.String(), flags, perm)
+	file, err = p.Fs().OpenFile(p.path, flags, perm)
 	defer func() {
 		if file != nil {
 			if cerr := file.Close(); cerr != nil {
@@ -266,8 +335,101 @@ func (p posixStr) Touch(perm os.FileMode, existOk bool) (err error) {
 	return
 }
 
-func (p posixStr) Must() MustActions {
-	return NewMustAction(p.String())
+func (p posixPath) Readlink() (PosixPath, error) {
+	target, err := p.Fs().Readlink(p.path)
+	if err != nil {
+		return nil, err
+	}
+	return p.with(target), nil
+}
+
+func (p posixPath) Rename(target string) (PosixPath, error) {
+	if err := p.Fs().Rename(p.path, target); err != nil {
+		return nil, err
+	}
+	return p.with(target), nil
+}
+
+func (p posixPath) Chmod(mode os.FileMode) error {
+	return p.Fs().Chmod(p.path, mode)
+}
+
+func (p posixPath) Chown(uid, gid int) error {
+	return p.Fs().Chown(p.path, uid, gid)
+}
+
+func (p posixPath) ReadDir() ([]PosixPath, error) {
+	infos, err := afero.ReadDir(p.Fs(), p.path)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]PosixPath, len(infos))
+	for i, info := range infos {
+		paths[i] = p.Join(info.Name())
+	}
+	return paths, nil
+}
+
+func (p posixPath) Walk(fn WalkFunc) error {
+	return afero.Walk(p.Fs(), p.path, func(path string, info os.FileInfo, err error) error {
+		var rich RichFileInfo
+		if info != nil {
+			rich = richInfo{info}
+		}
+		return fn(p.with(path), rich, err)
+	})
+}
+
+func (p posixPath) ReadFile() ([]byte, error) {
+	return afero.ReadFile(p.Fs(), p.path)
+}
+
+func (p posixPath) WriteFile(data []byte, perm os.FileMode) error {
+	return afero.WriteFile(p.Fs(), p.path, data, perm)
+}
+
+func (p posixPath) HardlinkTo(target string) error {
+	return p.Fs().Link(target, p.path)
+}
+
+func (p posixPath) Copy(dest string) (_ PosixPath, err error) {
+	var src, dst afero.File
+	var info os.FileInfo
+
+	if src, err = p.Fs().Open(p.path); err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	if info, err = src.Stat(); err != nil {
+		return nil, err
+	} else if info.IsDir() {
+		return nil, &os.PathError{Op: "copy", Path: p.path, Err: syscall.EISDIR}
+	}
+
+	perm := info.Mode().Perm()
+	if dst, err = p.Fs().OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cerr := dst.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+
+	if _, err = io.Copy(dst, src); err != nil {
+		return nil, err
+	}
+
+	// an existing dest keeps its permissions when it's opened
+	if err = p.Fs().Chmod(dest, perm); err != nil {
+		return nil, err
+	}
+	return p.with(dest), nil
+}
+
+func (p posixPath) Must() MustActions {
+	return posix2must(p)
 }
 
 type (
@@ -0,0 +1,247 @@
+package pathlib
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// PosixPathOpsSuite runs the same tests of the filesystem actions
+// against each of the Fs implementations
+type PosixPathOpsSuite struct {
+	RequireSuite
+	newFs func() Fs
+	fs    Fs
+	root  PosixPath
+	tmp   string
+}
+
+func TestPosixPathOpsOnOsFs(t *testing.T) {
+	suite.Run(t, &PosixPathOpsSuite{newFs: NewOsFs})
+}
+
+func TestPosixPathOpsOnMemFs(t *testing.T) {
+	suite.Run(t, &PosixPathOpsSuite{newFs: func() Fs { return NewMemFs() }})
+}
+
+func (s *PosixPathOpsSuite) SetupTest() {
+	s.fs = s.newFs()
+
+	if _, ok := s.fs.(*MemFs); ok {
+		s.root = NewPosixPathFs(s.fs, "/root")
+		s.root.Must().Mkdir(0o755)
+	} else {
+		var err error
+		s.tmp, err = ioutil.TempDir("", "posixpathops")
+		s.NoError(err)
+		s.root = NewPosixPathFs(s.fs, s.tmp)
+	}
+
+	s.root.Join("a.txt").Must().WriteFile([]byte("aaa"), 0o644)
+	s.root.Join("dir", "sub").Must().MkdirAll(0o755)
+	s.root.Join("dir", "b.txt").Must().WriteFile([]byte("bbb"), 0o600)
+	s.NoError(s.root.Join("link").SymlinkTo("dir/b.txt"))
+}
+
+func (s *PosixPathOpsSuite) TearDownTest() {
+	if s.tmp != "" {
+		s.NoError(os.RemoveAll(s.tmp))
+	}
+}
+
+func (s *PosixPathOpsSuite) owner(p PosixPath) (uid, gid int) {
+	info, err := p.Lstat()
+	s.NoError(err)
+	switch sys := info.Sys().(type) {
+	case *memNode:
+		return sys.uid, sys.gid
+	case *syscall.Stat_t:
+		return int(sys.Uid), int(sys.Gid)
+	}
+	s.FailNow("unknown Sys() type")
+	return
+}
+
+func (s *PosixPathOpsSuite) TestReadlink() {
+	target := s.root.Join("link").Must().Readlink()
+	s.Equal("dir/b.txt", target.String())
+	s.Equal(s.fs, target.Fs())
+
+	_, err := s.root.Join("a.txt").Readlink()
+	s.Error(err)
+	_, err = s.root.Join("missing").Readlink()
+	s.True(os.IsNotExist(err))
+}
+
+func (s *PosixPathOpsSuite) TestRename() {
+	moved := s.root.Join("a.txt").Must().Rename(s.root.Join("dir", "a.txt").String())
+	s.Equal(s.root.Join("dir", "a.txt").String(), moved.String())
+	s.Equal("aaa", string(moved.Must().ReadFile()))
+	s.False(s.root.Join("a.txt").Lexists())
+
+	_, err := s.root.Join("missing").Rename(s.root.Join("x").String())
+	s.True(os.IsNotExist(err))
+}
+
+func (s *PosixPathOpsSuite) TestChmodAndChown() {
+	p := s.root.Join("a.txt")
+	p.Must().Chmod(0o600)
+	info, err := p.Stat()
+	s.NoError(err)
+	s.Equal(os.FileMode(0o600), info.Mode().Perm())
+
+	p.Must().Chown(os.Getuid(), os.Getgid())
+	uid, gid := s.owner(p)
+	s.Equal(os.Getuid(), uid)
+	s.Equal(os.Getgid(), gid)
+
+	s.True(os.IsNotExist(s.root.Join("missing").Chmod(0o600)))
+}
+
+func (s *PosixPathOpsSuite) TestReadDir() {
+	var names []string
+	for _, p := range s.root.Must().ReadDir() {
+		s.Equal(s.fs, p.Fs())
+		names = append(names, p.Name())
+	}
+	s.Equal([]string{"a.txt", "dir", "link"}, names)
+
+	_, err := s.root.Join("a.txt").ReadDir()
+	s.Error(err)
+}
+
+func (s *PosixPathOpsSuite) TestWalk() {
+	var seen []string
+	s.root.Must().Walk(func(p PosixPath, info RichFileInfo, err error) error {
+		s.NoError(err)
+		rel, err := s.root.Rel(p.String())
+		s.NoError(err)
+
+		if info.IsSymlink() {
+			seen = append(seen, rel.String()+"@")
+		} else {
+			seen = append(seen, rel.String())
+		}
+		return nil
+	})
+	s.Equal([]string{".", "a.txt", "dir", "dir/b.txt", "dir/sub", "link@"}, seen)
+
+	err := s.root.Join("missing").Walk(func(p PosixPath, info RichFileInfo, err error) error {
+		s.Nil(info)
+		return err
+	})
+	s.True(os.IsNotExist(err))
+}
+
+func (s *PosixPathOpsSuite) TestReadAndWriteFile() {
+	p := s.root.Join("new.txt")
+	p.Must().WriteFile([]byte("hello"), 0o640)
+	s.Equal("hello", string(p.Must().ReadFile()))
+
+	p.Must().WriteFile([]byte("bye"), 0o640)
+	s.Equal("bye", string(p.Must().ReadFile()))
+
+	// reading through a symlink
+	s.Equal("bbb", string(s.root.Join("link").Must().ReadFile()))
+
+	_, err := s.root.Join("dir").ReadFile()
+	s.Error(err)
+}
+
+func (s *PosixPathOpsSuite) TestHardlinkTo() {
+	p := s.root.Join("hard")
+	p.Must().HardlinkTo(s.root.Join("a.txt").String())
+
+	same, err := p.SameFile(s.root.Join("a.txt"))
+	s.NoError(err)
+	s.True(same)
+	s.False(p.IsSymlink())
+
+	s.root.Join("a.txt").Must().WriteFile([]byte("changed"), 0o644)
+	s.Equal("changed", string(p.Must().ReadFile()))
+
+	err = s.root.Join("hard2").HardlinkTo(s.root.Join("dir").String())
+	s.Error(err)
+	err = p.HardlinkTo(s.root.Join("a.txt").String())
+	s.True(os.IsExist(err))
+}
+
+func (s *PosixPathOpsSuite) TestCopy() {
+	dest := s.root.Join("link").Must().Copy(s.root.Join("copy").String())
+	s.Equal("bbb", string(dest.Must().ReadFile()))
+	s.False(dest.IsSymlink())
+
+	info, err := dest.Stat()
+	s.NoError(err)
+	s.Equal(os.FileMode(0o600), info.Mode().Perm())
+
+	same, err := dest.SameFile(s.root.Join("dir", "b.txt"))
+	s.NoError(err)
+	s.False(same)
+
+	// overwriting takes the source's permissions
+	s.root.Join("a.txt").Must().Copy(dest.String())
+	s.Equal("aaa", string(dest.Must().ReadFile()))
+	info, err = dest.Stat()
+	s.NoError(err)
+	s.Equal(os.FileMode(0o644), info.Mode().Perm())
+
+	_, err = s.root.Join("dir").Copy(s.root.Join("dir2").String())
+	s.Error(err)
+	s.False(s.root.Join("dir2").Lexists())
+}
+
+func (s *PosixPathOpsSuite) TestSnapshot() {
+	changed := func(snap *Snapshot) bool {
+		c, err := snap.Changed()
+		s.NoError(err)
+		return c
+	}
+
+	missing := s.root.Join("missing").Must().Snapshot()
+	s.False(missing.Lexists())
+	s.False(missing.Exists())
+
+	file := s.root.Join("a.txt").Must().Snapshot()
+	s.True(file.Exists())
+	s.False(file.IsSymlink())
+	s.Equal(file.Info, file.Target)
+
+	link := s.root.Join("link").Must().Snapshot()
+	s.True(link.IsSymlink())
+	s.False(link.IsDangling())
+	b, err := s.root.Join("dir", "b.txt").Stat()
+	s.NoError(err)
+	s.True(link.SameFile(b))
+	s.False(file.SameFile(b))
+
+	s.NoError(s.root.Join("dangling").SymlinkTo("missing"))
+	dangling := s.root.Join("dangling").Must().Snapshot()
+	s.True(dangling.IsDangling())
+	s.True(dangling.Lexists())
+	s.False(dangling.Exists())
+	s.True(os.IsNotExist(dangling.TargetErr))
+
+	// nothing has changed yet
+	for _, snap := range []*Snapshot{missing, file, link, dangling} {
+		s.False(changed(snap), snap.Path.String())
+	}
+
+	s.root.Join("missing").Must().Touch(0o644, false)
+	s.root.Join("a.txt").Must().Chmod(0o600)
+	s.root.Join("link").Must().Remove()
+	s.NoError(s.root.Join("link").SymlinkTo("dir/b.txt"))
+	s.root.Join("dangling").Must().Remove()
+
+	for _, snap := range []*Snapshot{missing, file, link, dangling} {
+		s.True(changed(snap), snap.Path.String())
+	}
+
+	// a path under a file just doesn't exist
+	notDir, err := s.root.Join("a.txt", "x").Snapshot()
+	s.NoError(err)
+	s.False(notDir.Lexists())
+}
@@ -7,7 +7,6 @@ import (
 	"testing"
 
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/afero/mem"
 	"github.com/stretchr/testify/suite"
 
 	"github.com/slyphon/dfi/pkg/testhelper"
@@ -16,7 +15,8 @@ import (
 type PosixPathSuite struct {
 	testhelper.DFISuite
 	tmpdir *string
-	origFs Fs
+	// mfs is a new MemFs for each test, the paths from path use it
+	mfs *MemFs
 }
 
 var _ suite.AfterTest = &PosixPathSuite{}
@@ -31,23 +31,20 @@ func (s *PosixPathSuite) TempDir() string {
 	return *s.tmpdir
 }
 
-// some tests need the real filesystem, this will put it back in place
-func (s *PosixPathSuite) usingOsFs() {
-	if s.origFs != nil {
-		_ = SetFs(s.origFs)
-		s.origFs = nil
-	}
+// path returns a path on the test's MemFs, tests that need the real
+// filesystem use NewPosixPath
+func (s *PosixPathSuite) path(path string) PosixPath {
+	return NewPosixPathFs(s.mfs, path)
 }
 
 func TestPosixPaths(t *testing.T) {
 	s := new(PosixPathSuite)
 
-	s.AddBeforeHook(func (a, b string) {
-		s.origFs = SetFs(NewMemFsPlus())
+	s.AddBeforeHook(func(a, b string) {
+		s.mfs = NewMemFs()
 	})
 
-	s.AddAfterHook(func (a, b string) {
-		s.usingOsFs()
+	s.AddAfterHook(func(a, b string) {
 		if s.tmpdir != nil {
 			err := os.RemoveAll(*s.tmpdir)
 			s.tmpdir = nil
@@ -61,7 +58,6 @@ func TestPosixPaths(t *testing.T) {
 }
 
 func (s *PosixPathSuite) TestIsMount() {
-	s.usingOsFs()
 	pp := NewPosixPath("/")
 	s.True(pp.IsMount())
 
@@ -77,7 +73,6 @@ func (s *PosixPathSuite) touch(path string) {
 }
 
 func (s *PosixPathSuite) TestIsSameFile() {
-	s.usingOsFs()
 	d := s.TempDir()
 
 	filePath := fp.Join(d, "file")
@@ -92,7 +87,7 @@ func (s *PosixPathSuite) TestIsSameFile() {
 }
 
 func (s *PosixPathSuite) TestExMatch() {
-	pp := NewPosixPath("/this/is/a/dir/the.tar")
+	pp := s.path("/this/is/a/dir/the.tar")
 
 	shouldMatch := func(pattern string) {
 		b, e := pp.ExMatch(pattern)
@@ -105,21 +100,17 @@ func (s *PosixPathSuite) TestExMatch() {
 }
 
 func (s *PosixPathSuite) createFileWithMode(path string, mode os.FileMode) PosixPath {
-	fh, err := fs.Create(path)
-	s.NoError(err)
-	under, ok := fh.(*mem.File)
-	s.True(ok)
-	fdata := under.Data()
-	mem.SetMode(fdata, mode)
-	return NewPosixPath(path)
+	s.NoError(s.mfs.MkdirAll(fp.Dir(path), 0o755))
+	s.NoError(s.mfs.Mknod(path, mode))
+	return s.path(path)
 }
 
 const PermBits = 0o644
 
 func (s *PosixPathSuite) TestIsDir() {
 	path := "/path/to/dir"
-	s.NoError(fs.Mkdir(path, 0o755))
-	pp := NewPosixPath(path)
+	s.NoError(s.mfs.MkdirAll(path, 0o755))
+	pp := s.path(path)
 	s.True(pp.IsDir())
 }
 
@@ -143,4 +134,21 @@ func (s *PosixPathSuite) TestIsBlockDevice() {
 	s.True(pp.IsBlockDevice())
 }
 
+func (s *PosixPathSuite) TestFsIsKeptByDerivedPaths() {
+	mfs := NewMemFs()
+	p := NewPosixPathFs(mfs, "/a")
+
+	s.Equal(mfs, p.Join("b").Fs())
+	s.Equal(mfs, p.Join("b").Parent().Fs())
+	s.Equal(mfs, p.Clean().Fs())
+	dir, _ := p.Join("b").Split()
+	s.Equal(mfs, dir.Fs())
 
+	p.Join("b").Must().MkdirAll(0o755)
+	_, err := mfs.Stat("/a/b")
+	s.NoError(err)
+
+	// other filesystems are untouched
+	s.False(s.path("/a/b").Exists())
+	s.True(IsOsFs(NewPosixPath("/a/b").Fs()))
+}
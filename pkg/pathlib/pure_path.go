@@ -2,9 +2,13 @@ package pathlib
 
 import (
 	"fmt"
+	"os"
 	"path"
+	"strings"
 
 	"github.com/gobwas/glob"
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
 )
 
 type (
@@ -23,6 +27,47 @@ type (
 		// (basically '**' is supported)
 		ExMatch(pattern string) (matched bool, err error)
 		Split() (dir PurePath, file string)
+
+		// Stem is the final component without its suffix
+		Stem() string
+
+		// Suffix is the extension of the final component, including the
+		// '.', or "" if it has none. Note that '.bashrc' has no suffix.
+		Suffix() string
+
+		// Suffixes are all of the extensions of the final
+		// component, eg. [".tar", ".gz"]
+		Suffixes() []string
+
+		// WithName returns the path with the final component replaced
+		WithName(name string) (PurePath, error)
+
+		// WithSuffix returns the path with the suffix replaced, or added if
+		// there wasn't one. An empty suffix removes it.
+		WithSuffix(suffix string) (PurePath, error)
+
+		// Parts are the components of the path, starting with '/'
+		// if the path is absolute. '.' components are dropped.
+		Parts() []string
+
+		// Anchor is "/" for absolute paths, otherwise ""
+		Anchor() string
+		IsAbs() bool
+
+		// RelativeTo returns this path relative to other, which must be
+		// one of its ancestors (or the path itself). '..' is never added.
+		RelativeTo(other string) (PurePath, error)
+		IsRelativeTo(other string) bool
+
+		// Parents are the logical ancestors of the path, nearest first
+		Parents() []PurePath
+
+		// Expanduser replaces a leading '~' with the user's home directory
+		Expanduser() (PurePath, error)
+
+		// ExpandVars replaces $VAR and ${VAR} with the values of the
+		// environment variables, unset variables are replaced with ""
+		ExpandVars() PurePath
 	}
 
 	pureStr string
@@ -62,3 +107,139 @@ func (p pureStr) Split() (dir PurePath, name string) {
 	d, n := path.Split(string(p))
 	return pureStr(d), n
 }
+
+// name is the final component, or "" if there isn't one, eg. for "/"
+func (p pureStr) name() string {
+	switch n := path.Base(string(p)); n {
+	case "/", ".":
+		return ""
+	default:
+		return n
+	}
+}
+
+func (p pureStr) Suffix() string {
+	n := p.name()
+	if i := strings.LastIndex(n, "."); i > 0 && i < len(n)-1 {
+		return n[i:]
+	}
+	return ""
+}
+
+func (p pureStr) Stem() string {
+	return strings.TrimSuffix(p.name(), p.Suffix())
+}
+
+func (p pureStr) Suffixes() []string {
+	n := p.name()
+	if strings.HasSuffix(n, ".") {
+		return nil
+	}
+
+	var suffixes []string
+	for _, s := range strings.Split(strings.TrimLeft(n, "."), ".")[1:] {
+		suffixes = append(suffixes, "."+s)
+	}
+	return suffixes
+}
+
+func (p pureStr) WithName(name string) (PurePath, error) {
+	if p.name() == "" {
+		return nil, &InvalidNameError{Path: string(p)}
+	}
+	if name == "" || name == "." || strings.Contains(name, "/") {
+		return nil, &InvalidNameError{Path: string(p), Name: name}
+	}
+	return pureStr(path.Join(path.Dir(string(p)), name)), nil
+}
+
+func (p pureStr) WithSuffix(suffix string) (PurePath, error) {
+	if strings.Contains(suffix, "/") || (suffix != "" && (suffix == "." || !strings.HasPrefix(suffix, "."))) {
+		return nil, &InvalidNameError{Path: string(p), Name: suffix}
+	}
+	if p.name() == "" {
+		return nil, &InvalidNameError{Path: string(p)}
+	}
+	return p.WithName(p.Stem() + suffix)
+}
+
+func (p pureStr) Parts() []string {
+	var parts []string
+	if p.IsAbs() {
+		parts = append(parts, "/")
+	}
+	for _, c := range strings.Split(string(p), "/") {
+		if c != "" && c != "." {
+			parts = append(parts, c)
+		}
+	}
+	return parts
+}
+
+// joinParts is the inverse of Parts, unlike path.Join it leaves '..' alone
+func joinParts(parts []string) string {
+	if len(parts) > 0 && parts[0] == "/" {
+		return "/" + strings.Join(parts[1:], "/")
+	}
+	return strings.Join(parts, "/")
+}
+
+func (p pureStr) Anchor() string {
+	if p.IsAbs() {
+		return "/"
+	}
+	return ""
+}
+
+func (p pureStr) IsAbs() bool { return path.IsAbs(string(p)) }
+
+func (p pureStr) RelativeTo(other string) (PurePath, error) {
+	parts, otherParts := p.Parts(), pureStr(other).Parts()
+
+	if p.IsAbs() != path.IsAbs(other) || len(otherParts) > len(parts) {
+		return nil, &NotRelativeError{Path: string(p), Other: other}
+	}
+	for i := range otherParts {
+		if parts[i] != otherParts[i] {
+			return nil, &NotRelativeError{Path: string(p), Other: other}
+		}
+	}
+
+	if rest := parts[len(otherParts):]; len(rest) > 0 {
+		return pureStr(joinParts(rest)), nil
+	}
+	return pureStr("."), nil
+}
+
+func (p pureStr) IsRelativeTo(other string) bool {
+	_, err := p.RelativeTo(other)
+	return err == nil
+}
+
+func (p pureStr) Parents() []PurePath {
+	parts := p.Parts()
+	if len(parts) == 0 {
+		return nil
+	}
+
+	parents := make([]PurePath, 0, len(parts))
+	for i := len(parts) - 1; i > 0; i-- {
+		parents = append(parents, pureStr(joinParts(parts[:i])))
+	}
+	if !p.IsAbs() {
+		parents = append(parents, pureStr("."))
+	}
+	return parents
+}
+
+func (p pureStr) Expanduser() (PurePath, error) {
+	expanded, err := homedir.Expand(string(p))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to expand %#v", string(p))
+	}
+	return pureStr(expanded), nil
+}
+
+func (p pureStr) ExpandVars() PurePath {
+	return pureStr(os.ExpandEnv(string(p)))
+}
@@ -0,0 +1,83 @@
+package pathlib
+
+import (
+	"os"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// evalSymlinks is filepath.EvalSymlinks for any Fs: it returns path with
+// every symlink replaced by what it points at. Relative paths stay relative
+// unless a symlink points at an absolute path.
+func evalSymlinks(fsys Fs, name string) (string, error) {
+	hops := 0
+	rest := strings.Split(name, "/")
+	resolved := ""
+	if path.IsAbs(name) {
+		resolved = "/"
+	}
+
+	for len(rest) > 0 {
+		c := rest[0]
+		rest = rest[1:]
+
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			if resolved == "" || resolved == ".." || strings.HasSuffix(resolved, "/..") {
+				resolved = path.Join(resolved, "..")
+			} else if resolved != "/" {
+				resolved = path.Dir(resolved)
+				if resolved == "." {
+					resolved = ""
+				}
+			}
+			continue
+		}
+
+		candidate := path.Join(resolved, c)
+
+		info, _, err := fsys.LstatIfPossible(candidate)
+		if err != nil {
+			return "", err
+		}
+
+		if info.Mode()&os.ModeSymlink == 0 {
+			if !info.IsDir() && len(rest) > 0 && strings.Trim(strings.Join(rest, ""), "/.") != "" {
+				return "", &os.PathError{Op: "lstat", Path: name, Err: syscall.ENOTDIR}
+			}
+			resolved = candidate
+			continue
+		}
+
+		if hops++; hops > maxSymlinkHops {
+			return "", &os.PathError{Op: "lstat", Path: name, Err: syscall.ELOOP}
+		}
+
+		target, err := fsys.Readlink(candidate)
+		if err != nil {
+			return "", err
+		}
+
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+
+	if resolved == "" {
+		return ".", nil
+	}
+	return resolved, nil
+}
+
+// sameFile is os.SameFile, which also understands MemFs files
+func sameFile(a, b os.FileInfo) bool {
+	if na, ok := a.Sys().(*memNode); ok {
+		nb, ok := b.Sys().(*memNode)
+		return ok && na == nb
+	}
+	return os.SameFile(a, b)
+}
@@ -0,0 +1,88 @@
+package pathlib
+
+import (
+	"os"
+)
+
+// Snapshot is what was at a path when it was looked at. Asking a PosixPath
+// IsSymlink, IsDir, etc. stats the path every time, and the answers can
+// disagree if the path changes in between. A Snapshot takes one Lstat, plus
+// a Stat if the path is a symlink, and answers from those.
+type Snapshot struct {
+	Path PosixPath
+
+	// Info is the Lstat of the path, nil if nothing was there
+	Info RichFileInfo
+
+	// Target is the Stat of what the path points to. It's Info if the
+	// path isn't a symlink, and nil if it's a symlink that can't be
+	// followed, TargetErr says why
+	Target    RichFileInfo
+	TargetErr error
+}
+
+// Snapshot returns what's at the path now. Only a failed Lstat is an
+// error, a path that doesn't exist has a nil Info.
+func (p posixPath) Snapshot() (*Snapshot, error) {
+	s := &Snapshot{Path: p}
+
+	info, err := p.Lstat()
+	switch {
+	case os.IsNotExist(err) || IsNotDir(err):
+		return s, nil
+	case err != nil:
+		return nil, err
+	}
+
+	s.Info, s.Target = info, info
+	if info.IsSymlink() {
+		if s.Target, s.TargetErr = p.Stat(); s.TargetErr != nil {
+			s.Target = nil
+		}
+	}
+	return s, nil
+}
+
+// Lexists returns true if there was something at the path
+func (s *Snapshot) Lexists() bool { return s.Info != nil }
+
+// Exists returns true if there was something at the path, and it wasn't
+// a dangling symlink
+func (s *Snapshot) Exists() bool { return s.Target != nil }
+
+// IsSymlink returns true if the path was a symlink
+func (s *Snapshot) IsSymlink() bool { return s.Info != nil && s.Info.IsSymlink() }
+
+// IsDangling returns true if the path was a symlink that can't be followed
+func (s *Snapshot) IsDangling() bool { return s.IsSymlink() && s.Target == nil }
+
+// SameFile returns true if the path led to the file described by info,
+// following a symlink
+func (s *Snapshot) SameFile(info os.FileInfo) bool {
+	if s.Target == nil || info == nil {
+		return false
+	}
+	if ri, ok := info.(RichFileInfo); ok {
+		info = ri.getInfo()
+	}
+	return sameFile(s.Target.getInfo(), info)
+}
+
+// Changed looks at the path again, and returns true if something else
+// is there now: it appeared, went away, was replaced, or its type,
+// permissions or mtime changed. Call it right before acting on the
+// snapshot to narrow the window for races.
+func (s *Snapshot) Changed() (bool, error) {
+	now, err := s.Path.Lstat()
+	switch {
+	case os.IsNotExist(err) || IsNotDir(err):
+		return s.Info != nil, nil
+	case err != nil:
+		return false, err
+	case s.Info == nil:
+		return true, nil
+	case !sameFile(s.Info.getInfo(), now.getInfo()):
+		return true, nil
+	}
+	return s.Info.Mode() != now.Mode() || !s.Info.ModTime().Equal(now.ModTime()), nil
+}
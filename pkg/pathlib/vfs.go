@@ -3,6 +3,7 @@ package pathlib
 import (
 	"os"
 	fp "path/filepath"
+	"syscall"
 
 	"github.com/spf13/afero"
 )
@@ -19,12 +20,33 @@ type (
 		Glob(pattern string) ([]string, error)
 	}
 
+	Readlinker interface {
+		Readlink(name string) (string, error)
+	}
+
+	Chowner interface {
+		Chown(name string, uid, gid int) error
+	}
+
+	// Linker creates hard links
+	Linker interface {
+		Link(old, new string) error
+	}
+
+	// Flocker is a file that takes advisory locks, with the same
+	// arguments and errors as flock(2), see Flock
+	Flocker interface {
+		Flock(how int) error
+	}
 
 	Fs interface {
 		afero.Fs
 		afero.Lstater
 		Symlinker
 		Globber
+		Readlinker
+		Chowner
+		Linker
 	}
 
 	pathLibOsFs struct {
@@ -40,23 +62,44 @@ func (p pathLibOsFs) Glob(pattern string) ([]string, error) {
 	return fp.Glob(pattern)
 }
 
+func (p pathLibOsFs) Readlink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
+func (p pathLibOsFs) Chown(name string, uid, gid int) error {
+	return os.Chown(name, uid, gid)
+}
+
+func (p pathLibOsFs) Link(old, new string) error {
+	return os.Link(old, new)
+}
+
 func newPathLibOsFs() pathLibOsFs {
 	return pathLibOsFs{
 		OsFs: &afero.OsFs{},
 	}
 }
 
-var fs Fs
-
-func init() {
-	fs = newPathLibOsFs()
+// NewOsFs returns an Fs backed by the real filesystem
+func NewOsFs() Fs {
+	return newPathLibOsFs()
 }
 
-func SetFs(newFs Fs) (oldFs Fs) {
-	oldFs, fs = fs, newFs
-	return oldFs
+// IsOsFs returns true if fsys is the real filesystem, as returned by NewOsFs
+func IsOsFs(fsys Fs) bool {
+	_, ok := fsys.(pathLibOsFs)
+	return ok
 }
 
-func GetFs() Fs {
-	return fs
+// Flock takes or releases an advisory lock on f, as flock(2) does with how,
+// returning the errno as it is. Files on the real filesystem are locked by
+// their descriptor, others have to be Flockers, or ENOTSUP is returned.
+func Flock(f afero.File, how int) error {
+	switch f := f.(type) {
+	case interface{ Fd() uintptr }:
+		return syscall.Flock(int(f.Fd()), how)
+	case Flocker:
+		return f.Flock(how)
+	}
+	return syscall.ENOTSUP
 }